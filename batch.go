@@ -0,0 +1,112 @@
+package modd
+
+import (
+	"sync"
+	"time"
+)
+
+// restartBatch collects restarts of the running daemons of a pen for a
+// window, so that they can be applied together
+type restartBatch struct {
+	window time.Duration
+	// The reason for the first restart of each daemon in the batch
+	pending map[*daemon]string
+	timer   *time.Timer
+	sync.Mutex
+}
+
+// add queues a restart of d, and starts the window if it's the first in the
+// batch, calling flush when it ends. It reports whether d was queued, which it
+// isn't if there's no window, or d isn't running yet.
+func (b *restartBatch) add(d *daemon, reason string, flush func()) bool {
+	if b.window == 0 || !d.running() {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.pending == nil {
+		b.pending = make(map[*daemon]string)
+	}
+	if _, ok := b.pending[d]; !ok {
+		b.pending[d] = reason
+		d.log.NoticeAs("debug", ">> restart batched for %s", b.window)
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, flush)
+	}
+	return true
+}
+
+// take returns the batched restarts, and starts a new batch
+func (b *restartBatch) take() map[*daemon]string {
+	b.Lock()
+	defer b.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	p := b.pending
+	b.pending = nil
+	b.timer = nil
+	return p
+}
+
+// running reports whether the daemon has been started
+func (d *daemon) running() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.ex != nil
+}
+
+// awaitRestart waits until the daemon has started more than n times and is
+// ready, or has failed or been stopped. It returns false if the daemon is
+// shut down first.
+func (d *daemon) awaitRestart(n int) bool {
+	t := time.NewTicker(readyPoll)
+	defer t.Stop()
+	for {
+		d.Lock()
+		restarted, stuck := d.starts > n, d.failed || d.held
+		d.Unlock()
+		if stuck || restarted && d.isReady() {
+			return true
+		}
+		select {
+		case <-t.C:
+		case <-d.done:
+			return false
+		}
+	}
+}
+
+// requestRestart restarts d, or queues the restart if the pen batches
+// restarts
+func (dp *DaemonPen) requestRestart(d *daemon, reason string) {
+	if !dp.batch.add(d, reason, dp.flushRestarts) {
+		d.restart(reason)
+	}
+}
+
+// flushRestarts applies the batched restarts, in dependency order. A daemon
+// started after another in the batch is held back until that daemon has
+// restarted and is ready again.
+func (dp *DaemonPen) flushRestarts() {
+	pending := dp.batch.take()
+	starts := make(map[*daemon]int)
+	for d := range pending {
+		d.Lock()
+		starts[d] = d.starts
+		d.Unlock()
+	}
+	for _, d := range dp.ordered() {
+		reason, ok := pending[d]
+		if !ok {
+			continue
+		}
+		for _, dep := range d.after {
+			if n, ok := starts[dep]; ok && !dep.awaitRestart(n) {
+				return
+			}
+		}
+		d.restart(reason)
+	}
+}
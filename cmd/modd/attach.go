@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/cortesi/modd"
+)
+
+// Keys that leave modd attach without affecting the modd it's attached to
+const (
+	keyDetach    = 0x04 // Ctrl-D
+	keyInterrupt = 0x03 // Ctrl-C
+)
+
+// attach connects to the modd listening on the control socket at path. Its
+// output is copied to stdout, and keys read from stdin are sent to it as
+// commands, until it exits or Ctrl-C or Ctrl-D is pressed. If stdin isn't a
+// terminal, keys are sent as they're read, and output is shown until modd
+// exits.
+func attach(path string) error {
+	c, err := modd.DialControl(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	restore := func() {}
+	var in io.Reader = os.Stdin
+	if r, err := cbreak(); err == nil {
+		restore = r
+		in = &commandEcho{r: os.Stdin, w: os.Stdout}
+	}
+	defer restore()
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, c)
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := in.Read(buf); err != nil {
+				return
+			}
+			if buf[0] == keyDetach || buf[0] == keyInterrupt {
+				done <- nil
+				return
+			}
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return <-done
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	osexec "os/exec"
+	"strings"
+)
+
+// cbreak switches the terminal on stdin to a mode where keys are read as
+// they're pressed, without echo, and returns a function that restores the
+// previous mode. Output processing is unchanged, so log output displays as
+// usual. Ctrl-C no longer raises a signal, and must be handled as a key. This
+// fails if stdin isn't a terminal, or stty isn't available.
+func cbreak() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// commandEcho echoes commands, typed after the command key, to w as they're
+// read from r. Terminal echo is off in cbreak mode, and single keys aren't
+// echoed, but a command should be seen as it's typed.
+type commandEcho struct {
+	r      io.Reader
+	w      io.Writer
+	typing bool
+}
+
+func (e *commandEcho) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	for _, c := range p[:n] {
+		switch {
+		case !e.typing:
+			if c == ':' {
+				e.typing = true
+				e.w.Write([]byte{c})
+			}
+		case c == '\r' || c == '\n' || c == keyInterrupt:
+			e.typing = false
+			io.WriteString(e.w, "\n")
+		case c == 0x7f || c == '\b':
+			io.WriteString(e.w, "\b \b")
+		default:
+			e.w.Write([]byte{c})
+		}
+	}
+	return n, err
+}
+
+func stty(args ...string) (string, error) {
+	cmd := osexec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
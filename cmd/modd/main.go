@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/cortesi/modd"
+	"github.com/cortesi/modd/conf"
 	"github.com/cortesi/modd/notify"
+	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/termlog"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"mvdan.cc/sh/interp"
 	"mvdan.cc/sh/syntax"
@@ -18,13 +27,17 @@ const modfile = "./modd.conf"
 
 var file = kingpin.Flag(
 	"file",
-	fmt.Sprintf("Path to modfile (%s)", modfile),
+	fmt.Sprintf("Path to modfile (%s), or - to read it from stdin", modfile),
 ).
 	Default(modfile).
 	PlaceHolder("PATH").
 	Short('f').
 	String()
 
+var profile = kingpin.Flag("profile", "Merge the overlay for a profile over the config, read from modd.PROFILE.conf").
+	PlaceHolder("PROFILE").
+	String()
+
 var noconf = kingpin.Flag("noconf", "Don't watch our own config file").
 	Short('c').
 	Bool()
@@ -33,6 +46,17 @@ var beep = kingpin.Flag("bell", "Ring terminal bell if any command returns an er
 	Short('b').
 	Bool()
 
+var sound = kingpin.Flag("sound", "Play a sound when a block passes or fails").
+	Bool()
+
+var soundPass = kingpin.Flag("sound-pass", "Sound file played when a block passes").
+	PlaceHolder("FILE").
+	String()
+
+var soundFail = kingpin.Flag("sound-fail", "Sound file played when a block fails").
+	PlaceHolder("FILE").
+	String()
+
 var ignores = kingpin.Flag("ignores", "List default ignore patterns and exit").
 	Short('i').
 	Bool()
@@ -41,21 +65,154 @@ var doNotify = kingpin.Flag("notify", "Send stderr to system notification if com
 	Short('n').
 	Bool()
 
+var check = kingpin.Flag("check", "Check the config for problems and exit").
+	Bool()
+
+var dumpConfig = kingpin.Flag("dump-config", "Print the parsed config as JSON and exit").
+	Bool()
+
 var prep = kingpin.Flag("prep", "Run prep commands and exit").
 	Short('p').
 	Bool()
 
+var noWatch = kingpin.Flag("no-watch", "Run prep commands and start daemons, without watching for changes").
+	Bool()
+
+var noRestart = kingpin.Flag("no-restart", "Start daemons, but don't restart them on changes").
+	Bool()
+
+var firstMatch = kingpin.Flag("first-match", "Run only the highest-priority block matching each changed file").
+	Bool()
+
+var pauseDrop = kingpin.Flag("pause-drop", "Drop changes made while paused, instead of running them on resume").
+	Bool()
+
+var dieWithParent = kingpin.Flag("die-with-parent", "Shut down daemons and exit when modd's parent process exits (Linux only)").
+	Bool()
+
+var exitOnFail = kingpin.Flag("exit-on-fail", "Exit if any prep command fails").
+	Bool()
+
+var cooldown = kingpin.Flag("cooldown", "Wait after each run, and batch changes made in the meantime").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var settle = kingpin.Flag("settle", "Wait until there have been no changes for a period before acting on them").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var stagger = kingpin.Flag("stagger", "Wait a random time, up to a limit, before running each block's preps").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var maxRuntime = kingpin.Flag("max-runtime", "Shut down daemons and exit after running for a period").
+	PlaceHolder("DURATION").
+	Default("0s").
+	Duration()
+
+var contentHash = kingpin.Flag("content-hash", "Ignore changes that leave a file's content as it was").
+	Bool()
+
+var skipDuplicateCycles = kingpin.Flag("skip-duplicate-cycles", "Skip a run for the same changed files and content as the last").
+	Bool()
+
+var minInterval = kingpin.Flag("min-interval", "Least time between the end of one run triggered by changes and the start of the next").
+	PlaceHolder("DURATION").
+	Default("100ms").
+	Duration()
+
+var eventLog = kingpin.Flag("event-log", "Record lifecycle events to a file as JSON").
+	PlaceHolder("PATH").
+	String()
+
+var metrics = kingpin.Flag("metrics", "Serve counts of file changes received and acted on, in Prometheus format at /metrics").
+	PlaceHolder("ADDR").
+	String()
+
+var summaryFile = kingpin.Flag("summary-file", "Write a JSON summary of each run to a file").
+	PlaceHolder("PATH").
+	String()
+
+var stateFile = kingpin.Flag("state-file", "Record running daemons to a file, and adopt those recorded by an earlier modd").
+	PlaceHolder("PATH").
+	String()
+
+var maxCaptureLines = kingpin.Flag("max-capture-lines", "Most lines of command output kept in memory for errors and pipes").
+	PlaceHolder("N").
+	Default("0").
+	Int()
+
+var maxCaptureBytes = kingpin.Flag("max-capture-bytes", "Most bytes of command output kept in memory for errors and pipes").
+	PlaceHolder("SIZE").
+	Default("0").
+	String()
+
+var maxProcs = kingpin.Flag("max-procs", "Most commands run at once across all blocks, with daemon starts let through first").
+	PlaceHolder("N").
+	Default("0").
+	Int()
+
+var onSignal = kingpin.Flag("on-signal", "Act on a signal: restart-daemons, rerun-preps, reload-config or toggle-pause (repeatable)").
+	PlaceHolder("SIGNAL=ACTION").
+	Strings()
+
+var interactive = kingpin.Flag("interactive", "Read single-key commands from the terminal").
+	Bool()
+
+var status = kingpin.Flag("status", "Show a status line while prep commands run").
+	Bool()
+
+var noSeparators = kingpin.Flag("no-separators", "Don't print a separator at the start of each run triggered by changes").
+	Bool()
+
+var verbose = kingpin.Flag("verbose", "Log why blocks are run and daemons restarted").
+	Short('v').
+	Bool()
+
 var debug = kingpin.Flag("debug", "Debugging for modd development").
 	Default("false").
 	Bool()
 
+var detach = kingpin.Flag("detach", "Run in the background, outliving the terminal, until stopped from modd attach").
+	Bool()
+
+var detachLog = kingpin.Flag("detach-log", "File the output of a detached modd is appended to").
+	PlaceHolder("PATH").
+	Default(".modd.log").
+	String()
+
+var control = kingpin.Flag("control", fmt.Sprintf("Control socket that modd listens on and modd attach connects to (%s with --detach)", modd.DefaultControlSocket)).
+	PlaceHolder("PATH").
+	String()
+
 var exec = kingpin.Flag("exec", "Execute a command in the built-in shell").
 	String()
 
+var runCmd = kingpin.Command("run", "Watch for changes and run commands, the default").Default()
+
+var attachCmd = kingpin.Command("attach", "Attach to a modd listening on a control socket, showing its output and sending it keys as for --interactive. Ctrl-C or Ctrl-D detaches.")
+
 func main() {
 	kingpin.CommandLine.HelpFlag.Short('h')
 	kingpin.Version(modd.Version)
-	kingpin.Parse()
+	cmd := kingpin.Parse()
+
+	detached := os.Getenv(modd.DetachedEnv) != ""
+	os.Unsetenv(modd.DetachedEnv)
+	socket := *control
+	if socket == "" && (*detach || cmd == attachCmd.FullCommand()) {
+		socket = modd.DefaultControlSocket
+	}
+	if cmd == attachCmd.FullCommand() {
+		if err := attach(socket); err != nil {
+			fmt.Fprintf(os.Stderr, "modd attach: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	if *exec != "" {
 		parser := syntax.NewParser()
@@ -93,9 +250,15 @@ func main() {
 	}
 
 	log := termlog.NewLog()
-	if *debug {
+	if *debug || *verbose {
 		log.Enable("debug")
 	}
+	if *dieWithParent {
+		if err := modd.DieWithParent(); err != nil {
+			log.Shout("--die-with-parent: %s", err)
+			os.Exit(1)
+		}
+	}
 
 	notifiers := []notify.Notifier{}
 	if *doNotify {
@@ -109,22 +272,247 @@ func main() {
 	if *beep {
 		notifiers = append(notifiers, &notify.BeepNotifier{})
 	}
+	if *sound {
+		n := notify.NewSoundNotifier(*soundPass, *soundFail)
+		if n == nil {
+			log.Warn("Could not find an audio player, sounds are disabled")
+		} else {
+			notifiers = append(notifiers, n)
+		}
+	}
 
-	mr, err := modd.NewModRunner(*file, log, notifiers, !(*noconf))
+	if *file == modd.ConfStdin && *interactive {
+		log.Shout("--interactive can't be used with a config read from stdin")
+		return
+	}
+	mr, err := modd.NewProfileModRunner(*file, *profile, log, notifiers, !(*noconf))
 	if err != nil {
-		log.Shout("%s", err)
+		if ce, ok := err.(*conf.Error); ok {
+			log.Shout("%s", ce.Detail())
+		} else {
+			log.Shout("%s", err)
+		}
+		if *check {
+			os.Exit(1)
+		}
 		return
 	}
-
-	if *prep {
-		err := mr.PrepOnly(true)
+	if *check {
+		log.Notice("%s: ok", *file)
+		os.Exit(0)
+	}
+	if *dumpConfig {
+		ret, err := json.MarshalIndent(mr.Config, "", "  ")
 		if err != nil {
 			log.Shout("%s", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(ret))
+		os.Exit(0)
+	}
+	if mr.Config.PrimaryDaemon() != nil {
+		if *interactive {
+			log.Shout("--interactive can't be used with a +primary daemon")
+			return
+		}
+		if *file == modd.ConfStdin {
+			log.Shout("a +primary daemon can't be used with a config read from stdin")
+			return
+		}
+	}
+	mr.ExitOnFail = *exitOnFail
+	mr.NoWatch = *noWatch
+	mr.NoRestart = *noRestart
+	mr.FirstMatch = *firstMatch
+	mr.SignalActions, err = modd.ParseSignalActions(*onSignal)
+	if err != nil {
+		log.Shout("--on-signal: %s", err)
+		os.Exit(1)
+	}
+	mr.DropPaused = *pauseDrop
+	mr.NoSeparators = *noSeparators
+	mr.Cooldown = *cooldown
+	mr.MinInterval = *minInterval
+	mr.Settle = *settle
+	mr.Stagger = *stagger
+	mr.MaxRuntime = *maxRuntime
+	mr.ContentHash = *contentHash
+	mr.SkipDuplicateCycles = *skipDuplicateCycles
+	mr.SummaryFile = *summaryFile
+	mr.StateFile = *stateFile
+	shell.MaxCaptureLines = *maxCaptureLines
+	modd.MaxProcs = *maxProcs
+	captureBytes, err := conf.ParseSize(*maxCaptureBytes)
+	if err != nil {
+		log.Shout("--max-capture-bytes: %s", err)
+		os.Exit(1)
+	}
+	shell.MaxCaptureBytes = int(captureBytes)
+	if *detach && !detached {
+		os.Exit(startDetached(mr, socket, log))
+	}
+	if *status {
+		tty := terminal.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("TERM") != "dumb"
+		mr.Status = modd.NewStatusLine(color.Output, tty)
+		termlog.SetOutput(mr.Status)
+	}
+	// exit exits with code, after closing what deferred calls would have
+	var el *modd.EventLog
+	exit := func(code int) {
+		closeEventLog(el, log)
+		mr.Tracer.Close()
+		os.Exit(code)
+	}
+	if *eventLog != "" {
+		el, err = modd.NewEventLog(*eventLog, modd.DefaultEventLogSize)
+		if err != nil {
+			log.Shout("Could not open event log: %s", err)
+			return
+		}
+		defer closeEventLog(el, log)
+		mr.AddEventSink(el)
+	}
+	if *metrics != "" {
+		l, err := net.Listen("tcp", *metrics)
+		if err != nil {
+			log.Shout("Could not serve metrics: %s", err)
+			exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mr.MetricsHandler())
+		go http.Serve(l, mux)
+	}
+	mr.Tracer, err = modd.NewTracerFromEnv(log)
+	if err != nil {
+		log.Shout("Could not set up tracing: %s", err)
+		exit(1)
+	}
+	defer mr.Tracer.Close()
+	if socket != "" {
+		var cs *modd.ControlServer
+		cs, err = mr.ListenControl(socket, color.Output, func() {
+			cs.Close()
+			exit(0)
+		})
+		if err != nil {
+			log.Shout("Could not listen on control socket: %s", err)
+			exit(1)
+		}
+		defer cs.Close()
+		termlog.SetOutput(cs)
+	}
+
+	restore := func() {}
+	mr.BeforeHandoff = func() {
+		restore()
+		// The modd executed in its place is already detached
+		if detached {
+			os.Setenv(modd.DetachedEnv, "1")
+		}
+	}
+	if *interactive && !*prep {
+		var in io.Reader = os.Stdin
+		if r, err := cbreak(); err != nil {
+			log.Warn("stdin is not a terminal, follow each key with enter")
+		} else {
+			restore = r
+			in = &commandEcho{r: os.Stdin, w: os.Stdout}
 		}
+		go func() {
+			err := mr.Interactive(in, func() {
+				restore()
+				exit(0)
+			})
+			if err != nil {
+				log.Warn("interactive: %s", err)
+			}
+		}()
+	}
+
+	if *prep {
+		err = mr.PrepOnly(true)
 	} else {
 		err = mr.Run()
-		if err != nil {
+	}
+	restore()
+	if err != nil {
+		if _, ok := err.(modd.ProcError); !ok {
 			log.Shout("%s", err)
 		}
+		if _, ok := err.(modd.PreludeError); ok || *exitOnFail {
+			exit(exitCode(err))
+		}
+	}
+}
+
+// closeEventLog closes el, which may be nil, and warns about events that were
+// lost on the way
+func closeEventLog(el *modd.EventLog, log termlog.TermLog) {
+	if el == nil {
+		return
+	}
+	if err := el.Close(); err != nil {
+		log.Warn("event log: %s", err)
+	}
+	if n := el.Dropped(); n > 0 {
+		log.Warn("event log: %d events dropped while the log fell behind", n)
+	}
+}
+
+// startDetached starts modd again in the background, with the same arguments,
+// and waits for it to listen on the control socket. It returns the code to
+// exit with.
+func startDetached(mr *modd.ModRunner, socket string, log termlog.TermLog) int {
+	switch {
+	case *file == modd.ConfStdin:
+		log.Shout("--detach can't be used with a config read from stdin")
+		return 1
+	case *interactive:
+		log.Shout("--detach can't be used with --interactive, use modd attach instead")
+		return 1
+	case *status:
+		log.Shout("--detach can't be used with --status")
+		return 1
+	case mr.Config.PrimaryDaemon() != nil:
+		log.Shout("--detach can't be used with a +primary daemon")
+		return 1
+	}
+	hint := "modd attach"
+	if *control != "" {
+		hint += " --control " + *control
+	}
+	if c, err := modd.DialControl(socket); err == nil {
+		c.Close()
+		log.Shout("a detached modd is already listening at %s, use: %s", socket, hint)
+		return 1
+	}
+	pid, err := modd.Detach(os.Args[1:], *detachLog)
+	if err != nil {
+		log.Shout("Could not detach: %s", err)
+		return 1
+	}
+	for start := time.Now(); time.Since(start) < detachTimeout; time.Sleep(50 * time.Millisecond) {
+		if c, err := modd.DialControl(socket); err == nil {
+			c.Close()
+			log.Notice("modd detached as process %d, logging to %s - use: %s", pid, *detachLog, hint)
+			return 0
+		}
+	}
+	log.Shout("detached modd didn't start listening at %s, see %s", socket, *detachLog)
+	return 1
+}
+
+// detachTimeout is how long modd waits for a detached instance to start
+const detachTimeout = 10 * time.Second
+
+// exitCode returns the code modd exits with after a failure. Failed commands
+// pass on their own exit code where possible.
+func exitCode(err error) int {
+	if pe, ok := err.(modd.PreludeError); ok {
+		err = pe.Err
+	}
+	if pe, ok := err.(modd.ProcError); ok && pe.ExitCode > 0 {
+		return pe.ExitCode
 	}
+	return 1
 }
@@ -0,0 +1,81 @@
+package modd
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/fatih/color"
+)
+
+// daemonPalette holds the colours that daemon headers are drawn in. Red is
+// left out, since it's used for errors.
+var daemonPalette = []color.Attribute{
+	color.FgCyan,
+	color.FgMagenta,
+	color.FgYellow,
+	color.FgGreen,
+	color.FgHiBlue,
+	color.FgHiMagenta,
+	color.FgHiCyan,
+	color.FgHiGreen,
+	color.FgHiYellow,
+}
+
+// daemonKey returns the key that a daemon's colour is derived from, which is
+// its name
+func daemonKey(d conf.Daemon) string {
+	return d.Name()
+}
+
+// daemonColors assigns a palette index to each key, derived from a hash of
+// the key, so that a daemon keeps its colour when the config is reordered.
+// Keys whose hashes collide are moved along to the next free colour in sorted
+// order, so the assignment depends only on the set of keys. Once every colour
+// is taken, they're shared.
+func daemonColors(keys []string) map[string]int {
+	unique := []string{}
+	ret := map[string]int{}
+	for _, k := range keys {
+		if _, ok := ret[k]; !ok {
+			ret[k] = 0
+			unique = append(unique, k)
+		}
+	}
+	sort.Strings(unique)
+	n := len(daemonPalette)
+	used := make([]bool, n)
+	free := n
+	for _, k := range unique {
+		if free == 0 {
+			used = make([]bool, n)
+			free = n
+		}
+		h := fnv.New32a()
+		h.Write([]byte(k))
+		i := int(h.Sum32() % uint32(n))
+		for used[i] {
+			i = (i + 1) % n
+		}
+		used[i] = true
+		free--
+		ret[k] = i
+	}
+	return ret
+}
+
+// blockColors assigns colours to the daemons of blocks
+func blockColors(blocks []conf.Block) map[string]int {
+	keys := []string{}
+	for _, b := range blocks {
+		for _, d := range b.Daemons {
+			keys = append(keys, daemonKey(d))
+		}
+	}
+	return daemonColors(keys)
+}
+
+// colorHeader draws a header in the palette colour at index i
+func colorHeader(i int, header string) string {
+	return color.New(daemonPalette[i]).Sprint(header)
+}
@@ -0,0 +1,58 @@
+package modd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+)
+
+func TestDaemonColorsStable(t *testing.T) {
+	a := []conf.Block{
+		{Daemons: []conf.Daemon{{Command: "./server"}, {Command: "./worker"}}},
+		{Daemons: []conf.Daemon{{Command: "redis-server"}}},
+	}
+	b := []conf.Block{
+		{Daemons: []conf.Daemon{{Command: "redis-server"}}},
+		{Daemons: []conf.Daemon{{Command: "./worker"}, {Command: "./server"}}},
+	}
+	ca, cb := blockColors(a), blockColors(b)
+	for _, cmd := range []string{"./server", "./worker", "redis-server"} {
+		if ca[cmd] != cb[cmd] {
+			t.Errorf("Colour of %s changed with position: %d != %d", cmd, ca[cmd], cb[cmd])
+		}
+	}
+
+	named := blockColors([]conf.Block{
+		{Daemons: []conf.Daemon{{Command: "./server --port 8080", ProcName: "api"}}},
+	})
+	if _, ok := named["api"]; !ok {
+		t.Errorf("Expected the process name to be used as the key, got %#v", named)
+	}
+}
+
+func TestDaemonColorsCollisions(t *testing.T) {
+	n := len(daemonPalette)
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("./daemon-%d", i))
+	}
+	colors := daemonColors(keys)
+	seen := map[int]string{}
+	for _, k := range keys {
+		c := colors[k]
+		if c < 0 || c >= n {
+			t.Fatalf("Colour out of range for %s: %d", k, c)
+		}
+		if other, ok := seen[c]; ok {
+			t.Errorf("%s and %s share colour %d", k, other, c)
+		}
+		seen[c] = k
+	}
+
+	// Past the size of the palette, colours are shared, but still assigned
+	colors = daemonColors(append(keys, "./one-more", "./one-more"))
+	if len(colors) != n+1 {
+		t.Errorf("Expected %d assignments, got %d", n+1, len(colors))
+	}
+}
@@ -2,50 +2,917 @@ package conf
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // A Daemon is a persistent process that is kept running
 type Daemon struct {
 	Command       string
 	RestartSignal os.Signal
+	// ResizeSignal, if set, is sent to the daemon when modd's terminal is
+	// resized
+	ResizeSignal os.Signal
+	// RestartEvery, if non-zero, is the interval at which the daemon is
+	// restarted regardless of changes
+	RestartEvery time.Duration
+	// When, if set, must hold for the daemon to be started
+	When *Condition
+	// Buffer is the number of output lines queued for the log, and Overflow
+	// is the policy applied when the queue is full: "block", "drop-oldest",
+	// "drop-newest" or "sample"
+	Buffer   int
+	Overflow string
+	// ReadyPort, if set, is a local TCP port the daemon is ready once it
+	// accepts connections on. Otherwise, the daemon is ready once started.
+	// If ReadyTimeout is set, a daemon that isn't ready within that time is
+	// stopped and marked failed.
+	ReadyPort    int
+	ReadyTimeout time.Duration
+	// OnReady is a command run each time the daemon becomes ready. If
+	// OnReadyRequired is set, the daemon is marked unhealthy if it fails.
+	OnReady         string
+	OnReadyRequired bool
+	// Silence, if set, is how long the daemon may go without producing
+	// output before modd warns about it, or restarts it if SilenceRestart is
+	// set
+	Silence        time.Duration
+	SilenceRestart bool
+	// KeepStdin attaches a pipe to the daemon's standard input that's held
+	// open until shutdown, for daemons that exit on EOF
+	KeepStdin bool
+	// MaxMemory, if set, is the resident memory in bytes that the daemon's
+	// processes may use before it's restarted. Usage is sampled every
+	// MemoryInterval.
+	MaxMemory      int64
+	MemoryInterval time.Duration
+	// Fifo, if set, is the path of a FIFO that modd creates for the
+	// lifetime of the daemon. Anything written to it is relayed to the
+	// daemon's standard input, which is held open as for KeepStdin.
+	Fifo string
+	// PidFile, if set, is the path of a file that holds the PID of the
+	// daemon's process. It's written each time the daemon starts, and
+	// removed when it's shut down.
+	PidFile string
+	// WatchBinary restarts the daemon when the executable it runs changes
+	WatchBinary bool
+	// ProcName, if set, is the name the daemon's shell process is given in
+	// process listings, where the platform supports it
+	ProcName string
+	// PidPrefix prefixes each line of output with the PID of the daemon and
+	// the time since it started
+	PidPrefix bool
+	// Quiet discards the daemon's output. It's still read as it's produced,
+	// so the daemon doesn't stall on a full pipe.
+	Quiet bool
+	// NoRestart leaves the daemon running when its block is triggered. It's
+	// still started with the block, and restarted if it exits.
+	NoRestart bool
+	// Drain makes a restart wait for the daemon to exit on its own after
+	// its restart signal, once it has finished its work. If it's still
+	// running after DrainTimeout, or DefaultDrainTimeout if that's not set,
+	// it's stopped as it would be on shutdown.
+	Drain        bool
+	DrainTimeout time.Duration
+	// StopOrder groups daemons for shutdown. Groups are stopped in ascending
+	// order, each exiting before the next is signalled.
+	StopOrder int
+	// Primary connects modd's own stdin to the daemon's stdin, which is held
+	// open as for KeepStdin. Only one daemon may be primary.
+	Primary bool
+	// After names the daemons in the same block that must be ready before
+	// this daemon is first started
+	After []string
+	// Needs names the preps in the same block that gate the daemon. If one
+	// of them fails, the daemon isn't restarted, though other daemons in the
+	// block still are.
+	Needs []string
+	// Umask, if set, is the octal file mode creation mask the daemon is
+	// started with, in place of modd's own
+	Umask string
+	// Listen holds addresses that modd listens on for the daemon, passing
+	// the sockets to it as file descriptors from 3 up. Addresses are TCP
+	// host:port pairs, or unix:PATH for a Unix socket.
+	Listen []string
+	// User and Group, if set, are the user and group the daemon is run as,
+	// by name or numeric ID, which needs modd to have the privilege to
+	// change them
+	User  string
+	Group string
+}
+
+// DefaultDrainTimeout is how long a draining daemon has to exit after its
+// restart signal, if it doesn't set DrainTimeout
+const DefaultDrainTimeout = 30 * time.Second
+
+// Name returns the name other daemons refer to the daemon by: its process
+// name if it has one, and otherwise its command
+func (d Daemon) Name() string {
+	if d.ProcName != "" {
+		return d.ProcName
+	}
+	return d.Command
+}
+
+// checkUmask checks that val is an octal file mode creation mask
+func checkUmask(name, val string) error {
+	if n, err := strconv.ParseUint(val, 8, 32); err != nil || n > 0777 {
+		return fmt.Errorf("invalid umask for %s: %q", name, val)
+	}
+	return nil
+}
+
+// parseListen parses an address a daemon's socket listens on. A bare port
+// number listens on all interfaces.
+func parseListen(name, val string) (string, error) {
+	if strings.HasPrefix(val, "unix:") {
+		if val == "unix:" {
+			return "", fmt.Errorf("%s requires a socket path", name)
+		}
+		return val, nil
+	}
+	if n, err := strconv.Atoi(val); err == nil && n > 0 && n <= 65535 {
+		return ":" + val, nil
+	}
+	if _, _, err := net.SplitHostPort(val); err != nil {
+		return "", fmt.Errorf("invalid address for %s: %q", name, val)
+	}
+	return val, nil
+}
+
+var overflowPolicies = map[string]bool{
+	"block":       true,
+	"drop-oldest": true,
+	"drop-newest": true,
+	"sample":      true,
+}
+
+// A Condition is a minimal test expression. A condition of the form
+// $NAME=value or $NAME!=value compares an environment variable to a literal
+// value. Anything else is a shell command that must exit with status 0.
+type Condition struct {
+	Command string
+	Name    string
+	Value   string
+	Negate  bool
+}
+
+var envCondition = regexp.MustCompile(`^\$([a-zA-Z_][a-zA-Z0-9_]*)(!?=)(.*)$`)
+
+// ParseCondition parses a condition expression
+func ParseCondition(expr string) (*Condition, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, fmt.Errorf("empty condition")
+	}
+	m := envCondition.FindStringSubmatch(expr)
+	if m == nil {
+		return &Condition{Command: expr}, nil
+	}
+	return &Condition{Name: m[1], Value: m[3], Negate: m[2] == "!="}, nil
 }
 
 // A Prep runs and terminates
 type Prep struct {
 	Command  string
 	Onchange bool // Should prep skip initial run
+	Pipe     bool // Should prep receive the output of the previous prep on stdin
+	Persist  bool // Should prep run in the block's persistent shell session
+	// If set, the prep is skipped on change unless a changed file matches
+	// one of these patterns
+	OnlyIf []string
+	// If ContinueOnError is set, a failure of the prep is reported, but the
+	// block carries on with the next prep
+	ContinueOnError bool
+	// Timeout, if non-zero, is how long the prep may run before it's
+	// stopped. KillSignals is the escalation ladder used to stop it; if it's
+	// empty, a default ladder is used.
+	Timeout     time.Duration
+	KillSignals []KillStep
+	// DedupKey, if set, makes the prep run at most once per cycle across all
+	// preps with the same key. Later preps with the key take the outcome of
+	// the first.
+	DedupKey string
+	// Umask, if set, is the octal file mode creation mask the prep is run
+	// with, in place of modd's own
+	Umask string
+	// Keep, if set, names a value in which the standard output of the prep
+	// is kept when it succeeds, less its final newline. Preps in the block
+	// see the value kept by the previous run in the MODD_PREV_<Keep>
+	// variable, which is empty on the first run.
+	Keep string
+	// Name, if set, is the name daemons in the block refer to the prep by,
+	// to be gated by its result
+	Name string
+	// Retries is the number of times a failed prep is run again before it
+	// counts as failed. If RetryOnCodes is set, only failures with one of
+	// those exit codes are retried.
+	Retries      int
+	RetryOnCodes []int
+}
+
+// A KillStep is a step in an escalation ladder: Signal is sent, and the
+// process has Wait to exit before the next step. A process that outlives the
+// whole ladder is killed.
+type KillStep struct {
+	Signal os.Signal
+	Wait   time.Duration
+}
+
+// LookupSignal returns the signal with the given name, as used in daemon
+// options. Case is ignored, and the SIG prefix is optional.
+func LookupSignal(name string) (os.Signal, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasPrefix(name, "sig") {
+		name = "sig" + name
+	}
+	sig, ok := signals[name]
+	return sig, ok
+}
+
+// parseKillSignals parses a ladder of the form sigint/2s,sigterm/5s
+func parseKillSignals(val string) ([]KillStep, error) {
+	var ret []KillStep
+	for _, s := range strings.Split(val, ",") {
+		parts := strings.SplitN(s, "/", 2)
+		sig, ok := signals[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal: %s", parts[0])
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing wait for %s", parts[0])
+		}
+		dur, err := parsePositiveDuration(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, KillStep{Signal: sig, Wait: dur})
+	}
+	return ret, nil
+}
+
+// An EnvVar is an environment variable set for the commands in a block
+type EnvVar struct {
+	Name  string
+	Value string
+	// If Command is true, Value is a command whose output is the value of the
+	// variable
+	Command bool
 }
 
 // Block is a match pattern and a set of specifications
 type Block struct {
-	Include        []string
-	Exclude        []string
+	Include []string
+	Exclude []string
+	// Order lists the include and exclude patterns in the order they apply,
+	// with excludes marked by a leading "!". It's only set if an include
+	// follows an exclude, in which case later patterns refine earlier ones,
+	// and the last pattern that matches a file decides whether the block
+	// matches it. Excludes given before any include apply to every file, and
+	// come last. Without an Order, excludes apply to every include.
+	Order []string
+	// Base, if set, is the directory that the block's patterns are relative
+	// to. They're resolved against it when the block is parsed.
+	Base           string
 	NoCommonFilter bool
 	InDir          string
+	Label          string
+	// Encoding of command output, if not UTF-8
+	Encoding string
+	// Delimiter, if set, is the byte that command output is split into lines
+	// on, in place of newlines
+	Delimiter string
+	// If CleanEnv is set, commands inherit only the variables named in
+	// PassEnv from modd's environment
+	CleanEnv bool
+	PassEnv  []string
+	// Echo is "on" if commands are logged before they're run, or "off" if
+	// not. Blocks that don't set it take the global setting.
+	Echo string
+	// Header is "on" if the output of each prep is introduced by a header
+	// line naming the command, or "off" if output is logged without one.
+	// Blocks that don't set it take the global setting, and headers are on
+	// by default.
+	Header string
+	// Isolate is "on" if the block's preps run in a fresh temporary copy of
+	// its directory, which is removed once they're done, or "off" if not
+	Isolate string
+	// Collapse, if non-zero, collapses repeated lines of output, and is the
+	// longest a count of repeats is held back
+	Collapse time.Duration
+	// Rollback, if set, is a command run when a prep in the block fails, to
+	// undo the work of the preps before it
+	Rollback string
+	// Container, if set, is the container that preps in the block run in
+	Container *Container
+	// Every, if non-zero, is the interval at which the block is run while
+	// modd is watching, in addition to runs triggered by changes
+	Every time.Duration
+	// Batch, if non-zero, is how long restarts of the block's running
+	// daemons are collected for, before they're all restarted together in
+	// dependency order
+	Batch time.Duration
+	// Priority ranks the block against others whose patterns match the
+	// same file, when only the first match is run. Higher priorities win,
+	// and blocks of equal priority are taken in config order.
+	Priority int
+	// MinChanges, if non-zero, is the fewest matching files that must have
+	// changed for a change to trigger the block. Smaller changes are dropped,
+	// or held over and counted with the next change if Accumulate is set.
+	MinChanges int
+	Accumulate bool
+	// Mask holds patterns for sensitive text that's masked in the output of
+	// the block's commands. It's taken from the global mask directives.
+	Mask []string
+	// Shell is the shell that the block's commands are run with. Blocks that
+	// don't set it take the global shell.
+	Shell string
 
+	Env     []EnvVar
 	Daemons []Daemon
 	Preps   []Prep
 }
 
+// DefaultContainerRuntime is the command used to run containers, if a block
+// doesn't specify one
+const DefaultContainerRuntime = "docker"
+
+// A Container is an image that a block's preps are run in
+type Container struct {
+	Image string
+	// Runtime is the container runtime command, like docker or podman
+	Runtime string
+}
+
+func (b *Block) setContainer(image string, options []string) error {
+	if image == "" {
+		return fmt.Errorf("container requires an image")
+	}
+	c := &Container{Image: image, Runtime: DefaultContainerRuntime}
+	for _, v := range options {
+		name, val := splitOption(v)
+		switch name {
+		case "+runtime":
+			if val == "" {
+				return fmt.Errorf("%s requires a command", name)
+			}
+			c.Runtime = val
+		default:
+			return fmt.Errorf("unknown option: %s", v)
+		}
+	}
+	for _, p := range b.Preps {
+		if p.Persist {
+			return fmt.Errorf("container can't be used with +persist")
+		}
+	}
+	b.Container = c
+	return nil
+}
+
+var envName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func parseEnv(spec string, options []string) (EnvVar, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || !envName.MatchString(parts[0]) {
+		return EnvVar{}, fmt.Errorf("env must be of the form NAME=value")
+	}
+	e := EnvVar{Name: parts[0], Value: strings.TrimSpace(parts[1])}
+	for _, v := range options {
+		switch v {
+		case "+cmd":
+			e.Command = true
+		default:
+			return EnvVar{}, fmt.Errorf("unknown option: %s", v)
+		}
+	}
+	return e, nil
+}
+
+// delimiterNames are the names of delimiters that can't be given literally
+var delimiterNames = map[string]string{
+	"nul":     "\x00",
+	"tab":     "\t",
+	"newline": "\n",
+}
+
+func (b *Block) setDelimiter(spec string) error {
+	if b.Delimiter != "" {
+		return fmt.Errorf("delimiter can only be used once per block")
+	}
+	if d, ok := delimiterNames[spec]; ok {
+		spec = d
+	} else if len(spec) != 1 {
+		return fmt.Errorf("delimiter must be a single character, nul, tab or newline, got %q", spec)
+	}
+	b.Delimiter = spec
+	return nil
+}
+
+func (b *Block) setCollapse(spec string) error {
+	if b.Collapse != 0 {
+		return fmt.Errorf("collapse can only be used once per block")
+	}
+	d, err := parsePositiveDuration("collapse", spec)
+	if err != nil {
+		return err
+	}
+	b.Collapse = d
+	return nil
+}
+
+func (b *Block) setBatch(spec string) error {
+	if b.Batch != 0 {
+		return fmt.Errorf("batch can only be used once per block")
+	}
+	d, err := parsePositiveDuration("batch", spec)
+	if err != nil {
+		return err
+	}
+	b.Batch = d
+	return nil
+}
+
+func (b *Block) setPriority(spec string) error {
+	if b.Priority != 0 {
+		return fmt.Errorf("priority can only be used once per block")
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("invalid priority: %q", spec)
+	}
+	b.Priority = n
+	return nil
+}
+
+func (b *Block) setMinChanges(spec string, options []string) error {
+	if b.MinChanges != 0 {
+		return fmt.Errorf("minchanges can only be used once per block")
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid minchanges: %q", spec)
+	}
+	for _, v := range options {
+		switch v {
+		case "+accumulate":
+			b.Accumulate = true
+		default:
+			return fmt.Errorf("unknown option: %s", v)
+		}
+	}
+	b.MinChanges = n
+	return nil
+}
+
+func (b *Block) setEvery(spec string) error {
+	if b.Every != 0 {
+		return fmt.Errorf("every can only be used once per block")
+	}
+	d, err := parsePositiveDuration("every", spec)
+	if err != nil {
+		return err
+	}
+	b.Every = d
+	return nil
+}
+
+func (b *Block) setPassEnv(spec string) error {
+	if b.CleanEnv {
+		return fmt.Errorf("passenv can only be used once per block")
+	}
+	names := strings.Fields(spec)
+	for _, n := range names {
+		if !envName.MatchString(n) {
+			return fmt.Errorf("invalid variable name for passenv: %q", n)
+		}
+	}
+	b.CleanEnv = true
+	b.PassEnv = names
+	return nil
+}
+
+func (b *Block) addEnv(spec string, options []string) error {
+	e, err := parseEnv(spec, options)
+	if err != nil {
+		return err
+	}
+	b.Env = append(b.Env, e)
+	return nil
+}
+
+// splitOption splits an option of the form +name=value into its name and
+// value, unquoting quoted values. Options without a value have an empty value.
+func splitOption(opt string) (string, string) {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) == 1 {
+		return opt, ""
+	}
+	val := parts[1]
+	if len(val) > 1 && any(rune(val[0]), quotes) {
+		val = unquote(val)
+	}
+	return parts[0], val
+}
+
+func (b *Block) addDaemon(command string, options []string) error {
+	if b.Daemons == nil {
+		b.Daemons = []Daemon{}
+	}
+	d := Daemon{
+		Command:       command,
+		RestartSignal: syscall.SIGHUP,
+	}
+	onsilence := false
+	for _, v := range options {
+		name, val := splitOption(v)
+		switch name {
+		case "+onresize":
+			d.ResizeSignal = resizeSignal
+			if val != "" {
+				sig, ok := signals[val]
+				if !ok {
+					return fmt.Errorf("unknown signal: %s", val)
+				}
+				d.ResizeSignal = sig
+			}
+		case "+restartevery":
+			dur, err := parsePositiveDuration(name, val)
+			if err != nil {
+				return err
+			}
+			d.RestartEvery = dur
+		case "+when":
+			c, err := ParseCondition(val)
+			if err != nil {
+				return fmt.Errorf("invalid condition for %s: %s", name, err)
+			}
+			d.When = c
+		case "+buffer":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid size for %s: %q", name, val)
+			}
+			d.Buffer = n
+		case "+overflow":
+			if !overflowPolicies[val] {
+				return fmt.Errorf("unknown overflow policy: %q", val)
+			}
+			d.Overflow = val
+		case "+readyport":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || n > 65535 {
+				return fmt.Errorf("invalid port for %s: %q", name, val)
+			}
+			d.ReadyPort = n
+		case "+readytimeout":
+			dur, err := parsePositiveDuration(name, val)
+			if err != nil {
+				return err
+			}
+			d.ReadyTimeout = dur
+		case "+drain":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.Drain = true
+		case "+draintimeout":
+			dur, err := parsePositiveDuration(name, val)
+			if err != nil {
+				return err
+			}
+			d.DrainTimeout = dur
+		case "+onready":
+			if strings.TrimSpace(val) == "" {
+				return fmt.Errorf("%s requires a command", name)
+			}
+			d.OnReady = val
+		case "+silence":
+			dur, err := parsePositiveDuration(name, val)
+			if err != nil {
+				return err
+			}
+			d.Silence = dur
+		case "+umask":
+			if err := checkUmask(name, val); err != nil {
+				return err
+			}
+			d.Umask = val
+		case "+stoporder":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid order for %s: %q", name, val)
+			}
+			d.StopOrder = n
+		case "+onsilence":
+			onsilence = true
+			switch val {
+			case "warn":
+				d.SilenceRestart = false
+			case "restart":
+				d.SilenceRestart = true
+			default:
+				return fmt.Errorf("invalid action for %s: %q", name, val)
+			}
+		case "+onreadyrequired":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.OnReadyRequired = true
+		case "+keepstdin":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.KeepStdin = true
+		case "+maxmemory":
+			n, err := parsePositiveSize(name, val)
+			if err != nil {
+				return err
+			}
+			d.MaxMemory = n
+		case "+memoryinterval":
+			dur, err := parsePositiveDuration(name, val)
+			if err != nil {
+				return err
+			}
+			d.MemoryInterval = dur
+		case "+fifo":
+			if val == "" {
+				return fmt.Errorf("%s requires a path", name)
+			}
+			d.Fifo = val
+		case "+pidfile":
+			if val == "" {
+				return fmt.Errorf("%s requires a path", name)
+			}
+			d.PidFile = val
+		case "+watchbinary":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.WatchBinary = true
+		case "+pidprefix":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.PidPrefix = true
+		case "+quiet":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.Quiet = true
+		case "+norestart":
+			d.NoRestart = true
+		case "+primary":
+			if val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.Primary = true
+		case "+procname":
+			if val == "" {
+				return fmt.Errorf("%s requires a name", name)
+			}
+			d.ProcName = val
+		case "+user", "+group":
+			if val == "" {
+				return fmt.Errorf("%s requires a name", name)
+			}
+			if name == "+user" {
+				d.User = val
+			} else {
+				d.Group = val
+			}
+		case "+listen":
+			addr, err := parseListen(name, val)
+			if err != nil {
+				return err
+			}
+			d.Listen = append(d.Listen, addr)
+		case "+after":
+			if val == "" {
+				return fmt.Errorf("%s requires a daemon name", name)
+			}
+			d.After = append(d.After, strings.Split(val, ",")...)
+		case "+needs":
+			if val == "" {
+				return fmt.Errorf("%s requires a prep name", name)
+			}
+			d.Needs = append(d.Needs, strings.Split(val, ",")...)
+		default:
+			sig, ok := signals[strings.TrimPrefix(name, "+")]
+			if !ok || val != "" {
+				return fmt.Errorf("unknown option: %s", v)
+			}
+			d.RestartSignal = sig
+		}
+	}
+	if onsilence && d.Silence == 0 {
+		return fmt.Errorf("+onsilence requires +silence")
+	}
+	if d.ReadyTimeout > 0 && d.ReadyPort == 0 {
+		return fmt.Errorf("+readytimeout requires +readyport")
+	}
+	if d.DrainTimeout > 0 && !d.Drain {
+		return fmt.Errorf("+draintimeout requires +drain")
+	}
+	if d.MemoryInterval > 0 && d.MaxMemory == 0 {
+		return fmt.Errorf("+memoryinterval requires +maxmemory")
+	}
+	if d.Primary && d.Fifo != "" {
+		return fmt.Errorf("+primary can't be used with +fifo")
+	}
+	b.Daemons = append(b.Daemons, d)
+	return nil
+}
+
+// checkNeeds checks that the preps the block's daemons need exist
+func (b *Block) checkNeeds() error {
+	names := map[string]bool{}
+	for _, p := range b.Preps {
+		if p.Name != "" {
+			names[p.Name] = true
+		}
+	}
+	for _, d := range b.Daemons {
+		for _, n := range d.Needs {
+			if !names[n] {
+				return fmt.Errorf("+needs refers to unknown prep: %s", n)
+			}
+		}
+	}
+	return nil
+}
+
+// DaemonOrder returns the indices of the block's daemons in the order they're
+// started, so that each daemon comes after the daemons it names in After.
+// Otherwise, daemons keep their configured order. It's an error for After to
+// name an unknown daemon, or for daemons to depend on each other in a cycle.
+func (b *Block) DaemonOrder() ([]int, error) {
+	byName := map[string][]int{}
+	for i, d := range b.Daemons {
+		byName[d.Name()] = append(byName[d.Name()], i)
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make([]int, len(b.Daemons))
+	var order []int
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			for j, n := range path {
+				if n == b.Daemons[i].Name() {
+					path = append(path[j:], n)
+					break
+				}
+			}
+			return fmt.Errorf("daemon dependency cycle: %s", strings.Join(path, " -> "))
+		}
+		state[i] = visiting
+		path = append(path, b.Daemons[i].Name())
+		for _, dep := range b.Daemons[i].After {
+			deps, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("+after refers to unknown daemon: %s", dep)
+			}
+			for _, j := range deps {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+	for i := range b.Daemons {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
 func (b *Block) addPrep(command string, options []string) error {
 	if b.Preps == nil {
 		b.Preps = []Prep{}
 	}
 
-	var onchange = false
+	prep := Prep{Command: command}
 	for _, v := range options {
 		switch v {
 		case "+onchange":
-			onchange = true
+			prep.Onchange = true
+		case "+pipe":
+			if len(b.Preps) == 0 {
+				return fmt.Errorf("+pipe requires a preceding prep")
+			}
+			prep.Pipe = true
+		case "+persist":
+			prep.Persist = true
+		case "+continueonerror":
+			prep.ContinueOnError = true
 		default:
-			return fmt.Errorf("unknown option: %s", v)
+			name, val := splitOption(v)
+			switch name {
+			case "+onlyif":
+				if val == "" {
+					return fmt.Errorf("%s requires a pattern", name)
+				}
+				if err := checkPattern(val); err != nil {
+					return err
+				}
+				prep.OnlyIf = append(prep.OnlyIf, val)
+			case "+timeout":
+				dur, err := parsePositiveDuration(name, val)
+				if err != nil {
+					return err
+				}
+				prep.Timeout = dur
+			case "+killsignals":
+				steps, err := parseKillSignals(val)
+				if err != nil {
+					return err
+				}
+				prep.KillSignals = steps
+			case "+dedupkey":
+				if val == "" {
+					return fmt.Errorf("%s requires a key", name)
+				}
+				prep.DedupKey = val
+			case "+umask":
+				if err := checkUmask(name, val); err != nil {
+					return err
+				}
+				prep.Umask = val
+			case "+keep":
+				if !envName.MatchString(val) {
+					return fmt.Errorf("%s requires a name of letters, digits and underscores", name)
+				}
+				prep.Keep = strings.ToUpper(val)
+			case "+name":
+				if val == "" {
+					return fmt.Errorf("%s requires a name", name)
+				}
+				for _, other := range b.Preps {
+					if other.Name == val {
+						return fmt.Errorf("prep name %s is used more than once", val)
+					}
+				}
+				prep.Name = val
+			case "+retries":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return fmt.Errorf("%s must be a positive number, got %q", name, val)
+				}
+				prep.Retries = n
+			case "+retryon":
+				if val == "" {
+					return fmt.Errorf("%s requires exit codes", name)
+				}
+				for _, c := range strings.Split(val, ",") {
+					n, err := strconv.Atoi(c)
+					if err != nil || n < 1 || n > 255 {
+						return fmt.Errorf("invalid exit code for %s: %q", name, c)
+					}
+					prep.RetryOnCodes = append(prep.RetryOnCodes, n)
+				}
+			default:
+				return fmt.Errorf("unknown option: %s", v)
+			}
 		}
 	}
-
-	prep := Prep{command, onchange}
+	if prep.Pipe && prep.Persist {
+		return fmt.Errorf("+pipe can't be used with +persist")
+	}
+	if prep.Timeout > 0 && prep.Persist {
+		return fmt.Errorf("+timeout can't be used with +persist")
+	}
+	if prep.Umask != "" && prep.Persist {
+		return fmt.Errorf("+umask can't be used with +persist")
+	}
+	if prep.Persist && b.Container != nil {
+		return fmt.Errorf("+persist can't be used in a container")
+	}
+	if prep.KillSignals != nil && prep.Timeout == 0 {
+		return fmt.Errorf("+killsignals requires +timeout")
+	}
+	if prep.RetryOnCodes != nil && prep.Retries == 0 {
+		return fmt.Errorf("+retryon requires +retries")
+	}
 
 	b.Preps = append(b.Preps, prep)
 	return nil
@@ -53,8 +920,39 @@ func (b *Block) addPrep(command string, options []string) error {
 
 // Config represents a complete configuration
 type Config struct {
-	Blocks    []Block
+	Blocks []Block
+	// Env holds variables set for every block. Each block's Env starts with
+	// these, followed by its own variables, which take precedence.
+	Env []EnvVar
+	// Echo is set if commands are logged before they're run, in blocks that
+	// don't say otherwise
+	Echo bool
+	// Header is "on" or "off" for prep headers, in blocks that don't say
+	// otherwise, or empty if it's not set
+	Header string
+	// OnCycleEnd is a command run after each cycle, with a summary of the
+	// cycle in its environment
+	OnCycleEnd string
+	// Prelude is a command run once when modd starts, before anything else
+	Prelude string
+	// Teardown is a command run once when modd exits, after its daemons have
+	// shut down
+	Teardown string
+	// Mask holds regular expressions for sensitive text, like tokens, that's
+	// masked in the output of all commands
+	Mask []string
+	// Shell is the shell used for commands in blocks that don't set their
+	// own, and for commands outside of blocks
+	Shell     string
 	variables map[string]string
+	// Snippets are named commands defined by the config, which are expanded
+	// into the commands that refer to them as it's parsed
+	snippets map[string]string
+	// Snippets defined by the base config of an overlay, which the overlay
+	// can refer to and redefine
+	inherited map[string]string
+	// Whether echo was set, so that an overlay can turn it off
+	echoSet bool
 }
 
 // Equals checks if this Config equals another
@@ -64,6 +962,19 @@ func (c *Config) Equals(other *Config) bool {
 			return false
 		}
 	}
+	if len(c.Env) != 0 || len(other.Env) != 0 {
+		if !reflect.DeepEqual(c.Env, other.Env) {
+			return false
+		}
+	}
+	if c.Echo != other.Echo || c.Header != other.Header || c.OnCycleEnd != other.OnCycleEnd || c.Prelude != other.Prelude || c.Shell != other.Shell || c.Teardown != other.Teardown {
+		return false
+	}
+	if len(c.Mask) != 0 || len(other.Mask) != 0 {
+		if !reflect.DeepEqual(c.Mask, other.Mask) {
+			return false
+		}
+	}
 	if (c.variables != nil || len(c.variables) != 0) || (other.variables != nil || len(other.variables) != 0) {
 		if !reflect.DeepEqual(c.variables, other.variables) {
 			return false
@@ -72,6 +983,19 @@ func (c *Config) Equals(other *Config) bool {
 	return true
 }
 
+// PrimaryDaemon returns the daemon that modd's stdin is connected to, or nil if
+// there is none
+func (c *Config) PrimaryDaemon() *Daemon {
+	for i := range c.Blocks {
+		for j := range c.Blocks[i].Daemons {
+			if c.Blocks[i].Daemons[j].Primary {
+				return &c.Blocks[i].Daemons[j]
+			}
+		}
+	}
+	return nil
+}
+
 // IncludePatterns retrieves all include patterns from all blocks.
 func (c *Config) IncludePatterns() []string {
 	pmap := map[string]bool{}
@@ -90,11 +1014,29 @@ func (c *Config) IncludePatterns() []string {
 	return paths
 }
 
-func (c *Config) addBlock(b Block) {
+func (c *Config) addBlock(b Block) error {
 	if c.Blocks == nil {
 		c.Blocks = []Block{}
 	}
+	if c.GetBlock(b.Label) != nil {
+		return fmt.Errorf("block label %s shadows previous declaration", b.Label)
+	}
 	c.Blocks = append(c.Blocks, b)
+	return nil
+}
+
+// GetBlock returns the block with the given label, or nil if there is no such
+// block.
+func (c *Config) GetBlock(label string) *Block {
+	if label == "" {
+		return nil
+	}
+	for i := range c.Blocks {
+		if c.Blocks[i].Label == label {
+			return &c.Blocks[i]
+		}
+	}
+	return nil
 }
 
 func (c *Config) addVariable(key string, value string) error {
@@ -108,6 +1050,168 @@ func (c *Config) addVariable(key string, value string) error {
 	return nil
 }
 
+func (c *Config) addEnv(spec string, options []string) error {
+	e, err := parseEnv(spec, options)
+	if err != nil {
+		return err
+	}
+	c.Env = append(c.Env, e)
+	return nil
+}
+
+func (c *Config) setOnCycleEnd(command string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if c.OnCycleEnd != "" {
+		return fmt.Errorf("oncycleend can only be used once")
+	}
+	c.OnCycleEnd = command
+	return nil
+}
+
+func (c *Config) setPrelude(command string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if c.Prelude != "" {
+		return fmt.Errorf("prelude can only be used once")
+	}
+	c.Prelude = command
+	return nil
+}
+
+func (c *Config) setTeardown(command string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if c.Teardown != "" {
+		return fmt.Errorf("teardown can only be used once")
+	}
+	c.Teardown = command
+	return nil
+}
+
+func (c *Config) addMask(pattern string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if pattern == "" {
+		return fmt.Errorf("mask requires a pattern")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid pattern for mask: %s", err)
+	}
+	c.Mask = append(c.Mask, pattern)
+	return nil
+}
+
+func (c *Config) setShell(name string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if c.Shell != "" {
+		return fmt.Errorf("shell can only be used once")
+	}
+	c.Shell = name
+	return nil
+}
+
+// ShellName returns the name of the global shell: the shell directive if
+// there is one, and otherwise the @shell variable. It's empty if neither is
+// set.
+func (c *Config) ShellName() string {
+	if c.Shell != "" {
+		return c.Shell
+	}
+	return c.variables[shellVarName]
+}
+
+func (c *Config) setEcho(value string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	switch value {
+	case "on":
+		c.Echo = true
+	case "off":
+		c.Echo = false
+	default:
+		return fmt.Errorf("echo must be on or off, got %q", value)
+	}
+	c.echoSet = true
+	return nil
+}
+
+func (c *Config) setHeader(value string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	if value != "on" && value != "off" {
+		return fmt.Errorf("header must be on or off, got %q", value)
+	}
+	c.Header = value
+	return nil
+}
+
+// applyHeader gives the global header setting to each block without its own
+func (c *Config) applyHeader() {
+	if c.Header == "" {
+		return
+	}
+	for i := range c.Blocks {
+		if c.Blocks[i].Header == "" {
+			c.Blocks[i].Header = c.Header
+		}
+	}
+}
+
+// applyEcho gives the global echo setting to each block without its own
+func (c *Config) applyEcho() {
+	if !c.Echo {
+		return
+	}
+	for i := range c.Blocks {
+		if c.Blocks[i].Echo == "" {
+			c.Blocks[i].Echo = "on"
+		}
+	}
+}
+
+// applyShell gives the shell directive to each block without its own. Blocks
+// are left to fall back on the @shell variable when it's used instead.
+func (c *Config) applyShell() {
+	if c.Shell == "" {
+		return
+	}
+	for i := range c.Blocks {
+		if c.Blocks[i].Shell == "" {
+			c.Blocks[i].Shell = c.Shell
+		}
+	}
+}
+
+// applyMask gives the global mask patterns to each block
+func (c *Config) applyMask() {
+	if len(c.Mask) == 0 {
+		return
+	}
+	for i := range c.Blocks {
+		c.Blocks[i].Mask = c.Mask
+	}
+}
+
+// applyEnv prepends the global environment to the environment of each block
+func (c *Config) applyEnv() {
+	if len(c.Env) == 0 {
+		return
+	}
+	for i, b := range c.Blocks {
+		env := append([]EnvVar{}, c.Env...)
+		c.Blocks[i].Env = append(env, b.Env...)
+	}
+}
+
 // GetVariables returns a copy of the Variables map
 func (c *Config) GetVariables() map[string]string {
 	n := map[string]string{}
@@ -123,6 +1227,11 @@ func (c *Config) CommonExcludes(excludes []string) {
 	for i, b := range c.Blocks {
 		if !b.NoCommonFilter {
 			b.Exclude = append(b.Exclude, excludes...)
+			if b.Order != nil {
+				for _, e := range excludes {
+					b.Order = append(b.Order, "!"+e)
+				}
+			}
 		}
 		c.Blocks[i] = b
 	}
@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
@@ -18,3 +19,126 @@ func TestWatchPaths(t *testing.T) {
 		t.Errorf("Expected %#v, got %#v", expected, got)
 	}
 }
+
+func TestGetBlock(t *testing.T) {
+	c := Config{
+		Blocks: []Block{
+			{Include: []string{"a"}},
+			{Include: []string{"b"}, Label: "b"},
+		},
+	}
+	if b := c.GetBlock("b"); b == nil || b.Include[0] != "b" {
+		t.Errorf("Expected block b, got %#v", b)
+	}
+	if b := c.GetBlock("nonexistent"); b != nil {
+		t.Errorf("Expected nil, got %#v", b)
+	}
+	if b := c.GetBlock(""); b != nil {
+		t.Errorf("Expected nil for empty label, got %#v", b)
+	}
+}
+
+var conditionTests = []struct {
+	expr     string
+	expected *Condition
+}{
+	{"$ENABLE_WORKER=1", &Condition{Name: "ENABLE_WORKER", Value: "1"}},
+	{"$ENABLE_WORKER!=1", &Condition{Name: "ENABLE_WORKER", Value: "1", Negate: true}},
+	{"$MODE=", &Condition{Name: "MODE"}},
+	{"$MODE=a=b", &Condition{Name: "MODE", Value: "a=b"}},
+	{" $MODE=dev ", &Condition{Name: "MODE", Value: "dev"}},
+	{"test -f go.mod", &Condition{Command: "test -f go.mod"}},
+	{"$1=foo", &Condition{Command: "$1=foo"}},
+	{"[ \"$MODE\" = dev ]", &Condition{Command: "[ \"$MODE\" = dev ]"}},
+}
+
+func TestDaemonOrder(t *testing.T) {
+	b := Block{
+		Daemons: []Daemon{
+			{Command: "./worker", After: []string{"db", "cache"}},
+			{Command: "./web", After: []string{"./worker"}},
+			{Command: "postgres", ProcName: "db"},
+			{Command: "redis-server", ProcName: "cache", After: []string{"db"}},
+		},
+	}
+	order, err := b.DaemonOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{2, 3, 0, 1}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, order)
+	}
+
+	b.Daemons[2].After = []string{"./web"}
+	_, err = b.DaemonOrder()
+	expected := "daemon dependency cycle: ./worker -> db -> ./web -> ./worker"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	for _, tt := range conditionTests {
+		got, err := ParseCondition(tt.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %#v, got %#v", tt.expr, tt.expected, got)
+		}
+	}
+	if _, err := ParseCondition("  "); err == nil {
+		t.Errorf("Expected error for empty condition")
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	c, err := Parse(
+		"test",
+		"@shell = bash\nfoo {\ncollapse: 2s\nevery: 10m\nprep +timeout=1m +killsignals=sigint/2s: test\n"+
+			"daemon +sigterm +silence=5s: server\n"+
+			"daemon +readyport=8080 +readytimeout=30s +drain +draintimeout=1m: worker\n}",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Variables map[string]string
+		Blocks    []struct {
+			Include  []string
+			Collapse string
+			Every    string
+			Preps    []map[string]interface{}
+			Daemons  []map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(ret, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Variables["@shell"] != "bash" {
+		t.Errorf("Expected variables in output: %s", ret)
+	}
+	if len(got.Blocks) != 1 || got.Blocks[0].Collapse != "2s" || got.Blocks[0].Every != "10m0s" {
+		t.Fatalf("Unexpected blocks: %s", ret)
+	}
+	p := got.Blocks[0].Preps[0]
+	if p["Timeout"] != "1m0s" || !reflect.DeepEqual(p["KillSignals"], []interface{}{"sigint/2s"}) {
+		t.Errorf("Unexpected prep: %#v", p)
+	}
+	d := got.Blocks[0].Daemons[0]
+	if d["Command"] != "server" || d["RestartSignal"] != "sigterm" || d["Silence"] != "5s" {
+		t.Errorf("Unexpected daemon: %#v", d)
+	}
+	if _, ok := d["RestartEvery"]; ok {
+		t.Errorf("Expected unset durations to be omitted: %#v", d)
+	}
+	d = got.Blocks[0].Daemons[1]
+	if d["ReadyTimeout"] != "30s" || d["DrainTimeout"] != "1m0s" {
+		t.Errorf("Unexpected daemon: %#v", d)
+	}
+}
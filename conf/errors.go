@@ -0,0 +1,96 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cortesi/moddwatch/filter"
+)
+
+// An Error is a problem found while parsing a config file. All errors
+// returned by Parse are of this type.
+type Error struct {
+	// Name of the config file
+	Name string
+	// Line and Column of the problem, counting from 1. Columns are counted
+	// in characters.
+	Line   int
+	Column int
+	// Token is the text of the config at the problem, if any
+	Token   string
+	Message string
+	// Source is the line of the config the problem is on
+	Source string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Column, e.Message)
+}
+
+// Detail returns the error followed by the line of the config it's on, with
+// a marker under the problem
+func (e *Error) Detail() string {
+	marker := make([]rune, 0, e.Column)
+	for i, r := range []rune(e.Source) {
+		if i >= e.Column-1 {
+			break
+		}
+		// Keep tabs, so that the marker lines up however they're displayed
+		if r != '\t' {
+			r = ' '
+		}
+		marker = append(marker, r)
+	}
+	return fmt.Sprintf("%s\n    %s\n    %s^", e, e.Source, string(marker))
+}
+
+// newError creates an Error for a problem at byte offset pos of text
+func newError(name string, text string, pos Pos, msg string) *Error {
+	if int(pos) > len(text) {
+		pos = Pos(len(text))
+	}
+	before := text[:pos]
+	lineStart := strings.LastIndex(before, "\n") + 1
+	source := text[lineStart:]
+	if i := strings.IndexRune(source, '\n'); i >= 0 {
+		source = source[:i]
+	}
+	return &Error{
+		Name:    name,
+		Line:    1 + strings.Count(before, "\n"),
+		Column:  1 + utf8.RuneCountInString(before[lineStart:]),
+		Token:   tokenAt(text, pos),
+		Message: msg,
+		Source:  source,
+	}
+}
+
+// tokenAt returns the bare word or quoted string starting at pos, up to the
+// end of the line
+func tokenAt(text string, pos Pos) string {
+	s := text[pos:]
+	if i := strings.IndexRune(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if s != "" && any(rune(s[0]), quotes) {
+		if i := strings.IndexRune(s[1:], rune(s[0])); i >= 0 {
+			return s[:i+2]
+		}
+		return s
+	}
+	if i := strings.IndexAny(s, bareStringDisallowed+":"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// checkPattern checks that a file pattern is well formed
+func checkPattern(pattern string) error {
+	// Syntax errors are only found when the matcher reaches them, so the
+	// pattern is matched against itself to make sure it's read to the end
+	if _, err := filter.MatchAny(pattern, []string{pattern}); err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	return nil
+}
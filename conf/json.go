@@ -0,0 +1,103 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The JSON form of the configuration gives signals by their option names and
+// durations in Go's duration syntax, so that it reads like the config file.
+
+// signalName returns the option name of a signal, or "" if sig is nil
+func signalName(sig os.Signal) string {
+	if sig == nil {
+		return ""
+	}
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprint(sig)
+}
+
+// durationString returns d in Go's duration syntax, or "" if it's zero
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Daemon) MarshalJSON() ([]byte, error) {
+	type daemon Daemon
+	return json.Marshal(struct {
+		daemon
+		RestartSignal  string
+		ResizeSignal   string `json:",omitempty"`
+		RestartEvery   string `json:",omitempty"`
+		Silence        string `json:",omitempty"`
+		MemoryInterval string `json:",omitempty"`
+		ReadyTimeout   string `json:",omitempty"`
+		DrainTimeout   string `json:",omitempty"`
+	}{
+		daemon:         daemon(d),
+		RestartSignal:  signalName(d.RestartSignal),
+		ResizeSignal:   signalName(d.ResizeSignal),
+		RestartEvery:   durationString(d.RestartEvery),
+		Silence:        durationString(d.Silence),
+		MemoryInterval: durationString(d.MemoryInterval),
+		ReadyTimeout:   durationString(d.ReadyTimeout),
+		DrainTimeout:   durationString(d.DrainTimeout),
+	})
+}
+
+// MarshalJSON implements json.Marshaler
+func (p Prep) MarshalJSON() ([]byte, error) {
+	type prep Prep
+	return json.Marshal(struct {
+		prep
+		Timeout string `json:",omitempty"`
+	}{
+		prep:    prep(p),
+		Timeout: durationString(p.Timeout),
+	})
+}
+
+// MarshalJSON implements json.Marshaler. A step is given as it's written in
+// the config file.
+func (s KillStep) MarshalJSON() ([]byte, error) {
+	return json.Marshal(signalName(s.Signal) + "/" + s.Wait.String())
+}
+
+// MarshalJSON implements json.Marshaler
+func (b Block) MarshalJSON() ([]byte, error) {
+	type block Block
+	return json.Marshal(struct {
+		block
+		Collapse string `json:",omitempty"`
+		Every    string `json:",omitempty"`
+		Batch    string `json:",omitempty"`
+	}{
+		block:    block(b),
+		Collapse: durationString(b.Collapse),
+		Every:    durationString(b.Every),
+		Batch:    durationString(b.Batch),
+	})
+}
+
+// MarshalJSON implements json.Marshaler. Unlike the other fields, variables
+// aren't exported, so they're added here.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	return json.Marshal(struct {
+		config
+		Variables map[string]string
+	}{
+		config:    config(c),
+		Variables: c.GetVariables(),
+	})
+}
@@ -8,6 +8,7 @@ package conf
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 )
@@ -25,17 +26,40 @@ type itemType int
 
 const (
 	itemBareString itemType = iota
+	itemBase
+	itemBatch
 	itemColon
+	itemCollapse
+	itemContainer
 	itemComment
 	itemDaemon
+	itemDelimiter
+	itemEcho
+	itemEncoding
+	itemEnv
+	itemEvery
 	itemError // error occurred; value is text of error
 	itemEOF
+	itemHeader
+	itemHeredoc
 	itemInDir
+	itemIsolate
+	itemLabel
 	itemLeftParen
+	itemMask
+	itemMinChanges
+	itemOnCycleEnd
+	itemPassEnv
 	itemQuotedString
+	itemPrelude
 	itemPrep
+	itemPriority
 	itemRightParen
+	itemRollback
+	itemShell
+	itemSnippet
 	itemSpace
+	itemTeardown
 	itemVarName
 	itemEquals
 )
@@ -44,12 +68,30 @@ func (i itemType) String() string {
 	switch i {
 	case itemBareString:
 		return "barestring"
+	case itemBase:
+		return "base"
+	case itemBatch:
+		return "batch"
 	case itemComment:
 		return "comment"
 	case itemColon:
 		return "colon"
+	case itemCollapse:
+		return "collapse"
+	case itemContainer:
+		return "container"
 	case itemDaemon:
 		return "daemon"
+	case itemDelimiter:
+		return "delimiter"
+	case itemEcho:
+		return "echo"
+	case itemEncoding:
+		return "encoding"
+	case itemEnv:
+		return "env"
+	case itemEvery:
+		return "every"
 	case itemError:
 		return "error"
 	case itemEquals:
@@ -58,16 +100,44 @@ func (i itemType) String() string {
 		return "eof"
 	case itemInDir:
 		return "indir"
+	case itemIsolate:
+		return "isolate"
+	case itemLabel:
+		return "label"
 	case itemLeftParen:
 		return "lparen"
+	case itemOnCycleEnd:
+		return "oncycleend"
+	case itemPassEnv:
+		return "passenv"
 	case itemPrep:
 		return "prep"
+	case itemPriority:
+		return "priority"
+	case itemMinChanges:
+		return "minchanges"
 	case itemQuotedString:
 		return "quotedstring"
+	case itemHeader:
+		return "header"
+	case itemHeredoc:
+		return "heredoc"
 	case itemRightParen:
 		return "rparen"
+	case itemRollback:
+		return "rollback"
+	case itemPrelude:
+		return "prelude"
+	case itemMask:
+		return "mask"
+	case itemShell:
+		return "shell"
+	case itemSnippet:
+		return "snippet"
 	case itemSpace:
 		return "space"
+	case itemTeardown:
+		return "teardown"
 	case itemVarName:
 		return "var"
 	default:
@@ -101,6 +171,7 @@ type lexer struct {
 	width   Pos       // width of last rune read from input
 	lastPos Pos       // position of most recent item returned by nextItem
 	items   chan item // channel of scanned items
+	global  bool      // lexing a directive outside of a block
 }
 
 func (l *lexer) current() string {
@@ -316,6 +387,22 @@ Loop:
 	return nil
 }
 
+// acceptOptionValue accepts the value of a +name=value command option, which
+// is either a quoted string or a run of characters up to the next space or
+// colon
+func (l *lexer) acceptOptionValue() error {
+	if q := l.peek(); any(q, quotes) {
+		l.next()
+		return l.acceptQuotedString(q)
+	}
+	l.acceptFunc(
+		func(r rune) bool {
+			return !any(r, bareStringDisallowed) && r != ':' && r != eof
+		},
+	)
+	return nil
+}
+
 func any(r rune, s string) bool {
 	return strings.IndexRune(s, r) >= 0
 }
@@ -394,11 +481,55 @@ func lexVariables(l *lexer) stateFn {
 			}
 		} else {
 			l.backup()
+			if m := globalDirective.FindStringSubmatch(l.input[l.pos:]); m != nil && isDirective(l.input[l.pos:], m[0]) {
+				l.pos += Pos(len(m[1]))
+				switch m[1] {
+				case "env":
+					l.emit(itemEnv)
+				case "echo":
+					l.emit(itemEcho)
+				case "header":
+					l.emit(itemHeader)
+				case "prelude":
+					l.emit(itemPrelude)
+				case "mask":
+					l.emit(itemMask)
+				case "shell":
+					l.emit(itemShell)
+				case "snippet":
+					l.emit(itemSnippet)
+				case "teardown":
+					l.emit(itemTeardown)
+				default:
+					l.emit(itemOnCycleEnd)
+				}
+				l.global = true
+				return lexOptions
+			}
 			return lexPatterns
 		}
 	}
 }
 
+// isDirective reports whether the text at the start of input, matched by
+// globalDirective, begins a directive rather than a pattern like env:*.go. It
+// does if the colon is followed by a space or the end of the line, or if the
+// rest of the line doesn't open a block.
+func isDirective(input string, match string) bool {
+	rest := input[len(match):]
+	if rest == "" || any(rune(rest[0]), spaces) || rest[0] == '\n' {
+		return true
+	}
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[:i]
+	}
+	return !strings.Contains(rest, "{")
+}
+
+// globalDirective matches the start of a directive outside of a block, which
+// can't be confused with a pattern because of the colon
+var globalDirective = regexp.MustCompile(`^(env|echo|header|mask|oncycleend|prelude|shell|snippet|teardown)([ \t]+\+\w+)*[ \t]*:`)
+
 func lexTop(l *lexer) stateFn {
 	return lexVariables
 }
@@ -423,15 +554,66 @@ func lexInside(l *lexer) stateFn {
 		} else if !any(n, bareStringDisallowed) {
 			l.acceptWord()
 			switch l.current() {
+			case "base":
+				l.emit(itemBase)
+				return lexOptions
+			case "batch":
+				l.emit(itemBatch)
+				return lexOptions
+			case "collapse":
+				l.emit(itemCollapse)
+				return lexOptions
+			case "container":
+				l.emit(itemContainer)
+				return lexOptions
 			case "daemon":
 				l.emit(itemDaemon)
 				return lexOptions
+			case "delimiter":
+				l.emit(itemDelimiter)
+				return lexOptions
+			case "echo":
+				l.emit(itemEcho)
+				return lexOptions
+			case "encoding":
+				l.emit(itemEncoding)
+				return lexOptions
+			case "env":
+				l.emit(itemEnv)
+				return lexOptions
+			case "every":
+				l.emit(itemEvery)
+				return lexOptions
+			case "header":
+				l.emit(itemHeader)
+				return lexOptions
 			case "indir":
 				l.emit(itemInDir)
 				return lexOptions
+			case "isolate":
+				l.emit(itemIsolate)
+				return lexOptions
+			case "label":
+				l.emit(itemLabel)
+				return lexOptions
+			case "minchanges":
+				l.emit(itemMinChanges)
+				return lexOptions
+			case "passenv":
+				l.emit(itemPassEnv)
+				return lexOptions
+			case "rollback":
+				l.emit(itemRollback)
+				return lexOptions
 			case "prep":
 				l.emit(itemPrep)
 				return lexOptions
+			case "priority":
+				l.emit(itemPriority)
+				return lexOptions
+			case "shell":
+				l.emit(itemShell)
+				return lexOptions
 			default:
 				l.errorf("unknown directive: %s", l.current())
 				return nil
@@ -454,6 +636,13 @@ func lexOptions(l *lexer) stateFn {
 			return lexCommand
 		} else if n == '+' {
 			l.acceptWord()
+			if l.accept("=") {
+				err := l.acceptOptionValue()
+				if err != nil {
+					l.errorf("%s", err)
+					return nil
+				}
+			}
 			l.emit(itemBareString)
 		} else {
 			l.errorf("invalid command option")
@@ -462,8 +651,42 @@ func lexOptions(l *lexer) stateFn {
 	}
 }
 
+// endCommand returns the state to resume after a command
+func (l *lexer) endCommand() stateFn {
+	if l.global {
+		l.global = false
+		return lexVariables
+	}
+	return lexInside
+}
+
+// heredocStart matches the line that opens a heredoc, which names the line
+// that closes it
+var heredocStart = regexp.MustCompile(`^<<([A-Za-z_][A-Za-z0-9_]*)[ \t]*\n`)
+
+// acceptHeredoc accepts a heredoc opened by the text at the current position,
+// if there is one, up to and including the line that closes it
+func (l *lexer) acceptHeredoc() (bool, error) {
+	m := heredocStart.FindStringSubmatch(l.input[l.pos:])
+	if m == nil {
+		return false, nil
+	}
+	l.pos += Pos(len(m[0]))
+	for int(l.pos) < len(l.input) {
+		line := l.input[l.pos:]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		l.pos += Pos(len(line))
+		if strings.TrimSpace(line) == m[1] {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("unterminated heredoc, expected %s", m[1])
+}
+
 // lexCommand lexes a single command. Commands can either be unquoted and on a
-// single line, or quoted and span multiple lines.
+// single line, quoted and span multiple lines, or given as a heredoc.
 func lexCommand(l *lexer) stateFn {
 	for {
 		n := l.next()
@@ -477,14 +700,26 @@ func lexCommand(l *lexer) stateFn {
 				return nil
 			}
 			l.emit(itemQuotedString)
-			return lexInside
+			return l.endCommand()
 		} else if any(n, spaces) {
 			l.acceptRun(spaces)
 			l.emit(itemSpace)
 		} else {
+			if n == '<' {
+				l.backup()
+				ok, err := l.acceptHeredoc()
+				if err != nil {
+					l.errorf("%s", err)
+					return nil
+				} else if ok {
+					l.emit(itemHeredoc)
+					return l.endCommand()
+				}
+				l.next()
+			}
 			l.acceptLine(true)
 			l.emit(itemBareString)
-			return lexInside
+			return l.endCommand()
 		}
 	}
 }
@@ -92,6 +92,89 @@ var lexTests = []struct {
 			{itemQuotedString, `'bar'`},
 		},
 	},
+	{
+		"env +cmd: FOO=bar\nenv {}", []itm{
+			{itemEnv, "env"},
+			{itemBareString, "+cmd"},
+			{itemColon, ":"},
+			{itemBareString, "FOO=bar\n"},
+			{itemBareString, "env"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"oncycleend: ./status\n{}", []itm{
+			{itemOnCycleEnd, "oncycleend"},
+			{itemColon, ":"},
+			{itemBareString, "./status\n"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"mask: token=\\S+\n{}", []itm{
+			{itemMask, "mask"},
+			{itemColon, ":"},
+			{itemBareString, "token=\\S+\n"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"shell: bash\n{\nshell: sh\n}", []itm{
+			{itemShell, "shell"},
+			{itemColon, ":"},
+			{itemBareString, "bash\n"},
+			{itemLeftParen, "{"},
+			{itemShell, "shell"},
+			{itemColon, ":"},
+			{itemBareString, "sh\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	// Patterns that start like a directive
+	{
+		"env:*.go {}", []itm{
+			{itemBareString, "env:*.go"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"snippet:foo/** {}", []itm{
+			{itemBareString, "snippet:foo/**"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"mask:secret\n{}", []itm{
+			{itemMask, "mask"},
+			{itemColon, ":"},
+			{itemBareString, "secret\n"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"snippet: test = go test @snippet(flags)\n{}", []itm{
+			{itemSnippet, "snippet"},
+			{itemColon, ":"},
+			{itemBareString, "test = go test @snippet(flags)\n"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"prelude: ./setup\n{}", []itm{
+			{itemPrelude, "prelude"},
+			{itemColon, ":"},
+			{itemBareString, "./setup\n"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
 	{
 		"one {\ndaemon: foo\n}", []itm{
 			{itemBareString, "one"},
@@ -124,6 +207,18 @@ var lexTests = []struct {
 			{itemRightParen, "}"},
 		},
 	},
+	{
+		"one {\ndaemon +optone=one +opttwo='two: 2' : foo\n}", []itm{
+			{itemBareString, "one"},
+			{itemLeftParen, "{"},
+			{itemDaemon, "daemon"},
+			{itemBareString, "+optone=one"},
+			{itemBareString, "+opttwo='two: 2'"},
+			{itemColon, ":"},
+			{itemBareString, "foo\n"},
+			{itemRightParen, "}"},
+		},
+	},
 	{
 		"one {\ndaemon +optone +opttwo : foo\n}", []itm{
 			{itemBareString, "one"},
@@ -256,6 +351,33 @@ var lexTests = []struct {
 			{itemRightParen, "}"},
 		},
 	},
+	{
+		"{\nlabel: foo\n}\n", []itm{
+			{itemLeftParen, "{"},
+			{itemLabel, "label"},
+			{itemColon, ":"},
+			{itemBareString, "foo\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"{\nprep: <<EOF\n  a\n  EOF\n}\n", []itm{
+			{itemLeftParen, "{"},
+			{itemPrep, "prep"},
+			{itemColon, ":"},
+			{itemHeredoc, "<<EOF\n  a\n  EOF\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"{\nrollback: ./undo\n}\n", []itm{
+			{itemLeftParen, "{"},
+			{itemRollback, "rollback"},
+			{itemColon, ":"},
+			{itemBareString, "./undo\n"},
+			{itemRightParen, "}"},
+		},
+	},
 	{
 		"@W = b", []itm{
 			{itemVarName, "@W"},
@@ -291,9 +413,11 @@ var lexErrorTests = []struct {
 	{"{oink: bar}", "unknown directive: oink", 5},
 	{"! {}", "! must be followed by a string", 2},
 	{"{ daemon +*: foo\n}", "invalid command option", 11},
+	{"{ daemon +foo='bar: foo\n}", "unterminated quoted string", 25},
 	{"@foo = \n}", "= must be followed by a string", 9},
 	{"@foo =", "unterminated variable assignment", 6},
 	{"@foo = '", "unterminated quoted string", 8},
+	{"{prep: <<EOF\nfoo\n}", "unterminated heredoc, expected EOF", 18},
 }
 
 func TestLexErrors(t *testing.T) {
@@ -0,0 +1,225 @@
+package conf
+
+import "fmt"
+
+// The variable an overlay sets to say how its lists are merged
+const mergeVarName = "@merge"
+
+// The variable that names the global shell, if there's no shell directive
+const shellVarName = "@shell"
+
+// How the lists of a block in an overlay are merged with the lists of the
+// block it overrides: replacing them, or appended to them
+const (
+	MergeReplace = "replace"
+	MergeAppend  = "append"
+)
+
+// Merge merges an overlay over a base config, neither of which has had its
+// global settings applied to its blocks, and returns the result.
+//
+// Settings made by the overlay win, except that its mask patterns are added
+// to the base config's, so that an overlay can't unmask output. Variables and env variables are merged by
+// name. An overlay block with the same label as a base block overrides it:
+// the options set in the overlay block win, env variables are merged by name,
+// and its patterns, preps and daemons replace the base block's, or are
+// appended to them if the overlay sets @merge = append. All other overlay
+// blocks are added after the base blocks.
+func Merge(base, overlay *Config) (*Config, error) {
+	mode := MergeReplace
+	if m, ok := overlay.variables[mergeVarName]; ok {
+		if m != MergeReplace && m != MergeAppend {
+			return nil, fmt.Errorf("%s must be %s or %s, got %q", mergeVarName, MergeReplace, MergeAppend, m)
+		}
+		mode = m
+	}
+	ret := &Config{
+		Blocks:     append([]Block{}, base.Blocks...),
+		Env:        mergeEnv(base.Env, overlay.Env),
+		Echo:       base.Echo,
+		echoSet:    base.echoSet,
+		Header:     base.Header,
+		OnCycleEnd: base.OnCycleEnd,
+		Prelude:    base.Prelude,
+		Teardown:   base.Teardown,
+		Shell:      base.Shell,
+		Mask:       append(append([]string{}, base.Mask...), overlay.Mask...),
+	}
+	if overlay.echoSet {
+		ret.Echo, ret.echoSet = overlay.Echo, true
+	}
+	if overlay.Header != "" {
+		ret.Header = overlay.Header
+	}
+	if overlay.OnCycleEnd != "" {
+		ret.OnCycleEnd = overlay.OnCycleEnd
+	}
+	if overlay.Prelude != "" {
+		ret.Prelude = overlay.Prelude
+	}
+	if overlay.Teardown != "" {
+		ret.Teardown = overlay.Teardown
+	}
+	if overlay.Shell != "" {
+		ret.Shell = overlay.Shell
+	}
+	for k, v := range base.variables {
+		ret.addVariable(k, v)
+	}
+	for k, v := range overlay.variables {
+		if k != mergeVarName {
+			delete(ret.variables, k)
+			ret.addVariable(k, v)
+		}
+	}
+	for _, o := range overlay.Blocks {
+		b := ret.GetBlock(o.Label)
+		if b == nil {
+			ret.Blocks = append(ret.Blocks, o)
+			continue
+		}
+		if err := mergeBlock(b, o, mode); err != nil {
+			return nil, fmt.Errorf("block %s: %s", o.Label, err)
+		}
+	}
+	primaries := 0
+	for _, b := range ret.Blocks {
+		for _, d := range b.Daemons {
+			if d.Primary {
+				primaries++
+			}
+		}
+	}
+	if primaries > 1 {
+		return nil, fmt.Errorf("+primary can only be used by one daemon")
+	}
+	return ret, nil
+}
+
+// mergeEnv returns base with the variables of overlay set over it. Variables
+// that override a base variable take its place, and the rest are appended.
+func mergeEnv(base, overlay []EnvVar) []EnvVar {
+	if len(overlay) == 0 {
+		return base
+	}
+	ret := append([]EnvVar{}, base...)
+Outer:
+	for _, e := range overlay {
+		for i := range ret {
+			if ret[i].Name == e.Name {
+				ret[i] = e
+				continue Outer
+			}
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// mergeList returns overlay in place of base if it's non-empty, or base and
+// overlay joined together in append mode
+func mergeList(base, overlay []string, mode string) []string {
+	switch {
+	case len(overlay) == 0:
+		return base
+	case mode == MergeAppend:
+		return append(append([]string{}, base...), overlay...)
+	}
+	return overlay
+}
+
+// mergeOrder returns the Order of block b once the patterns of o are merged
+// over it, as mergeList merges its includes and excludes
+func mergeOrder(b *Block, o Block, mode string) []string {
+	if mode == MergeAppend {
+		return refines(append(append([]string{}, b.patternOrder()...), o.patternOrder()...))
+	}
+	inc, exc := b, b
+	if len(o.Include) > 0 {
+		inc = &o
+	}
+	if len(o.Exclude) > 0 {
+		exc = &o
+	}
+	if inc == exc {
+		return inc.Order
+	}
+	return nil
+}
+
+// mergeBlock merges block o of an overlay over block b
+func mergeBlock(b *Block, o Block, mode string) error {
+	b.Order = mergeOrder(b, o, mode)
+	b.Include = mergeList(b.Include, o.Include, mode)
+	b.Exclude = mergeList(b.Exclude, o.Exclude, mode)
+	b.NoCommonFilter = b.NoCommonFilter || o.NoCommonFilter
+	b.Env = mergeEnv(b.Env, o.Env)
+	if len(o.Preps) > 0 {
+		if mode == MergeAppend {
+			b.Preps = append(append([]Prep{}, b.Preps...), o.Preps...)
+		} else {
+			b.Preps = o.Preps
+		}
+	}
+	if len(o.Daemons) > 0 {
+		if mode == MergeAppend {
+			b.Daemons = append(append([]Daemon{}, b.Daemons...), o.Daemons...)
+		} else {
+			b.Daemons = o.Daemons
+		}
+	}
+	if o.InDir != "" {
+		b.InDir = o.InDir
+	}
+	if o.Encoding != "" {
+		b.Encoding = o.Encoding
+	}
+	if o.Delimiter != "" {
+		b.Delimiter = o.Delimiter
+	}
+	if o.CleanEnv {
+		b.CleanEnv, b.PassEnv = true, o.PassEnv
+	}
+	if o.Echo != "" {
+		b.Echo = o.Echo
+	}
+	if o.Header != "" {
+		b.Header = o.Header
+	}
+	if o.Isolate != "" {
+		b.Isolate = o.Isolate
+	}
+	if o.Collapse != 0 {
+		b.Collapse = o.Collapse
+	}
+	if o.Rollback != "" {
+		b.Rollback = o.Rollback
+	}
+	if o.Shell != "" {
+		b.Shell = o.Shell
+	}
+	if o.Container != nil {
+		b.Container = o.Container
+	}
+	if o.Every != 0 {
+		b.Every = o.Every
+	}
+	if o.Batch != 0 {
+		b.Batch = o.Batch
+	}
+	if o.Priority != 0 {
+		b.Priority = o.Priority
+	}
+	if o.MinChanges != 0 {
+		b.MinChanges, b.Accumulate = o.MinChanges, o.Accumulate
+	}
+	if b.Container != nil {
+		for _, p := range b.Preps {
+			if p.Persist {
+				return fmt.Errorf("container can't be used with +persist")
+			}
+		}
+	}
+	_, err := b.DaemonOrder()
+	return err
+}
@@ -0,0 +1,249 @@
+package conf
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const mergeBase = `
+@shell = bash
+@port = 8080
+env: MODE=dev
+env: LOG=debug
+oncycleend: ./status.sh
+
+**/*.go {
+	label: build
+	prep: go build ./...
+	daemon: ./server
+}
+
+docs/** {
+	prep: make docs
+}
+`
+
+var mergeTests = []struct {
+	overlay  string
+	expected *Config
+}{
+	{
+		"",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**/*.go"},
+					Label:   "build",
+					Env:     []EnvVar{{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}},
+					Preps:   []Prep{{Command: "go build ./..."}},
+					Daemons: []Daemon{{Command: "./server", RestartSignal: syscall.SIGHUP}},
+				},
+				{
+					Include: []string{"docs/**"},
+					Env:     []EnvVar{{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}},
+					Preps:   []Prep{{Command: "make docs"}},
+				},
+			},
+			Env:        []EnvVar{{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}},
+			OnCycleEnd: "./status.sh",
+			variables:  map[string]string{"@shell": "bash", "@port": "8080"},
+		},
+	},
+	{
+		`
+		@port = 9090
+		env: MODE=ci
+		env: CI=1
+		echo: on
+
+		**/*.go {
+			label: build
+			prep: go vet ./...
+		}
+
+		{
+			prep: ./report.sh
+		}
+		`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**/*.go"},
+					Label:   "build",
+					Echo:    "on",
+					Env: []EnvVar{
+						{Name: "MODE", Value: "ci"}, {Name: "LOG", Value: "debug"}, {Name: "CI", Value: "1"},
+					},
+					Preps:   []Prep{{Command: "go vet ./..."}},
+					Daemons: []Daemon{{Command: "./server", RestartSignal: syscall.SIGHUP}},
+				},
+				{
+					Include: []string{"docs/**"},
+					Echo:    "on",
+					Env: []EnvVar{
+						{Name: "MODE", Value: "ci"}, {Name: "LOG", Value: "debug"}, {Name: "CI", Value: "1"},
+					},
+					Preps: []Prep{{Command: "make docs"}},
+				},
+				{
+					Echo: "on",
+					Env: []EnvVar{
+						{Name: "MODE", Value: "ci"}, {Name: "LOG", Value: "debug"}, {Name: "CI", Value: "1"},
+					},
+					Preps: []Prep{{Command: "./report.sh"}},
+				},
+			},
+			Env: []EnvVar{
+				{Name: "MODE", Value: "ci"}, {Name: "LOG", Value: "debug"}, {Name: "CI", Value: "1"},
+			},
+			Echo:       true,
+			OnCycleEnd: "./status.sh",
+			variables:  map[string]string{"@shell": "bash", "@port": "9090"},
+		},
+	},
+	{
+		`
+		@merge = append
+		oncycleend: ./notify.sh
+
+		**/*.proto {
+			label: build
+			env: LOG=info
+			indir: ./cmd
+			prep: go vet ./...
+			daemon: ./worker
+		}
+		`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**/*.go", "**/*.proto"},
+					Label:   "build",
+					InDir:   "./cmd",
+					Env: []EnvVar{
+						{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}, {Name: "LOG", Value: "info"},
+					},
+					Preps: []Prep{{Command: "go build ./..."}, {Command: "go vet ./..."}},
+					Daemons: []Daemon{
+						{Command: "./server", RestartSignal: syscall.SIGHUP},
+						{Command: "./worker", RestartSignal: syscall.SIGHUP},
+					},
+				},
+				{
+					Include: []string{"docs/**"},
+					Env:     []EnvVar{{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}},
+					Preps:   []Prep{{Command: "make docs"}},
+				},
+			},
+			Env:        []EnvVar{{Name: "MODE", Value: "dev"}, {Name: "LOG", Value: "debug"}},
+			OnCycleEnd: "./notify.sh",
+			variables:  map[string]string{"@shell": "bash", "@port": "8080"},
+		},
+	},
+}
+
+func TestMerge(t *testing.T) {
+	for i, tt := range mergeTests {
+		ret, err := ParseProfile("base", mergeBase, "overlay", tt.overlay)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if !ret.Equals(tt.expected) {
+			t.Errorf("%d\nexpected:\n\t%#v\ngot\n\t%#v", i, tt.expected, ret)
+		}
+	}
+}
+
+func TestMergeOrder(t *testing.T) {
+	base := "src/** !**/testdata/** {\nlabel: test\n}"
+	// Appended patterns refine the ones before them
+	ret, err := ParseProfile("base", base, "overlay", "@merge = append\n**/golden/* {\nlabel: test\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"src/**", "!**/testdata/**", "**/golden/*"}
+	if !reflect.DeepEqual(ret.Blocks[0].Order, expected) {
+		t.Errorf("Expected order %#v, got %#v", expected, ret.Blocks[0].Order)
+	}
+	// Replaced patterns take their order with them
+	ret, err = ParseProfile("base", "a/** !a/b/** a/b/c/** {\nlabel: test\n}", "overlay", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Blocks[0].Order != nil {
+		t.Errorf("Expected no order, got %#v", ret.Blocks[0].Order)
+	}
+}
+
+func TestMergeSnippets(t *testing.T) {
+	base := "snippet: test = go test ./...\nsnippet: vet = go vet ./...\n{\nprep: @snippet(test)\n}"
+	// An overlay can use the base config's snippets, and redefine them
+	// for its own commands
+	ret, err := ParseProfile("base", base, "overlay", "snippet: test = go test -race ./...\n{\nprep: @snippet(vet) && @snippet(test)\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"go test ./...", "go vet ./... && go test -race ./..."}
+	for i, b := range ret.Blocks {
+		if b.Preps[0].Command != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], b.Preps[0].Command)
+		}
+	}
+	if _, err := ParseProfile("base", base, "overlay", "{\nprep: @snippet(lint)\n}"); err == nil || err.Error() != "overlay:2:7: undefined snippet: lint" {
+		t.Errorf("Expected an undefined snippet error, got %v", err)
+	}
+}
+
+func TestMergeEcho(t *testing.T) {
+	ret, err := ParseProfile("base", "echo: on\n{}", "overlay", "echo: off\n{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Echo || ret.Blocks[0].Echo != "" || ret.Blocks[1].Echo != "" {
+		t.Errorf("Expected echo to be turned off by the overlay, got %#v", ret)
+	}
+	ret, err = ParseProfile("base", "echo: on\n{}", "overlay", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.Echo {
+		t.Errorf("Expected echo to be kept from the base")
+	}
+}
+
+func TestMergeShell(t *testing.T) {
+	base := "shell: sh\n{}\n{\nlabel: build\nshell: bash\n}"
+	ret, err := ParseProfile("base", base, "overlay", "shell: powershell\n{\nlabel: build\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Shell != "powershell" || ret.Blocks[0].Shell != "powershell" || ret.Blocks[1].Shell != "bash" {
+		t.Errorf("Expected the overlay's shell in blocks without their own, got %#v", ret)
+	}
+}
+
+var mergeErrorTests = []struct {
+	overlay string
+	err     string
+}{
+	{"@merge = sideways\n{}", `overlay: @merge must be replace or append, got "sideways"`},
+	{"{\nlabel: build\ncontainer: golang\nprep +persist: make\n}", "overlay:4:6: +persist can't be used in a container"},
+	{"{\nlabel: build\ncontainer: golang\n}", "overlay: block build: container can't be used with +persist"},
+	{"{ daemon: \n }", "overlay:1:11: empty command specification"},
+	{"{\ndaemon +primary: a\n}", "overlay: +primary can only be used by one daemon"},
+}
+
+func TestMergeErrors(t *testing.T) {
+	base := "{\nlabel: build\nprep +persist: go build\ndaemon +primary: repl\n}"
+	for _, tt := range mergeErrorTests {
+		_, err := ParseProfile("base", base, "overlay", tt.overlay)
+		if err == nil {
+			t.Errorf("%q: expected error", tt.overlay)
+			continue
+		}
+		if err.Error() != tt.err {
+			t.Errorf("%q: expected %q, got %q", tt.overlay, tt.err, err)
+		}
+	}
+}
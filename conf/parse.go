@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"runtime"
 	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type parser struct {
@@ -17,8 +19,14 @@ type parser struct {
 	text   string
 	lex    *lexer
 	config *Config
+	// Snippets the config can refer to without defining them
+	inherited map[string]string
 
 	peekItem *item
+	// The last item returned by next, where errors are reported by default
+	last item
+	// Set once a primary daemon has been parsed
+	primary bool
 }
 
 // Dreadfully naive at the momet, but then so is the lexer.
@@ -34,12 +42,14 @@ func (p *parser) next() item {
 	if p.peekItem != nil {
 		itm := *p.peekItem
 		p.peekItem = nil
+		p.last = itm
 		return itm
 	}
 	nxt := p.lex.nextSignificantItem()
 	if nxt.typ == itemError {
-		p.errorf("%s", nxt.val)
+		p.errorAt(nxt, "%s", nxt.val)
 	}
+	p.last = nxt
 	return nxt
 }
 
@@ -83,7 +93,10 @@ func (p *parser) collect(types ...itemType) []item {
 }
 
 func (p *parser) collectValues(types ...itemType) []string {
-	items := p.collect(types...)
+	return itemValues(p.collect(types...))
+}
+
+func itemValues(items []item) []string {
 	ret := make([]string, len(items))
 	for i, v := range items {
 		ret[i] = v.val
@@ -93,29 +106,41 @@ func (p *parser) collectValues(types ...itemType) []string {
 
 // Collects an arbitrary number of patterns, and returns a (watch, exclude,
 // NoCommonFilter) tuple.
-func (p *parser) collectPatterns() ([]string, []string, bool) {
+func (p *parser) collectPatterns() ([]string, []string, []string, bool) {
 	noCommonFilter := false
 	watch := []string{}
 	exclude := []string{}
+	var order []string
 
 	vals := p.collect(itemBareString, itemQuotedString)
 	for _, v := range vals {
+		pattern := strings.TrimPrefix(v.val, "!")
+		if v.typ == itemQuotedString {
+			pattern = unquote(pattern)
+		}
+		if err := checkPattern(pattern); err != nil {
+			p.errorAt(v, "%s", err)
+		}
 		switch v.typ {
 		case itemBareString:
 			if v.val[0] == '!' {
 				exclude = append(exclude, v.val[1:])
+				order = append(order, v.val)
 			} else {
 				if v.val == "+noignore" {
 					noCommonFilter = true
 				} else {
 					watch = append(watch, v.val)
+					order = append(order, v.val)
 				}
 			}
 		case itemQuotedString:
 			if v.val[0] == '!' {
 				exclude = append(exclude, unquote(v.val[1:]))
+				order = append(order, "!"+unquote(v.val[1:]))
 			} else {
 				watch = append(watch, unquote(v.val))
+				order = append(order, unquote(v.val))
 			}
 		}
 	}
@@ -125,14 +150,44 @@ func (p *parser) collectPatterns() ([]string, []string, bool) {
 	if len(exclude) == 0 {
 		exclude = nil
 	}
-	return watch, exclude, noCommonFilter
+	return watch, exclude, refines(order), noCommonFilter
 }
 
-// errorf formats the error and terminates processing.
+// errorf formats the error and terminates processing. The error is reported
+// at the last item read.
 func (p *parser) errorf(format string, args ...interface{}) {
+	p.errorAt(p.last, format, args...)
+}
+
+// errorAt is like errorf, but reports the error at itm
+func (p *parser) errorAt(itm item, format string, args ...interface{}) {
 	p.config = nil
-	format = fmt.Sprintf("%s:%d: %s", p.name, p.lex.lineNumber(), format)
-	panic(fmt.Errorf(format, args...))
+	panic(newError(p.name, p.text, itm.pos, fmt.Sprintf(format, args...)))
+}
+
+// parseDirective reads the options of a directive, and its value
+func (p *parser) parseDirective() ([]item, item) {
+	options := p.collect(itemBareString)
+	p.mustNext(itemColon)
+	return options, p.mustNext(itemBareString, itemQuotedString, itemHeredoc)
+}
+
+// blame reports err, returned when a directive's options and value were
+// applied. To find the option responsible, try is called with the options up
+// to each one in turn, and the error is reported at the first that fails. If
+// try fails without options, the error is reported at the value. Try must
+// apply the directive to a copy of its target.
+func (p *parser) blame(err error, options []item, value item, try func([]string) error) {
+	at := value
+	if try(nil) == nil {
+		for i := range options {
+			if try(itemValues(options[:i+1])) != nil {
+				at = options[i]
+				break
+			}
+		}
+	}
+	p.errorAt(at, "%s", err)
 }
 
 func (p *parser) stopParse() {
@@ -158,9 +213,47 @@ func (p *parser) recover(errp *error) {
 func (p *parser) parse() (err error) {
 	defer p.recover(&err)
 	p.lex = lex(p.name, p.text)
-	p.config = &Config{}
+	p.config = &Config{inherited: p.inherited}
 	for {
 		for {
+			var apply func(c *Config, value string, options []string) error
+			switch p.peek().typ {
+			case itemEnv:
+				apply = (*Config).addEnv
+			case itemEcho:
+				apply = (*Config).setEcho
+			case itemHeader:
+				apply = (*Config).setHeader
+			case itemOnCycleEnd:
+				apply = (*Config).setOnCycleEnd
+			case itemPrelude:
+				apply = (*Config).setPrelude
+			case itemMask:
+				apply = (*Config).addMask
+			case itemShell:
+				apply = (*Config).setShell
+			case itemSnippet:
+				apply = (*Config).addSnippet
+			case itemTeardown:
+				apply = (*Config).setTeardown
+			}
+			if apply != nil {
+				itm := p.next()
+				options, value := p.parseDirective()
+				command := prepValue(value)
+				switch itm.typ {
+				case itemOnCycleEnd, itemPrelude, itemTeardown:
+					command = p.expandSnippets(value)
+				}
+				err = apply(p.config, command, itemValues(options))
+				if err != nil {
+					p.blame(err, options, value, func(opts []string) error {
+						c := *p.config
+						return apply(&c, command, opts)
+					})
+				}
+				continue
+			}
 			var k, v string
 			k, v, err = p.parseVariable()
 			if err != nil {
@@ -177,7 +270,10 @@ func (p *parser) parse() (err error) {
 		if p.peek().typ == itemEOF {
 			break
 		}
-		p.config.addBlock(*p.parseBlock())
+		err = p.config.addBlock(*p.parseBlock())
+		if err != nil {
+			p.errorf("%s", err)
+		}
 	}
 	return err
 }
@@ -207,55 +303,188 @@ func (p *parser) parseVariable() (string, string, error) {
 
 func prepValue(itm item) string {
 	val := itm.val
+	if itm.typ == itemHeredoc {
+		return heredocBody(val)
+	}
 	if itm.typ == itemQuotedString {
 		val = unquote(val)
 	}
 	return strings.TrimSpace(val)
 }
 
+// heredocBody returns the lines of a heredoc between its opening and closing
+// lines, verbatim but for the leading whitespace common to all lines that
+// aren't blank, which is removed
+func heredocBody(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	lines = lines[1 : len(lines)-1]
+	var indent string
+	first := true
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		lead := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if first {
+			indent, first = lead, false
+		}
+		for !strings.HasPrefix(lead, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	for i, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			lines[i] = ""
+		} else {
+			lines[i] = l[len(indent):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseBlockOption parses the value of a block option that takes no flags and
+// may only be specified once. The current value of the option is used to
+// detect repeated declarations.
+func (p *parser) parseBlockOption(name string, current string) string {
+	keyword := p.last
+	options := p.collect(itemBareString)
+	if len(options) > 0 {
+		p.errorAt(options[0], "%s takes no options", name)
+	}
+	p.mustNext(itemColon)
+	val := prepValue(p.mustNext(itemBareString, itemQuotedString, itemHeredoc))
+	if current != "" {
+		p.errorAt(keyword, "%s can only be used once per block", name)
+	}
+	return val
+}
+
+// checkPrimary makes sure that the daemon just parsed, with options, is the
+// only primary daemon
+func (p *parser) checkPrimary(options []item) {
+	if !p.primary {
+		p.primary = true
+		return
+	}
+	for _, o := range options {
+		if o.val == "+primary" {
+			p.errorAt(o, "+primary can only be used by one daemon")
+		}
+	}
+}
+
 func (p *parser) parseBlock() *Block {
 	block := &Block{}
-	block.Include, block.Exclude, block.NoCommonFilter = p.collectPatterns()
+	block.Include, block.Exclude, block.Order, block.NoCommonFilter = p.collectPatterns()
 	nxt := p.next()
 	if nxt.typ != itemLeftParen {
-		p.errorf("expected block open parentheses, got %q", nxt.val)
+		p.errorAt(nxt, "expected block open parentheses, got %q", nxt.val)
 	}
 Loop:
 	for {
 		nxt = p.next()
 		switch nxt.typ {
+		case itemBase:
+			block.Base = p.parseBlockOption("base", block.Base)
 		case itemInDir:
-			options := p.collectValues(itemBareString)
-			if len(options) > 0 {
-				p.errorf("indir takes no options")
+			block.InDir = p.parseBlockOption("indir", block.InDir)
+		case itemLabel:
+			block.Label = p.parseBlockOption("label", block.Label)
+		case itemEncoding:
+			block.Encoding = p.parseBlockOption("encoding", block.Encoding)
+			if _, err := htmlindex.Get(block.Encoding); err != nil {
+				p.errorf("unknown encoding: %q", block.Encoding)
 			}
-			p.mustNext(itemColon)
-			dir := prepValue(p.mustNext(itemBareString, itemQuotedString))
-			if block.InDir != "" {
-				p.errorf("indir can only be used once per block")
+		case itemEcho:
+			block.Echo = p.parseBlockOption("echo", block.Echo)
+			if block.Echo != "on" && block.Echo != "off" {
+				p.errorf("echo must be on or off, got %q", block.Echo)
+			}
+		case itemHeader:
+			block.Header = p.parseBlockOption("header", block.Header)
+			if block.Header != "on" && block.Header != "off" {
+				p.errorf("header must be on or off, got %q", block.Header)
+			}
+		case itemIsolate:
+			block.Isolate = p.parseBlockOption("isolate", block.Isolate)
+			if block.Isolate != "on" && block.Isolate != "off" {
+				p.errorf("isolate must be on or off, got %q", block.Isolate)
+			}
+		case itemRollback:
+			block.Rollback = p.parseBlockOption("rollback", block.Rollback)
+		case itemShell:
+			block.Shell = p.parseBlockOption("shell", block.Shell)
+		case itemDelimiter:
+			err := block.setDelimiter(p.parseBlockOption("delimiter", ""))
+			if err != nil {
+				p.errorf("%s", err)
 			}
-			block.InDir = dir
-		case itemDaemon:
-			options := p.collectValues(itemBareString)
-			p.mustNext(itemColon)
-			err := block.addDaemon(
-				prepValue(p.mustNext(itemBareString, itemQuotedString)),
-				options,
-			)
+		case itemCollapse:
+			err := block.setCollapse(p.parseBlockOption("collapse", ""))
 			if err != nil {
 				p.errorf("%s", err)
 			}
-		case itemPrep:
-			options := p.collectValues(itemBareString)
-			p.mustNext(itemColon)
-			err := block.addPrep(
-				prepValue(p.mustNext(itemBareString, itemQuotedString)),
-				options,
-			)
+		case itemEvery:
+			err := block.setEvery(p.parseBlockOption("every", ""))
 			if err != nil {
 				p.errorf("%s", err)
 			}
+		case itemBatch:
+			err := block.setBatch(p.parseBlockOption("batch", ""))
+			if err != nil {
+				p.errorf("%s", err)
+			}
+		case itemPriority:
+			err := block.setPriority(p.parseBlockOption("priority", ""))
+			if err != nil {
+				p.errorf("%s", err)
+			}
+		case itemPassEnv:
+			err := block.setPassEnv(p.parseBlockOption("passenv", ""))
+			if err != nil {
+				p.errorf("%s", err)
+			}
+		case itemContainer, itemDaemon, itemEnv, itemMinChanges, itemPrep:
+			apply := (*Block).addPrep
+			switch nxt.typ {
+			case itemContainer:
+				if block.Container != nil {
+					p.errorf("container can only be used once per block")
+				}
+				apply = (*Block).setContainer
+			case itemMinChanges:
+				if block.MinChanges != 0 {
+					p.errorf("minchanges can only be used once per block")
+				}
+				apply = (*Block).setMinChanges
+			case itemDaemon:
+				apply = (*Block).addDaemon
+			case itemEnv:
+				apply = (*Block).addEnv
+			}
+			options, value := p.parseDirective()
+			command := prepValue(value)
+			if nxt.typ == itemDaemon || nxt.typ == itemPrep {
+				command = p.expandSnippets(value)
+			}
+			err := apply(block, command, itemValues(options))
+			if err != nil {
+				p.blame(err, options, value, func(opts []string) error {
+					b := *block
+					return apply(&b, command, opts)
+				})
+			}
+			if nxt.typ == itemDaemon && block.Daemons[len(block.Daemons)-1].Primary {
+				p.checkPrimary(options)
+			}
 		case itemRightParen:
+			if _, err := block.DaemonOrder(); err != nil {
+				p.errorf("%s", err)
+			}
+			if err := block.checkNeeds(); err != nil {
+				p.errorf("%s", err)
+			}
+			block.resolveBase()
 			break Loop
 		default:
 			p.errorf("unexpected input: %s", nxt.val)
@@ -264,12 +493,61 @@ Loop:
 	return block
 }
 
-// Parse parses a string, and returns a completed Config
-func Parse(name string, text string) (*Config, error) {
-	p := &parser{name: name, text: text}
+// expandSnippets returns the command given by value, with the snippets it
+// refers to expanded
+func (p *parser) expandSnippets(value item) string {
+	command, err := p.config.expandSnippets(prepValue(value))
+	if err != nil {
+		p.errorAt(value, "%s", err)
+	}
+	return command
+}
+
+// parseRaw parses a string into a Config, without applying global settings to
+// its blocks. Commands can refer to the inherited snippets, as well as those
+// the config defines.
+func parseRaw(name string, text string, inherited map[string]string) (*Config, error) {
+	p := &parser{name: name, text: text, inherited: inherited}
 	err := p.parse()
 	if err != nil {
 		return nil, err
 	}
 	return p.config, nil
 }
+
+// Parse parses a string, and returns a completed Config
+func Parse(name string, text string) (*Config, error) {
+	c, err := parseRaw(name, text, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.applyEnv()
+	c.applyEcho()
+	c.applyHeader()
+	c.applyMask()
+	c.applyShell()
+	return c, nil
+}
+
+// ParseProfile parses a base config and a profile overlay, merges the overlay
+// over the base as described for Merge, and returns the completed Config
+func ParseProfile(name string, text string, overlayName string, overlay string) (*Config, error) {
+	base, err := parseRaw(name, text, nil)
+	if err != nil {
+		return nil, err
+	}
+	over, err := parseRaw(overlayName, overlay, base.snippets)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Merge(base, over)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", overlayName, err)
+	}
+	c.applyEnv()
+	c.applyEcho()
+	c.applyHeader()
+	c.applyMask()
+	c.applyShell()
+	return c, nil
+}
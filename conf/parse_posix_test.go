@@ -12,15 +12,33 @@ var parsePosixTests = []struct {
 }{
 	{
 		"{\ndaemon +sigusr1: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGUSR1}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGUSR1}}}}},
 	},
 	{
 		"{\ndaemon +sigusr2: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGUSR2}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGUSR2}}}}},
 	},
 	{
 		"{\ndaemon +sigwinch: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGWINCH}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGWINCH}}}}},
+	},
+	{
+		"{\ndaemon +onresize: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, ResizeSignal: syscall.SIGWINCH},
+		}}}},
+	},
+	{
+		"{\ndaemon +sigterm +onresize=sigusr1: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGTERM, ResizeSignal: syscall.SIGUSR1},
+		}}}},
+	},
+	{
+		"{\ndaemon +onresize='sigusr2': c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, ResizeSignal: syscall.SIGUSR2},
+		}}}},
 	},
 }
 
@@ -3,6 +3,7 @@ package conf
 import (
 	"syscall"
 	"testing"
+	"time"
 )
 
 var parseTests = []struct {
@@ -69,6 +70,39 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		`src/** !**/testdata/** {}`,
+		&Config{
+			Blocks: []Block{
+				{Include: []string{"src/**"}, Exclude: []string{"**/testdata/**"}},
+			},
+		},
+	},
+	{
+		`src/** !**/testdata/** "**/testdata/golden/*" {}`,
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"src/**", "**/testdata/golden/*"},
+					Exclude: []string{"**/testdata/**"},
+					Order:   []string{"src/**", "!**/testdata/**", "**/testdata/golden/*"},
+				},
+			},
+		},
+	},
+	{
+		"**/*.go !**/testdata/** /abs/** {\nbase: ./web/\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"web/**/*.go", "/abs/**"},
+					Exclude: []string{"web/**/testdata/**"},
+					Order:   []string{"web/**/*.go", "!web/**/testdata/**", "/abs/**"},
+					Base:    "./web/",
+				},
+			},
+		},
+	},
 	{
 		`foo +noignore {}`,
 		&Config{
@@ -96,7 +130,7 @@ var parseTests = []struct {
 			Blocks: []Block{
 				{
 					Include: []string{"foo"},
-					Daemons: []Daemon{{"command", syscall.SIGHUP}},
+					Daemons: []Daemon{{Command: "command", RestartSignal: syscall.SIGHUP}},
 				},
 			},
 		},
@@ -105,25 +139,272 @@ var parseTests = []struct {
 		"{\ndaemon +sighup: c\n}",
 		&Config{
 			Blocks: []Block{
-				{Daemons: []Daemon{{"c", syscall.SIGHUP}}},
+				{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGHUP}}},
 			},
 		},
 	},
 	{
 		"{\ndaemon +sigterm: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGTERM}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGTERM}}}}},
 	},
 	{
 		"{\ndaemon +sigint: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGINT}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGINT}}}}},
 	},
 	{
 		"{\ndaemon +sigkill: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGKILL}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGKILL}}}}},
 	},
 	{
 		"{\ndaemon +sigquit: c\n}",
-		&Config{Blocks: []Block{{Daemons: []Daemon{{"c", syscall.SIGQUIT}}}}},
+		&Config{Blocks: []Block{{Daemons: []Daemon{{Command: "c", RestartSignal: syscall.SIGQUIT}}}}},
+	},
+	{
+		"{\ndaemon +restartevery=1h30m: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, RestartEvery: 90 * time.Minute},
+		}}}},
+	},
+	{
+		"{\ndaemon +silence=30s +onsilence=restart: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:        "c",
+				RestartSignal:  syscall.SIGHUP,
+				Silence:        30 * time.Second,
+				SilenceRestart: true,
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +primary: python3 -i\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Daemons: []Daemon{
+						{Command: "python3 -i", RestartSignal: syscall.SIGHUP, Primary: true},
+					},
+				},
+			},
+		},
+	},
+	{
+		"{\ndaemon +keepstdin: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, KeepStdin: true},
+		}}}},
+	},
+	{
+		"{\ndaemon +maxmemory=512M +memoryinterval=1s: c\ndaemon +maxmemory=4096: d\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, MaxMemory: 512 << 20, MemoryInterval: time.Second},
+			{Command: "d", RestartSignal: syscall.SIGHUP, MaxMemory: 4096},
+		}}}},
+	},
+	{
+		"{\nevery: 1d\ndaemon +maxmemory=1.5GiB +restartevery=1d12h: c\n}",
+		&Config{Blocks: []Block{{
+			Every: 24 * time.Hour,
+			Daemons: []Daemon{
+				{Command: "c", RestartSignal: syscall.SIGHUP, MaxMemory: 3 << 29, RestartEvery: 36 * time.Hour},
+			},
+		}}},
+	},
+	{
+		"{\nprep +dedupkey=modcache: go mod download\n}",
+		&Config{Blocks: []Block{{
+			Preps: []Prep{{Command: "go mod download", DedupKey: "modcache"}},
+		}}},
+	},
+	{
+		"{\nprep +continueonerror +name=build-a: make a\ndaemon +needs=build-a: ./a\n}",
+		&Config{
+			Blocks: []Block{{
+				Preps:   []Prep{{Command: "make a", ContinueOnError: true, Name: "build-a"}},
+				Daemons: []Daemon{{Command: "./a", RestartSignal: syscall.SIGHUP, Needs: []string{"build-a"}}},
+			}},
+		},
+	},
+	{
+		"{\nprep +retries=3 +retryon=75,76: fetch\nprep +retries=1: flaky\n}",
+		&Config{Blocks: []Block{{
+			Preps: []Prep{
+				{Command: "fetch", Retries: 3, RetryOnCodes: []int{75, 76}},
+				{Command: "flaky", Retries: 1},
+			},
+		}}},
+	},
+	{
+		"{\nprep +keep=last_files: echo @mods\n}",
+		&Config{Blocks: []Block{{
+			Preps: []Prep{{Command: "echo @mods", Keep: "LAST_FILES"}},
+		}}},
+	},
+	{
+		"{\n  prep: <<EOF\n    if true; then\n\n      echo 'a \\\"b\\\"'\n    fi\n  EOF\n  daemon +sigterm: <<END\n\tserve \\\n\t  --port 8080\nEND\n}",
+		&Config{Blocks: []Block{{
+			Preps:   []Prep{{Command: "if true; then\n\n  echo 'a \\\"b\\\"'\nfi"}},
+			Daemons: []Daemon{{Command: "serve \\\n  --port 8080", RestartSignal: syscall.SIGTERM}},
+		}}},
+	},
+	{
+		"{\nprep: <<EOF cat\n}",
+		&Config{Blocks: []Block{{
+			Preps: []Prep{{Command: "<<EOF cat"}},
+		}}},
+	},
+	{
+		"{\nprep +umask=077: ./gen-keys\ndaemon +umask=027: ./server\n}",
+		&Config{Blocks: []Block{{
+			Preps:   []Prep{{Command: "./gen-keys", Umask: "077"}},
+			Daemons: []Daemon{{Command: "./server", RestartSignal: syscall.SIGHUP, Umask: "027"}},
+		}}},
+	},
+	{
+		"{\ndaemon +listen=8080 +listen='localhost:9090' +listen='unix:run/admin.sock': ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:       "./server",
+				RestartSignal: syscall.SIGHUP,
+				Listen:        []string{":8080", "localhost:9090", "unix:run/admin.sock"},
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +user=www +group=1001: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, User: "www", Group: "1001"},
+		}}}},
+	},
+	{
+		"{\ndaemon +norestart: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, NoRestart: true},
+		}}}},
+	},
+	{
+		"{\ndaemon +pidprefix: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, PidPrefix: true},
+		}}}},
+	},
+	{
+		"{\ndaemon +quiet: ./chatty\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./chatty", RestartSignal: syscall.SIGHUP, Quiet: true},
+		}}}},
+	},
+	{
+		"{\ndaemon +procname=api-server: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, ProcName: "api-server"},
+		}}}},
+	},
+	{
+		"{\ndaemon +procname=db: postgres\ndaemon: redis-server\ndaemon +after=db,redis-server +after=db: ./worker\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "postgres", RestartSignal: syscall.SIGHUP, ProcName: "db"},
+			{Command: "redis-server", RestartSignal: syscall.SIGHUP},
+			{Command: "./worker", RestartSignal: syscall.SIGHUP, After: []string{"db", "redis-server", "db"}},
+		}}}},
+	},
+	{
+		"{\ndaemon +fifo=/tmp/repl.ctl: repl\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "repl", RestartSignal: syscall.SIGHUP, Fifo: "/tmp/repl.ctl"},
+		}}}},
+	},
+	{
+		"{\ndaemon +pidfile=run/server.pid: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, PidFile: "run/server.pid"},
+		}}}},
+	},
+	{
+		"{\ndaemon +watchbinary: ./server\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGHUP, WatchBinary: true},
+		}}}},
+	},
+	{
+		"{\ndaemon +stoporder=2: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, StopOrder: 2},
+		}}}},
+	},
+	{
+		"{\ndelimiter: nul\n}\n{\ndelimiter: ;\n}",
+		&Config{Blocks: []Block{{Delimiter: "\x00"}, {Delimiter: ";"}}},
+	},
+	{
+		"{\nencoding: shift_jis\nprep: c\n}",
+		&Config{Blocks: []Block{{Encoding: "shift_jis", Preps: []Prep{{Command: "c"}}}}},
+	},
+	{
+		"{\ndaemon +readyport=8080 +onready='./migrate up' +onreadyrequired: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:         "c",
+				RestartSignal:   syscall.SIGHUP,
+				ReadyPort:       8080,
+				OnReady:         "./migrate up",
+				OnReadyRequired: true,
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +readyport=8080 +readytimeout=30s: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:       "c",
+				RestartSignal: syscall.SIGHUP,
+				ReadyPort:     8080,
+				ReadyTimeout:  30 * time.Second,
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +drain +draintimeout=1m: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:       "c",
+				RestartSignal: syscall.SIGHUP,
+				Drain:         true,
+				DrainTimeout:  time.Minute,
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +buffer=100 +overflow=drop-oldest: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:       "c",
+				RestartSignal: syscall.SIGHUP,
+				Buffer:        100,
+				Overflow:      "drop-oldest",
+			},
+		}}}},
+	},
+	{
+		"{\ndaemon +overflow=sample: c\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{Command: "c", RestartSignal: syscall.SIGHUP, Overflow: "sample"},
+		}}}},
+	},
+	{
+		"{\ndaemon +when=$WORKER=1: c\ndaemon +when='test -f x': d\n}",
+		&Config{Blocks: []Block{{Daemons: []Daemon{
+			{
+				Command:       "c",
+				RestartSignal: syscall.SIGHUP,
+				When:          &Condition{Name: "WORKER", Value: "1"},
+			},
+			{
+				Command:       "d",
+				RestartSignal: syscall.SIGHUP,
+				When:          &Condition{Command: "test -f x"},
+			},
+		}}}},
 	},
 	{
 		"foo {\nprep: command\n}",
@@ -175,7 +456,7 @@ var parseTests = []struct {
 			Blocks: []Block{
 				{
 					Include: []string{"foo", "bar"},
-					Preps:   []Prep{{"command", false}},
+					Preps:   []Prep{{Command: "command"}},
 				},
 			},
 		},
@@ -241,6 +522,271 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"foo {\nprep: one\nprep +pipe: two\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						Prep{Command: "one"},
+						Prep{Command: "two", Pipe: true},
+					},
+				},
+			},
+		},
+	},
+	{
+		"{\nprep +timeout=5m: go test\nprep +timeout=1s +killsignals=sigint/2s,sigterm/5s: make\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Preps: []Prep{
+						Prep{Command: "go test", Timeout: 5 * time.Minute},
+						Prep{
+							Command: "make",
+							Timeout: time.Second,
+							KillSignals: []KillStep{
+								{Signal: syscall.SIGINT, Wait: 2 * time.Second},
+								{Signal: syscall.SIGTERM, Wait: 5 * time.Second},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		"{\ncontainer: golang:1.22\nprep: go test ./...\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Container: &Container{Image: "golang:1.22", Runtime: "docker"},
+					Preps:     []Prep{Prep{Command: "go test ./..."}},
+				},
+			},
+		},
+	},
+	{
+		"{\ncontainer +runtime=podman: alpine\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Container: &Container{Image: "alpine", Runtime: "podman"},
+				},
+			},
+		},
+	},
+	{
+		"{\nprep: ./deploy\nrollback: ./undeploy\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Rollback: "./undeploy",
+					Preps:    []Prep{Prep{Command: "./deploy"}},
+				},
+			},
+		},
+	},
+	{
+		"{\nprep +continueonerror: lint\nprep: make\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Preps: []Prep{
+						Prep{Command: "lint", ContinueOnError: true},
+						Prep{Command: "make"},
+					},
+				},
+			},
+		},
+	},
+	{
+		"{\nprep +persist: cd foo\nprep +persist: make\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Preps: []Prep{
+						Prep{Command: "cd foo", Persist: true},
+						Prep{Command: "make", Persist: true},
+					},
+				},
+			},
+		},
+	},
+	{
+		"** {\nprep +onlyif=**/*.proto +onlyif='*.txt': protoc\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"**"},
+					Preps: []Prep{
+						Prep{Command: "protoc", OnlyIf: []string{"**/*.proto", "*.txt"}},
+					},
+				},
+			},
+		},
+	},
+	{
+		"{\nenv: FOO=bar baz\nenv +cmd: SECRET=cat secret\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Env: []EnvVar{
+						{Name: "FOO", Value: "bar baz"},
+						{Name: "SECRET", Value: "cat secret", Command: true},
+					},
+				},
+			},
+		},
+	},
+	{
+		"env:*.go {}\nsnippet:foo/** {}",
+		&Config{Blocks: []Block{{Include: []string{"env:*.go"}}, {Include: []string{"snippet:foo/**"}}}},
+	},
+	{
+		"@shell = bash\nenv: FOO=global\nenv +cmd: BAR=date\nenv {\nenv: FOO=block\n}\n{}",
+		&Config{
+			Env: []EnvVar{
+				{Name: "FOO", Value: "global"},
+				{Name: "BAR", Value: "date", Command: true},
+			},
+			Blocks: []Block{
+				{
+					Include: []string{"env"},
+					Env: []EnvVar{
+						{Name: "FOO", Value: "global"},
+						{Name: "BAR", Value: "date", Command: true},
+						{Name: "FOO", Value: "block"},
+					},
+				},
+				{
+					Env: []EnvVar{
+						{Name: "FOO", Value: "global"},
+						{Name: "BAR", Value: "date", Command: true},
+					},
+				},
+			},
+			variables: map[string]string{"@shell": "bash"},
+		},
+	},
+	{
+		"echo: on\n{}\n{\necho: off\n}",
+		&Config{Echo: true, Blocks: []Block{{Echo: "on"}, {Echo: "off"}}},
+	},
+	{
+		"header: off\n{}\n{\nheader: on\n}",
+		&Config{Header: "off", Blocks: []Block{{Header: "off"}, {Header: "on"}}},
+	},
+	{
+		"teardown: docker network rm dev\n{}",
+		&Config{Teardown: "docker network rm dev", Blocks: []Block{{}}},
+	},
+	{
+		"snippet: test = go test -race @dirmods\nsnippet: all = @snippet(test) ./...\n" +
+			"{\nprep: @snippet(test) -v\ndaemon: @snippet( all ) && echo \\@snippet(test)\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Preps: []Prep{{Command: "go test -race @dirmods -v"}},
+					Daemons: []Daemon{
+						{Command: "go test -race @dirmods ./... && echo \\@snippet(test)", RestartSignal: syscall.SIGHUP},
+					},
+				},
+			},
+		},
+	},
+	{
+		"snippet: <<EOF\n  lint = go vet \\\n    ./...\nEOF\nprelude: @snippet(lint)\n{}",
+		&Config{Prelude: "go vet \\\n  ./...", Blocks: []Block{{}}},
+	},
+	{
+		"oncycleend: ./status.sh\n{}",
+		&Config{OnCycleEnd: "./status.sh", Blocks: []Block{{}}},
+	},
+	{
+		"mask: token=\\S+\nmask: '(?i)password: \\w+'\n{}\n{}",
+		&Config{
+			Mask: []string{`token=\S+`, `(?i)password: \w+`},
+			Blocks: []Block{
+				{Mask: []string{`token=\S+`, `(?i)password: \w+`}},
+				{Mask: []string{`token=\S+`, `(?i)password: \w+`}},
+			},
+		},
+	},
+	{
+		"shell: bash\n{}\n{\nshell: sh\n}",
+		&Config{Shell: "bash", Blocks: []Block{{Shell: "bash"}, {Shell: "sh"}}},
+	},
+	{
+		"@shell = bash\n{}\n{\nshell: sh\n}",
+		&Config{
+			variables: map[string]string{"@shell": "bash"},
+			Blocks:    []Block{{}, {Shell: "sh"}},
+		},
+	},
+	{
+		"@shell = sh\nshell: bash\n{}",
+		&Config{
+			Shell:     "bash",
+			variables: map[string]string{"@shell": "sh"},
+			Blocks:    []Block{{Shell: "bash"}},
+		},
+	},
+	{
+		"prelude: ./scripts/gen-config\n{}",
+		&Config{Prelude: "./scripts/gen-config", Blocks: []Block{{}}},
+	},
+	{
+		"{\ncollapse: 2s\n}",
+		&Config{Blocks: []Block{{Collapse: 2 * time.Second}}},
+	},
+	{
+		"{\nevery: 10m\n}",
+		&Config{Blocks: []Block{{Every: 10 * time.Minute}}},
+	},
+	{
+		"{\nbatch: 250ms\n}",
+		&Config{Blocks: []Block{{Batch: 250 * time.Millisecond}}},
+	},
+	{
+		"{\nisolate: on\n}",
+		&Config{Blocks: []Block{{Isolate: "on"}}},
+	},
+	{
+		"{\npriority: 10\n}\n{\npriority: -1\n}",
+		&Config{Blocks: []Block{{Priority: 10}, {Priority: -1}}},
+	},
+	{
+		"{\nminchanges: 3\n}\n{\nminchanges +accumulate: 5\n}",
+		&Config{Blocks: []Block{{MinChanges: 3}, {MinChanges: 5, Accumulate: true}}},
+	},
+	{
+		"{\npassenv: PATH HOME\n}\n{\npassenv: ''\n}",
+		&Config{
+			Blocks: []Block{
+				{CleanEnv: true, PassEnv: []string{"PATH", "HOME"}},
+				{CleanEnv: true, PassEnv: []string{}},
+			},
+		},
+	},
+	{
+		"{\nenv: 'FOO=multi\nline'\n}",
+		&Config{
+			Blocks: []Block{
+				{Env: []EnvVar{{Name: "FOO", Value: "multi\nline"}}},
+			},
+		},
+	},
+	{
+		"{ label: foo\n }\n{ label: 'bar'\n }",
+		&Config{
+			Blocks: []Block{
+				{Label: "foo"},
+				{Label: "bar"},
+			},
+		},
+	},
 }
 
 func TestParse(t *testing.T) {
@@ -259,19 +805,164 @@ var parseErrorTests = []struct {
 	input string
 	err   string
 }{
-	{"{", "test:1: unterminated block"},
-	{"a", "test:1: expected block open parentheses, got \"\""},
-	{`foo { "bar": "bar" }`, "test:1: invalid input"},
-	{"foo { daemon: \n }", "test:1: empty command specification"},
-	{"foo { daemon: \" }", "test:1: unterminated quoted string"},
-	{"foo { daemon *: foo }", "test:1: invalid syntax"},
-	{"foo { daemon +invalid: foo }", "test:1: unknown option: +invalid"},
-	{"foo { prep +invalid: foo }", "test:1: unknown option: +invalid"},
-	{"@foo bar {}", "test:1: Expected ="},
-	{"@foo =", "test:1: unterminated variable assignment"},
-	{"@foo=bar\n@foo=bar {}", "test:2: variable @foo shadows previous declaration"},
-	{"{indir +foo: bar\n}", "test:1: indir takes no options"},
-	{"{indir: bar\nindir: voing\n}", "test:2: indir can only be used once per block"},
+	{"{", "test:1:2: unterminated block"},
+	{"a", "test:1:2: expected block open parentheses, got \"\""},
+	{`foo { "bar": "bar" }`, "test:1:7: invalid input"},
+	{"foo { daemon: \n }", "test:1:15: empty command specification"},
+	{"foo { daemon: \" }", "test:1:15: unterminated quoted string"},
+	{"foo { daemon *: foo }", "test:1:14: invalid syntax"},
+	{"foo { daemon +invalid: foo }", "test:1:14: unknown option: +invalid"},
+	{"foo { prep +invalid: foo }", "test:1:12: unknown option: +invalid"},
+	{"foo { prep +pipe: foo }", "test:1:12: +pipe requires a preceding prep"},
+	{"foo { prep: foo\nprep +pipe +persist: bar }", "test:2:12: +pipe can't be used with +persist"},
+	{"[a-z {}", `test:1:1: invalid pattern "[a-z": syntax error in pattern`},
+	{"foo !'bar/{a,b' {}", `test:1:5: invalid pattern "bar/{a,b": syntax error in pattern`},
+	{"foo { prep +onlyif=[x: foo }", `test:1:12: invalid pattern "[x": syntax error in pattern`},
+	{"foo { frob: foo }", "test:1:7: unknown directive: frob"},
+	{"foo { container: a\ncontainer: b }", "test:2:1: container can only be used once per block"},
+	{"foo { container +runtime: a }", "test:1:17: +runtime requires a command"},
+	{"foo { container: a\nprep +persist: b }", "test:2:6: +persist can't be used in a container"},
+	{"foo { prep +persist: b\ncontainer: a }", "test:2:12: container can't be used with +persist"},
+	{"foo { prep +dedupkey: a }", "test:1:12: +dedupkey requires a key"},
+	{"foo { prep +keep=a-b: a }", "test:1:12: +keep requires a name of letters, digits and underscores"},
+	{"foo { daemon +user: a }", "test:1:14: +user requires a name"},
+	{"foo { daemon +listen=http: a }", "test:1:14: invalid address for +listen: \"http\""},
+	{"foo { daemon +listen='unix:': a }", "test:1:14: +listen requires a socket path"},
+	{"foo { prep +umask=999: a }", "test:1:12: invalid umask for +umask: \"999\""},
+	{"foo { daemon +umask=01000: a }", "test:1:14: invalid umask for +umask: \"01000\""},
+	{"foo { prep +persist +umask=022: a }", "test:1:21: +umask can't be used with +persist"},
+	{"{every: often\n}", "test:1:9: invalid duration for every: \"often\""},
+	{"{every: 1m\nevery: 2m\n}", "test:2:8: every can only be used once per block"},
+	{"{batch: soon\n}", "test:1:9: invalid duration for batch: \"soon\""},
+	{"{batch: 1s\nbatch: 2s\n}", "test:2:8: batch can only be used once per block"},
+	{"{priority: high\n}", "test:1:12: invalid priority: \"high\""},
+	{"{priority: 1\npriority: 2\n}", "test:2:11: priority can only be used once per block"},
+	{"{minchanges: 0\n}", "test:1:14: invalid minchanges: \"0\""},
+	{"{minchanges +drop: 2\n}", "test:1:13: unknown option: +drop"},
+	{"{minchanges: 1\nminchanges: 2\n}", "test:2:1: minchanges can only be used once per block"},
+	{"foo { rollback: a\nrollback: b }", "test:2:1: rollback can only be used once per block"},
+	{"foo { prep +timeout=forever: foo }", `test:1:12: invalid duration for +timeout: "forever"`},
+	{"foo { prep +timeout=1s +persist: foo }", "test:1:24: +timeout can't be used with +persist"},
+	{"foo { prep +killsignals=sigint/1s: foo }", "test:1:12: +killsignals requires +timeout"},
+	{"foo { prep +timeout=1s +killsignals=sigfoo/1s: foo }", "test:1:24: unknown signal: sigfoo"},
+	{"foo { prep +timeout=1s +killsignals=sigint: foo }", "test:1:24: missing wait for sigint"},
+	{"foo { prep +timeout=1s +killsignals=sigint/x: foo }", `test:1:24: invalid duration for sigint: "x"`},
+	{"foo { daemon +maxmemory=lots: foo }", "test:1:14: invalid size for +maxmemory: \"lots\""},
+	{"foo { daemon +maxmemory=1P: foo }", "test:1:14: invalid size for +maxmemory: \"1P\""},
+	{"foo { daemon +maxmemory=0MB: foo }", "test:1:14: invalid size for +maxmemory: \"0MB\""},
+	{"{every: 1h1d\n}", "test:1:9: invalid duration for every: \"1h1d\""},
+	{"{every: 106751d24h\n}", "test:1:9: duration out of range for every: \"106751d24h\""},
+	{"foo { daemon +memoryinterval=1s: foo }", "test:1:14: +memoryinterval requires +maxmemory"},
+	{"foo { daemon +fifo: foo }", "test:1:14: +fifo requires a path"},
+	{"foo { daemon +pidfile: foo }", "test:1:14: +pidfile requires a path"},
+	{"{\ndaemon +primary +fifo=ctl: repl\n}", "test:2:17: +primary can't be used with +fifo"},
+	{"{\ndaemon +primary: a\n}\n{\ndaemon +sigterm +primary: b\n}", "test:5:17: +primary can only be used by one daemon"},
+	{"foo { daemon +procname: foo }", "test:1:14: +procname requires a name"},
+	{"foo { daemon +after: foo }", "test:1:14: +after requires a daemon name"},
+	{"foo {\ndaemon +after=db: foo\n}", "test:3:1: +after refers to unknown daemon: db"},
+	{"foo {\nprep +name=a: x\ndaemon +needs=a,b: foo\n}", "test:4:1: +needs refers to unknown prep: b"},
+	{"foo {\ndaemon +needs: foo\n}", "test:2:8: +needs requires a prep name"},
+	{"foo {\nprep +name=a: x\nprep +name=a: y\n}", "test:3:6: prep name a is used more than once"},
+	{"foo { prep +name: a }", "test:1:12: +name requires a name"},
+	{"foo { prep +retries=0: a }", "test:1:12: +retries must be a positive number, got \"0\""},
+	{"foo { prep +retries=2 +retryon=75,x: a }", "test:1:23: invalid exit code for +retryon: \"x\""},
+	{"foo { prep +retryon=75: a }", "test:1:12: +retryon requires +retries"},
+	{"foo {\ndaemon +procname=a +after=b: foo\ndaemon +procname=b +after=a: bar\n}", "test:4:1: daemon dependency cycle: a -> b -> a"},
+	{"foo { prep +onlyif: foo }", "test:1:12: +onlyif requires a pattern"},
+	{"foo { prep +onchange=yes: foo }", "test:1:12: unknown option: +onchange=yes"},
+	{"foo { daemon +onresize=sigfoo: foo }", "test:1:14: unknown signal: sigfoo"},
+	{"foo { daemon +sigterm=foo: foo }", "test:1:14: unknown option: +sigterm=foo"},
+	{"foo { daemon +restartevery=soon: foo }", "test:1:14: invalid duration for +restartevery: \"soon\""},
+	{"foo { daemon +restartevery: foo }", "test:1:14: invalid duration for +restartevery: \"\""},
+	{"foo { daemon +buffer=0: foo }", "test:1:14: invalid size for +buffer: \"0\""},
+	{"foo { daemon +overflow=drop: foo }", "test:1:14: unknown overflow policy: \"drop\""},
+	{"foo { daemon +readyport=http: foo }", "test:1:14: invalid port for +readyport: \"http\""},
+	{"foo { daemon +readyport=70000: foo }", "test:1:14: invalid port for +readyport: \"70000\""},
+	{"foo { daemon +readyport=80 +readytimeout=soon: foo }", "test:1:28: invalid duration for +readytimeout: \"soon\""},
+	{"foo { daemon +readytimeout=1s: foo }", "test:1:14: +readytimeout requires +readyport"},
+	{"foo { daemon +drain=yes: foo }", "test:1:14: unknown option: +drain=yes"},
+	{"foo { daemon +draintimeout=1s: foo }", "test:1:14: +draintimeout requires +drain"},
+	{"foo { daemon +onready: foo }", "test:1:14: +onready requires a command"},
+	{"foo { daemon +onreadyrequired=yes: foo }", "test:1:14: unknown option: +onreadyrequired=yes"},
+	{"foo { daemon +silence=0s: foo }", "test:1:14: invalid duration for +silence: \"0s\""},
+	{"foo { daemon +silence=1s +onsilence=kill: foo }", "test:1:26: invalid action for +onsilence: \"kill\""},
+	{"foo { daemon +onsilence=warn: foo }", "test:1:14: +onsilence requires +silence"},
+	{"foo { daemon +stoporder=first: foo }", "test:1:14: invalid order for +stoporder: \"first\""},
+	{"foo { daemon +when: foo }", "test:1:14: invalid condition for +when: empty condition"},
+	{"@foo bar {}", "test:1:6: Expected ="},
+	{"@foo =", "test:1:7: unterminated variable assignment"},
+	{"@foo=bar\n@foo=bar {}", "test:2:6: variable @foo shadows previous declaration"},
+	{"{indir +foo: bar\n}", "test:1:8: indir takes no options"},
+	{"{indir: bar\nindir: voing\n}", "test:2:1: indir can only be used once per block"},
+	{"{base: bar\nbase: voing\n}", "test:2:1: base can only be used once per block"},
+	{"{env: FOO\n}", "test:1:7: env must be of the form NAME=value"},
+	{"{env: 1FOO=bar\n}", "test:1:7: env must be of the form NAME=value"},
+	{"{env +foo: FOO=bar\n}", "test:1:6: unknown option: +foo"},
+	{"env: FOO\n{}", "test:1:6: env must be of the form NAME=value"},
+	{"echo: loud\n{}", "test:1:7: echo must be on or off, got \"loud\""},
+	{"{echo: loud\n}", "test:1:8: echo must be on or off, got \"loud\""},
+	{"{isolate: yes\n}", "test:1:11: isolate must be on or off, got \"yes\""},
+	{"{isolate: on\nisolate: off\n}", "test:2:1: isolate can only be used once per block"},
+	{"{echo: on\necho: off\n}", "test:2:1: echo can only be used once per block"},
+	{"header: maybe\n{}", "test:1:9: header must be on or off, got \"maybe\""},
+	{"{header: maybe\n}", "test:1:10: header must be on or off, got \"maybe\""},
+	{"{header: on\nheader: off\n}", "test:2:1: header can only be used once per block"},
+	{"oncycleend +foo: bar\n{}", "test:1:12: unknown option: +foo"},
+	{"oncycleend: foo\noncycleend: bar\n{}", "test:2:13: oncycleend can only be used once"},
+	{"prelude: foo\nprelude: bar\n{}", "test:2:10: prelude can only be used once"},
+	{"teardown: foo\nteardown: bar\n{}", "test:2:11: teardown can only be used once"},
+	{"teardown +foo: bar\n{}", "test:1:10: unknown option: +foo"},
+	{"snippet: test\n{}", "test:1:10: snippet must be of the form NAME = command"},
+	{"snippet: a b = foo\n{}", "test:1:10: snippet must be of the form NAME = command"},
+	{"snippet: test =\n{}", "test:1:10: snippet test is empty"},
+	{"snippet: test = foo\nsnippet: test = bar\n{}", "test:2:10: snippet test is already defined"},
+	{"snippet +foo: test = foo\n{}", "test:1:9: unknown option: +foo"},
+	{"snippet: all = @snippet(test) ./...\n{}", "test:1:10: undefined snippet: test"},
+	{"{\nprep: @snippet(test)\n}", "test:2:7: undefined snippet: test"},
+	{"{\ndaemon: foo @snippet(bar)\n}", "test:2:9: undefined snippet: bar"},
+	{"{\nprep: foo\n}\nsnippet: foo = bar\n{\nprep: @snippet(fo)\n}", "test:6:7: undefined snippet: fo"},
+	{"teardown: @snippet(test)\n{}", "test:1:11: undefined snippet: test"},
+	{"mask: token=(\n{}", "test:1:7: invalid pattern for mask: error parsing regexp: missing closing ): `token=(`"},
+	{"mask +foo: token\n{}", "test:1:6: unknown option: +foo"},
+	{"shell: bash\nshell: sh\n{}", "test:2:8: shell can only be used once"},
+	{"{shell +foo: bash\n}", "test:1:8: shell takes no options"},
+	{"{shell: bash\nshell: sh\n}", "test:2:1: shell can only be used once per block"},
+	{"{collapse: often\n}", "test:1:12: invalid duration for collapse: \"often\""},
+	{"{collapse: 1s\ncollapse: 2s\n}", "test:2:11: collapse can only be used once per block"},
+	{"{passenv: PATH 1FOO\n}", "test:1:11: invalid variable name for passenv: \"1FOO\""},
+	{"{passenv: PATH\npassenv: HOME\n}", "test:2:10: passenv can only be used once per block"},
+	{"{encoding: latin1\nencoding: sjis\n}", "test:2:1: encoding can only be used once per block"},
+	{"{encoding: klingon\n}", "test:1:12: unknown encoding: \"klingon\""},
+	{"{delimiter: ab\n}", "test:1:13: delimiter must be a single character, nul, tab or newline, got \"ab\""},
+	{"{delimiter: nul\ndelimiter: tab\n}", "test:2:12: delimiter can only be used once per block"},
+	{"{label +foo: bar\n}", "test:1:8: label takes no options"},
+	{"{label: bar\nlabel: voing\n}", "test:2:1: label can only be used once per block"},
+	{"{label: bar\n}\n{label: bar\n}", "test:4:1: block label bar shadows previous declaration"},
+}
+
+func TestErrorDetail(t *testing.T) {
+	_, err := Parse("test", "**/*.go {\n\tprep: make\n\tdaemon +sigfoo +sigterm: ./server\n}\n")
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %#v", err)
+	}
+	expected := Error{
+		Name:    "test",
+		Line:    3,
+		Column:  9,
+		Token:   "+sigfoo",
+		Message: "unknown option: +sigfoo",
+		Source:  "\tdaemon +sigfoo +sigterm: ./server",
+	}
+	if *e != expected {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, *e)
+	}
+	detail := "test:3:9: unknown option: +sigfoo\n" +
+		"    \tdaemon +sigfoo +sigterm: ./server\n" +
+		"    \t       ^"
+	if e.Detail() != detail {
+		t.Errorf("Expected\n%s\ngot\n%s", detail, e.Detail())
+	}
 }
 
 func TestErrorsParse(t *testing.T) {
@@ -0,0 +1,108 @@
+package conf
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/moddwatch/filter"
+)
+
+// patternOrder returns the block's patterns in the order they apply, with
+// excludes marked by a leading "!". Without an Order, excludes apply after
+// every include.
+func (b *Block) patternOrder() []string {
+	if b.Order != nil {
+		return b.Order
+	}
+	ret := append([]string{}, b.Include...)
+	for _, p := range b.Exclude {
+		ret = append(ret, "!"+p)
+	}
+	return ret
+}
+
+// refines returns order if an include in it follows an exclude that follows
+// another include, and so refines it, and nil otherwise. Excludes given before
+// any include apply to every file, so they're moved to the end.
+func refines(order []string) []string {
+	var leading, rest []string
+	refined, excluded := false, false
+	for _, p := range order {
+		switch {
+		case !strings.HasPrefix(p, "!"):
+			refined = refined || excluded
+			rest = append(rest, p)
+		case len(rest) == 0:
+			leading = append(leading, p)
+		default:
+			excluded = true
+			rest = append(rest, p)
+		}
+	}
+	if !refined {
+		return nil
+	}
+	return append(rest, leading...)
+}
+
+// resolveBase resolves the block's patterns against its Base directory.
+// Absolute patterns are left as they are.
+func (b *Block) resolveBase() {
+	if b.Base == "" {
+		return
+	}
+	resolve := func(p string) string {
+		neg := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if !filepath.IsAbs(p) {
+			p = path.Join(filepath.ToSlash(b.Base), p)
+		}
+		if neg {
+			return "!" + p
+		}
+		return p
+	}
+	for _, l := range [][]string{b.Include, b.Exclude, b.Order} {
+		for i, p := range l {
+			l[i] = resolve(p)
+		}
+	}
+}
+
+// Matches reports whether the block's patterns match path. A path must be
+// matched by an include, and not by an exclude. If the block has an Order,
+// the last pattern that matches the path decides.
+func (b *Block) Matches(path string) (bool, error) {
+	if b.Order == nil {
+		p, err := filter.File(path, b.Include, b.Exclude)
+		return p != "", err
+	}
+	matched := false
+	for _, p := range b.Order {
+		exclude := strings.HasPrefix(p, "!")
+		ok, err := filter.MatchAny(path, []string{strings.TrimPrefix(p, "!")})
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched = !exclude
+		}
+	}
+	return matched, nil
+}
+
+// Filter returns the paths that the block's patterns match
+func (b *Block) Filter(paths []string) ([]string, error) {
+	ret := []string{}
+	for _, p := range paths {
+		ok, err := b.Matches(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ret = append(ret, p)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,58 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var matchesTests = []struct {
+	patterns string
+	matched  []string
+}{
+	// Excludes apply to every include, wherever they're given
+	{"!**/testdata/** src/**", []string{"src/main.go"}},
+	{"src/** !**/testdata/**", []string{"src/main.go"}},
+	// An include after an exclude refines it, and the last pattern to match
+	// decides
+	{
+		"src/** !**/testdata/** **/golden/*",
+		[]string{"src/main.go", "src/testdata/golden/a.txt", "src/testdata/golden/b.tmp"},
+	},
+	{
+		"src/** !**/testdata/** **/golden/* !**/*.tmp",
+		[]string{"src/main.go", "src/testdata/golden/a.txt"},
+	},
+	// Excludes that come first still apply to later includes
+	{"!**/*.tmp src/** !**/testdata/** **/golden/*", []string{"src/main.go", "src/testdata/golden/a.txt"}},
+	// Patterns are resolved against the block's base
+	{"*.txt {\nbase: src/testdata\n}", []string{"src/testdata/input.txt"}},
+	{"** !golden/*.tmp {\nbase: src/testdata/\n}", []string{"src/testdata/input.txt", "src/testdata/golden/a.txt"}},
+}
+
+func TestBlockMatches(t *testing.T) {
+	paths := []string{
+		"src/main.go",
+		"src/testdata/input.txt",
+		"src/testdata/golden/a.txt",
+		"src/testdata/golden/b.tmp",
+		"docs/index.md",
+	}
+	for _, tt := range matchesTests {
+		text := tt.patterns
+		if !strings.HasSuffix(text, "}") {
+			text += " {}"
+		}
+		cnf, err := Parse("test", text)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.patterns, err)
+		}
+		ret, err := cnf.Blocks[0].Filter(paths)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.patterns, err)
+		}
+		if !reflect.DeepEqual(ret, tt.matched) {
+			t.Errorf("%q: expected %#v, got %#v", tt.patterns, tt.matched, ret)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// snippetRef matches a reference to a snippet in a command, with the
+// backslashes that may escape it
+var snippetRef = regexp.MustCompile(`(\\*)@snippet\(([^)]*)\)`)
+
+var snippetName = regexp.MustCompile(`^\w+$`)
+
+// addSnippet defines a snippet from a spec of the form NAME = command. The
+// command can refer to snippets defined before it.
+func (c *Config) addSnippet(spec string, options []string) error {
+	if len(options) > 0 {
+		return fmt.Errorf("unknown option: %s", options[0])
+	}
+	parts := strings.SplitN(spec, "=", 2)
+	name := strings.TrimSpace(parts[0])
+	if len(parts) != 2 || !snippetName.MatchString(name) {
+		return fmt.Errorf("snippet must be of the form NAME = command")
+	}
+	if _, ok := c.snippets[name]; ok {
+		return fmt.Errorf("snippet %s is already defined", name)
+	}
+	command, err := c.expandSnippets(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return err
+	}
+	if command == "" {
+		return fmt.Errorf("snippet %s is empty", name)
+	}
+	if c.snippets == nil {
+		c.snippets = map[string]string{}
+	}
+	c.snippets[name] = command
+	return nil
+}
+
+// snippet returns the command of the named snippet, looking in the snippets
+// inherited from a base config if the config doesn't define it itself
+func (c *Config) snippet(name string) (string, bool) {
+	if s, ok := c.snippets[name]; ok {
+		return s, true
+	}
+	s, ok := c.inherited[name]
+	return s, ok
+}
+
+// expandSnippets replaces the snippet references in command with the commands
+// they name. Backslashes before a reference are halved, as they are before a
+// variable, and a reference escaped by an odd number of them is left for
+// variable expansion to unescape.
+func (c *Config) expandSnippets(command string) (string, error) {
+	var err error
+	ret := snippetRef.ReplaceAllStringFunc(command, func(ref string) string {
+		m := snippetRef.FindStringSubmatch(ref)
+		if err != nil || len(m[1])%2 != 0 {
+			return ref
+		}
+		name := strings.TrimSpace(m[2])
+		s, ok := c.snippet(name)
+		if !ok {
+			err = fmt.Errorf("undefined snippet: %s", name)
+			return ref
+		}
+		return m[1][:len(m[1])/2] + s
+	})
+	return ret, err
+}
@@ -0,0 +1,109 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// day is the length of the d unit accepted by ParseDuration
+const day = 24 * time.Hour
+
+var daysPrefix = regexp.MustCompile(`^(\d+)d`)
+
+// rangeError is returned for a duration or size too large to represent
+type rangeError struct {
+	kind string
+	spec string
+}
+
+func (e rangeError) Error() string {
+	return fmt.Sprintf("%s out of range: %q", e.kind, e.spec)
+}
+
+// ParseDuration parses a duration in Go's syntax, like "500ms", "2s" or
+// "1h30m", with the addition of a d unit for days, which may only lead, as in
+// "1d12h"
+func ParseDuration(s string) (time.Duration, error) {
+	m := daysPrefix.FindStringSubmatch(s)
+	if m == nil {
+		return time.ParseDuration(s)
+	}
+	days, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || days > int64(math.MaxInt64/day) {
+		return 0, rangeError{"duration", s}
+	}
+	var rest time.Duration
+	if s = s[len(m[0]):]; s != "" {
+		rest, err = time.ParseDuration(s)
+		if err != nil || rest < 0 {
+			return 0, fmt.Errorf("invalid duration: %q", m[0]+s)
+		}
+	}
+	if rest > math.MaxInt64-time.Duration(days)*day {
+		return 0, rangeError{"duration", m[0] + s}
+	}
+	return time.Duration(days)*day + rest, nil
+}
+
+// sizeUnits are the multiples of the unit suffixes accepted by ParseSize
+var sizeUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+var sizePattern = regexp.MustCompile(`(?i)^\s*([0-9]*\.?[0-9]+)\s*(?:([kmgt])(?:i?b)?|b)?\s*$`)
+
+// ParseSize parses a size in bytes, like "512", "100MB" or "1.5GiB". Units
+// are binary multiples whichever way they're written, so that K, KB and KiB
+// are all 1024 bytes, and case is ignored.
+func ParseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	mul := sizeUnits[strings.ToLower(m[2])]
+	if n, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+		if n > math.MaxInt64/mul {
+			return 0, rangeError{"size", s}
+		}
+		return n * mul, nil
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || f*float64(mul) >= math.MaxInt64 {
+		return 0, rangeError{"size", s}
+	}
+	return int64(f * float64(mul)), nil
+}
+
+// parsePositiveDuration parses the value of an option that takes a duration
+// greater than zero
+func parsePositiveDuration(name, spec string) (time.Duration, error) {
+	d, err := ParseDuration(spec)
+	if _, ok := err.(rangeError); ok {
+		return 0, fmt.Errorf("duration out of range for %s: %q", name, spec)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration for %s: %q", name, spec)
+	}
+	return d, nil
+}
+
+// parsePositiveSize parses the value of an option that takes a size greater
+// than zero
+func parsePositiveSize(name, spec string) (int64, error) {
+	n, err := ParseSize(spec)
+	if _, ok := err.(rangeError); ok {
+		return 0, fmt.Errorf("size out of range for %s: %q", name, spec)
+	}
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size for %s: %q", name, spec)
+	}
+	return n, nil
+}
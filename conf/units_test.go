@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var durationTests = []struct {
+	spec     string
+	expected time.Duration
+	err      bool
+}{
+	{"500ms", 500 * time.Millisecond, false},
+	{"2s", 2 * time.Second, false},
+	{"10m", 10 * time.Minute, false},
+	{"1h30m", 90 * time.Minute, false},
+	{"1.5h", 90 * time.Minute, false},
+	{"1d", 24 * time.Hour, false},
+	{"2d12h", 60 * time.Hour, false},
+	{"0", 0, false},
+	{"", 0, true},
+	{"10", 0, true},
+	{"soon", 0, true},
+	{"1w", 0, true},
+	{"1h1d", 0, true},
+	{"1d-1h", 0, true},
+	{"99999999999d", 0, true},
+	{"106751d24h", 0, true},
+	{"106751d23h47m17s", 0, true},
+	{"106751d23h47m16.854775807s", time.Duration(math.MaxInt64), false},
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tt := range durationTests {
+		ret, err := ParseDuration(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if ret != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.spec, tt.expected, ret)
+		}
+	}
+}
+
+var sizeTests = []struct {
+	spec     string
+	expected int64
+	err      bool
+}{
+	{"512", 512, false},
+	{"512b", 512, false},
+	{"4K", 4 << 10, false},
+	{"4kb", 4 << 10, false},
+	{"100MB", 100 << 20, false},
+	{"100 MiB", 100 << 20, false},
+	{"1GiB", 1 << 30, false},
+	{"1.5G", 3 << 29, false},
+	{"2T", 2 << 40, false},
+	{"", 0, true},
+	{"MB", 0, true},
+	{"1P", 0, true},
+	{"1ib", 0, true},
+	{"-1M", 0, true},
+	{"1.2.3M", 0, true},
+	{"99999999999T", 0, true},
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range sizeTests {
+		ret, err := ParseSize(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if ret != tt.expected {
+			t.Errorf("%q: expected %d, got %d", tt.spec, tt.expected, ret)
+		}
+	}
+}
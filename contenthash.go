@@ -0,0 +1,153 @@
+package modd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+)
+
+type contentHash [sha256.Size]byte
+
+// contentHashes remembers a hash of the content of each file seen, so that
+// changes that leave a file's content as it was, like a touch, can be
+// ignored
+type contentHashes map[string]contentHash
+
+// hashFile returns the hash of the content of the file at p. If ok is false,
+// p isn't a regular file that could be read.
+func hashFile(p string) (sum contentHash, ok bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return sum, false
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+		return sum, false
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, false
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, true
+}
+
+// seed records the hashes of the files under root matched by the blocks, so
+// that the first change to each can be checked
+func (hs contentHashes) seed(root string, blocks []conf.Block) {
+	for _, b := range blocks {
+		paths, err := moddwatch.List(root, b.Include, nil)
+		if err != nil {
+			continue
+		}
+		if paths, err = b.Filter(paths); err != nil {
+			continue
+		}
+		for _, p := range paths {
+			if sum, ok := hashFile(p); ok {
+				hs[p] = sum
+			}
+		}
+	}
+}
+
+// filter returns mod without the added and changed files whose content
+// matches the hash recorded for them, recording the hashes of the rest.
+// Deleted files are forgotten. If nothing is left, nil is returned.
+func (hs contentHashes) filter(mod *moddwatch.Mod) *moddwatch.Mod {
+	ret := &moddwatch.Mod{Deleted: mod.Deleted}
+	for _, p := range mod.Deleted {
+		delete(hs, p)
+	}
+	keep := func(paths []string) []string {
+		var kept []string
+		for _, p := range paths {
+			sum, ok := hashFile(p)
+			if !ok {
+				kept = append(kept, p)
+				continue
+			}
+			if prev, seen := hs[p]; seen && prev == sum {
+				continue
+			}
+			hs[p] = sum
+			kept = append(kept, p)
+		}
+		return kept
+	}
+	ret.Added = keep(mod.Added)
+	ret.Changed = keep(mod.Changed)
+	if ret.Empty() {
+		return nil
+	}
+	return ret
+}
+
+// cycleSignature returns a hash of the files in mod, and the content of those
+// that were added or changed, so that two sets of changes with the same files
+// and content have the same signature
+func cycleSignature(mod *moddwatch.Mod) contentHash {
+	h := sha256.New()
+	add := func(kind string, paths []string, content bool) {
+		paths = append([]string(nil), paths...)
+		sort.Strings(paths)
+		for _, p := range paths {
+			fmt.Fprintf(h, "%s\x00%s\x00", kind, p)
+			if content {
+				if sum, ok := hashFile(p); ok {
+					h.Write(sum[:])
+				}
+			}
+			h.Write([]byte{'\n'})
+		}
+	}
+	add("added", mod.Added, true)
+	add("changed", mod.Changed, true)
+	add("deleted", mod.Deleted, false)
+	var sum contentHash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// filterContent passes the changes received on modchan on to the returned
+// channel, minus the files whose content hasn't changed, until a nil is
+// received or done is closed. Changes that are filtered out entirely are
+// logged and dropped.
+func (mr *ModRunner) filterContent(root string, modchan chan *moddwatch.Mod, done chan struct{}) chan *moddwatch.Mod {
+	hs := contentHashes{}
+	hs.seed(root, mr.Config.Blocks)
+	ret := make(chan *moddwatch.Mod, cap(modchan))
+	go func() {
+		for {
+			var mod *moddwatch.Mod
+			select {
+			case mod = <-modchan:
+			case <-done:
+				return
+			}
+			if mod != nil {
+				filtered := hs.filter(mod)
+				mr.watch.filter(mod, filtered)
+				if filtered == nil {
+					mr.Log.NoticeAs("debug", "content unchanged, ignored: %s", changeSummary(mod))
+					continue
+				}
+				mod = filtered
+			}
+			select {
+			case ret <- mod:
+			case <-done:
+				return
+			}
+			if mod == nil {
+				return
+			}
+		}
+	}()
+	return ret
+}
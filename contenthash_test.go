@@ -0,0 +1,98 @@
+package modd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestContentHashesFilter(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, f := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(f, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hs := contentHashes{}
+	hs.seed(".", []conf.Block{{Include: []string{"*"}}})
+	if len(hs) != 2 {
+		t.Fatalf("Expected 2 seeded hashes, got %d", len(hs))
+	}
+
+	// A touch leaves the content alone
+	now := time.Now().Add(time.Second)
+	os.Chtimes("a", now, now)
+	if mod := hs.filter(&moddwatch.Mod{Changed: []string{"a"}}); mod != nil {
+		t.Errorf("Expected a touch to be ignored, got %#v", mod)
+	}
+
+	ioutil.WriteFile("a", []byte("changed"), 0644)
+	ioutil.WriteFile("c", []byte("new"), 0644)
+	mod := hs.filter(&moddwatch.Mod{Changed: []string{"a", "b"}, Added: []string{"c"}})
+	expected := &moddwatch.Mod{Changed: []string{"a"}, Added: []string{"c"}}
+	if !reflect.DeepEqual(mod, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, mod)
+	}
+	if mod := hs.filter(&moddwatch.Mod{Changed: []string{"a", "c"}}); mod != nil {
+		t.Errorf("Expected repeated changes to be ignored, got %#v", mod)
+	}
+
+	// Deleted files are always passed on, and a file recreated with the
+	// same content counts as a change
+	os.Remove("b")
+	if mod := hs.filter(&moddwatch.Mod{Deleted: []string{"b"}}); mod == nil {
+		t.Errorf("Expected deletion to be passed on")
+	}
+	ioutil.WriteFile("b", []byte("b"), 0644)
+	if mod := hs.filter(&moddwatch.Mod{Added: []string{"b"}}); mod == nil {
+		t.Errorf("Expected a recreated file to be passed on")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	if err := ioutil.WriteFile("a", []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +onchange: echo ":cycle:" @mods
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, ContentHash: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	expected := []string{":cycle: ./a", ":cycle: ./b"}
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		now := time.Now().Add(time.Second)
+		os.Chtimes("a", now, now)
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		ioutil.WriteFile("a", []byte("two"), 0644)
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, expected[0])
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		ioutil.WriteFile("b", []byte("new"), 0644)
+		modchan <- &moddwatch.Mod{Added: []string{"b"}}
+		waitFor(t, lt, expected[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
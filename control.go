@@ -0,0 +1,153 @@
+package modd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cortesi/modd/shell"
+)
+
+// DefaultControlSocket is the control socket used by --detach and modd attach
+// when no other is given
+const DefaultControlSocket = ".modd.sock"
+
+// DetachedEnv is set in the environment of a modd started by Detach, which
+// unsets it once it's running
+const DetachedEnv = "MODD_DETACHED"
+
+// AttachLines is the number of recent lines of modd's output replayed to a
+// client when it attaches. Fewer are kept if shell.MaxCaptureLines or
+// shell.MaxCaptureBytes is lower.
+var AttachLines = 200
+
+// controlWriteTimeout is how long a write to an attached client may block
+// before the client is dropped, so that a stalled client can't hold up the log
+const controlWriteTimeout = time.Second
+
+// A ControlServer lets clients attach to a running modd over a Unix socket.
+// It's an io.Writer to be set as the log output: everything written to it is
+// written to its underlying output, and sent to each attached client. Clients
+// send single-key commands and command lines back, as for Interactive.
+type ControlServer struct {
+	path   string
+	out    io.Writer
+	l      net.Listener
+	recent *shell.CaptureBuffer
+	conns  map[net.Conn]bool
+	sync.Mutex
+}
+
+// ListenControl listens for clients on the Unix socket at path, passing
+// their commands to mr. Output is written through to out. Pressing the quit
+// key in a client shuts down daemons and then calls quit. A socket left
+// behind by a modd that's no longer running is replaced, but it's an error
+// for another modd to be listening at path.
+func (mr *ModRunner) ListenControl(path string, out io.Writer, quit func()) (*ControlServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("another modd is already listening at %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	cs := &ControlServer{
+		path:   path,
+		out:    out,
+		l:      l,
+		recent: shell.NewCaptureBuffer(AttachLines),
+		conns:  map[net.Conn]bool{},
+	}
+	go cs.serve(mr, quit)
+	return cs, nil
+}
+
+func (cs *ControlServer) serve(mr *ModRunner, quit func()) {
+	for {
+		c, err := cs.l.Accept()
+		if err != nil {
+			return
+		}
+		cs.Lock()
+		cs.conns[c] = true
+		cs.send(c, cs.recent.String())
+		cs.send(c, interactiveHelp+", ctrl-d - detach\n")
+		cs.Unlock()
+		go func() {
+			if err := mr.readKeys(c, quit); err != nil {
+				mr.Log.NoticeAs("debug", "control client: %s", err)
+			}
+			cs.drop(c)
+		}()
+	}
+}
+
+// send writes s to the client c, and drops it if that fails. The lock must
+// be held.
+func (cs *ControlServer) send(c net.Conn, s string) {
+	c.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	if _, err := io.WriteString(c, s); err != nil {
+		delete(cs.conns, c)
+		c.Close()
+	}
+}
+
+func (cs *ControlServer) drop(c net.Conn) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.conns, c)
+	c.Close()
+}
+
+// Write writes p to the underlying output and to each attached client
+func (cs *ControlServer) Write(p []byte) (int, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.recent.Write(p)
+	for c := range cs.conns {
+		cs.send(c, string(p))
+	}
+	return cs.out.Write(p)
+}
+
+// Path returns the path of the control socket
+func (cs *ControlServer) Path() string {
+	return cs.path
+}
+
+// Close stops listening, disconnects attached clients, and removes the socket
+func (cs *ControlServer) Close() error {
+	if cs == nil {
+		return nil
+	}
+	err := cs.l.Close()
+	cs.Lock()
+	defer cs.Unlock()
+	for c := range cs.conns {
+		c.Close()
+	}
+	cs.conns = map[net.Conn]bool{}
+	return err
+}
+
+// DialControl connects to the modd listening on the control socket at path.
+// It's an error if no modd is listening there.
+func DialControl(path string) (net.Conn, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		if _, serr := os.Stat(path); serr != nil {
+			return nil, fmt.Errorf("no modd is running with a control socket at %s", path)
+		}
+		return nil, fmt.Errorf("no modd is listening at %s, it may have exited: %s", path, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,138 @@
+// +build !windows
+
+package modd
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+// readUntil reads lines from c until one contains s, and returns them
+func readUntil(t *testing.T, c net.Conn, s string) string {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	var read []string
+	br := bufio.NewReader(c)
+	for {
+		l, err := br.ReadString('\n')
+		read = append(read, l)
+		if strings.Contains(l, s) {
+			return strings.Join(read, "")
+		}
+		if err != nil {
+			t.Fatalf("Expected %q, got %q: %s", s, strings.Join(read, ""), err)
+		}
+	}
+}
+
+func TestControlServer(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log}
+	out := &bytes.Buffer{}
+	quit := make(chan bool, 1)
+	cs, err := mr.ListenControl("modd.sock", out, func() { quit <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	if _, err := mr.ListenControl("modd.sock", out, func() {}); err == nil {
+		t.Errorf("Expected an error listening on a socket that's in use")
+	}
+	cs.Write([]byte("before\n"))
+
+	c, err := DialControl("modd.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Recent output is replayed, followed by the keys
+	if ret := readUntil(t, c, "keys:"); !strings.HasPrefix(ret, "before\n") {
+		t.Errorf("Expected recent output to be replayed, got %q", ret)
+	}
+	cs.Write([]byte("after\n"))
+	readUntil(t, c, "after")
+	if out.String() != "before\nafter\n" {
+		t.Errorf("Expected output to be written through, got %q", out.String())
+	}
+
+	// Commands are run to the end of the line, and pausing twice over the
+	// socket leaves modd paused
+	waitPaused := func(paused bool) {
+		start := time.Now()
+		for mr.Paused() != paused {
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for paused to be %v", paused)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	c.Write([]byte(":pause\n:pause\n"))
+	waitPaused(true)
+	c.Write([]byte(":resume\n"))
+	waitPaused(false)
+	if n := strings.Count(lt.String(), ">> paused"); n != 1 {
+		t.Errorf("Expected to pause once, got %d:\n%s", n, lt.String())
+	}
+
+	c.Write([]byte("q"))
+	select {
+	case <-quit:
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the quit key")
+	}
+	if !strings.Contains(lt.String(), ">> quitting") {
+		t.Errorf("Expected keys from the client to be acted on, got:\n%s", lt.String())
+	}
+}
+
+func TestControlStale(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	if _, err := DialControl("modd.sock"); err == nil || !strings.Contains(err.Error(), "no modd is running") {
+		t.Errorf("Expected an error without a running modd, got %v", err)
+	}
+	// A socket file left behind by a modd that's gone
+	if err := ioutil.WriteFile("modd.sock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialControl("modd.sock"); err == nil || !strings.Contains(err.Error(), "may have exited") {
+		t.Errorf("Expected an error for a stale socket, got %v", err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log}
+	cs, err := mr.ListenControl("modd.sock", ioutil.Discard, func() {})
+	if err != nil {
+		t.Fatalf("Expected a stale socket to be replaced, got %s", err)
+	}
+	cs.Close()
+}
+
+func TestControlReplayLimit(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	defer func(l, b int) { shell.MaxCaptureLines, shell.MaxCaptureBytes = l, b }(shell.MaxCaptureLines, shell.MaxCaptureBytes)
+	shell.MaxCaptureLines = 2
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log}
+	cs, err := mr.ListenControl("modd.sock", ioutil.Discard, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	cs.Write([]byte("one\ntwo\nthree\n"))
+	c, err := DialControl("modd.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ret := readUntil(t, c, "keys:"); !strings.HasPrefix(ret, "two\nthree\nkeys:") {
+		t.Errorf("Expected replayed output to be bounded by the capture limit, got %q", ret)
+	}
+}
@@ -0,0 +1,191 @@
+package modd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/termlog"
+)
+
+// BlockResult is the outcome of a block run during a cycle
+type BlockResult struct {
+	// Name identifies the block in messages, and is its label if it has one
+	Name  string
+	Label string
+	// Err is the error that stopped the block, or nil if it passed
+	Err error
+	// NonFatal holds the failures of preps with the ContinueOnError flag,
+	// which didn't stop the block
+	NonFatal []error
+	// Duration is how long the block took to run
+	Duration time.Duration
+	// Restarted is the number of daemons the block restarted
+	Restarted int
+}
+
+// CycleResult collects the outcomes of the blocks run in a single cycle.
+// Blocks without matching changes don't run, and aren't included.
+type CycleResult struct {
+	Start    time.Time
+	Duration time.Duration
+	Blocks   []BlockResult
+}
+
+// Failed returns the names of the blocks that failed
+func (c *CycleResult) Failed() []string {
+	var ret []string
+	for _, b := range c.Blocks {
+		if b.Err != nil {
+			ret = append(ret, b.Name)
+		}
+	}
+	return ret
+}
+
+// Warned returns the names of the blocks that passed, but had non-fatal prep
+// failures
+func (c *CycleResult) Warned() []string {
+	var ret []string
+	for _, b := range c.Blocks {
+		if b.Err == nil && len(b.NonFatal) > 0 {
+			ret = append(ret, b.Name)
+		}
+	}
+	return ret
+}
+
+func (c *CycleResult) String() string {
+	failed := c.Failed()
+	warned := c.Warned()
+	if len(failed) == 0 && len(warned) == 0 {
+		return fmt.Sprintf("%d of %d blocks passed", len(c.Blocks), len(c.Blocks))
+	}
+	var parts []string
+	if len(failed) > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"%d of %d blocks failed: %s", len(failed), len(c.Blocks), strings.Join(failed, ", "),
+		))
+	}
+	if len(warned) > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"%d of %d blocks had non-fatal failures: %s",
+			len(warned), len(c.Blocks), strings.Join(warned, ", "),
+		))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// LastCycle returns the result of the last completed cycle, or nil if no
+// cycle has completed. If a cycle is in progress, it waits for it to finish.
+func (mr *ModRunner) LastCycle() *CycleResult {
+	mr.Lock()
+	defer mr.Unlock()
+	return mr.lastCycle
+}
+
+// endCycle records the result of a cycle, reports any failures, and writes
+// the summary file if there is one. The lock must be held.
+func (mr *ModRunner) endCycle(result *CycleResult, dworld *DaemonWorld) {
+	result.Duration = time.Since(result.Start)
+	mr.lastCycle = result
+	if mr.SummaryFile != "" {
+		mr.writeSummary(result, dworld)
+	}
+	if len(result.Failed()) > 0 {
+		mr.Log.Say("%s", failingBanner(">> %s", result))
+	} else if len(result.Warned()) > 0 {
+		mr.Log.Warn(">> %s", result)
+	}
+}
+
+// Restarted returns the number of daemons restarted during the cycle
+func (c *CycleResult) Restarted() int {
+	n := 0
+	for _, b := range c.Blocks {
+		n += b.Restarted
+	}
+	return n
+}
+
+// notifyCycle calls the OnCycle callbacks with result. Panics in callbacks
+// are recovered and logged.
+func (mr *ModRunner) notifyCycle(result *CycleResult) {
+	if result == nil {
+		return
+	}
+	for _, f := range mr.cycleHooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					mr.Log.Shout("cycle callback panicked: %v", r)
+				}
+			}()
+			f(*result)
+		}()
+	}
+}
+
+// cycleStats summarises a single cycle. It counts preps as their end events
+// are emitted.
+type cycleStats struct {
+	start    time.Time
+	preps    int
+	failures int
+	daemons  int
+	sync.Mutex
+}
+
+func (s *cycleStats) Event(e Event) {
+	if e.Type != EventPrepEnd {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.preps++
+	if e.ExitCode != 0 || e.Error != "" {
+		s.failures++
+	}
+}
+
+// environ returns the summary as NAME=value pairs
+func (s *cycleStats) environ(d time.Duration) []string {
+	s.Lock()
+	defer s.Unlock()
+	return []string{
+		"MODD_PREPS=" + strconv.Itoa(s.preps),
+		"MODD_FAILURES=" + strconv.Itoa(s.failures),
+		"MODD_DAEMONS_RESTARTED=" + strconv.Itoa(s.daemons),
+		fmt.Sprintf("MODD_DURATION=%.3f", d.Seconds()),
+	}
+}
+
+// cycleEnd runs the oncycleend command in the background, with the summary of
+// the cycle added to the global environment
+func (mr *ModRunner) cycleEnd(stats *cycleStats, envs *envCache, log termlog.TermLog) {
+	duration := time.Since(stats.start)
+	sh, err := shell.GetShellName(mr.Config.ShellName())
+	if err != nil {
+		log.Shout("Error running oncycleend: %s", err)
+		return
+	}
+	env, err := envs.resolve(mr.Config.Env, sh, "")
+	if err != nil {
+		log.Shout("Error running oncycleend: %s", err)
+		return
+	}
+	opts := procOptions{
+		env:  append(env, stats.environ(duration)...),
+		mask: maskPattern(mr.Config.Mask),
+	}
+	cmd := mr.Config.OnCycleEnd
+	go func() {
+		_, err := runProc(cmd, sh, "", opts, log.Stream(niceHeader("oncycleend: ", cmd)))
+		if err != nil {
+			log.Warn(">> oncycleend failed: %s", err)
+		}
+	}()
+}
@@ -1,19 +1,32 @@
 package modd
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cortesi/modd/conf"
 	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/modd/varcmd"
+	"github.com/cortesi/moddwatch"
 	"github.com/cortesi/termlog"
+	"golang.org/x/text/encoding"
 )
 
 const (
-	// MinRestart is the minimum amount of time between daemon restarts
+	// MinRestart is the minimum amount of time between daemon restarts. Restart
+	// requests made within this period of a restart still in progress are
+	// coalesced into it.
 	MinRestart = 500 * time.Millisecond
 	// MulRestart is the exponential backoff multiplier applied when the daemon exits uncleanly
 	MulRestart = 2
@@ -21,6 +34,58 @@ const (
 	MaxRestart = 8 * time.Second
 )
 
+// HistoryLength is the number of past runs retained for each daemon
+var HistoryLength = 20
+
+// RunRecord describes a single completed run of a daemon process
+type RunRecord struct {
+	Start time.Time
+	End   time.Time
+	// ExitCode is the exit code of the process, or -1 if it could not be
+	// started or was terminated by a signal
+	ExitCode int
+	// Reason the run ended: "exited" if the process exited of its own accord,
+	// "restart" or "shutdown" if modd stopped it, "periodic" or "silence" if
+	// it was restarted by a timer or the silence watchdog, "binary" if its
+	// executable changed, "memory" if it went over its memory limit,
+	// "readiness-timeout" if it didn't become ready in time, "stop" if it was
+	// stopped on its own with StopDaemon, and "error" if the process could
+	// not be run
+	Reason string
+}
+
+// The reason recorded for a run that was stopped because it didn't become
+// ready within its readiness timeout
+const readinessTimeout = "readiness-timeout"
+
+// DaemonStatus is a snapshot of the state of a daemon
+type DaemonStatus struct {
+	Command string
+	Running bool
+	// Disabled is true if the daemon's start condition did not hold
+	Disabled bool
+	// Ready is true if the current run has become ready. Unhealthy is true if
+	// its required onready hook failed.
+	Ready     bool
+	Unhealthy bool
+	// Failed is true if the last run didn't become ready in time. A failed
+	// daemon isn't restarted until it's next triggered.
+	Failed bool
+	// Waiting is true if the daemon's first start is held back until the
+	// daemons it's started after are ready
+	Waiting bool
+	// Held is true if the daemon was stopped with StopDaemon, and isn't
+	// restarted until it's started with StartDaemon
+	Held bool
+	// Start time and process ID of the current run, if the daemon is running
+	Started  time.Time
+	Pid      int
+	Restarts int
+	// Uptime is the cumulative time the daemon has spent running
+	Uptime  time.Duration
+	History []RunRecord
+}
+
 // A single daemon
 type daemon struct {
 	conf  conf.Daemon
@@ -29,23 +94,183 @@ type daemon struct {
 	ex    *shell.Executor
 	log   termlog.Stream
 	shell string
+	env   []conf.EnvVar
+	envs  *envCache
 	stop  bool
+
+	// Restricts the variables inherited from modd's environment
+	cleanEnv bool
+	passEnv  []string
+	// Collapses repeated output lines, if non-zero
+	collapse time.Duration
+	// Log the command line before each start
+	echo bool
+
+	// Log for the onready hook
+	readyLog termlog.Stream
+	// Character encoding of the output, if not UTF-8
+	encoding encoding.Encoding
+	// The byte output is split into lines on, if not newline
+	delimiter string
+
+	// Set if the daemon's start condition failed
+	disabled bool
+
+	// Lifecycle events are reported to events, tagged with the block label
+	events *eventBus
+	block  string
+
+	// Destinations for output lines, if not the log
+	stdout func(string, ...interface{})
+	stderr func(string, ...interface{})
+	// Called with each line of standard error, as well as logging it
+	onStderr func(string)
+	// Matches sensitive text that's masked in the output, if set
+	mask *regexp.Regexp
+
+	// Write end of the pipe held open on the process's stdin, if any
+	stdin *os.File
+	// The relay of modd's stdin to the daemon, if it's primary
+	relay *stdinRelay
+	// The daemons that must be ready before this daemon is first started
+	after []*daemon
+	// The pen the daemon belongs to, which restarts may be batched by
+	pen *DaemonPen
+	// A process left by an earlier instance of modd that's adopted on the
+	// first start, in place of starting a new one
+	adoption *SavedDaemon
+	// Sockets passed to the daemon's processes, opened on the first start
+	// and kept until shutdown
+	listeners []*listener
+
+	// Closed when the daemon is shut down, and when its run loop has exited
+	done   chan struct{}
+	exited chan struct{}
+	// Wakes the run loop of a failed daemon to start it again
+	retry chan struct{}
+
+	// Run state, protected by the mutex
+	started   time.Time
+	ready     bool
+	unhealthy bool
+	failed    bool
+	starts    int
+	uptime    time.Duration
+	reason    string
+	history   []RunRecord
+	// Set while a restart is in progress, from the time the signal is sent
+	// until a new process has started
+	restarting bool
+	signalled  time.Time
+	// Set while a draining daemon is given time to exit after its restart
+	// signal
+	draining bool
+	// Set while the first start is held back until dependencies are ready
+	waiting bool
+	// Set while the daemon is stopped on its own, until it's started again
+	held bool
+	// Records each run as a span, if tracing is on
+	tracer *Tracer
+	// The most recent lines of output, for Tail
+	recent *shell.CaptureBuffer
 	sync.Mutex
 }
 
 func (d *daemon) Run() {
+	defer close(d.exited)
+	if d.conf.ProcName != "" && !shell.ProcNameSupported {
+		d.log.Notice(">> +procname is not supported on this platform, ignored")
+	}
+	if d.conf.Umask != "" && !shell.UmaskSupported {
+		d.log.Warn(">> +umask is not supported on this platform, ignored")
+	}
+	if len(d.conf.Listen) > 0 && !shell.ExtraFilesSupported {
+		d.log.Warn(">> +listen is not supported on this platform, ignored")
+	}
+	if d.conf.Fifo != "" {
+		p := d.path(d.conf.Fifo)
+		f, err := openFifo(p)
+		if err != nil {
+			d.log.Shout("could not create fifo: %s", err)
+		} else {
+			defer os.Remove(p)
+			defer f.Close()
+			go d.relayFifo(f)
+		}
+	}
+	if d.conf.PidFile != "" {
+		p := d.path(d.conf.PidFile)
+		d.Lock()
+		adopting := d.adoption != nil
+		d.Unlock()
+		if data, err := ioutil.ReadFile(p); err == nil && !adopting {
+			d.log.NoticeAs(
+				"debug", ">> replacing stale pidfile %s, pid %s", p, strings.TrimSpace(string(data)),
+			)
+		}
+	}
+	if d.relay != nil {
+		d.relay.attach(d)
+		defer d.relay.detach(d)
+	}
 	var lastStart time.Time
 	delay := MinRestart
-	for d.stop != true {
+	for !d.stopped() {
 		if delay > MinRestart {
 			d.log.Notice(">> restart backoff... %dms", delay/time.Millisecond)
 		}
 		if !lastStart.IsZero() {
-			time.Sleep(delay)
+			// Don't start a new process if we're shut down during the backoff
+			select {
+			case <-time.After(delay):
+			case <-d.done:
+				return
+			}
+		}
+		if d.stopped() || !d.awaitRetry() {
+			return
+		}
+		var err error
+		var pstate *shell.ExecState
+		span := d.tracer.startDaemon()
+		if sd := d.takeAdoption(); sd != nil {
+			d.log.Notice(">> adopting pid %d, left running by an earlier modd", sd.Pid)
+			lastStart = sd.Started
+			if lastStart.IsZero() {
+				lastStart = time.Now()
+			}
+			d.setStarted(lastStart)
+			d.events.emit(Event{Type: EventDaemonStart, Block: d.block, Command: d.conf.Command})
+			err, pstate = d.adopted(sd)
+		} else {
+			d.log.Notice(">> starting...")
+			lastStart = time.Now()
+			d.setStarted(lastStart)
+			d.events.emit(Event{Type: EventDaemonStart, Block: d.block, Command: d.conf.Command})
+			err, pstate = d.run()
+		}
+		d.removePidFile()
+		rec := d.record(lastStart, time.Now(), err, pstate)
+		stop := Event{
+			Type:     EventDaemonStop,
+			Block:    d.block,
+			Command:  d.conf.Command,
+			ExitCode: rec.ExitCode,
+			Reason:   rec.Reason,
+		}
+		if err != nil {
+			stop.Error = err.Error()
+		}
+		d.events.emit(stop)
+		if span != nil {
+			span.set("modd.block", d.block)
+			span.set("modd.command", d.conf.Command)
+			span.set("process.exit_code", rec.ExitCode)
+			span.set("modd.reason", rec.Reason)
+			span.set("modd.duration_ms", int(rec.End.Sub(rec.Start)/time.Millisecond))
+			span.fail(err)
+			span.finish()
 		}
-		d.log.Notice(">> starting...")
-		lastStart = time.Now()
-		err, pstate := d.ex.Run(d.log, false)
 
 		if err != nil {
 			d.log.Shout("execution error: %s", err)
@@ -60,65 +285,928 @@ func (d *daemon) Run() {
 		}
 
 		// If we exited cleanly, or the process ran for > MaxRestart, we reset
-		// the delay timer
-		if time.Now().Sub(lastStart) > MaxRestart {
+		// the delay timer. A run that never became ready counts as a crash,
+		// however long it took to give up on it.
+		ran := time.Now().Sub(lastStart)
+		if ran > MaxRestart && rec.Reason != readinessTimeout {
 			delay = MinRestart
+			d.log.NoticeAs("debug", ">> ran for %s, backoff reset to %s", ran, delay)
 		} else {
 			delay *= MulRestart
 			if delay > MaxRestart {
 				delay = MaxRestart
 			}
+			d.log.NoticeAs("debug", ">> ran for %s, backoff increased to %s", ran, delay)
+		}
+		if !d.awaitRetry() {
+			return
+		}
+	}
+}
+
+// awaitRetry waits for a failed daemon to be triggered again, or a held
+// daemon to be started, and returns immediately if the daemon is neither. It
+// returns false if the daemon is shut down first.
+func (d *daemon) awaitRetry() bool {
+	d.Lock()
+	failed, held := d.failed, d.held
+	d.Unlock()
+	if held {
+		d.log.Notice(">> stopped, not restarting until started")
+	} else if failed {
+		d.log.Notice(">> failed, not restarting until triggered")
+	}
+	for failed || held {
+		select {
+		case <-d.retry:
+		case <-d.done:
+			return false
+		}
+		d.Lock()
+		failed, held = d.failed, d.held
+		d.Unlock()
+	}
+	return true
+}
+
+// run resolves the daemon's environment and runs the process once
+func (d *daemon) run() (error, *shell.ExecState) {
+	env, err := d.envs.resolve(d.env, d.shell, d.indir)
+	if err != nil {
+		return err, nil
+	}
+	// Closed when this run of the daemon is over
+	exited := make(chan struct{})
+	defer close(exited)
+
+	var onOutput func()
+	if d.conf.Silence > 0 {
+		activity := make(chan struct{}, 1)
+		onOutput = func() {
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+		go d.watchSilence(activity, exited)
+	}
+	if d.conf.MaxMemory > 0 {
+		go d.watchMemory(exited)
+	}
+	var stdin *os.File
+	if d.conf.KeepStdin || d.conf.Fifo != "" || d.conf.Primary {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err, nil
+		}
+		defer r.Close()
+		defer d.closeStdin(w)
+		stdin = r
+		d.Lock()
+		d.stdin = w
+		d.Unlock()
+	}
+	d.Lock()
+	if stdin != nil {
+		d.ex.Stdin = stdin
+	}
+	if len(d.listeners) > 0 {
+		env = append(env[:len(env):len(env)], fmt.Sprintf("LISTEN_FDS=%d", len(d.listeners)))
+	}
+	d.ex.Env = env
+	d.ex.CleanEnv = d.cleanEnv
+	d.ex.PassEnv = d.passEnv
+	d.setOutput(onOutput)
+	ex := d.ex
+	d.Unlock()
+	if d.conf.ReadyPort > 0 || d.conf.OnReady != "" {
+		go d.awaitReady(env, exited)
+	}
+	go d.releaseOnStart(procs.acquire(true), exited)
+	if d.conf.PidFile != "" {
+		go d.writePidFile(ex, exited)
+	}
+	return ex.Run(d.log, false)
+}
+
+// setOutput routes the output of the daemon's process to where it's
+// configured to go. The lock must be held.
+func (d *daemon) setOutput(onOutput func()) {
+	d.ex.Stdout = d.stdout
+	d.ex.Stderr = d.stderr
+	if d.conf.Quiet {
+		d.ex.Stdout, d.ex.Stderr = discard, discard
+	}
+	d.ex.OnStderr = d.onStderr
+	d.ex.Mask = d.mask
+	d.ex.OnOutput = onOutput
+	d.ex.OnLine = d.recent.AddLine
+}
+
+// path resolves p, which is relative to the daemon's directory
+func (d *daemon) path(p string) string {
+	if d.indir != "" && !filepath.IsAbs(p) {
+		return filepath.Join(d.indir, p)
+	}
+	return p
+}
+
+// writePidFile writes the PID of the daemon's process to its pidfile once the
+// process has started, replacing whatever the file held
+func (d *daemon) writePidFile(ex *shell.Executor, exited chan struct{}) {
+	t := time.NewTicker(readyPoll / 10)
+	defer t.Stop()
+	pid := ex.Pid()
+	for pid == 0 {
+		select {
+		case <-t.C:
+		case <-exited:
+			return
+		}
+		pid = ex.Pid()
+	}
+	// The file is written under the lock, so that it can't be written after
+	// the run is over and removePidFile has removed it
+	d.Lock()
+	defer d.Unlock()
+	select {
+	case <-exited:
+		return
+	default:
+	}
+	err := writeAtomic(d.path(d.conf.PidFile), []byte(fmt.Sprintf("%d\n", pid)))
+	if err != nil {
+		d.log.Shout("could not write pidfile: %s", err)
+	}
+}
+
+// removePidFile removes the daemon's pidfile once a run is over, so that it
+// doesn't name a process that's gone while the daemon is stopped or waiting to
+// restart
+func (d *daemon) removePidFile() {
+	if d.conf.PidFile == "" {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	os.Remove(d.path(d.conf.PidFile))
+}
+
+// takeAdoption returns the process that the daemon adopts in place of
+// starting a new one, if any, and forgets it
+func (d *daemon) takeAdoption() *SavedDaemon {
+	d.Lock()
+	defer d.Unlock()
+	sd := d.adoption
+	d.adoption = nil
+	return sd
+}
+
+// adopted takes charge of a process left running by an earlier instance of
+// modd, and waits for it to exit. Its readiness is checked again, as though
+// it had just started. If the earlier modd passed on its output pipes, the
+// output is logged as usual.
+func (d *daemon) adopted(sd *SavedDaemon) (error, *shell.ExecState) {
+	exited := make(chan struct{})
+	defer close(exited)
+	if d.conf.ReadyPort > 0 || d.conf.OnReady != "" {
+		env, err := d.envs.resolve(d.env, d.shell, d.indir)
+		if err != nil {
+			return err, nil
+		}
+		go d.awaitReady(env, exited)
+	}
+	stdout, stderr := sd.output()
+	d.Lock()
+	d.setOutput(nil)
+	ex := d.ex
+	d.Unlock()
+	if d.conf.PidFile != "" {
+		go d.writePidFile(ex, exited)
+	}
+	return ex.Adopt(sd.Pid, d.log, stdout, stderr)
+}
+
+// discard is an output sink that drops lines
+func discard(string, ...interface{}) {}
+
+// pidPrefix formats the PID of a daemon process and its uptime, to prefix
+// lines of output
+func pidPrefix(pid int, start time.Time) string {
+	return fmt.Sprintf("[pid=%d +%s]", pid, time.Since(start).Round(100*time.Millisecond))
+}
+
+// closeStdin closes w if it's still held open on the daemon's stdin. If w is
+// nil, whatever pipe is held open is closed.
+func (d *daemon) closeStdin(w *os.File) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stdin != nil && (w == nil || w == d.stdin) {
+		d.stdin.Close()
+		d.stdin = nil
+	}
+}
+
+// relayFifo copies anything written to the daemon's FIFO to the standard input
+// of its current process, until f is closed. Input that arrives while no
+// process is running is discarded.
+func (d *daemon) relayFifo(f *os.File) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			d.Lock()
+			w := d.stdin
+			d.Unlock()
+			if w == nil {
+				d.log.NoticeAs("debug", ">> fifo input discarded, daemon not running")
+			} else {
+				w.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// watchSilence warns, or restarts the daemon, each time it goes for longer
+// than its configured silence period without producing output. It returns
+// when exited is closed.
+func (d *daemon) watchSilence(activity chan struct{}, exited chan struct{}) {
+	t := time.NewTimer(d.conf.Silence)
+	defer t.Stop()
+	for {
+		select {
+		case <-activity:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+			d.log.Warn(">> no output for %s", d.conf.Silence)
+			if d.conf.SilenceRestart {
+				d.restart("silence")
+			}
+		case <-exited:
+			return
+		}
+		t.Reset(d.conf.Silence)
+	}
+}
+
+// errNoMemorySampling is returned by groupMemory on platforms where memory use
+// can't be sampled
+var errNoMemorySampling = errors.New("memory sampling is unavailable")
+
+// DefaultMemoryInterval is how often a daemon's memory use is sampled, if it
+// has a limit but no interval is configured
+const DefaultMemoryInterval = 5 * time.Second
+
+// watchMemory samples the resident memory of the daemon's processes, and
+// restarts the daemon each time it's over the limit. It returns when exited
+// is closed.
+func (d *daemon) watchMemory(exited chan struct{}) {
+	interval := d.conf.MemoryInterval
+	if interval == 0 {
+		interval = DefaultMemoryInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-exited:
+			return
+		}
+		pid := d.ex.Pid()
+		if pid == 0 {
+			continue
+		}
+		rss, err := groupMemory(pid)
+		if err == errNoMemorySampling {
+			d.log.Warn(">> memory sampling is unavailable on this platform")
+			return
+		} else if err != nil {
+			d.log.NoticeAs("debug", ">> could not sample memory: %s", err)
+			continue
+		}
+		if rss > d.conf.MaxMemory {
+			d.log.Warn(">> using %d bytes of memory, over the limit of %d", rss, d.conf.MaxMemory)
+			d.restart("memory")
+		}
+	}
+}
+
+// readyPoll is the interval at which a starting daemon is checked for
+// readiness
+const readyPoll = 100 * time.Millisecond
+
+// awaitReady waits for the current run of the daemon to become ready, and
+// then runs its onready hook. It gives up if exited is closed first, and
+// stops the daemon if it has a readiness timeout that expires.
+func (d *daemon) awaitReady(env []string, exited chan struct{}) {
+	t := time.NewTicker(readyPoll)
+	defer t.Stop()
+	var deadline <-chan time.Time
+	if d.conf.ReadyTimeout > 0 {
+		timer := time.NewTimer(d.conf.ReadyTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var pid int
+	for {
+		if pid = d.ex.Pid(); pid != 0 && d.probe() {
+			break
+		}
+		select {
+		case <-t.C:
+		case <-deadline:
+			d.notReady()
+			return
+		case <-exited:
+			return
+		}
+	}
+	d.log.Notice(">> ready")
+	d.Lock()
+	d.ready = true
+	d.Unlock()
+	d.events.emit(Event{Type: EventDaemonReady, Block: d.block, Command: d.conf.Command})
+	if d.conf.OnReady == "" {
+		return
+	}
+
+	env = append(append([]string{}, env...), fmt.Sprintf("MODD_DAEMON_PID=%d", pid))
+	if d.conf.ReadyPort > 0 {
+		env = append(env, fmt.Sprintf("MODD_DAEMON_PORT=%d", d.conf.ReadyPort))
+	}
+	opts := procOptions{env: env, cleanEnv: d.cleanEnv, passEnv: d.passEnv, mask: d.mask}
+	_, err := runProc(d.conf.OnReady, d.shell, d.indir, opts, d.readyLog)
+	if err != nil {
+		d.log.Warn(">> onready hook failed: %s", err)
+		if d.conf.OnReadyRequired {
+			d.Lock()
+			d.unhealthy = true
+			d.Unlock()
+		}
+	}
+}
+
+// notReady stops the current run of the daemon, which didn't become ready
+// within its readiness timeout, and marks the daemon failed
+func (d *daemon) notReady() {
+	d.log.Shout(">> not ready after %s, stopping", d.conf.ReadyTimeout)
+	d.Lock()
+	d.reason = readinessTimeout
+	d.failed = true
+	d.Unlock()
+	if err := d.ex.Stop(); err != nil {
+		d.log.Warn("failed to stop %s: %v", d.conf.Command, err)
+	}
+}
+
+// probe checks whether the daemon is ready to accept work
+func (d *daemon) probe() bool {
+	if d.conf.ReadyPort == 0 {
+		return true
+	}
+	addr := net.JoinHostPort("localhost", strconv.Itoa(d.conf.ReadyPort))
+	conn, err := net.DialTimeout("tcp", addr, readyPoll)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (d *daemon) setStarted(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	d.starts++
+	d.started = t
+	d.ready = false
+	d.unhealthy = false
+	d.restarting = false
+}
+
+// record adds a completed run to the daemon's history, and returns the new
+// record
+func (d *daemon) record(start time.Time, end time.Time, err error, pstate *shell.ExecState) RunRecord {
+	d.Lock()
+	defer d.Unlock()
+	rec := RunRecord{Start: start, End: end, ExitCode: -1, Reason: d.reason}
+	if err == nil && pstate != nil {
+		rec.ExitCode = pstate.ExitCode
+	}
+	if rec.Reason == "" {
+		if err != nil {
+			rec.Reason = "error"
+		} else {
+			rec.Reason = "exited"
 		}
 	}
+	d.reason = ""
+	d.started = time.Time{}
+	d.ready = false
+	d.uptime += end.Sub(start)
+	d.history = append(d.history, rec)
+	if len(d.history) > HistoryLength {
+		d.history = d.history[len(d.history)-HistoryLength:]
+	}
+	return rec
+}
+
+// Status returns a snapshot of the daemon's state
+func (d *daemon) Status() DaemonStatus {
+	d.Lock()
+	defer d.Unlock()
+	st := DaemonStatus{
+		Command:  d.conf.Command,
+		Running:  !d.started.IsZero(),
+		Disabled: d.disabled,
+		Ready:    d.ready,
+		Started:  d.started,
+		Uptime:   d.uptime,
+		History:  make([]RunRecord, len(d.history)),
+	}
+	st.Unhealthy = d.unhealthy
+	st.Failed = d.failed
+	st.Waiting = d.waiting
+	st.Held = d.held
+	if st.Running && d.ex != nil {
+		st.Pid = d.ex.Pid()
+	}
+	if d.starts > 1 {
+		st.Restarts = d.starts - 1
+	}
+	copy(st.History, d.history)
+	if st.Running {
+		st.Uptime += time.Since(d.started)
+	}
+	return st
 }
 
 // Restart the daemon, or start it if it's not yet running
 func (d *daemon) Restart() {
+	d.restart("restart")
+}
+
+// Start starts the daemon if it's not yet running, and otherwise leaves it
+// alone. It reports whether the daemon was started.
+func (d *daemon) Start() bool {
+	d.Lock()
+	started := d.ex != nil
+	d.Unlock()
+	if !started {
+		d.restart("restart")
+	}
+	return !started
+}
+
+// restartEvery restarts the daemon at the interval specified in its
+// configuration, until it is shut down.
+func (d *daemon) restartEvery() {
+	t := time.NewTicker(d.conf.RestartEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.log.Notice(">> periodic restart")
+			d.restart("periodic")
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// binarySettle is how long the daemon's executable must go unchanged after a
+// write before the daemon is restarted, so that it isn't run half-written
+const binarySettle = 500 * time.Millisecond
+
+// binaryPath resolves the executable run by the daemon's command
+func (d *daemon) binaryPath() (string, error) {
+	fields := strings.Fields(d.conf.Command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	name := fields[0]
+	if d.indir != "" && strings.ContainsRune(name, filepath.Separator) && !filepath.IsAbs(name) {
+		name = filepath.Join(d.indir, name)
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(p)
+}
+
+// watchBinary restarts the daemon each time its executable is modified, once
+// the file has settled, until the daemon is shut down.
+func (d *daemon) watchBinary() {
+	p, err := d.binaryPath()
+	if err != nil {
+		d.log.Warn(">> can't watch binary: %s", err)
+		return
+	}
+	modchan := make(chan *moddwatch.Mod, 16)
+	watcher, err := moddwatch.Watch(
+		filepath.Dir(p), []string{filepath.Base(p)}, nil, lullTime, modchan,
+	)
+	if err != nil {
+		d.log.Warn(">> can't watch binary: %s", err)
+		return
+	}
+	defer watcher.Stop()
+	d.log.NoticeAs("debug", ">> watching binary %s", p)
+	for {
+		select {
+		case <-modchan:
+			if !d.settle(p) {
+				return
+			}
+			d.log.Notice(">> binary changed")
+			if d.pen != nil {
+				d.pen.requestRestart(d, "binary")
+			} else {
+				d.restart("binary")
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// settle waits until the file at p exists and hasn't changed for
+// binarySettle. It returns false if the daemon is shut down first.
+func (d *daemon) settle(p string) bool {
+	last, _ := os.Stat(p)
+	for {
+		select {
+		case <-time.After(binarySettle):
+		case <-d.done:
+			return false
+		}
+		st, err := os.Stat(p)
+		if err == nil && last != nil && st.Size() == last.Size() && st.ModTime().Equal(last.ModTime()) {
+			return true
+		}
+		last = st
+	}
+}
+
+// restart restarts the daemon, recording reason as the cause of the exit of
+// the current process.
+func (d *daemon) restart(reason string) {
 	d.Lock()
 	defer d.Unlock()
+	if d.stop {
+		d.log.NoticeAs("debug", ">> not restarting, daemon is shut down")
+		return
+	} else if d.disabled {
+		d.log.NoticeAs("debug", ">> not restarting, daemon is disabled")
+		return
+	} else if d.held {
+		d.log.NoticeAs("debug", ">> not restarting, daemon is stopped")
+		return
+	} else if d.failed {
+		d.failed = false
+		select {
+		case d.retry <- struct{}{}:
+		default:
+		}
+		return
+	} else if d.restarting && time.Since(d.signalled) < MinRestart {
+		d.log.NoticeAs("debug", ">> not restarting, restart already in progress")
+		return
+	} else if d.draining {
+		d.log.NoticeAs("debug", ">> not restarting, waiting for the daemon to drain")
+		return
+	}
 	if d.ex == nil {
+		if d.waiting {
+			return
+		} else if !d.depsReady() {
+			d.waiting = true
+			go d.awaitDeps(reason)
+			return
+		}
+		if d.conf.When != nil {
+			ok, err := d.check(d.conf.When)
+			if err != nil {
+				d.log.Shout("Could not evaluate condition: %s", err)
+			}
+			if !ok {
+				d.log.Notice(">> disabled: condition not met")
+				d.disabled = true
+				return
+			}
+		}
+		if len(d.conf.Listen) > 0 && d.listeners == nil && shell.ExtraFilesSupported {
+			ls, err := listen(d.conf.Listen, d.indir)
+			if err != nil {
+				d.log.Shout("%s", err)
+				return
+			}
+			d.listeners = ls
+		}
 		ex, err := shell.NewExecutor(d.shell, d.conf.Command, d.indir)
 		if err != nil {
 			d.log.Shout("Could not create executor: %s", err)
+			return
+		}
+		ex.ExtraFiles = listenerFiles(d.listeners)
+		ex.Encoding = d.encoding
+		ex.Delimiter = d.delimiter
+		ex.Umask = d.conf.Umask
+		ex.User = d.conf.User
+		ex.Group = d.conf.Group
+		ex.Collapse = d.collapse
+		ex.Echo = d.echo
+		ex.ProcName = d.conf.ProcName
+		if d.conf.PidPrefix {
+			ex.Prefix = pidPrefix
+		}
+		ex.QueueSize = d.conf.Buffer
+		ex.Overflow = shell.Overflow(d.conf.Overflow)
+		if ex.Overflow != "" && ex.QueueSize == 0 {
+			ex.QueueSize = shell.DefaultQueueSize
 		}
 		d.ex = ex
+		d.restarting = true
+		d.signalled = time.Now()
 		go d.Run()
+		if d.conf.RestartEvery > 0 {
+			go d.restartEvery()
+		}
+		if d.conf.WatchBinary {
+			go d.watchBinary()
+		}
 	} else {
+		d.reason = reason
+		d.restarting = true
+		d.signalled = time.Now()
 		d.log.Notice(">> sending signal %s", d.conf.RestartSignal)
 		err := d.ex.Signal(d.conf.RestartSignal)
 		if err != nil {
 			d.log.Warn(
 				"failed to send %s signal to %s: %v", d.conf.RestartSignal, d.conf.Command, err,
 			)
+		} else if d.conf.Drain {
+			d.draining = true
+			go d.awaitDrain(d.ex, d.ex.Exited())
+		}
+	}
+}
+
+// awaitDrain waits for a draining daemon to exit on its own after its restart
+// signal, and stops it with the signals of shell.DefaultLadder if it's still
+// running once its drain timeout has passed. exited is closed when the signalled process
+// exits.
+func (d *daemon) awaitDrain(ex *shell.Executor, exited <-chan struct{}) {
+	defer func() {
+		d.Lock()
+		d.draining = false
+		d.Unlock()
+	}()
+	timeout := d.conf.DrainTimeout
+	if timeout == 0 {
+		timeout = conf.DefaultDrainTimeout
+	}
+	d.log.Notice(">> waiting up to %s for the daemon to drain", timeout)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-exited:
+		d.log.NoticeAs("debug", ">> drained")
+	case <-t.C:
+		d.log.Warn(">> not drained after %s, stopping", timeout)
+		ex.Terminate(nil)
+	case <-d.done:
+	}
+}
+
+// halt gracefully stops the daemon, sending the signals of
+// shell.DefaultLadder in turn, and holds it stopped until it's resumed. It
+// returns once the process has exited and its output is drained.
+func (d *daemon) halt() {
+	d.Lock()
+	if d.held {
+		d.Unlock()
+		return
+	}
+	d.held = true
+	ex := d.ex
+	running := !d.started.IsZero()
+	if running {
+		d.reason = "stop"
+	}
+	d.Unlock()
+	if running {
+		d.log.Notice(">> stopping")
+		ex.Terminate(nil)
+	}
+}
+
+// resume starts a daemon held stopped by halt
+func (d *daemon) resume() {
+	d.Lock()
+	if !d.held {
+		d.Unlock()
+		return
+	}
+	d.held, d.failed = false, false
+	started := d.ex != nil
+	select {
+	case d.retry <- struct{}{}:
+	default:
+	}
+	d.Unlock()
+	if !started {
+		d.restart("restart")
+	}
+}
+
+// isReady reports whether the daemon is running and ready. Daemons without a
+// readiness probe or onready hook are ready once started.
+func (d *daemon) isReady() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.started.IsZero() || d.failed {
+		return false
+	}
+	return d.ready || (d.conf.ReadyPort == 0 && d.conf.OnReady == "")
+}
+
+// depsReady reports whether all the daemons this daemon is started after are
+// ready
+func (d *daemon) depsReady() bool {
+	for _, dep := range d.after {
+		if !dep.isReady() {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitDeps waits until the daemon's dependencies are ready, and then starts
+// it. It gives up if the daemon is shut down first.
+func (d *daemon) awaitDeps(reason string) {
+	names := make([]string, len(d.after))
+	for i, dep := range d.after {
+		names[i] = dep.conf.Name()
+	}
+	d.log.Notice(">> waiting for %s", strings.Join(names, ", "))
+	t := time.NewTicker(readyPoll)
+	defer t.Stop()
+	for !d.depsReady() {
+		select {
+		case <-t.C:
+		case <-d.done:
+			return
 		}
 	}
+	d.Lock()
+	d.waiting = false
+	d.Unlock()
+	d.restart(reason)
+}
+
+// check evaluates a start condition for the daemon. Commands are run in the
+// daemon's directory and environment, with their output discarded.
+func (d *daemon) check(c *conf.Condition) (bool, error) {
+	if c.Command == "" {
+		return (os.Getenv(c.Name) == c.Value) != c.Negate, nil
+	}
+	env, err := d.envs.resolve(d.env, d.shell, d.indir)
+	if err != nil {
+		return false, err
+	}
+	ex, err := shell.NewExecutor(d.shell, c.Command, d.indir)
+	if err != nil {
+		return false, err
+	}
+	ex.Env = env
+	ex.CleanEnv = d.cleanEnv
+	ex.PassEnv = d.passEnv
+	quiet := termlog.NewLog()
+	quiet.Quiet()
+	err, estate := ex.Run(quiet.Stream(""), false)
+	if err != nil {
+		return false, err
+	}
+	return estate.Error == nil, nil
+}
+
+// Restart all daemons, or start them if they're not running yet
+func (dw *DaemonWorld) Restart() {
+	for _, dp := range dw.DaemonPens {
+		dp.Restart()
+	}
+}
+
+// Resize forwards a terminal resize to the daemon, if it has opted in
+func (d *daemon) Resize() {
+	d.Lock()
+	defer d.Unlock()
+	if d.conf.ResizeSignal == nil || d.ex == nil || !d.ex.Running() {
+		return
+	}
+	err := d.ex.Signal(d.conf.ResizeSignal)
+	if err != nil {
+		d.log.Warn(
+			"failed to send %s signal to %s: %v", d.conf.ResizeSignal, d.conf.Command, err,
+		)
+	}
 }
 
 func (d *daemon) Shutdown(sig os.Signal) error {
 	d.log.Notice(">> stopping")
+	d.Lock()
+	d.reason = "shutdown"
+	if !d.stop {
+		close(d.done)
+	}
 	d.stop = true
-	if d.ex != nil {
-		return d.ex.Stop()
+	ex := d.ex
+	d.Unlock()
+	// Let daemons waiting on stdin notice the shutdown
+	d.closeStdin(nil)
+	if ex != nil {
+		return ex.Stop()
 	}
 	return nil
 }
 
+// closeListeners closes the sockets passed to the daemon, once it's shut down
+func (d *daemon) closeListeners() {
+	d.Lock()
+	defer d.Unlock()
+	closeListeners(d.listeners)
+	d.listeners = nil
+}
+
+func (d *daemon) stopped() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.stop
+}
+
+// wait blocks until the daemon's run loop has exited after a shutdown. It
+// returns immediately if the daemon was never started.
+func (d *daemon) wait() {
+	d.Lock()
+	started := d.ex != nil
+	d.Unlock()
+	if started {
+		<-d.exited
+	}
+}
+
 // DaemonPen is a group of daemons in a single block, managed as a unit.
 type DaemonPen struct {
 	daemons []*daemon
+	// Indices of the daemons in the order they're started
+	order []int
+	// Restarts waiting to be applied together, if the block batches them
+	batch restartBatch
 	sync.Mutex
 }
 
 // NewDaemonPen creates a new DaemonPen
 func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog) (*DaemonPen, error) {
+	return newDaemonPen(block, vars, log, &envCache{}, nil, nil)
+}
+
+// newDaemonPen is like NewDaemonPen, with additional context. Colors gives the
+// palette index of each daemon's header, keyed by daemonKey. If it's nil,
+// colours are assigned among the daemons of the block.
+func newDaemonPen(
+	block conf.Block,
+	vars map[string]string,
+	log termlog.TermLog,
+	envs *envCache,
+	events *eventBus,
+	colors map[string]int,
+) (*DaemonPen, error) {
+	if colors == nil {
+		colors = blockColors([]conf.Block{block})
+	}
 	d := make([]*daemon, len(block.Daemons))
+	mask := maskPattern(block.Mask)
 	for i, dmn := range block.Daemons {
+		hue := colors[daemonKey(dmn)]
 		vcmd := varcmd.VarCmd{Block: nil, Modified: nil, Vars: vars}
 		finalcmd, err := vcmd.Render(dmn.Command)
 		if err != nil {
 			return nil, err
 		}
 		dmn.Command = finalcmd
+		if dmn.OnReady != "" {
+			dmn.OnReady, err = vcmd.Render(dmn.OnReady)
+			if err != nil {
+				return nil, err
+			}
+		}
 		var indir string
 		if block.InDir != "" {
 			indir = block.InDir
@@ -128,60 +1216,341 @@ func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog)
 				return nil, err
 			}
 		}
-		sh, err := shell.GetShellName(vars[shellVarName])
+		sh, err := shell.GetShellName(blockShell(block, vars))
 		if err != nil {
 			return nil, err
 		}
+		var enc encoding.Encoding
+		if block.Encoding != "" {
+			enc, err = shell.LookupEncoding(block.Encoding)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		d[i] = &daemon{
-			conf:  dmn,
-			log:   log.Stream(niceHeader("daemon: ", dmn.Command)),
-			shell: sh,
-			indir: indir,
+			conf:     dmn,
+			log:      log.Stream(colorHeader(hue, niceHeader("daemon: ", dmn.Command))),
+			readyLog: log.Stream(niceHeader("onready: ", dmn.OnReady)),
+			shell:    sh,
+			indir:    indir,
+			env:      block.Env,
+			cleanEnv: block.CleanEnv,
+			passEnv:  block.PassEnv,
+			collapse: block.Collapse,
+			echo:     block.Echo == "on",
+			envs:     envs,
+			encoding: enc,
+			events:   events,
+			block:    block.Label,
+			done:     make(chan struct{}),
+			exited:   make(chan struct{}),
+			retry:    make(chan struct{}, 1),
+			recent:   shell.NewCaptureBuffer(TailLines),
+		}
+		if dmn.Primary {
+			d[i].relay = primaryStdin
 		}
+		d[i].mask = mask
+		d[i].delimiter = block.Delimiter
+	}
+	order, err := block.DaemonOrder()
+	if err != nil {
+		return nil, err
 	}
-	return &DaemonPen{daemons: d}, nil
+	for i, dmn := range block.Daemons {
+		for _, name := range dmn.After {
+			for j, other := range block.Daemons {
+				if other.Name() == name {
+					d[i].after = append(d[i].after, d[j])
+				}
+			}
+		}
+	}
+	dp := &DaemonPen{daemons: d, order: order}
+	dp.batch.window = block.Batch
+	for _, dmn := range d {
+		dmn.pen = dp
+	}
+	return dp, nil
 }
 
 // Restart all daemons in the pen, or start them if they're not running yet.
+// Daemons are started in dependency order, and each is held back until the
+// daemons it's started after are ready.
 func (dp *DaemonPen) Restart() {
 	dp.Lock()
 	defer dp.Unlock()
-	if dp.daemons != nil {
-		for _, d := range dp.daemons {
-			d.Restart()
+	for _, d := range dp.ordered() {
+		dp.requestRestart(d, "restart")
+	}
+}
+
+// ordered returns the daemons of the pen in the order they're started
+func (dp *DaemonPen) ordered() []*daemon {
+	ret := make([]*daemon, len(dp.order))
+	for i, j := range dp.order {
+		ret[i] = dp.daemons[j]
+	}
+	return ret
+}
+
+// restartOnChange restarts the daemons in the pen after a change, or starts
+// them if they're not running yet. Running daemons with the NoRestart flag are
+// left alone, as are all running daemons if norestart is set. Daemons that
+// need one of the failed preps aren't touched. It returns the number of
+// daemons restarted or started.
+func (dp *DaemonPen) restartOnChange(norestart bool, failed []string) int {
+	dp.Lock()
+	defer dp.Unlock()
+	n := 0
+	for _, d := range dp.ordered() {
+		if failedNeed(d.conf, failed) != "" {
+			continue
+		}
+		if norestart || d.conf.NoRestart {
+			if d.Start() {
+				n++
+			}
+		} else {
+			dp.requestRestart(d, "restart")
+			n++
+		}
+	}
+	return n
+}
+
+// RestartWhere restarts the daemons in the pen whose configuration satisfies
+// pred, or starts them if they're not running yet. It returns the number of
+// daemons matched, which may be zero.
+func (dp *DaemonPen) RestartWhere(pred func(conf.Daemon) bool) int {
+	dp.Lock()
+	defer dp.Unlock()
+	n := 0
+	for _, d := range dp.ordered() {
+		if pred(d.conf) {
+			dp.requestRestart(d, "restart")
+			n++
 		}
 	}
+	return n
 }
 
-// Shutdown all daemons in the pen
+// RestartContaining restarts the daemons in the pen whose command contains
+// sub. It returns the number of daemons matched.
+func (dp *DaemonPen) RestartContaining(sub string) int {
+	return dp.RestartWhere(func(d conf.Daemon) bool {
+		return strings.Contains(d.Command, sub)
+	})
+}
+
+// named returns the daemons in the pen named id, as for conf.Daemon.Name, or
+// an error if there are none
+func (dp *DaemonPen) named(id string) ([]*daemon, error) {
+	dp.Lock()
+	defer dp.Unlock()
+	var ret []*daemon
+	for _, d := range dp.daemons {
+		if d.conf.Name() == id {
+			ret = append(ret, d)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no daemon named %s", id)
+	}
+	return ret, nil
+}
+
+// StopDaemon gracefully stops the daemons in the pen named id, leaving the
+// others running. Each is sent the signals of shell.DefaultLadder in turn,
+// and StopDaemon returns once they've exited and their output is drained.
+// They aren't restarted until they're started with StartDaemon.
+func (dp *DaemonPen) StopDaemon(id string) error {
+	daemons, err := dp.named(id)
+	if err != nil {
+		return err
+	}
+	for _, d := range daemons {
+		d.halt()
+	}
+	return nil
+}
+
+// StartDaemon starts the daemons in the pen named id that were stopped with
+// StopDaemon
+func (dp *DaemonPen) StartDaemon(id string) error {
+	daemons, err := dp.named(id)
+	if err != nil {
+		return err
+	}
+	for _, d := range daemons {
+		d.resume()
+	}
+	return nil
+}
+
+// SetOutput routes lines from the standard output and error of the daemon at
+// index i in the pen to the stdout and stderr functions, instead of the log.
+// If either function is nil, the corresponding stream goes to the log. The
+// change takes effect the next time the daemon process starts.
+func (dp *DaemonPen) SetOutput(
+	i int,
+	stdout func(string, ...interface{}),
+	stderr func(string, ...interface{}),
+) error {
+	dp.Lock()
+	defer dp.Unlock()
+	if i < 0 || i >= len(dp.daemons) {
+		return fmt.Errorf("No such daemon: %d", i)
+	}
+	d := dp.daemons[i]
+	d.Lock()
+	defer d.Unlock()
+	d.stdout, d.stderr = stdout, stderr
+	return nil
+}
+
+// OnStderr registers fn to be called with each line of standard error from
+// the daemon at index i in the pen, for tooling that watches for crash
+// reports. Lines are still logged, or sent to the function given to
+// SetOutput. A nil fn removes the callback. The change takes effect the next
+// time the daemon process starts.
+func (dp *DaemonPen) OnStderr(i int, fn func(string)) error {
+	dp.Lock()
+	defer dp.Unlock()
+	if i < 0 || i >= len(dp.daemons) {
+		return fmt.Errorf("No such daemon: %d", i)
+	}
+	d := dp.daemons[i]
+	d.Lock()
+	defer d.Unlock()
+	d.onStderr = fn
+	return nil
+}
+
+// Resize forwards a terminal resize to all daemons in the pen that have opted
+// in.
+func (dp *DaemonPen) Resize() {
+	dp.Lock()
+	defer dp.Unlock()
+	for _, d := range dp.daemons {
+		d.Resize()
+	}
+}
+
+// wantsResize returns true if any daemon in the pen has opted in to resize
+// forwarding.
+func (dp *DaemonPen) wantsResize() bool {
+	for _, d := range dp.daemons {
+		if d.conf.ResizeSignal != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns a snapshot of the state of all daemons in the pen
+func (dp *DaemonPen) Status() []DaemonStatus {
+	dp.Lock()
+	defer dp.Unlock()
+	ret := make([]DaemonStatus, len(dp.daemons))
+	for i, d := range dp.daemons {
+		ret[i] = d.Status()
+	}
+	return ret
+}
+
+// Shutdown all daemons in the pen. Daemons are stopped in groups of equal
+// StopOrder, lowest first, and each group must exit before the next is
+// stopped.
 func (dp *DaemonPen) Shutdown(sig os.Signal) {
 	dp.Lock()
 	defer dp.Unlock()
-	if dp.daemons != nil {
-		for _, d := range dp.daemons {
+	dp.batch.take()
+	for _, group := range stopGroups(dp.daemons) {
+		for _, d := range group {
 			d.Shutdown(sig)
 		}
+		for _, d := range group {
+			d.wait()
+			d.closeListeners()
+		}
+	}
+}
+
+// stopGroups partitions daemons by StopOrder, in the sequence they should be
+// stopped. Daemons keep their configured order within a group.
+func stopGroups(daemons []*daemon) [][]*daemon {
+	byOrder := make(map[int][]*daemon)
+	var orders []int
+	for _, d := range daemons {
+		o := d.conf.StopOrder
+		if _, ok := byOrder[o]; !ok {
+			orders = append(orders, o)
+		}
+		byOrder[o] = append(byOrder[o], d)
 	}
+	sort.Ints(orders)
+	ret := make([][]*daemon, len(orders))
+	for i, o := range orders {
+		ret[i] = byOrder[o]
+	}
+	return ret
 }
 
 // DaemonWorld represents the entire world of daemons
 type DaemonWorld struct {
 	DaemonPens []*DaemonPen
+
+	// Environment shared by all daemons and preps in this world
+	env *envCache
+	// Destination for lifecycle events, or nil
+	events *eventBus
 }
 
 // NewDaemonWorld creates a DaemonWorld
 func NewDaemonWorld(cnf *conf.Config, log termlog.TermLog) (*DaemonWorld, error) {
+	return newDaemonWorld(cnf, log, nil)
+}
+
+func newDaemonWorld(cnf *conf.Config, log termlog.TermLog, events *eventBus) (*DaemonWorld, error) {
+	env := &envCache{}
 	daemonPens := make([]*DaemonPen, len(cnf.Blocks))
+	colors := blockColors(cnf.Blocks)
 	for i, b := range cnf.Blocks {
-		d, err := NewDaemonPen(b, cnf.GetVariables(), log)
+		d, err := newDaemonPen(b, cnf.GetVariables(), log, env, events, colors)
 		if err != nil {
 			return nil, err
 		}
 		daemonPens[i] = d
 
 	}
-	return &DaemonWorld{daemonPens}, nil
+	return &DaemonWorld{DaemonPens: daemonPens, env: env, events: events}, nil
+}
+
+// setTracer has every daemon record its runs with t
+func (dw *DaemonWorld) setTracer(t *Tracer) {
+	for _, dp := range dw.DaemonPens {
+		for _, d := range dp.daemons {
+			d.tracer = t
+		}
+	}
+}
+
+// Resize forwards a terminal resize to all daemons that have opted in
+func (dw *DaemonWorld) Resize() {
+	for _, dp := range dw.DaemonPens {
+		dp.Resize()
+	}
+}
+
+// Status returns a snapshot of the state of all daemons, grouped by block
+func (dw *DaemonWorld) Status() [][]DaemonStatus {
+	ret := make([][]DaemonStatus, len(dw.DaemonPens))
+	for i, dp := range dw.DaemonPens {
+		ret[i] = dp.Status()
+	}
+	return ret
 }
 
 // Shutdown all daemons with signal s
@@ -0,0 +1,171 @@
+// +build !windows
+
+package modd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestDaemonResize(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:      "trap 'echo :resized: yes' USR1; echo :ready: yes; while true; do sleep 0.1; done",
+				ResizeSignal: syscall.SIGUSR1,
+			},
+			{
+				Command: "trap 'echo :unwanted: yes' USR1; while true; do sleep 0.1; done",
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	waitFor(t, lt, ":ready: yes")
+	dp.Resize()
+	waitFor(t, lt, ":resized: yes")
+	for _, e := range events(lt.String()) {
+		if strings.HasPrefix(e, ":unwanted:") {
+			t.Errorf("Daemon that did not opt in received resize signal")
+		}
+	}
+}
+
+func TestDaemonListen(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:       `echo ":fds: $LISTEN_FDS"; test -S /dev/fd/3 && echo ":socket: yes"; sleep 100`,
+				RestartSignal: syscall.SIGTERM,
+				Listen:        []string{"unix:daemon.sock"},
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	waitFor(t, lt, ":fds: 1")
+	waitFor(t, lt, ":socket: yes")
+
+	// The socket is held by modd, so connections wait out a restart
+	dp.Restart()
+	conn, err := net.Dial("unix", "daemon.sock")
+	if err != nil {
+		t.Fatalf("Expected the socket to accept connections: %s", err)
+	}
+	conn.Close()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Restarts == 1 && st.Running })
+
+	dp.Shutdown(nil)
+	if _, err := os.Stat("daemon.sock"); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestDaemonFifo(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, write := range []bool{true, false} {
+		lt := termlog.NewLogTest()
+		b := conf.Block{
+			Daemons: []conf.Daemon{
+				{Command: "cat", RestartSignal: syscall.SIGTERM, Fifo: "control"},
+			},
+		}
+		dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dp.Restart()
+		waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+		if write {
+			fp, err := os.OpenFile("control", os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(fp, ":fifo: relayed\n")
+			fp.Close()
+			start := time.Now()
+			for !hasEvent(lt, ":fifo: relayed") {
+				if time.Since(start) > timeout {
+					t.Fatalf("FIFO input was not relayed:\n%s", lt.String())
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		dp.Shutdown(nil)
+		if _, err := os.Stat("control"); !os.IsNotExist(err) {
+			t.Errorf("Expected FIFO to be removed on shutdown, got %v", err)
+		}
+	}
+}
+
+func TestDaemonDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		warned  bool
+	}{
+		// Finishes its work after the restart signal, and exits on its own
+		{"drains", "trap 'echo :draining: now; sleep 0.2; exit 0' HUP", false},
+		// Ignores the restart signal, and is stopped once its time is up
+		{"stubborn", "trap 'echo :draining: now' HUP", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lt := termlog.NewLogTest()
+			lt.Log.Enable("debug")
+			b := conf.Block{
+				Daemons: []conf.Daemon{
+					{
+						Command:       tt.command + "; echo :start: yes; while true; do sleep 0.05; done",
+						RestartSignal: syscall.SIGHUP,
+						Drain:         true,
+						DrainTimeout:  time.Second,
+					},
+				},
+			}
+			dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dp.Restart()
+			defer dp.Shutdown(nil)
+			waitFor(t, lt, ":start: yes")
+			dp.Restart()
+			waitFor(t, lt, ":draining: now")
+			start := time.Now()
+			for strings.Count(strings.Join(events(lt.String()), "\n"), ":start: yes") < 2 {
+				if time.Since(start) > timeout {
+					t.Fatalf("Timed out waiting for the daemon to restart, got:\n%s", lt.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			out := lt.String()
+			if warned := strings.Contains(out, ">> not drained after 1s, stopping"); warned != tt.warned {
+				t.Errorf("Expected warning %v, got:\n%s", tt.warned, out)
+			}
+			if drained := strings.Contains(out, ">> drained"); drained == tt.warned {
+				t.Errorf("Expected drained %v, got:\n%s", !tt.warned, out)
+			}
+		})
+	}
+}
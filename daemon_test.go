@@ -0,0 +1,913 @@
+package modd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestDaemonHistory(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{{Command: "exit 3"}},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	start := time.Now()
+	for {
+		st := dp.Status()[0]
+		if len(st.History) > 0 {
+			rec := st.History[0]
+			if rec.ExitCode != 3 || rec.Reason != "exited" {
+				t.Errorf("Unexpected run record: %#v", rec)
+			}
+			if st.Uptime <= 0 {
+				t.Errorf("Expected positive uptime, got %s", st.Uptime)
+			}
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for daemon history")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDaemonHistoryBound(t *testing.T) {
+	defer func(n int) { HistoryLength = n }(HistoryLength)
+	HistoryLength = 2
+
+	d := &daemon{}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		d.setStarted(start)
+		d.record(start, start.Add(time.Second), nil, &shell.ExecState{ExitCode: i})
+	}
+	st := d.Status()
+	if len(st.History) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(st.History))
+	}
+	if st.History[0].ExitCode != 3 || st.History[1].ExitCode != 4 {
+		t.Errorf("Expected the most recent records, got %#v", st.History)
+	}
+	if st.Restarts != 4 {
+		t.Errorf("Expected 4 restarts, got %d", st.Restarts)
+	}
+	if st.Uptime != 5*time.Second {
+		t.Errorf("Expected cumulative uptime of 5s, got %s", st.Uptime)
+	}
+	if st.Running {
+		t.Errorf("Expected daemon to be stopped")
+	}
+}
+
+func TestDaemonRestartEvery(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:       "sleep 100",
+				RestartSignal: syscall.SIGTERM,
+				RestartEvery:  200 * time.Millisecond,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	start := time.Now()
+	for {
+		st := dp.Status()[0]
+		if len(st.History) > 0 {
+			if st.History[0].Reason != "periodic" {
+				t.Errorf("Expected periodic restart, got %#v", st.History[0])
+			}
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for periodic restart")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDaemonWhen(t *testing.T) {
+	os.Setenv("MODD_TEST_WHEN", "1")
+	defer os.Unsetenv("MODD_TEST_WHEN")
+
+	tests := []struct {
+		expr    string
+		enabled bool
+	}{
+		{"$MODD_TEST_WHEN=1", true},
+		{"$MODD_TEST_WHEN=0", false},
+		{"$MODD_TEST_WHEN!=1", false},
+		{"$MODD_TEST_UNSET!=1", true},
+		{"true", true},
+		{"exit 1", false},
+	}
+	for _, tt := range tests {
+		c, err := conf.ParseCondition(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt := termlog.NewLogTest()
+		b := conf.Block{
+			Daemons: []conf.Daemon{
+				{Command: "sleep 100", RestartSignal: syscall.SIGTERM, When: c},
+			},
+		}
+		dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dp.Restart()
+		st := dp.Status()[0]
+		if st.Disabled == tt.enabled {
+			t.Errorf("%q: expected enabled=%v, got status %#v", tt.expr, tt.enabled, st)
+		}
+		if !tt.enabled {
+			// A disabled daemon stays disabled on subsequent restarts
+			dp.Restart()
+			if dp.daemons[0].ex != nil {
+				t.Errorf("%q: disabled daemon was started", tt.expr)
+			}
+		}
+		dp.Shutdown(nil)
+	}
+}
+
+func waitStatus(t *testing.T, dp *DaemonPen, cond func(DaemonStatus) bool) DaemonStatus {
+	start := time.Now()
+	for {
+		st := dp.Status()[0]
+		if cond(st) {
+			return st
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for daemon status, got %#v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDaemonOnReady(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:       "sleep 100",
+				RestartSignal: syscall.SIGTERM,
+				ReadyPort:     port,
+				OnReady:       `echo ":ready: $MODD_DAEMON_PORT"`,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	waitFor(t, lt, fmt.Sprintf(":ready: %d", port))
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Ready })
+	if st.Unhealthy {
+		t.Errorf("Daemon should be healthy: %#v", st)
+	}
+}
+
+func TestDaemonReadyTimeout(t *testing.T) {
+	// A port that nothing listens on
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:       "sleep 100",
+				RestartSignal: syscall.SIGTERM,
+				ReadyPort:     port,
+				ReadyTimeout:  300 * time.Millisecond,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Failed && !st.Running })
+	if len(st.History) != 1 || st.History[0].Reason != readinessTimeout {
+		t.Errorf("Expected a run ended by the readiness timeout, got %#v", st.History)
+	}
+	if !strings.Contains(lt.String(), "not ready after 300ms") {
+		t.Errorf("Expected the timeout to be logged, got:\n%s", lt.String())
+	}
+
+	// A failed daemon isn't restarted until it's triggered
+	time.Sleep(3 * MinRestart)
+	if st := dp.Status()[0]; st.Running || st.Restarts != 0 {
+		t.Errorf("Failed daemon should not be restarted: %#v", st)
+	}
+	dp.Restart()
+	st = waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	if st.Failed || st.Restarts != 1 {
+		t.Errorf("Expected the daemon to be retried: %#v", st)
+	}
+}
+
+func TestDaemonOnReadyFailure(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:         "sleep 100",
+				RestartSignal:   syscall.SIGTERM,
+				OnReady:         `[ "$MODD_DAEMON_PID" -gt 0 ] && exit 3`,
+				OnReadyRequired: true,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Unhealthy })
+	if !st.Ready || !st.Running {
+		t.Errorf("Unhealthy daemon should still be running: %#v", st)
+	}
+}
+
+func TestDaemonSilence(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:        "sleep 100",
+				RestartSignal:  syscall.SIGTERM,
+				Silence:        200 * time.Millisecond,
+				SilenceRestart: true,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return len(st.History) > 0 })
+	if st.History[0].Reason != "silence" {
+		t.Errorf("Expected silence restart, got %#v", st.History[0])
+	}
+	if !strings.Contains(lt.String(), ">> no output for 200ms") {
+		t.Errorf("Expected silence warning, got:\n%s", lt.String())
+	}
+}
+
+func TestDaemonHeartbeat(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:        "while true; do echo beat; sleep 0.05; done",
+				RestartSignal:  syscall.SIGTERM,
+				Silence:        500 * time.Millisecond,
+				SilenceRestart: true,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	time.Sleep(1500 * time.Millisecond)
+	dp.Shutdown(nil)
+
+	if strings.Contains(lt.String(), ">> no output for 500ms") {
+		t.Errorf("Daemon with regular output should not trip the watchdog:\n%s", lt.String())
+	}
+}
+
+func TestDaemonAfter(t *testing.T) {
+	// The database becomes ready when something listens on its port
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100 # worker", RestartSignal: syscall.SIGTERM, After: []string{"db"}},
+			{Command: "sleep 100 # db", RestartSignal: syscall.SIGTERM, ProcName: "db", ReadyPort: port},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+
+	start := time.Now()
+	for !dp.Status()[1].Running {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for db to start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(3 * readyPoll)
+	if st := dp.Status()[0]; st.Running || !st.Waiting {
+		t.Fatalf("Worker should wait for db to be ready: %#v", st)
+	}
+
+	l, err = net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	if st.Waiting || !dp.Status()[1].Ready {
+		t.Errorf("Expected worker to start once db was ready: %#v", dp.Status())
+	}
+}
+
+func TestDaemonBatch(t *testing.T) {
+	lt := termlog.NewLogTest()
+	window := 300 * time.Millisecond
+	b := conf.Block{
+		Batch: window,
+		Daemons: []conf.Daemon{
+			{Command: "echo :start: api; sleep 100", RestartSignal: syscall.SIGTERM, After: []string{"db"}},
+			{Command: "echo :start: db; sleep 100", RestartSignal: syscall.SIGTERM, ProcName: "db"},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	waitFor(t, lt, ":start: api")
+
+	// Restarts asked for apart are applied together once the window ends,
+	// with the database first, though the api was asked for first
+	start := time.Now()
+	if n := dp.RestartContaining("api"); n != 1 {
+		t.Fatalf("Expected one daemon to match, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	dp.RestartContaining("db")
+	for _, st := range dp.Status() {
+		if st.Restarts != 0 {
+			t.Errorf("Expected no restart before the window ends: %#v", st)
+		}
+	}
+	for dp.Status()[0].Restarts == 0 || dp.Status()[1].Restarts == 0 {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for the batch: %#v", dp.Status())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if d := time.Since(start); d < window {
+		t.Errorf("Expected restarts to wait for the window, took %s", d)
+	}
+	st := dp.Status()
+	for _, st := range st {
+		if st.Restarts != 1 {
+			t.Errorf("Expected each daemon to restart once: %#v", st)
+		}
+	}
+	if st[0].Started.Before(st[1].Started) {
+		t.Errorf("Expected db to be restarted before api: %#v", st)
+	}
+}
+
+func TestStopDaemon(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM, ProcName: "a"},
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM, ProcName: "b"},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	running := func(st []DaemonStatus) bool { return st[0].Running && st[1].Running }
+	start := time.Now()
+	for !running(dp.Status()) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for daemons to start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := dp.StopDaemon("c"); err == nil || err.Error() != "no daemon named c" {
+		t.Errorf("Expected an error for an unknown daemon, got %v", err)
+	}
+	if err := dp.StopDaemon("a"); err != nil {
+		t.Fatal(err)
+	}
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return !st.Running })
+	if !st.Held || len(st.History) != 1 || st.History[0].Reason != "stop" {
+		t.Errorf("Expected a to be held after stopping: %#v", st)
+	}
+	if other := dp.Status()[1]; !other.Running || other.Restarts != 0 {
+		t.Errorf("Expected b to be left alone: %#v", other)
+	}
+
+	// Triggering the block doesn't start a held daemon
+	dp.Restart()
+	time.Sleep(3 * MinRestart)
+	if st := dp.Status()[0]; st.Running {
+		t.Errorf("Held daemon should not be restarted: %#v", st)
+	}
+	if err := dp.StartDaemon("a"); err != nil {
+		t.Fatal(err)
+	}
+	st = waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	if st.Held || st.Restarts != 1 {
+		t.Errorf("Expected a to be started again: %#v", st)
+	}
+}
+
+func TestDaemonStopOrder(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100 # db", StopOrder: 1},
+			{Command: "sleep 100 # web"},
+			{Command: "sleep 100 # cache", StopOrder: 1},
+		},
+	}
+	rec := &eventRecorder{}
+	bus := &eventBus{}
+	bus.add(rec)
+	dp, err := newDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log, &envCache{}, bus, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	start := time.Now()
+	for _, d := range dp.daemons {
+		for d.ex.Pid() == 0 {
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for daemons to start")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	dp.Shutdown(nil)
+
+	rec.Lock()
+	defer rec.Unlock()
+	var stopped []string
+	for _, e := range rec.events {
+		if e.Type == EventDaemonStop {
+			stopped = append(stopped, e.Command)
+		}
+	}
+	if len(stopped) != 3 {
+		t.Fatalf("Expected all daemons to have exited, got %#v", stopped)
+	}
+	if stopped[0] != "sleep 100 # web" {
+		t.Errorf("Expected web to stop first, got %#v", stopped)
+	}
+}
+
+func TestDaemonRestartContaining(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100 # web", RestartSignal: syscall.SIGTERM},
+			{Command: "sleep 100 # worker", RestartSignal: syscall.SIGTERM},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+
+	if n := dp.RestartContaining("nothing"); n != 0 {
+		t.Errorf("Expected no matches, got %d", n)
+	}
+	if n := dp.RestartContaining("# web"); n != 1 {
+		t.Fatalf("Expected 1 match, got %d", n)
+	}
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	if st := dp.Status()[1]; st.Running {
+		t.Errorf("Expected only the matching daemon to start: %#v", st)
+	}
+	if n := dp.RestartContaining("sleep"); n != 2 {
+		t.Errorf("Expected 2 matches, got %d", n)
+	}
+}
+
+func TestDaemonKeepStdin(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "cat", RestartSignal: syscall.SIGTERM, KeepStdin: true},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	time.Sleep(500 * time.Millisecond)
+	if st := dp.Status()[0]; len(st.History) != 0 {
+		t.Errorf("Daemon reading stdin should keep running, got %#v", st.History)
+	}
+	dp.Shutdown(nil)
+	if dp.daemons[0].stdin != nil {
+		t.Errorf("Expected stdin to be closed on shutdown")
+	}
+}
+
+func TestDaemonOnStderr(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:       "echo out; echo panic: boom >&2; echo more; echo exit 2 >&2; sleep 100",
+				RestartSignal: syscall.SIGTERM,
+				PidPrefix:     true,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.OnStderr(1, func(string) {}); err == nil {
+		t.Errorf("Expected an error for a missing daemon")
+	}
+	lines := make(chan string, 10)
+	if err := dp.OnStderr(0, func(l string) { lines <- l }); err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+	var got []string
+	for len(got) < 2 {
+		select {
+		case l := <-lines:
+			got = append(got, l)
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for stderr, got %#v", got)
+		}
+	}
+	expected := []string{"panic: boom", "exit 2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, got)
+	}
+	start := time.Now()
+	for !strings.Contains(lt.String(), "] more") {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for stdout, got:\n%s", lt.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case l := <-lines:
+		t.Errorf("Unexpected line: %q", l)
+	default:
+	}
+	// Logging carries on as usual
+	if !strings.Contains(lt.String(), "panic: boom") {
+		t.Errorf("Expected stderr to be logged, got:\n%s", lt.String())
+	}
+}
+
+func TestDaemonPrimary(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "cat", RestartSignal: syscall.SIGTERM, Primary: true},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	d := dp.daemons[0]
+	d.relay = &stdinRelay{in: r}
+	connected := func() bool {
+		d.Lock()
+		defer d.Unlock()
+		return d.stdin != nil
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	// Wait for the pipe to be connected before writing
+	waitStatus(t, dp, func(DaemonStatus) bool { return connected() })
+	fmt.Fprintln(w, ":input: one")
+	waitFor(t, lt, ":input: one")
+
+	// The new process is connected after a restart
+	dp.Restart()
+	waitStatus(t, dp, func(s DaemonStatus) bool {
+		return s.Running && s.Started != st.Started && connected()
+	})
+	fmt.Fprintln(w, ":input: two")
+	waitFor(t, lt, ":input: two")
+}
+
+func TestPidPrefix(t *testing.T) {
+	tests := []struct {
+		uptime   time.Duration
+		expected string
+	}{
+		{2300 * time.Millisecond, "[pid=1234 +2.3s]"},
+		{0, "[pid=1234 +0s]"},
+		{75 * time.Second, "[pid=1234 +1m15s]"},
+	}
+	for _, tt := range tests {
+		// Allow for the time elapsed before pidPrefix reads the clock
+		ret := pidPrefix(1234, time.Now().Add(-tt.uptime-10*time.Millisecond))
+		if ret != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, ret)
+		}
+	}
+}
+
+func TestDaemonPidPrefix(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "echo ready; sleep 10", RestartSignal: syscall.SIGTERM, PidPrefix: true},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+	expected := regexp.MustCompile(`\[pid=[1-9][0-9]* \+[0-9.]+m?s\] ready`)
+	start := time.Now()
+	for !expected.MatchString(lt.String()) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Expected prefixed output, got:\n%s", lt.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonQuiet(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	lt := termlog.NewLogTest()
+	// Far more output than a pipe holds, so the daemon only gets as far as
+	// touching the file if its output is drained
+	cmd := "for i in $(seq 1 20000); do echo chatty$i; echo noisy$i >&2; done; touch drained; sleep 100"
+	b := conf.Block{
+		Daemons: []conf.Daemon{{Command: cmd, RestartSignal: syscall.SIGTERM, Quiet: true}},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Restart()
+	defer dp.Shutdown(nil)
+	start := time.Now()
+	for {
+		if _, err := os.Stat("drained"); err == nil {
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("Expected the daemon's output to be drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	out := lt.String()
+	if strings.Contains(out, "chatty1") || strings.Contains(out, "noisy1") {
+		t.Errorf("Expected no output to be logged, got:\n%s", out)
+	}
+	if !strings.Contains(out, ">> starting") {
+		t.Errorf("Expected the daemon's lifecycle to be logged, got:\n%s", out)
+	}
+}
+
+func TestDaemonRestartCoalesce(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "trap 'echo :hup:' HUP; while true; do sleep 0.05; done", RestartSignal: syscall.SIGHUP},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	signals := func() int { return strings.Count(lt.String(), ">> sending signal") }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dp.Restart()
+		}()
+	}
+	wg.Wait()
+	if n := signals(); n != 1 {
+		t.Errorf("Expected overlapping restarts to send one signal, got %d", n)
+	}
+	time.Sleep(MinRestart)
+	dp.Restart()
+	if n := signals(); n != 2 {
+		t.Errorf("Expected a restart after the window to send a signal, got %d", n)
+	}
+}
+
+func TestDaemonNoRestart(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM, NoRestart: true},
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	signals := func() int { return strings.Count(lt.String(), ">> sending signal") }
+
+	// Daemons are started as usual, whether or not they're restarted
+	dp.restartOnChange(true, nil)
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+	for _, st := range dp.Status() {
+		if st.Restarts != 0 {
+			t.Errorf("Unexpected restarts: %#v", st)
+		}
+	}
+	time.Sleep(MinRestart)
+	dp.restartOnChange(true, nil)
+	if n := signals(); n != 0 {
+		t.Errorf("Expected no restart signals with norestart, got %d", n)
+	}
+	dp.restartOnChange(false, nil)
+	if n := signals(); n != 1 {
+		t.Errorf("Expected only the daemon without +norestart to restart, got %d signals", n)
+	}
+}
+
+func TestDaemonNeedsFailed(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM, Needs: []string{"build-a"}},
+			{Command: "sleep 101", RestartSignal: syscall.SIGTERM, Needs: []string{"build-b"}},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.restartOnChange(false, []string{"build-a"})
+	for start := time.Now(); !dp.Status()[1].Running; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for the daemon whose prep passed")
+		}
+	}
+	if st := dp.Status()[0]; st.Running {
+		t.Errorf("Expected the daemon whose prep failed to be left alone, got %#v", st)
+	}
+}
+
+func TestDaemonWatchBinary(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	writeServer := func(msg string) {
+		err := ioutil.WriteFile("server", []byte("#!/bin/sh\necho "+msg+"\nexec sleep 100\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeServer("one")
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "./server", RestartSignal: syscall.SIGTERM, WatchBinary: true},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+
+	writeServer("two")
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return len(st.History) > 0 })
+	if st.History[0].Reason != "binary" {
+		t.Errorf("Expected restart for a changed binary, got %#v", st.History)
+	}
+}
+
+func TestDaemonPidFile(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	// A pidfile left behind by a modd that crashed
+	if err := ioutil.WriteFile("daemon.pid", []byte("99999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{Command: "sleep 100", RestartSignal: syscall.SIGTERM, PidFile: "daemon.pid"},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// waitPid waits for the pidfile to name a running daemon other than last
+	waitPid := func(last int) int {
+		start := time.Now()
+		for {
+			pid := dp.Status()[0].Pid
+			data, _ := ioutil.ReadFile("daemon.pid")
+			if pid != 0 && pid != last && string(data) == fmt.Sprintf("%d\n", pid) {
+				return pid
+			}
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for pidfile, got %q for pid %d", data, pid)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	dp.Restart()
+	pid := waitPid(0)
+	// A restart replaces the PID
+	dp.Restart()
+	waitPid(pid)
+	dp.Shutdown(nil)
+	if _, err := os.Stat("daemon.pid"); !os.IsNotExist(err) {
+		t.Errorf("Expected pidfile to be removed on shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Detach starts modd again with args, in the background and in a session of
+// its own, so that it outlives the terminal. Its output is appended to the
+// file at logPath, and DetachedEnv is set in its environment. It returns the
+// process ID of the new modd.
+func Detach(args []string, logPath string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), DetachedEnv+"=1")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
@@ -0,0 +1,10 @@
+// +build windows
+
+package modd
+
+import "errors"
+
+// Detach is not supported on Windows
+func Detach(args []string, logPath string) (int, error) {
+	return 0, errors.New("--detach isn't supported on Windows")
+}
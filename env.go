@@ -0,0 +1,102 @@
+package modd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/termlog"
+)
+
+// envCache resolves the environment for the commands in a block. The output of
+// +cmd helpers is cached until the cache is reset, so each helper runs at most
+// once per cycle no matter how many commands use it. The cache also records
+// the outcome of preps with a dedup key, so that they too run once per cycle.
+type envCache struct {
+	values map[string]string
+	preps  map[string]prepResult
+	sync.Mutex
+}
+
+// prepResult is the outcome of a prep run with a dedup key
+type prepResult struct {
+	output string
+	err    error
+}
+
+// reset discards all cached values
+func (c *envCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.values = nil
+	c.preps = nil
+}
+
+// ran returns the outcome of the prep run with the dedup key key since the
+// cache was reset, if there was one
+func (c *envCache) ran(key string) (prepResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.preps[key]
+	return r, ok
+}
+
+// record records the outcome of a prep with the dedup key key
+func (c *envCache) record(key string, r prepResult) {
+	c.Lock()
+	defer c.Unlock()
+	if c.preps == nil {
+		c.preps = map[string]prepResult{}
+	}
+	c.preps[key] = r
+}
+
+// resolve returns env as a list of NAME=value pairs. Resolved values are
+// secret, so they never appear in logs or errors.
+func (c *envCache) resolve(env []conf.EnvVar, sh string, dir string) ([]string, error) {
+	ret := make([]string, len(env))
+	for i, e := range env {
+		val := e.Value
+		if e.Command {
+			var err error
+			val, err = c.run(e.Value, sh, dir)
+			if err != nil {
+				return nil, fmt.Errorf("Error resolving env %s: %s", e.Name, err)
+			}
+		}
+		ret[i] = e.Name + "=" + val
+	}
+	return ret, nil
+}
+
+func (c *envCache) run(cmd string, sh string, dir string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	key := strings.Join([]string{sh, dir, cmd}, "\x00")
+	if v, ok := c.values[key]; ok {
+		return v, nil
+	}
+	ex, err := shell.NewExecutor(sh, cmd, dir)
+	if err != nil {
+		return "", err
+	}
+	ex.BufferOutput = true
+	quiet := termlog.NewLog()
+	quiet.Quiet()
+	err, estate := ex.Run(quiet.Stream(""), true)
+	if err != nil {
+		return "", err
+	} else if estate.Error != nil {
+		return "", fmt.Errorf(
+			"%s: %s", estate.Error, strings.TrimSpace(estate.ErrOutput),
+		)
+	}
+	if c.values == nil {
+		c.values = map[string]string{}
+	}
+	val := strings.TrimRight(estate.Output, "\r\n")
+	c.values[key] = val
+	return val, nil
+}
@@ -0,0 +1,90 @@
+package modd
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestEnvCache(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	env := []conf.EnvVar{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "SECRET", Value: "echo run >> count; echo hunter2", Command: true},
+		{Name: "AGAIN", Value: "echo run >> count; echo hunter2", Command: true},
+	}
+	c := &envCache{}
+	for i := 0; i < 2; i++ {
+		ret, err := c.resolve(env, "bash", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"PLAIN=value", "SECRET=hunter2", "AGAIN=hunter2"}
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+		}
+	}
+	checkRuns := func(expected int) {
+		data, err := ioutil.ReadFile("count")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(data), "run"); n != expected {
+			t.Errorf("Expected helper to run %d times, ran %d times", expected, n)
+		}
+	}
+	checkRuns(1)
+	c.reset()
+	if _, err := c.resolve(env, "bash", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkRuns(2)
+}
+
+func TestEnvCacheError(t *testing.T) {
+	env := []conf.EnvVar{
+		{Name: "SECRET", Value: "echo hunter2; echo failed >&2; false", Command: true},
+	}
+	c := &envCache{}
+	_, err := c.resolve(env, "bash", "")
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if !strings.Contains(err.Error(), "SECRET") || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("Unhelpful error: %s", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Secret leaked into error: %s", err)
+	}
+}
+
+func TestRunPrepsEnv(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Env: []conf.EnvVar{
+			{Name: "PLAIN", Value: "value"},
+			{Name: "SECRET", Value: "echo hunter2", Command: true},
+		},
+		Preps: []conf.Prep{
+			{Command: `echo ":env: $PLAIN"; test "$SECRET" = hunter2 && echo ":secret: ok"`},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{":env: value", ":secret: ok"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if strings.Contains(lt.String(), "hunter2\n") {
+		t.Errorf("Secret leaked into log:\n%s", lt.String())
+	}
+}
@@ -0,0 +1,170 @@
+package modd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultEventLogSize is the size in bytes at which an event log is rotated
+const DefaultEventLogSize = 10 * 1024 * 1024
+
+// eventLogQueue is the number of events buffered before Event drops them
+const eventLogQueue = 1024
+
+// EventLog is an EventSink that writes events to a file as newline-delimited
+// JSON. Writes happen in the background so that logging does not slow down
+// the main loop, and events that arrive while the queue is full are dropped
+// rather than holding it up. When the file grows beyond MaxSize, it is
+// renamed with a .1 suffix, replacing any previous rotated log, and a new file
+// is started.
+type EventLog struct {
+	Path    string
+	MaxSize int64
+
+	events  chan Event
+	done    chan struct{}
+	fp      *os.File
+	w       *bufio.Writer
+	size    int64
+	err     error
+	dropped int64
+	// Set once Close has begun, after which events are ignored
+	closed bool
+	mu     sync.RWMutex
+}
+
+// NewEventLog opens an event log at path, appending to it if it exists
+func NewEventLog(path string, maxSize int64) (*EventLog, error) {
+	l := &EventLog{
+		Path:    path,
+		MaxSize: maxSize,
+		events:  make(chan Event, eventLogQueue),
+		done:    make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *EventLog) open() error {
+	fp, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	l.fp = fp
+	l.w = bufio.NewWriter(fp)
+	l.size = st.Size()
+	return nil
+}
+
+// Event implements EventSink. It never blocks: the event is dropped if the
+// queue is full, and ignored if the log is closed.
+func (l *EventLog) Event(e Event) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full
+func (l *EventLog) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+func (l *EventLog) run() {
+	defer close(l.done)
+	for e := range l.events {
+		l.write(e)
+		// Flush once the queue is drained, so bursts are written together
+		if len(l.events) == 0 && l.err == nil {
+			l.err = l.w.Flush()
+		}
+	}
+	if l.err == nil {
+		l.err = l.w.Flush()
+	}
+	if err := l.fp.Close(); l.err == nil {
+		l.err = err
+	}
+}
+
+func (l *EventLog) write(e Event) {
+	if l.err != nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		l.err = err
+		return
+	}
+	b = append(b, '\n')
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.MaxSize {
+		if l.err = l.rotate(); l.err != nil {
+			return
+		}
+	}
+	n, err := l.w.Write(b)
+	l.size += int64(n)
+	l.err = err
+}
+
+func (l *EventLog) rotate() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.Path, l.Path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close flushes all pending events and closes the log. It returns the first
+// error encountered while writing, if any, and may be called more than once.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return l.err
+}
+
+// ReadEvents decodes an event log from r, calling fn for each event in
+// order. Reading stops at the first error returned by fn.
+func ReadEvents(r io.Reader, fn func(Event) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
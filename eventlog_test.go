@@ -0,0 +1,167 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+type eventRecorder struct {
+	events []Event
+	sync.Mutex
+}
+
+func (r *eventRecorder) Event(e Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func readEventLog(t *testing.T, path string) []Event {
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var ret []Event
+	err = ReadEvents(fp, func(e Event) error {
+		ret = append(ret, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadEvents: %s", err)
+	}
+	return ret
+}
+
+func TestPrepEvents(t *testing.T) {
+	rec := &eventRecorder{}
+	bus := &eventBus{}
+	bus.add(rec)
+	b := conf.Block{
+		Label: "build",
+		Preps: []conf.Prep{
+			{Command: "true"},
+			{Command: "exit 2"},
+		},
+	}
+	lt := termlog.NewLogTest()
+	vars := map[string]string{shellVarName: "bash"}
+	err := runPreps(b, vars, nil, nil, lt.Log, nil, true, &envCache{}, bus, nil, nil, nil)
+	if _, ok := err.(ProcError); !ok {
+		t.Fatalf("Expected ProcError, got %#v", err)
+	}
+	var types []string
+	for i, e := range rec.events {
+		if e.Seq != uint64(i+1) {
+			t.Errorf("Expected sequence %d, got %d", i+1, e.Seq)
+		}
+		if e.Block != "build" {
+			t.Errorf("Unexpected block: %s", e.Block)
+		}
+		types = append(types, e.Type)
+	}
+	expected := []string{EventPrepStart, EventPrepEnd, EventPrepStart, EventPrepEnd}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Expected\n%#v\nGot\n%#v", expected, types)
+	}
+	if rec.events[1].ExitCode != 0 || rec.events[3].ExitCode != 2 {
+		t.Errorf("Unexpected exit codes: %#v", rec.events)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	el, err := NewEventLog("events.log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := &eventBus{}
+	bus.add(el)
+	bus.emit(Event{Type: EventChange, Paths: []string{"a", "b"}})
+	bus.emit(Event{Type: EventPrepStart, Command: "make"})
+	if err := el.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	ret := readEventLog(t, "events.log")
+	if len(ret) != 2 {
+		t.Fatalf("Expected 2 events, got %#v", ret)
+	}
+	if ret[0].Seq != 1 || !reflect.DeepEqual(ret[0].Paths, []string{"a", "b"}) {
+		t.Errorf("Unexpected event: %#v", ret[0])
+	}
+	if ret[1].Seq != 2 || ret[1].Command != "make" || ret[1].Time.IsZero() {
+		t.Errorf("Unexpected event: %#v", ret[1])
+	}
+}
+
+func TestEventLogRotate(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	el, err := NewEventLog("events.log", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := &eventBus{}
+	bus.add(el)
+	for i := 0; i < 10; i++ {
+		bus.emit(Event{Type: EventPrepStart, Command: "make"})
+	}
+	if err := el.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	for _, p := range []string{"events.log", "events.log.1"} {
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() > 200 {
+			t.Errorf("%s exceeds maximum size: %d", p, st.Size())
+		}
+	}
+	ret := readEventLog(t, "events.log")
+	if len(ret) == 0 || ret[len(ret)-1].Seq != 10 {
+		t.Errorf("Expected current log to end with the last event, got %#v", ret)
+	}
+}
+
+func TestEventLogFull(t *testing.T) {
+	// Without a writer running, the queue fills, and further events are
+	// dropped rather than blocking
+	el := &EventLog{events: make(chan Event, 2), done: make(chan struct{})}
+	for i := 0; i < 5; i++ {
+		el.Event(Event{Type: EventPrepStart})
+	}
+	if n := el.Dropped(); n != 3 {
+		t.Errorf("Expected 3 events dropped, got %d", n)
+	}
+}
+
+func TestEventLogClosed(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	el, err := NewEventLog("events.log", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el.Event(Event{Type: EventChange})
+	if err := el.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	// Events after Close are ignored, and closing again is harmless
+	el.Event(Event{Type: EventPrepStart})
+	if err := el.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if ret := readEventLog(t, "events.log"); len(ret) != 1 || ret[0].Type != EventChange {
+		t.Errorf("Expected only the event before Close, got %#v", ret)
+	}
+}
@@ -0,0 +1,104 @@
+package modd
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// EventChange is emitted when a file change triggers a block
+	EventChange = "change"
+	// EventPrepStart is emitted before a prep command runs
+	EventPrepStart = "prep:start"
+	// EventPrepEnd is emitted after a prep command completes
+	EventPrepEnd = "prep:end"
+	// EventDaemonStart is emitted each time a daemon process is started
+	EventDaemonStart = "daemon:start"
+	// EventDaemonReady is emitted each time a daemon process becomes ready
+	EventDaemonReady = "daemon:ready"
+	// EventDaemonStop is emitted each time a daemon process exits
+	EventDaemonStop = "daemon:stop"
+	// EventPause and EventResume are emitted when modd is paused and resumed
+	EventPause  = "pause"
+	EventResume = "resume"
+)
+
+// Event describes a single point in the lifecycle of a modd run
+type Event struct {
+	// Seq increases by one for every event emitted by a ModRunner
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Label of the block the event relates to, if any
+	Block   string   `json:"block,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+	// Matches gives the files matched by each pattern, on change events
+	Matches []PatternMatch `json:"matches,omitempty"`
+	// ExitCode and Reason are set on end and stop events
+	ExitCode int    `json:"exitcode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// An EventSink receives lifecycle events. Events are delivered synchronously
+// and in order, so implementations should return quickly.
+type EventSink interface {
+	Event(Event)
+}
+
+// eventBus numbers events and dispatches them to sinks. A nil eventBus
+// discards all events.
+type eventBus struct {
+	sinks []EventSink
+	seq   uint64
+	sync.Mutex
+}
+
+func (b *eventBus) add(s EventSink) {
+	b.Lock()
+	defer b.Unlock()
+	b.sinks = append(b.sinks, s)
+}
+
+func (b *eventBus) remove(s EventSink) {
+	b.Lock()
+	defer b.Unlock()
+	for i, v := range b.sinks {
+		if v == s {
+			b.sinks = append(b.sinks[:i], b.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+// close closes the sinks that hold events to be written, like an EventLog, so
+// that nothing is lost when modd exits
+func (b *eventBus) close() {
+	b.Lock()
+	sinks := append([]EventSink(nil), b.sinks...)
+	b.Unlock()
+	for _, s := range sinks {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+func (b *eventBus) emit(e Event) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range b.sinks {
+		s.Event(e)
+	}
+}
@@ -0,0 +1,24 @@
+// +build !windows
+
+package modd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openFifo creates a FIFO at path, or reuses one left there, and opens it for
+// reading. It's opened read-write, so that opening it doesn't block until a
+// writer appears, and reads don't see end of file each time a writer closes
+// it.
+func openFifo(path string) (*os.File, error) {
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode()&os.ModeNamedPipe == 0 {
+			return nil, fmt.Errorf("%s exists and is not a FIFO", path)
+		}
+	} else if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,13 @@
+// +build windows
+
+package modd
+
+import (
+	"fmt"
+	"os"
+)
+
+// openFifo always fails on Windows, which has no FIFOs.
+func openFifo(path string) (*os.File, error) {
+	return nil, fmt.Errorf("FIFOs are not supported on Windows")
+}
@@ -0,0 +1,106 @@
+package modd
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxProcs, if non-zero, is the most commands modd runs at once across all
+// blocks, not counting a slot kept for daemons. Preps and other commands hold
+// a slot while they run. A daemon holds one only while it starts, and is let
+// through ahead of waiting commands. If all the slots are taken it can use the
+// one kept for daemons, so daemons that run indefinitely never starve others,
+// and restarts never queue behind long preps.
+var MaxProcs int
+
+// procs limits the commands running at once to MaxProcs
+var procs = &procGate{}
+
+type procGate struct {
+	running int
+	// Daemons waiting for a slot, which commands wait behind
+	urgent int
+	// Whether the slot kept for daemons is taken
+	reserved bool
+	cond     *sync.Cond
+	sync.Mutex
+}
+
+// acquire waits for a slot, and returns a function that gives it back, which
+// may be called more than once. Urgent callers are let through before any
+// others that are waiting, and can take the slot kept for them if all the
+// others are in use.
+func (g *procGate) acquire(urgent bool) func() {
+	if MaxProcs <= 0 {
+		return func() {}
+	}
+	g.Lock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.Mutex)
+	}
+	if urgent {
+		g.urgent++
+	}
+	reserved := false
+	for {
+		if g.running < MaxProcs && (urgent || g.urgent == 0) {
+			break
+		}
+		if urgent && !g.reserved {
+			reserved = true
+			break
+		}
+		g.cond.Wait()
+	}
+	if urgent {
+		g.urgent--
+	}
+	if reserved {
+		g.reserved = true
+	} else {
+		g.running++
+	}
+	g.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.Lock()
+			if reserved {
+				g.reserved = false
+			} else {
+				g.running--
+			}
+			g.cond.Broadcast()
+			g.Unlock()
+		})
+	}
+}
+
+// held returns the number of slots in use, including the one kept for
+// daemons
+func (g *procGate) held() int {
+	g.Lock()
+	defer g.Unlock()
+	if g.reserved {
+		return g.running + 1
+	}
+	return g.running
+}
+
+// releaseOnStart gives the slot that a daemon took to start back once its
+// process is running, or once the run is over
+func (d *daemon) releaseOnStart(release func(), exited chan struct{}) {
+	defer release()
+	d.Lock()
+	ex := d.ex
+	d.Unlock()
+	t := time.NewTicker(readyPoll / 10)
+	defer t.Stop()
+	for ex.Pid() == 0 {
+		select {
+		case <-t.C:
+		case <-exited:
+			return
+		}
+	}
+}
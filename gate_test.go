@@ -0,0 +1,155 @@
+package modd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func withMaxProcs(n int) func() {
+	old := MaxProcs
+	MaxProcs = n
+	return func() { MaxProcs = old }
+}
+
+func TestProcGateUrgent(t *testing.T) {
+	defer withMaxProcs(1)()
+	g := &procGate{}
+	release := g.acquire(false)
+	order := make(chan string, 2)
+	go func() {
+		defer g.acquire(false)()
+		order <- "prep"
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		defer g.acquire(true)()
+		order <- "daemon"
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	release()
+	for _, expected := range []string{"daemon", "prep"} {
+		select {
+		case ret := <-order:
+			if ret != expected {
+				t.Errorf("Expected %s to go next, got %s", expected, ret)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for %s", expected)
+		}
+	}
+	// The slots are given back after the order is sent
+	for start := time.Now(); g.held() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Expected all slots to be returned, %d held", g.held())
+		}
+	}
+}
+
+func TestProcGateReserved(t *testing.T) {
+	defer withMaxProcs(1)()
+	g := &procGate{}
+	release := g.acquire(false)
+	defer release()
+
+	// A daemon takes the slot kept for it while a long prep holds the other
+	acquired := make(chan func(), 1)
+	go func() { acquired <- g.acquire(true) }()
+	var daemon func()
+	select {
+	case daemon = <-acquired:
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for a daemon behind a long prep")
+	}
+
+	// Another daemon waits for the kept slot, and a prep can't take it
+	go func() { acquired <- g.acquire(true) }()
+	prep := make(chan func(), 1)
+	go func() { prep <- g.acquire(false) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatalf("Expected the second daemon to wait for the kept slot")
+	case <-prep:
+		t.Fatalf("Expected the prep to wait")
+	default:
+	}
+	daemon()
+	select {
+	case daemon = <-acquired:
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the second daemon")
+	}
+	daemon()
+	select {
+	case <-prep:
+		t.Fatalf("Expected the prep to wait for the first prep to finish")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case r := <-prep:
+		r()
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for the prep")
+	}
+	if n := g.held(); n != 0 {
+		t.Errorf("Expected all slots to be returned, %d held", n)
+	}
+}
+
+func TestMaxProcs(t *testing.T) {
+	defer withMaxProcs(2)()
+	lt := termlog.NewLogTest()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := runProc("sleep 0.2", "bash", "", procOptions{}, lt.Log.Stream("")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Expected four commands to take two turns on two slots, took %s", d)
+	}
+}
+
+func TestMaxProcsDaemon(t *testing.T) {
+	defer withMaxProcs(1)()
+	lt := termlog.NewLogTest()
+	cnf, err := conf.Parse("test", "@shell = bash\n{\ndaemon: sleep 100\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid != 0 })
+
+	// A running daemon doesn't keep its slot, so preps still run
+	done := make(chan error, 1)
+	go func() {
+		_, err := runProc("true", "bash", "", procOptions{}, lt.Log.Stream(""))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("Timed out waiting for a prep behind a running daemon")
+	}
+}
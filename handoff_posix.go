@@ -0,0 +1,66 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reexec executes modd afresh in place of this process, with the same
+// arguments. It only returns if that fails.
+func reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), handoffEnv+"=1")
+	return syscall.Exec(exe, os.Args, env)
+}
+
+// output returns the output pipes passed on with the daemon, if both are
+// pipes
+func (sd SavedDaemon) output() (stdout, stderr *os.File) {
+	if !isPipe(sd.Stdout) || !isPipe(sd.Stderr) {
+		return nil, nil
+	}
+	return os.NewFile(uintptr(sd.Stdout), "stdout"), os.NewFile(uintptr(sd.Stderr), "stderr")
+}
+
+// closeOutput closes the output pipes passed on with a daemon that isn't
+// adopted
+func (sd SavedDaemon) closeOutput() {
+	if stdout, stderr := sd.output(); stdout != nil {
+		stdout.Close()
+		stderr.Close()
+	}
+}
+
+func isPipe(fd int) bool {
+	var st syscall.Stat_t
+	if fd <= 2 || syscall.Fstat(fd, &st) != nil {
+		return false
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFIFO
+}
+
+// notifyHandoff hands the daemons of dworld off to the next instance of modd
+// when modd receives SIGUSR2, unless SIGUSR2 is given another action. The
+// returned function removes the handler.
+func notifyHandoff(mr *ModRunner, dworld *DaemonWorld) func() {
+	if mr.hasSignalAction(syscall.SIGUSR2) {
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			mr.handoff(dworld)
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,25 @@
+// +build windows
+
+package modd
+
+import (
+	"errors"
+	"os"
+)
+
+// reexec isn't supported on Windows, where daemons can't be handed off
+func reexec() error {
+	return errors.New("not supported on Windows")
+}
+
+// output returns no pipes, since daemons can't be handed off on Windows
+func (sd SavedDaemon) output() (stdout, stderr *os.File) {
+	return nil, nil
+}
+
+func (sd SavedDaemon) closeOutput() {}
+
+// notifyHandoff is a no-op on Windows, which has no SIGUSR2.
+func notifyHandoff(mr *ModRunner, dworld *DaemonWorld) func() {
+	return func() {}
+}
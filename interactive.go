@@ -0,0 +1,275 @@
+package modd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Keys understood by Interactive
+const (
+	keyRestart   = 'r'
+	keyPreps     = 'p'
+	keyStatus    = 's'
+	keyTail      = 't'
+	keyPause     = 'z'
+	keyQuit      = 'q'
+	keyHelp      = 'h'
+	keyCommand   = ':'
+	keyInterrupt = 0x03 // Ctrl-C, when the terminal doesn't generate signals
+)
+
+const interactiveHelp = "keys: r - restart daemons, p - run preps, s - daemon status, t - recent daemon output, z - pause/resume, q - quit, : - command"
+
+const commandHelp = "commands: stop NAME, start NAME, tail NAME [LINES], pause, resume"
+
+// interactiveTail is the number of lines of each daemon's output shown by the
+// tail key
+const interactiveTail = 20
+
+// Interactive reads single-key commands from r, and acts on them until r is
+// closed or the quit key is pressed. On quit, running commands are stopped,
+// daemons are shut down, and then quit is called, without waiting for a
+// running cycle to finish. Whitespace is ignored, so keys can also be entered
+// one per line when r isn't a terminal. The command key starts a command
+// line, such as "stop NAME", which runs to the end of the line.
+func (mr *ModRunner) Interactive(r io.Reader, quit func()) error {
+	mr.Log.Notice(interactiveHelp)
+	return mr.readKeys(r, quit)
+}
+
+// readKeys acts on the keys read from r, as for Interactive
+func (mr *ModRunner) readKeys(r io.Reader, quit func()) error {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch c {
+		case keyRestart:
+			go mr.restartDaemons()
+		case keyPreps:
+			go mr.rerunPreps()
+		case keyStatus:
+			mr.statusTable(terminalWidth())
+		case keyTail:
+			mr.tailDaemons("", interactiveTail)
+		case keyPause:
+			mr.TogglePause()
+		case keyCommand:
+			line, err := readCommand(br)
+			mr.runCommand(line)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		case keyQuit, keyInterrupt:
+			mr.Log.Notice(">> quitting")
+			// Running commands are stopped rather than waited for, so a long
+			// cycle doesn't hold up the quit
+			commands.terminate()
+			if dworld := mr.daemonWorld(); dworld != nil {
+				dworld.Shutdown(os.Interrupt)
+			}
+			mr.runTeardown()
+			quit()
+			return nil
+		case ' ', '\t', '\r', '\n':
+		case keyHelp, '?':
+			mr.Log.Notice(interactiveHelp)
+		default:
+			mr.Log.Notice("unknown key %q - %s", c, interactiveHelp)
+		}
+	}
+}
+
+// readCommand reads the rest of a command line, after the command key, up to
+// the end of the line. Backspace removes the last character, and Ctrl-C
+// abandons the command.
+func readCommand(br *bufio.Reader) (string, error) {
+	var line []rune
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return string(line), err
+		}
+		switch c {
+		case '\r', '\n':
+			return string(line), nil
+		case keyInterrupt:
+			return "", nil
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			line = append(line, c)
+		}
+	}
+}
+
+// runCommand acts on a command line read after the command key. Daemon names
+// run to the end of the line, so they can be commands with spaces in them.
+func (mr *ModRunner) runCommand(line string) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), args[0]))
+	switch args[0] {
+	case "stop", "start":
+		if name == "" {
+			mr.Log.Notice("usage: %s NAME", args[0])
+			return
+		}
+		mr.stopOrStart(args[0], name)
+	case "tail":
+		n := interactiveTail
+		if len(args) > 2 {
+			if l, err := strconv.Atoi(args[len(args)-1]); err == nil {
+				if l <= 0 {
+					mr.Log.Notice("usage: tail NAME [LINES]")
+					return
+				}
+				n = l
+				name = strings.TrimSpace(strings.TrimSuffix(name, args[len(args)-1]))
+			}
+		}
+		if name == "" {
+			mr.Log.Notice("usage: tail NAME [LINES]")
+			return
+		}
+		mr.tailDaemons(name, n)
+	case "pause", "resume":
+		if name != "" {
+			mr.Log.Notice("usage: %s", args[0])
+		} else if args[0] == "pause" {
+			mr.Pause()
+		} else {
+			mr.Resume()
+		}
+	case "help":
+		mr.Log.Notice(commandHelp)
+	default:
+		mr.Log.Notice("unknown command %q - %s", args[0], commandHelp)
+	}
+}
+
+// stopOrStart stops or starts the daemons of the running configuration named
+// name, as for DaemonPen.StopDaemon and StartDaemon
+func (mr *ModRunner) stopOrStart(cmd, name string) {
+	found := false
+	if dworld := mr.daemonWorld(); dworld != nil {
+		for _, dp := range dworld.DaemonPens {
+			if dp == nil {
+				continue
+			}
+			var err error
+			if cmd == "stop" {
+				err = dp.StopDaemon(name)
+			} else {
+				err = dp.StartDaemon(name)
+			}
+			if err == nil {
+				found = true
+			}
+		}
+	}
+	if !found {
+		mr.Log.Notice(">> no daemon named %s", name)
+	} else if cmd == "start" {
+		mr.Log.Notice(">> started %s", name)
+	} else {
+		mr.Log.Notice(">> stopped %s", name)
+	}
+}
+
+// restartDaemons restarts the daemons of the running configuration. Like
+// rerunPreps, it waits for a running cycle to finish first.
+func (mr *ModRunner) restartDaemons() {
+	mr.Lock()
+	defer mr.Unlock()
+	if mr.dworld == nil {
+		mr.Log.Notice(">> no daemons running")
+		return
+	}
+	mr.Log.Notice(">> restarting daemons")
+	mr.dworld.Restart()
+}
+
+// statusTable logs a table of the status of the daemons of the running
+// configuration, fitted to width columns
+func (mr *ModRunner) statusTable(width int) {
+	dworld := mr.daemonWorld()
+	if dworld == nil {
+		mr.Log.Notice(">> no daemons running")
+		return
+	}
+	shown := false
+	for _, dp := range dworld.DaemonPens {
+		if dp != nil && len(dp.Status()) > 0 {
+			dp.StatusTable(mr.Log, width)
+			shown = true
+		}
+	}
+	if !shown {
+		mr.Log.Notice(">> no daemons running")
+	}
+}
+
+// tailDaemons logs the last n lines of output of each daemon of the running
+// configuration named name, or of all of them if name is empty
+func (mr *ModRunner) tailDaemons(name string, n int) {
+	shown := false
+	if dworld := mr.daemonWorld(); dworld != nil {
+		for _, dp := range dworld.DaemonPens {
+			if dp == nil {
+				continue
+			}
+			dp.Lock()
+			daemons := dp.daemons
+			dp.Unlock()
+			for _, d := range daemons {
+				if name != "" && d.conf.Name() != name {
+					continue
+				}
+				mr.Log.Say("%s", separatorBanner("-- %s --", d.conf.Name()))
+				for _, l := range d.recent.Last(n) {
+					mr.Log.Say("%s", l)
+				}
+				shown = true
+			}
+		}
+	}
+	if !shown && name != "" {
+		mr.Log.Notice(">> no daemon named %s", name)
+	} else if !shown {
+		mr.Log.Notice(">> no daemons running")
+	}
+}
+
+// rerunPreps runs the preps of all blocks, including those that normally
+// only run on change, without restarting daemons. It waits for a running
+// cycle to finish first, so Interactive runs it in the background, leaving
+// keys to be read meanwhile.
+func (mr *ModRunner) rerunPreps() {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.Log.Notice(">> running preps")
+	envs := &envCache{}
+	if mr.dworld != nil {
+		envs = mr.dworld.env
+		envs.reset()
+	}
+	for i, b := range mr.Config.Blocks {
+		name := blockName(i, b)
+		_, err := mr.runBlock(name, b, nil, nil, false, nil, envs, mr.Log, nil)
+		mr.outcome(name, err == nil || nonFatal(err), mr.Log)
+	}
+}
@@ -0,0 +1,196 @@
+package modd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestInteractive(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			prep +onchange: echo ":prep: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	// Preps and restarts run in the background, so each is waited for
+	// before the next keys are sent
+	r, w := io.Pipe()
+	quit := make(chan bool, 1)
+	go func() {
+		if err := mr.Interactive(r, func() { quit <- true }); err != nil {
+			t.Error(err)
+		}
+	}()
+	io.WriteString(w, "p\n")
+	waitFor(t, lt, ":prep: ran")
+	io.WriteString(w, "r")
+	for start := time.Now(); !strings.Contains(lt.String(), ">> no daemons running"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for the restart:\n%s", lt.String())
+		}
+	}
+	io.WriteString(w, " x z q p")
+	w.Close()
+	select {
+	case <-quit:
+	case <-time.After(timeout):
+		t.Fatalf("Expected quit to be called")
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{":prep: ran"}) {
+		t.Errorf("Expected preps to run once, got %#v\n%s", ret, lt.String())
+	}
+	if !mr.Paused() {
+		t.Errorf("Expected z to pause")
+	}
+	for _, s := range []string{">> no daemons running", "unknown key 'x'", ">> paused"} {
+		if !strings.Contains(lt.String(), s) {
+			t.Errorf("Expected %q in output:\n%s", s, lt.String())
+		}
+	}
+}
+
+func TestInteractiveQuitDuringCycle(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":prep: waiting"; [ -e ran ] || { touch ran; sleep 100; }
+			daemon: sleep 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, ":prep: waiting")
+		// Quitting stops the prep and the daemons, rather than waiting for
+		// the cycle, and doesn't wait for the preps asked for before it
+		quit := make(chan bool, 1)
+		go mr.Interactive(strings.NewReader("pq"), func() { quit <- true })
+		select {
+		case <-quit:
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting to quit during a cycle")
+		}
+		for _, st := range mr.daemonWorld().DaemonPens[0].Status() {
+			if st.Running {
+				t.Errorf("Expected the daemon to be stopped: %#v", st)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatusDuringCycle(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			prep +onchange: echo ":prep: waiting"; while [ ! -e release ]; do sleep 0.01; done
+			daemon: sleep 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, ":prep: waiting")
+		// The status and tail are shown while the cycle is still running
+		done := make(chan bool)
+		go func() {
+			mr.statusTable(80)
+			mr.tailDaemons("", 1)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			t.Errorf("Timed out waiting for the status during a cycle")
+		}
+		ioutil.WriteFile("release", nil, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lt.String(), "DAEMON") || !strings.Contains(lt.String(), "-- sleep 100 --") {
+		t.Errorf("Expected the status and tail in output:\n%s", lt.String())
+	}
+}
+
+func TestInteractiveStopStart(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		** {
+			daemon +procname=web +pidfile=web.pid: sleep 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		dp := mr.daemonWorld().DaemonPens[0]
+		waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+
+		keys := ":stop web\n:stop nope\n:stop\n:bogus\n:sto\x7fp\x7f\x7f\x7f\x03"
+		if err := mr.Interactive(strings.NewReader(keys), func() {}); err != nil {
+			t.Fatal(err)
+		}
+		st := waitStatus(t, dp, func(st DaemonStatus) bool { return !st.Running })
+		if !st.Held {
+			t.Errorf("Expected the daemon to be held: %#v", st)
+		}
+		if _, err := os.Stat("web.pid"); !os.IsNotExist(err) {
+			t.Errorf("Expected the pidfile to be removed once stopped, got %v", err)
+		}
+		for _, s := range []string{
+			">> stopped web", ">> no daemon named nope", "usage: stop NAME", `unknown command "bogus"`,
+		} {
+			if !strings.Contains(lt.String(), s) {
+				t.Errorf("Expected %q in output:\n%s", s, lt.String())
+			}
+		}
+
+		if err := mr.Interactive(strings.NewReader(":start web"), func() {}); err != nil {
+			t.Fatal(err)
+		}
+		st = waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running })
+		if st.Held {
+			t.Errorf("Expected the daemon to be started: %#v", st)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
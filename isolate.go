@@ -0,0 +1,89 @@
+package modd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// isolateSkip names the directories that aren't copied into an isolated
+// directory
+var isolateSkip = map[string]bool{
+	".git": true,
+	".hg":  true,
+	".svn": true,
+	".bzr": true,
+}
+
+// isolate makes a fresh temporary directory holding a copy of dir, or of the
+// current directory if dir is empty, for a block's preps to run in. VCS
+// directories aren't copied. The returned function removes the directory.
+func isolate(dir string) (string, func(), error) {
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempDir("", "modd-isolate-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.RemoveAll(tmp) }
+	if err := copyTree(dir, tmp); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("could not isolate %s: %s", dir, err)
+	}
+	return tmp, remove, nil
+}
+
+// copyTree copies the files, directories and symlinks under src into the
+// existing directory dst, keeping their modes. Other kinds of file are
+// passed over.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if isolateSkip[fi.Name()] {
+				return filepath.SkipDir
+			}
+			return os.Mkdir(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(p, target, mode.Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
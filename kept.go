@@ -0,0 +1,64 @@
+package modd
+
+import (
+	"sync"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// keptValues holds the output of a block's preps with the Keep option, from
+// one run of the block to the next. The methods of a nil keptValues keep
+// nothing, so every run is a first run.
+type keptValues struct {
+	values map[string]string
+	sync.Mutex
+}
+
+// env returns the variables that pass the values kept by the last run to the
+// preps of b. Values that haven't been kept yet are empty.
+func (k *keptValues) env(b conf.Block) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, p := range b.Preps {
+		if p.Keep == "" || seen[p.Keep] {
+			continue
+		}
+		seen[p.Keep] = true
+		ret = append(ret, "MODD_PREV_"+p.Keep+"="+k.get(p.Keep))
+	}
+	return ret
+}
+
+// keptValues returns the values kept by the preps of the named block
+func (mr *ModRunner) keptValues(block string) *keptValues {
+	if mr.kept == nil {
+		mr.kept = make(map[string]*keptValues)
+	}
+	k := mr.kept[block]
+	if k == nil {
+		k = &keptValues{}
+		mr.kept[block] = k
+	}
+	return k
+}
+
+func (k *keptValues) get(name string) string {
+	if k == nil {
+		return ""
+	}
+	k.Lock()
+	defer k.Unlock()
+	return k.values[name]
+}
+
+func (k *keptValues) set(name, value string) {
+	if k == nil {
+		return
+	}
+	k.Lock()
+	defer k.Unlock()
+	if k.values == nil {
+		k.values = make(map[string]string)
+	}
+	k.values[name] = value
+}
@@ -0,0 +1,95 @@
+package modd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A listener is a socket that modd listens on for a daemon, and passes to it.
+// The socket outlives the daemon's processes, so connections made while the
+// daemon restarts wait to be accepted rather than being refused.
+type listener struct {
+	file *os.File
+	// The path of a Unix socket, removed when the listener is closed
+	path string
+}
+
+// listen opens a socket for each of addrs, which are host:port pairs or
+// unix:PATH. Relative socket paths are taken from dir.
+func listen(addrs []string, dir string) ([]*listener, error) {
+	var ret []*listener
+	for _, a := range addrs {
+		l, err := listenOne(a, dir)
+		if err != nil {
+			closeListeners(ret)
+			return nil, fmt.Errorf("could not listen on %s: %s", a, err)
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+func listenOne(addr string, dir string) (*listener, error) {
+	var nl interface {
+		net.Listener
+		File() (*os.File, error)
+	}
+	var path string
+	if strings.HasPrefix(addr, "unix:") {
+		path = strings.TrimPrefix(addr, "unix:")
+		if dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		// The socket is removed when the listener is closed, not when the
+		// original descriptor is closed below
+		ul.SetUnlinkOnClose(false)
+		nl = ul
+	} else {
+		ta, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tl, err := net.ListenTCP("tcp", ta)
+		if err != nil {
+			return nil, err
+		}
+		nl = tl
+	}
+	// File returns a duplicate of the socket's descriptor, which is all
+	// that's kept
+	f, err := nl.File()
+	nl.Close()
+	if err != nil {
+		if path != "" {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	return &listener{file: f, path: path}, nil
+}
+
+// listenerFiles returns the files of ls, to be passed to a process
+func listenerFiles(ls []*listener) []*os.File {
+	var ret []*os.File
+	for _, l := range ls {
+		ret = append(ret, l.file)
+	}
+	return ret
+}
+
+// closeListeners closes ls, and removes their sockets
+func closeListeners(ls []*listener) {
+	for _, l := range ls {
+		l.file.Close()
+		if l.path != "" {
+			os.Remove(l.path)
+		}
+	}
+}
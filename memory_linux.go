@@ -0,0 +1,43 @@
+package modd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// groupMemory returns the total resident memory in bytes of the processes in
+// process group pgid, read from /proc
+func groupMemory(pgid int) (int64, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			// The process has exited since the glob
+			continue
+		}
+		// The command name is in parentheses, and may contain spaces, so
+		// the fields are counted from the closing parenthesis. The process
+		// group is the third field after it, and rss, in pages, the 22nd.
+		s := string(data)
+		fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		if pgrp, err := strconv.Atoi(fields[2]); err != nil || pgrp != pgid {
+			continue
+		}
+		rss, err := strconv.ParseInt(fields[21], 10, 64)
+		if err != nil {
+			continue
+		}
+		total += rss * int64(os.Getpagesize())
+	}
+	return total, nil
+}
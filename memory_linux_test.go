@@ -0,0 +1,44 @@
+package modd
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func TestDaemonMaxMemory(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{
+			{
+				Command:        "a=$(printf '%050000000d' 0); sleep 100",
+				RestartSignal:  syscall.SIGTERM,
+				MaxMemory:      20 << 20,
+				MemoryInterval: 100 * time.Millisecond,
+			},
+		},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return len(st.History) > 0 })
+	if st.History[0].Reason != "memory" {
+		t.Errorf("Expected restart for memory use, got %#v", st.History)
+	}
+}
+
+func TestGroupMemory(t *testing.T) {
+	rss, err := groupMemory(syscall.Getpgrp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss <= 0 {
+		t.Errorf("Expected the test's process group to use memory, got %d", rss)
+	}
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package modd
+
+// groupMemory is only available on Linux
+func groupMemory(pgid int) (int64, error) {
+	return 0, errNoMemorySampling
+}
@@ -0,0 +1,27 @@
+package modd
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MetricsHandler returns a handler that serves the runner's WatchStats in the
+// Prometheus text format
+func (mr *ModRunner) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := mr.WatchStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []struct {
+			name  string
+			help  string
+			value int64
+		}{
+			{"modd_watch_events_total", "File changes received from the watcher.", st.Events},
+			{"modd_watch_filtered_total", "File changes dropped without running anything.", st.Filtered},
+			{"modd_watch_debounced_total", "File changes folded into a batch already waiting to run.", st.Debounced},
+			{"modd_watch_cycles_total", "Cycles run for file changes.", st.Cycles},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+		}
+	})
+}
@@ -1,18 +1,26 @@
 package modd
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cortesi/modd/conf"
 	"github.com/cortesi/modd/notify"
 	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/moddwatch/filter"
 	"github.com/cortesi/termlog"
+	"github.com/fatih/color"
 )
 
 // Version is the modd release version
@@ -22,6 +30,9 @@ const lullTime = time.Millisecond * 100
 
 const shellVarName = "@shell"
 
+// errMaxRuntime is returned by runOnChan when MaxRuntime has passed
+var errMaxRuntime = errors.New("max runtime reached")
+
 // CommonExcludes is a list of commonly excluded files suitable for passing in
 // the excludes parameter to Watch - includes repo directories, temporary
 // files, and so forth.
@@ -51,21 +62,148 @@ var CommonExcludes = []string{
 	"**/node_modules/**",
 }
 
+// ConfStdin is the configuration path that reads the config from stdin
+const ConfStdin = "-"
+
+// The name used for a config read from stdin in messages
+const stdinName = "<stdin>"
+
 // ModRunner coordinates running the modd command
 type ModRunner struct {
-	Log        termlog.TermLog
-	Config     *conf.Config
+	Log    termlog.TermLog
+	Config *conf.Config
+	// ConfPath is the path to the config file, or ConfStdin. A config read
+	// from stdin can't be reloaded.
 	ConfPath   string
 	ConfReload bool
-	Notifiers  []notify.Notifier
+	// Profile, if set, names an overlay that's merged over the config. It's
+	// read from the file given by ProfilePath.
+	Profile   string
+	Notifiers []notify.Notifier
+	// ExitOnFail causes Run to return as soon as any prep fails
+	ExitOnFail bool
+	// NoSeparators turns off the line printed at the start of each cycle
+	// triggered by changes
+	NoSeparators bool
+	// NoWatch causes Run to run the blocks once and leave the daemons
+	// running until modd is interrupted, without watching for changes
+	NoWatch bool
+	// Cooldown is a period after each cycle during which changes are
+	// accumulated, and then acted on together in a single cycle
+	Cooldown time.Duration
+	// Settle, if non-zero, is how long the filesystem must be quiet before
+	// changes are acted on. Each change restarts the wait, so that preps
+	// aren't run and daemons restarted while a long burst of writes is
+	// still going on.
+	Settle time.Duration
+	// Stagger, if non-zero, is the longest random delay inserted before the
+	// preps of each block in a cycle, to spread out the load of blocks that
+	// run together
+	Stagger time.Duration
+	// ContentHash ignores changes to files whose content is the same as when
+	// they were last seen, like those made by tools that only touch
+	// modification times. Files are hashed when changed, and once at startup.
+	ContentHash bool
+	// SkipDuplicateCycles skips a cycle triggered by changes when the files
+	// that changed, and their content, are the same as for the cycle
+	// triggered by changes before it, like an editor that writes a file
+	// twice in a row
+	SkipDuplicateCycles bool
+	// MinInterval is the least time between the end of one cycle triggered
+	// by changes and the start of the next. Changes that arrive sooner are
+	// held back until it has passed, which breaks loops where a cycle's
+	// output triggers the next cycle.
+	MinInterval time.Duration
+	// NoRestart leaves running daemons alone when their blocks are
+	// triggered. Daemons are still started with their blocks, and restarted
+	// if they exit.
+	NoRestart bool
+	// FirstMatch runs only one block for each changed file: the matching
+	// block with the highest priority, or the first in the config of those
+	// with equal priority. Other matching blocks aren't run for the file.
+	FirstMatch bool
+	// SignalActions maps signals that modd receives to what it does about
+	// them. SIGUSR1 and SIGUSR2 lose their usual meanings if they're mapped.
+	SignalActions map[os.Signal]SignalAction
+	// DropPaused discards changes made while modd is paused, instead of
+	// running them when it's resumed
+	DropPaused bool
+	// MaxRuntime, if non-zero, is how long Run keeps going before it shuts
+	// the daemons down and returns. An unfinished cycle is completed first.
+	MaxRuntime time.Duration
+	// SummaryFile, if set, is the path of a JSON file that's replaced with a
+	// summary of each cycle as it completes
+	SummaryFile string
+	// StateFile, if set, is the path of a JSON file that records the running
+	// daemons. Daemons recorded there by an earlier instance of modd adopt
+	// their processes, if they're still running, rather than starting anew.
+	StateFile string
+	// BeforeHandoff, if set, is called before modd executes itself afresh to
+	// hand its daemons off, to undo changes it's made to the terminal
+	BeforeHandoff func()
+	// Runner, if set, is used to run preps and restart daemons in place of
+	// the shell
+	Runner Runner
+	// Tracer, if set, records each cycle as a trace, with spans for the
+	// blocks, preps and daemon runs in it
+	Tracer *Tracer
+	// Status, if set, shows that preps are running
+	Status *StatusLine
+
+	// The reader used for a config read from stdin, and its contents once
+	// read
+	stdin     io.Reader
+	stdinConf []byte
+	// The daemons of the currently running configuration, if any. It's set
+	// with both the runner's lock and worldLock held, so that it can be read
+	// with worldLock alone while a cycle holds the runner's lock.
+	dworld    *DaemonWorld
+	worldLock sync.Mutex
+	// Receives once MaxRuntime has passed since Run started
+	expired <-chan time.Time
+	events  eventBus
+	pause   pauser
+	// Called with the result of each cycle
+	cycleHooks []func(CycleResult)
+	// Whether the last run of each block passed, keyed by block name
+	passed map[string]bool
+	// Changes held over for blocks with MinChanges and Accumulate set, until
+	// there are enough of them, keyed by block name
+	held map[string]*moddwatch.Mod
+	// Output kept by preps for the next run of their block, keyed by block
+	// name
+	kept map[string]*keptValues
+	// The source of stagger delays, seeded when first used
+	staggerRand *rand.Rand
+	// Makes sure the teardown command runs only once
+	teardown sync.Once
+	// Counts of the changes received from the watcher
+	watch watchCounters
+	// The channel changes from the watcher are sent on while the runner is
+	// running, which Inject sends on too
+	changes chan *moddwatch.Mod
+	// The result of the last completed cycle, and the number of cycles run
+	lastCycle *CycleResult
+	cycles    int
+	sync.Mutex
 }
 
 // NewModRunner constructs a new ModRunner
 func NewModRunner(confPath string, log termlog.TermLog, notifiers []notify.Notifier, confreload bool) (*ModRunner, error) {
+	return NewProfileModRunner(confPath, "", log, notifiers, confreload)
+}
+
+// NewProfileModRunner constructs a new ModRunner, with the overlay for
+// profile merged over its config
+func NewProfileModRunner(confPath string, profile string, log termlog.TermLog, notifiers []notify.Notifier, confreload bool) (*ModRunner, error) {
+	if profile != "" && confPath == ConfStdin {
+		return nil, fmt.Errorf("a profile can't be used with a config read from stdin")
+	}
 	mr := &ModRunner{
 		Log:        log,
 		ConfPath:   confPath,
-		ConfReload: confreload,
+		ConfReload: confreload && confPath != ConfStdin,
+		Profile:    profile,
 		Notifiers:  notifiers,
 	}
 	err := mr.ReadConfig()
@@ -75,112 +213,775 @@ func NewModRunner(confPath string, log termlog.TermLog, notifiers []notify.Notif
 	return mr, nil
 }
 
-// ReadConfig parses the configuration file in ConfPath
+// OnCycle registers f to be called with the result of each cycle, once it's
+// complete. Callbacks are called in the order they were registered, after
+// the runner's lock is released, so they may call LastCycle. A callback that
+// panics is reported, and doesn't stop modd. OnCycle should be called before
+// the runner is started.
+func (mr *ModRunner) OnCycle(f func(CycleResult)) {
+	mr.cycleHooks = append(mr.cycleHooks, f)
+}
+
+// AddEventSink registers s to receive all lifecycle events from the runner.
+// It should be called before the runner is started.
+func (mr *ModRunner) AddEventSink(s EventSink) {
+	mr.events.add(s)
+}
+
+// ProfilePath returns the path of the overlay for profile, which sits beside
+// the config at confPath: the overlay for profile ci of modd.conf is
+// modd.ci.conf.
+func ProfilePath(confPath string, profile string) string {
+	ext := filepath.Ext(confPath)
+	return strings.TrimSuffix(confPath, ext) + "." + profile + ext
+}
+
+// ReadConfig parses the configuration file in ConfPath. If ConfPath is
+// ConfStdin, the config is read from stdin the first time, and the same
+// config is parsed again on later calls. If Profile is set, its overlay is
+// merged over the config.
 func (mr *ModRunner) ReadConfig() error {
-	ret, err := ioutil.ReadFile(mr.ConfPath)
-	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+	name := mr.ConfPath
+	var ret []byte
+	var err error
+	if mr.ConfPath == ConfStdin {
+		name = stdinName
+		ret, err = mr.readStdinConf()
+	} else {
+		ret, err = ioutil.ReadFile(mr.ConfPath)
 	}
-	newcnf, err := conf.Parse(mr.ConfPath, string(ret))
 	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+		return fmt.Errorf("Error reading config file %s: %s", name, err)
+	}
+	// Parse errors give the file name and position, and are returned as they
+	// are, so that callers can show the details
+	var newcnf *conf.Config
+	if mr.Profile != "" {
+		overlayPath := ProfilePath(mr.ConfPath, mr.Profile)
+		overlay, err := ioutil.ReadFile(overlayPath)
+		if err != nil {
+			return fmt.Errorf("Error reading profile %s: %s", mr.Profile, err)
+		}
+		newcnf, err = conf.ParseProfile(name, string(ret), overlayPath, string(overlay))
+		if err != nil {
+			return err
+		}
+	} else {
+		newcnf, err = conf.Parse(name, string(ret))
+		if err != nil {
+			return err
+		}
 	}
 
-	if _, err := shell.GetShellName(newcnf.GetVariables()[shellVarName]); err != nil {
+	if _, err := shell.GetShellName(newcnf.ShellName()); err != nil {
 		return err
 	}
+	for _, b := range newcnf.Blocks {
+		if _, err := shell.GetShellName(b.Shell); err != nil {
+			return err
+		}
+		for _, d := range b.Daemons {
+			if err := shell.CheckCredential(d.User, d.Group); err != nil {
+				return fmt.Errorf("daemon %s: %s", d.Name(), err)
+			}
+		}
+	}
 
 	newcnf.CommonExcludes(CommonExcludes)
 	mr.Config = newcnf
 	return nil
 }
 
+// confChanged reports whether mod touches the config file or the overlay of
+// its profile
+func (mr *ModRunner) confChanged(mod *moddwatch.Mod) bool {
+	if mod.Has(mr.ConfPath) {
+		return true
+	}
+	return mr.Profile != "" && mod.Has(ProfilePath(mr.ConfPath, mr.Profile))
+}
+
+// readStdinConf reads the config from stdin, unless it has already been read
+func (mr *ModRunner) readStdinConf() ([]byte, error) {
+	if mr.stdinConf != nil {
+		return mr.stdinConf, nil
+	}
+	r := mr.stdin
+	if r == nil {
+		r = os.Stdin
+	}
+	ret, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	mr.stdinConf = ret
+	return ret, nil
+}
+
+// PreludeError is returned when the prelude command fails, in which case
+// nothing else is run
+type PreludeError struct {
+	Err error
+}
+
+func (e PreludeError) Error() string {
+	return fmt.Sprintf("prelude failed: %s", e.Err)
+}
+
+// runPrelude runs the prelude command of the config, if it has one
+func (mr *ModRunner) runPrelude() error {
+	if mr.Config.Prelude == "" {
+		return nil
+	}
+	if err := mr.runGlobal("prelude: ", mr.Config.Prelude); err != nil {
+		return PreludeError{err}
+	}
+	return nil
+}
+
+// runTeardown runs the teardown command of the config, if it has one, once
+// daemons have shut down. It's run at most once, and a failure is logged.
+func (mr *ModRunner) runTeardown() {
+	mr.teardown.Do(func() {
+		if mr.Config == nil || mr.Config.Teardown == "" {
+			return
+		}
+		if err := mr.runGlobal("teardown: ", mr.Config.Teardown); err != nil {
+			if _, ok := err.(ProcError); !ok {
+				mr.Log.Shout("teardown failed: %s", err)
+			}
+		}
+	})
+}
+
+// runGlobal runs cmd, a command from outside of any block, with the global
+// environment. Its output is logged under a header starting with kind.
+func (mr *ModRunner) runGlobal(kind, cmd string) error {
+	sh, err := shell.GetShellName(mr.Config.ShellName())
+	if err != nil {
+		return err
+	}
+	env, err := (&envCache{}).resolve(mr.Config.Env, sh, "")
+	if err != nil {
+		return err
+	}
+	opts := procOptions{env: env, echo: mr.Config.Echo, mask: maskPattern(mr.Config.Mask)}
+	_, err = runProc(cmd, sh, "", opts, mr.Log.Stream(niceHeader(kind, cmd)))
+	return err
+}
+
 // PrepOnly runs all prep functions and exits
 func (mr *ModRunner) PrepOnly(initial bool) error {
+	if err := mr.runPrelude(); err != nil {
+		return err
+	}
+	defer mr.runTeardown()
+	envs := &envCache{}
 	for _, b := range mr.Config.Blocks {
-		err := RunPreps(b, mr.Config.GetVariables(), nil, mr.Log, mr.Notifiers, initial)
-		if err != nil {
+		err := runPreps(
+			b, mr.Config.GetVariables(), nil, nil, mr.Log, mr.Notifiers, initial,
+			envs, &mr.events, mr.Runner, nil, nil,
+		)
+		if err != nil && !nonFatal(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func (mr *ModRunner) runBlock(b conf.Block, mod *moddwatch.Mod, dpen *DaemonPen) {
+// RunBlock runs the preps of the block with the specified label, and restarts
+// its daemons if modd is running. Output from the preps is sent to log. If
+// only preps with the ContinueOnError flag failed, the daemons are restarted
+// and a NonFatalError is returned.
+func (mr *ModRunner) RunBlock(label string, log termlog.TermLog) error {
+	mr.Lock()
+	defer mr.Unlock()
+	for i, b := range mr.Config.Blocks {
+		if b.Label != "" && b.Label == label {
+			var dpen *DaemonPen
+			envs := &envCache{}
+			if mr.dworld != nil {
+				dpen = mr.dworld.DaemonPens[i]
+				envs = mr.dworld.env
+			}
+			name := blockName(i, b)
+			_, err := mr.runBlock(name, b, nil, nil, false, dpen, envs, log, nil)
+			mr.outcome(name, err == nil || nonFatal(err), log)
+			return err
+		}
+	}
+	return fmt.Errorf("No such block: %s", label)
+}
+
+// runBlock runs the preps of block b, and then restarts its daemons. It returns
+// the number of daemons restarted or started.
+func (mr *ModRunner) runBlock(
+	name string,
+	b conf.Block,
+	mod *moddwatch.Mod,
+	matches []PatternMatch,
+	initial bool,
+	dpen *DaemonPen,
+	envs *envCache,
+	log termlog.TermLog,
+	span *Span,
+) (int, error) {
 	if b.InDir != "" {
 		currentDir, err := os.Getwd()
 		if err != nil {
-			mr.Log.Shout("Error getting current working directory: %s", err)
-			return
+			log.Shout("Error getting current working directory: %s", err)
+			return 0, err
 		}
 		err = os.Chdir(b.InDir)
 		if err != nil {
-			mr.Log.Shout(
+			log.Shout(
 				"Error changing to indir directory \"%s\": %s",
 				b.InDir,
 				err,
 			)
-			return
+			return 0, err
 		}
 		defer func() {
 			err := os.Chdir(currentDir)
 			if err != nil {
-				mr.Log.Shout("Error returning to original directory: %s", err)
+				log.Shout("Error returning to original directory: %s", err)
 			}
 		}()
 	}
-	err := RunPreps(
+	done := func(bool) {}
+	if len(b.Preps) > 0 {
+		done = mr.building(name, log)
+	}
+	err := runPreps(
 		b,
 		mr.Config.GetVariables(),
-		mod, mr.Log,
+		mod, matches, log,
 		mr.Notifiers,
-		mod == nil,
+		initial,
+		envs,
+		&mr.events,
+		mr.Runner,
+		mr.keptValues(name),
+		span,
 	)
-	if err != nil {
+	done(err == nil || nonFatal(err))
+	if err != nil && !nonFatal(err) {
 		if _, ok := err.(ProcError); !ok {
-			mr.Log.Shout("Error running prep: %s", err)
+			log.Shout("Error running prep: %s", err)
 		}
-		return
+		return 0, err
+	}
+	if len(b.Daemons) > 0 && len(matches) > 0 && (mr.Runner != nil || dpen != nil) {
+		log.NoticeAs("debug", "restarting daemons, changes matched %s", patternList(matches))
+	}
+	var failed []string
+	if nf, ok := err.(NonFatalError); ok {
+		failed = nf.Failed
+	}
+	daemons := []conf.Daemon{}
+	for _, d := range b.Daemons {
+		if p := failedNeed(d, failed); p != "" {
+			log.Warn(">> not restarting %s, prep %s failed", d.Name(), p)
+		} else {
+			daemons = append(daemons, d)
+		}
+	}
+	b.Daemons = daemons
+	restarted := 0
+	if mr.Runner != nil {
+		if !initial {
+			b = mr.restartable(b)
+		}
+		if len(b.Daemons) > 0 {
+			mr.Runner.Restart(b)
+		}
+		restarted = len(b.Daemons)
+	} else if dpen != nil {
+		restarted = dpen.restartOnChange(mr.NoRestart, failed)
+	}
+	return restarted, err
+}
+
+// failedNeed returns the first of the preps that d needs to be among failed,
+// or an empty string if none are
+func failedNeed(d conf.Daemon, failed []string) string {
+	for _, n := range d.Needs {
+		for _, f := range failed {
+			if n == f {
+				return n
+			}
+		}
+	}
+	return ""
+}
+
+// restartable returns a copy of b with only the daemons that are restarted
+// when the block is triggered
+func (mr *ModRunner) restartable(b conf.Block) conf.Block {
+	daemons := []conf.Daemon{}
+	for _, d := range b.Daemons {
+		if !mr.NoRestart && !d.NoRestart {
+			daemons = append(daemons, d)
+		}
+	}
+	b.Daemons = daemons
+	return b
+}
+
+// staggerDelay returns a random delay between zero and Stagger. The lock must
+// be held.
+func (mr *ModRunner) staggerDelay() time.Duration {
+	if mr.staggerRand == nil {
+		mr.staggerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(mr.staggerRand.Int63n(int64(mr.Stagger) + 1))
+}
+
+// Trigger runs a single cycle for mod, as if the changes had been detected by
+// the watcher. If mod is nil, all blocks run as they do when modd starts.
+// Daemons are restarted only if modd is running.
+func (mr *ModRunner) Trigger(mod *moddwatch.Mod) error {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return err
 	}
-	dpen.Restart()
+	mr.Lock()
+	dworld := mr.dworld
+	mr.Unlock()
+	if dworld == nil {
+		dworld = &DaemonWorld{
+			DaemonPens: make([]*DaemonPen, len(mr.Config.Blocks)),
+			env:        &envCache{},
+			events:     &mr.events,
+		}
+	}
+	return mr.trigger(currentDir, mod, dworld)
+}
+
+// trigger runs all blocks matching mod, recording the outcome as the last
+// cycle. If ExitOnFail is set, the first error stops the run and is returned.
+// Non-fatal prep failures are recorded, but don't stop the run. The
+// oncycleend command, if any, is started once the cycle is done, whether or
+// not it succeeded.
+func (mr *ModRunner) trigger(root string, mod *moddwatch.Mod, dworld *DaemonWorld) error {
+	return mr.runCycle(root, mod, -1, dworld)
 }
 
-func (mr *ModRunner) trigger(root string, mod *moddwatch.Mod, dworld *DaemonWorld) {
+// runCycle runs a cycle, as for trigger. If scheduled is a block index, only
+// that block is run, for its schedule rather than a change, and mod is
+// ignored.
+func (mr *ModRunner) runCycle(root string, mod *moddwatch.Mod, scheduled int, dworld *DaemonWorld) error {
+	mr.Lock()
+	defer func() {
+		result := mr.lastCycle
+		mr.Unlock()
+		mr.notifyCycle(result)
+	}()
+	dworld.env.reset()
+	mr.cycles++
+	if scheduled >= 0 {
+		mod = nil
+		if !mr.NoSeparators {
+			b := mr.Config.Blocks[scheduled]
+			mr.Log.Say("%s", separatorBanner(
+				"-- cycle %d: %s, every %s --", mr.cycles, blockName(scheduled, b), b.Every,
+			))
+		}
+	} else if mod != nil && !mr.NoSeparators {
+		mr.Log.Say("%s", separatorBanner("-- cycle %d: %s --", mr.cycles, changeSummary(mod)))
+	}
+	result := &CycleResult{Start: time.Now()}
+	defer mr.endCycle(result, dworld)
+	cspan := mr.Tracer.startCycle()
+	if cspan != nil {
+		cspan.set("modd.cycle", mr.cycles)
+		switch {
+		case scheduled >= 0:
+			cspan.set("modd.trigger", "schedule")
+		case mod != nil:
+			cspan.set("modd.trigger", "change")
+			cspan.set("modd.changes", len(mod.All())+len(mod.Deleted))
+		default:
+			cspan.set("modd.trigger", "initial")
+		}
+		defer func() {
+			cspan.set("modd.blocks", len(result.Blocks))
+			failed := result.Failed()
+			cspan.set("modd.failed", len(failed))
+			if len(failed) > 0 {
+				cspan.fail(fmt.Errorf("failed: %s", strings.Join(failed, ", ")))
+			}
+			cspan.finish()
+		}()
+	}
+	var stats *cycleStats
+	if mr.Config.OnCycleEnd != "" {
+		stats = &cycleStats{start: time.Now()}
+		mr.events.add(stats)
+		defer func() {
+			mr.events.remove(stats)
+			mr.cycleEnd(stats, dworld.env, mr.Log)
+		}()
+	}
+	var claims []*moddwatch.Mod
+	if mr.FirstMatch && mod != nil && scheduled < 0 {
+		var err error
+		claims, err = firstMatches(root, mod, mr.Config.Blocks)
+		if err != nil {
+			mr.Log.Shout("Error filtering events: %s", err)
+			return nil
+		}
+	}
 	for i, b := range mr.Config.Blocks {
+		name := blockName(i, b)
 		lmod := mod
-		if lmod != nil {
+		var matches []PatternMatch
+		initial := lmod == nil
+		if scheduled >= 0 {
+			if i != scheduled {
+				continue
+			}
+			mr.Log.NoticeAs("debug", "%s: scheduled by timer, every %s", name, b.Every)
+			initial = false
+		} else if lmod != nil {
 			var err error
-			lmod, err = mod.Filter(root, b.Include, b.Exclude)
+			lmod, err = filterBlock(mod, &b)
 			if err != nil {
 				mr.Log.Shout("Error filtering events: %s", err)
 				continue
 			}
 			if lmod.Empty() {
+				mr.Log.NoticeAs("debug", "%s: not scheduled, no matching changes", name)
 				continue
 			}
+			if claims != nil {
+				if claims[i].Empty() {
+					mr.Log.NoticeAs("debug", "%s: not scheduled, changes matched a block of higher priority", name)
+					continue
+				}
+				lmod = claims[i]
+			}
+			if b.MinChanges > 0 {
+				var enough bool
+				if lmod, enough = mr.enoughChanges(name, b, lmod); !enough {
+					continue
+				}
+			}
+			matches = matchPatterns(b, lmod)
+			mr.Log.NoticeAs(
+				"debug", "%s: scheduled, changes matched %s", name, patternList(matches),
+			)
+			mr.events.emit(Event{
+				Type:    EventChange,
+				Block:   b.Label,
+				Paths:   lmod.All(),
+				Matches: matches,
+			})
+		} else {
+			mr.Log.NoticeAs("debug", "%s: scheduled for initial run", name)
+		}
+		if mr.Stagger > 0 && len(b.Preps) > 0 {
+			d := mr.staggerDelay()
+			mr.Log.NoticeAs("debug", "%s: staggered by %s", name, d)
+			time.Sleep(d)
+		}
+		start := time.Now()
+		span := cspan.child("block")
+		restarted, err := mr.runBlock(name, b, lmod, matches, initial, dworld.DaemonPens[i], dworld.env, mr.Log, span)
+		br := BlockResult{Name: name, Label: b.Label, Duration: time.Since(start), Restarted: restarted}
+		if nf, ok := err.(NonFatalError); ok {
+			br.NonFatal = nf.Errors
+			err = nil
+		}
+		br.Err = err
+		mr.outcome(name, err == nil, mr.Log)
+		result.Blocks = append(result.Blocks, br)
+		if span != nil {
+			span.set("modd.block", name)
+			span.set("modd.restarted", br.Restarted)
+			span.set("modd.nonfatal", len(br.NonFatal))
+			span.fail(err)
+			span.finish()
+		}
+		if stats != nil {
+			stats.Lock()
+			stats.daemons += br.Restarted
+			stats.Unlock()
+		}
+		if err != nil {
+			mr.Log.NoticeAs("debug", "%s: prep failed, daemons not restarted", name)
+			if mr.ExitOnFail {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enoughChanges reports whether the changes in mod meet the block's
+// MinChanges threshold, and returns the changes to run the block for. If the
+// block accumulates changes, those held over from earlier are joined to mod,
+// and the total is held over again if it falls short.
+func (mr *ModRunner) enoughChanges(name string, b conf.Block, mod *moddwatch.Mod) (*moddwatch.Mod, bool) {
+	if held := mr.held[name]; held != nil && b.Accumulate {
+		joined := held.Join(*mod)
+		mod = &joined
+	}
+	delete(mr.held, name)
+	n := len(mod.All()) + len(mod.Deleted)
+	if n >= b.MinChanges {
+		return mod, true
+	}
+	if b.Accumulate {
+		if mr.held == nil {
+			mr.held = make(map[string]*moddwatch.Mod)
 		}
-		mr.runBlock(b, lmod, dworld.DaemonPens[i])
+		mr.held[name] = mod
+		mr.Log.NoticeAs(
+			"debug", "%s: not scheduled, %d of %d changes needed, held for the next change",
+			name, n, b.MinChanges,
+		)
+	} else {
+		mr.Log.NoticeAs(
+			"debug", "%s: not scheduled, %d of %d changes needed", name, n, b.MinChanges,
+		)
 	}
+	return mod, false
+}
+
+var (
+	recoveredBanner = color.New(color.FgGreen, color.Bold).SprintfFunc()
+	failingBanner   = color.New(color.FgRed, color.Bold).SprintfFunc()
+	separatorBanner = termlog.DefaultPalette.Header.SprintfFunc()
+)
+
+// summaryFiles is the number of changed files named in a cycle separator
+const summaryFiles = 3
+
+// changeSummary describes the files in mod, for the separator at the start of
+// a cycle
+func changeSummary(mod *moddwatch.Mod) string {
+	files := append(mod.All(), mod.Deleted...)
+	if len(files) == 0 {
+		return "no changes"
+	}
+	sort.Strings(files)
+	if len(files) <= summaryFiles {
+		return strings.Join(files, ", ")
+	}
+	return fmt.Sprintf(
+		"%s and %d more", strings.Join(files[:summaryFiles], ", "), len(files)-summaryFiles,
+	)
+}
+
+// outcome records whether a run of the named block passed, tells any
+// OutcomeNotifiers, and announces the transitions from failing to passing and
+// back
+func (mr *ModRunner) outcome(name string, passed bool, log termlog.TermLog) {
+	if mr.passed == nil {
+		mr.passed = make(map[string]bool)
+	}
+	last, seen := mr.passed[name]
+	mr.passed[name] = passed
+	for _, n := range mr.Notifiers {
+		if on, ok := n.(notify.OutcomeNotifier); ok {
+			on.Outcome(name, passed)
+		}
+	}
+	if !seen || last == passed {
+		return
+	}
+	if passed {
+		log.Say("%s", recoveredBanner(">> %s: recovered", name))
+	} else {
+		log.Say("%s", failingBanner(">> %s: now failing", name))
+	}
+}
+
+// blockName returns a name for block b at index i, for use in messages
+func blockName(i int, b conf.Block) string {
+	if b.Label != "" {
+		return b.Label
+	}
+	return fmt.Sprintf("block %d", i+1)
+}
+
+// PatternMatch records the changed files matched by one of a block's include
+// patterns
+type PatternMatch struct {
+	Pattern string   `json:"pattern"`
+	Files   []string `json:"files"`
+}
+
+// filterBlock returns the changes of mod that the patterns of b match
+func filterBlock(mod *moddwatch.Mod, b *conf.Block) (*moddwatch.Mod, error) {
+	changed, err := b.Filter(mod.Changed)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := b.Filter(mod.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	added, err := b.Filter(mod.Added)
+	if err != nil {
+		return nil, err
+	}
+	return &moddwatch.Mod{Changed: changed, Deleted: deleted, Added: added}, nil
+}
+
+// matchPatterns returns the include patterns of b that match files in mod,
+// with the files each one matched. mod holds only files that the block
+// matches.
+func matchPatterns(b conf.Block, mod *moddwatch.Mod) []PatternMatch {
+	ret := []PatternMatch{}
+	for _, p := range b.Include {
+		files, err := filter.Files(mod.All(), []string{p}, nil)
+		if err == nil && len(files) > 0 {
+			ret = append(ret, PatternMatch{Pattern: p, Files: files})
+		}
+	}
+	return ret
+}
+
+// firstMatches divides the files of mod between blocks, giving each file to
+// the block of the highest priority that matches it, and of those, the first
+// in config order. The returned Mods hold the files each block was given.
+func firstMatches(root string, mod *moddwatch.Mod, blocks []conf.Block) ([]*moddwatch.Mod, error) {
+	order := make([]int, len(blocks))
+	for i := range blocks {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return blocks[order[a]].Priority > blocks[order[b]].Priority
+	})
+	claimed := map[string]bool{}
+	unclaimed := func(files []string) []string {
+		ret := []string{}
+		for _, f := range files {
+			if !claimed[f] {
+				ret = append(ret, f)
+			}
+		}
+		return ret
+	}
+	ret := make([]*moddwatch.Mod, len(blocks))
+	for _, i := range order {
+		lmod, err := filterBlock(mod, &blocks[i])
+		if err != nil {
+			return nil, err
+		}
+		won := &moddwatch.Mod{
+			Changed: unclaimed(lmod.Changed),
+			Deleted: unclaimed(lmod.Deleted),
+			Added:   unclaimed(lmod.Added),
+		}
+		for _, f := range append(won.All(), won.Deleted...) {
+			claimed[f] = true
+		}
+		ret[i] = won
+	}
+	return ret, nil
+}
+
+// patternList formats the patterns of matches for logging
+func patternList(matches []PatternMatch) string {
+	patterns := make([]string, len(matches))
+	for i, m := range matches {
+		patterns[i] = m.Pattern
+	}
+	return strings.Join(patterns, ", ")
+}
+
+// reloadConfig reads the config again, and reports whether it was read. If it
+// can't be, the problem is logged and the running config is kept.
+func (mr *ModRunner) reloadConfig() bool {
+	mr.Log.Notice("Reloading config %s", mr.ConfPath)
+	err := mr.ReadConfig()
+	if ce, ok := err.(*conf.Error); ok {
+		mr.Log.Warn("%s", ce.Detail())
+		return false
+	} else if err != nil {
+		mr.Log.Warn("%s", err)
+		return false
+	}
+	return true
+}
+
+func (mr *ModRunner) setDaemonWorld(dworld *DaemonWorld) {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.worldLock.Lock()
+	defer mr.worldLock.Unlock()
+	mr.dworld = dworld
+}
+
+// daemonWorld returns the daemons of the running configuration, or nil if
+// there are none. It doesn't wait for a running cycle to finish.
+func (mr *ModRunner) daemonWorld() *DaemonWorld {
+	mr.worldLock.Lock()
+	defer mr.worldLock.Unlock()
+	return mr.dworld
+}
+
+func (mr *ModRunner) setChanges(changes chan *moddwatch.Mod) {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.changes = changes
+}
+
+// Inject acts on paths as though the watcher had just reported them changed,
+// for tools that learn of changes some other way. Unlike Trigger, which runs a
+// cycle at once, the paths take the same route as changes from the watcher,
+// so they're counted, debounced, filtered and matched against the blocks in
+// the same way. Paths are relative to the working directory. An error is
+// returned if the runner isn't running.
+func (mr *ModRunner) Inject(paths []string) error {
+	mr.Lock()
+	changes := mr.changes
+	mr.Unlock()
+	if changes == nil {
+		return fmt.Errorf("modd is not running")
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	changes <- &moddwatch.Mod{Changed: append([]string(nil), paths...)}
+	return nil
 }
 
 // Gives control of chan to caller
 func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()) error {
-	dworld, err := NewDaemonWorld(mr.Config, mr.Log)
+	dworld, err := newDaemonWorld(mr.Config, mr.Log, &mr.events)
 	if err != nil {
 		return err
 	}
+	dworld.setTracer(mr.Tracer)
 	defer dworld.Shutdown(os.Kill)
+	mr.setDaemonWorld(dworld)
+	defer mr.setDaemonWorld(nil)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	defer signal.Reset(os.Interrupt, os.Kill)
 	go func() {
 		dworld.Shutdown(<-c)
+		mr.runTeardown()
+		if mr.StateFile != "" {
+			os.Remove(mr.StateFile)
+		}
+		mr.events.close()
+		mr.Tracer.Close()
 		os.Exit(0)
 	}()
+	defer notifyResize(dworld)()
+	if mr.StateFile != "" {
+		defer mr.keepState(dworld)()
+	}
+	defer notifyHandoff(mr, dworld)()
 
 	ipatts := mr.Config.IncludePatterns()
-	if mr.ConfReload {
+	if mr.ConfReload && mr.ConfPath != ConfStdin {
 		ipatts = append(ipatts, filepath.Dir(mr.ConfPath))
 	}
 
@@ -188,43 +989,237 @@ func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()
 	if err != nil {
 		return err
 	}
-	// FIXME: This takes a long time. We could start it in parallel with the
-	// first process run in a goroutine
-	watcher, err := moddwatch.Watch(currentDir, ipatts, []string{}, lullTime, modchan)
+	// Changes are read from modchan, which counts them, and is filtered when
+	// content hashing
+	src := modchan
+	mr.setChanges(src)
+	defer mr.setChanges(nil)
+	done := make(chan struct{})
+	defer close(done)
+	modchan = mr.countChanges(src, done)
+	if mr.ContentHash {
+		modchan = mr.filterContent(currentDir, modchan, done)
+	}
+	if !mr.NoWatch {
+		// FIXME: This takes a long time. We could start it in parallel with
+		// the first process run in a goroutine
+		watcher, err := moddwatch.Watch(currentDir, ipatts, []string{}, lullTime, src)
+		if err != nil {
+			return fmt.Errorf("Error watching: %s", err)
+		}
+		defer watcher.Stop()
+	}
 
+	err = mr.trigger(currentDir, nil, dworld)
 	if err != nil {
-		return fmt.Errorf("Error watching: %s", err)
+		return err
+	}
+	if mr.NoWatch {
+		mr.Log.Notice(">> not watching for changes, interrupt to stop")
 	}
-	defer watcher.Stop()
-
-	mr.trigger(currentDir, nil, dworld)
 	go readyCallback()
-	for mod := range modchan {
+	ticks := make(chan int)
+	if !mr.NoWatch {
+		defer schedule(mr.Config.Blocks, ticks)()
+	}
+	defer notifyPause(mr)()
+	reload := make(chan struct{}, 1)
+	defer notifySignals(mr, reload)()
+	resumed := mr.pause.wake()
+	var pending *moddwatch.Mod
+	var lastEnd time.Time
+	var lastSig contentHash
+	for {
+		mod := pending
+		pending = nil
 		if mod == nil {
-			break
-		}
-		if mr.ConfReload && mod.Has(mr.ConfPath) {
-			mr.Log.Notice("Reloading config %s", mr.ConfPath)
-			err := mr.ReadConfig()
-			if err != nil {
-				mr.Log.Warn("%s", err)
+			select {
+			case mod = <-modchan:
+			case i := <-ticks:
+				if mr.Paused() {
+					mr.Log.NoticeAs("debug", "%s: scheduled run skipped, paused", blockName(i, mr.Config.Blocks[i]))
+					continue
+				}
+				err := mr.runCycle(currentDir, nil, i, dworld)
+				if err != nil {
+					return err
+				}
 				continue
+			case <-resumed:
+				if mod = mr.pause.release(); mod == nil {
+					continue
+				}
+				mr.Log.NoticeAs("debug", "running changes made while paused")
+			case <-reload:
+				if mr.reloadConfig() {
+					return nil
+				}
+				continue
+			case <-mr.expired:
+				mr.Log.Notice(">> max runtime of %s reached, shutting down", mr.MaxRuntime)
+				return errMaxRuntime
+			}
+			if mod == nil {
+				break
+			}
+			if mr.Settle > 0 {
+				var stop bool
+				mod, stop = quiesce(modchan, mod, mr.Settle, &mr.watch)
+				if stop {
+					break
+				}
+			}
+		}
+		if mr.pause.hold(mod, mr.DropPaused, &mr.watch) {
+			if mr.DropPaused {
+				mr.watch.filter(mod, nil)
+				mr.Log.NoticeAs("debug", "paused, changes dropped: %s", changeSummary(mod))
 			} else {
+				mr.Log.NoticeAs("debug", "paused, changes held: %s", changeSummary(mod))
+			}
+			continue
+		}
+		if mr.ConfReload && mr.confChanged(mod) {
+			if mr.reloadConfig() {
 				return nil
 			}
+			continue
+		}
+		if wait := mr.MinInterval - time.Since(lastEnd); !lastEnd.IsZero() && wait > 0 {
+			mr.Log.Notice(">> throttling, next run in %s", wait.Round(time.Millisecond))
+			var stop bool
+			pending, stop = cooldown(modchan, mod, wait, &mr.watch)
+			if stop {
+				break
+			}
+			continue
+		}
+		if mr.SkipDuplicateCycles {
+			sig := cycleSignature(mod)
+			if sig == lastSig {
+				mr.watch.filter(mod, nil)
+				mr.Log.NoticeAs("debug", "same changes as the last cycle, skipped: %s", changeSummary(mod))
+				continue
+			}
+			lastSig = sig
 		}
 		mr.Log.SayAs("debug", "Delta: \n%s", mod.String())
-		mr.trigger(currentDir, mod, dworld)
+		mr.watch.cycle()
+		err := mr.trigger(currentDir, mod, dworld)
+		if err != nil {
+			return err
+		}
+		lastEnd = time.Now()
+		if mr.Cooldown > 0 {
+			var stop bool
+			pending, stop = cooldown(modchan, nil, mr.Cooldown, &mr.watch)
+			if stop {
+				break
+			}
+			if pending != nil {
+				mr.Log.NoticeAs("debug", "cooldown: batched changes into one run")
+			}
+		}
 	}
 	return nil
 }
 
+// schedule sends the index of each block with an Every interval on ticks,
+// once per interval, until the returned function is called. Ticks are dropped
+// while a previous one is waiting to be received, so a block that runs for
+// longer than its interval isn't queued up.
+func schedule(blocks []conf.Block, ticks chan<- int) func() {
+	done := make(chan struct{})
+	for i, b := range blocks {
+		if b.Every <= 0 {
+			continue
+		}
+		go func(i int, every time.Duration) {
+			t := time.NewTicker(every)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					select {
+					case ticks <- i:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}(i, b.Every)
+	}
+	return func() { close(done) }
+}
+
+// cooldown accumulates changes from modchan for duration d, joined to mod if
+// it's not nil, and returns them joined together, or nil if there were none.
+// Changes joined to others are counted in w. If the channel is closed or
+// receives nil during the cooldown, stop is true.
+func cooldown(modchan chan *moddwatch.Mod, mod *moddwatch.Mod, d time.Duration, w *watchCounters) (*moddwatch.Mod, bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-modchan:
+			if m == nil {
+				return nil, true
+			}
+			if mod == nil {
+				mod = m
+			} else {
+				w.debounce(m)
+				joined := mod.Join(*m)
+				mod = &joined
+			}
+		case <-timer.C:
+			return mod, false
+		}
+	}
+}
+
+// quiesce joins changes from modchan to mod until none have arrived for d, and
+// returns the result. Joined changes are counted in w. If modchan is closed
+// with a nil, stop is true.
+func quiesce(modchan chan *moddwatch.Mod, mod *moddwatch.Mod, d time.Duration, w *watchCounters) (ret *moddwatch.Mod, stop bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-modchan:
+			if m == nil {
+				return nil, true
+			}
+			w.debounce(m)
+			joined := mod.Join(*m)
+			mod = &joined
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(d)
+		case <-timer.C:
+			return mod, false
+		}
+	}
+}
+
 // Run is the top-level runner for modd
 func (mr *ModRunner) Run() error {
+	if err := mr.runPrelude(); err != nil {
+		return err
+	}
+	defer mr.runTeardown()
+	if mr.MaxRuntime > 0 {
+		mr.expired = time.After(mr.MaxRuntime)
+	}
 	for {
 		modchan := make(chan *moddwatch.Mod, 1024)
 		err := mr.runOnChan(modchan, func() {})
-		if err != nil {
+		if err == errMaxRuntime {
+			return nil
+		} else if err != nil {
 			return err
 		}
 	}
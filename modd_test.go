@@ -1,7 +1,9 @@
 package modd
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -51,6 +53,26 @@ func events(p string) []string {
 	return parts
 }
 
+// waitFor waits until the output line s appears in the log
+func waitFor(t *testing.T, lt *termlog.LogTest, s string) {
+	start := time.Now()
+	for !hasEvent(lt, s) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for %q, got:\n%s", s, lt.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func hasEvent(lt *termlog.LogTest, s string) bool {
+	for _, e := range events(lt.String()) {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func _testWatch(t *testing.T, modfunc func(), expected []string) {
 	defer utils.WithTempDir(t)()
 
@@ -225,3 +247,1258 @@ func TestWatch(t *testing.T) {
 		},
 	)
 }
+
+func TestRunBlock(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	touch("a/initial")
+
+	confTxt := `
+		@shell = bash
+
+		a/** {
+			label: first
+			prep +onchange: echo ":first:" @mods
+		}
+		{
+			label: second
+			prep: echo ":second:"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+	}
+
+	err = mr.RunBlock("first", lt.Log)
+	if err != nil {
+		t.Fatalf("RunBlock: %s", err)
+	}
+	expected := []string{":first: ./a/initial"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	if err := mr.RunBlock("nonexistent", lt.Log); err == nil {
+		t.Errorf("Expected error for unknown block label")
+	}
+}
+
+func TestReadConfigStdin(t *testing.T) {
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:      lt.Log,
+		ConfPath: ConfStdin,
+		stdin:    strings.NewReader("{\nprep: echo hello\n}\n"),
+	}
+	for i := 0; i < 2; i++ {
+		if err := mr.ReadConfig(); err != nil {
+			t.Fatalf("ReadConfig: %s", err)
+		}
+		if len(mr.Config.Blocks) != 1 || mr.Config.Blocks[0].Preps[0].Command != "echo hello" {
+			t.Fatalf("Unexpected config: %#v", mr.Config)
+		}
+	}
+
+	mr = ModRunner{ConfPath: ConfStdin, stdin: strings.NewReader("{\nprep +foo: x\n}\n")}
+	err := mr.ReadConfig()
+	if err == nil || !strings.Contains(err.Error(), stdinName) {
+		t.Errorf("Expected error naming stdin, got %v", err)
+	}
+}
+
+func TestReadConfigProfile(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	if p := ProfilePath("conf/modd.conf", "ci"); p != "conf/modd.ci.conf" {
+		t.Errorf("Unexpected profile path: %s", p)
+	}
+	err := ioutil.WriteFile("modd.conf", []byte("{\nlabel: test\nprep: go test\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	_, err = NewProfileModRunner("modd.conf", "ci", lt.Log, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "profile ci") {
+		t.Errorf("Expected an error for a missing overlay, got %v", err)
+	}
+	err = ioutil.WriteFile("modd.ci.conf", []byte("{\nlabel: test\nprep: go test -race\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr, err := NewProfileModRunner("modd.conf", "ci", lt.Log, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mr.Config.Blocks) != 1 || mr.Config.Blocks[0].Preps[0].Command != "go test -race" {
+		t.Errorf("Expected the overlay to replace the prep, got %#v", mr.Config)
+	}
+	mod := &moddwatch.Mod{Changed: []string{"modd.ci.conf"}}
+	if !mr.confChanged(mod) {
+		t.Errorf("Expected a change to the overlay to reload the config")
+	}
+}
+
+func TestExitOnFail(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	confTxt := `
+		@shell = bash
+
+		{
+			daemon: sleep 100
+		}
+		{
+			prep: exit 3
+		}
+		{
+			prep: echo ":never: runs"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:        lt.Log,
+		Config:     cnf,
+		ExitOnFail: true,
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		t.Errorf("Watch loop should not be reached")
+		modchan <- nil
+	})
+	pe, ok := err.(ProcError)
+	if !ok {
+		t.Fatalf("Expected ProcError, got %#v", err)
+	}
+	if pe.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", pe.ExitCode)
+	}
+	if hasEvent(lt, ":never: runs") {
+		t.Errorf("Blocks after the failure should not run")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	defer utils.WithTempDir(t)()
+
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +onchange: echo ":cycle:" @mods
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:      lt.Log,
+		Config:   cnf,
+		Cooldown: 500 * time.Millisecond,
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	expected := []string{":cycle: ./a", ":cycle: ./b ./c ./d"}
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		// The first change starts a cycle immediately. The rest arrive in
+		// a burst, and are batched into a single cycle after the cooldown.
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"b"}}
+		modchan <- &moddwatch.Mod{Added: []string{"c"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"d", "b"}}
+		waitFor(t, lt, expected[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +onchange: echo ":cycle:" @mods
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:    lt.Log,
+		Config: cnf,
+		Settle: 300 * time.Millisecond,
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	expected := []string{":cycle: ./a ./b ./c ./d ./e ./f"}
+	var quiet time.Duration
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		// A steady stream of changes, each closer together than the settle
+		// period, is held back until it stops
+		for _, f := range []string{"a", "b", "c", "d", "e", "f"} {
+			modchan <- &moddwatch.Mod{Changed: []string{f}}
+			time.Sleep(100 * time.Millisecond)
+			if hasEvent(lt, expected[0]) {
+				t.Errorf("Cycle ran before the changes stopped")
+			}
+		}
+		last := time.Now()
+		waitFor(t, lt, expected[0])
+		quiet = time.Since(last)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if quiet < 150*time.Millisecond {
+		t.Errorf("Expected the cycle to wait for quiet, it started %s after the last change", quiet)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +onchange: echo ":cycle:" @mods
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{
+		Log:         lt.Log,
+		Config:      cnf,
+		MinInterval: 300 * time.Millisecond,
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	expected := []string{":cycle: ./a", ":cycle: ./b ./c"}
+	var elapsed time.Duration
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, expected[0])
+		// Changes just after a cycle are held back, even though they're a
+		// separate burst
+		start := time.Now()
+		modchan <- &moddwatch.Mod{Changed: []string{"b"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"c"}}
+		waitFor(t, lt, expected[1])
+		elapsed = time.Since(start)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if elapsed < 250*time.Millisecond {
+		t.Errorf("Expected the second cycle to be held back, it started after %s", elapsed)
+	}
+	if !strings.Contains(lt.String(), "throttling") {
+		t.Errorf("Expected throttling to be logged, got:\n%s", lt.String())
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		**/*.go **/*.txt {
+			label: go
+			prep: exit 1
+			daemon: sleep 100
+		}
+		**/*.css {
+			prep: echo ":css:"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	lt.Log.Enable("debug")
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	rec := &eventRecorder{}
+	mr.AddEventSink(rec)
+	err = mr.Trigger(&moddwatch.Mod{Changed: []string{"src/main.go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PatternMatch{{Pattern: "**/*.go", Files: []string{"src/main.go"}}}
+	if rec.events[0].Type != EventChange || !reflect.DeepEqual(rec.events[0].Matches, expected) {
+		t.Errorf("Expected change event with matches %#v, got %#v", expected, rec.events)
+	}
+	for _, s := range []string{
+		"go: scheduled, changes matched **/*.go\n",
+		"pattern **/*.go matched src/main.go\n",
+		"go: prep failed, daemons not restarted\n",
+		"block 2: not scheduled, no matching changes\n",
+	} {
+		if !strings.Contains(lt.String(), s) {
+			t.Errorf("Expected %q in output:\n%s", s, lt.String())
+		}
+	}
+}
+
+func TestOutcomeBanners(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+
+		** {
+			label: build
+			prep: test -f ok
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	count := func(s string) int { return strings.Count(lt.String(), s) }
+
+	mr.Trigger(nil)
+	if count(">> build: now failing") != 0 {
+		t.Errorf("First failure should not be announced:\n%s", lt.String())
+	}
+	if err := ioutil.WriteFile("ok", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mr.Trigger(nil)
+	mr.Trigger(nil)
+	if count(">> build: recovered") != 1 {
+		t.Errorf("Expected one recovery notice:\n%s", lt.String())
+	}
+	if err := os.Remove("ok"); err != nil {
+		t.Fatal(err)
+	}
+	mr.Trigger(nil)
+	if count(">> build: now failing") != 1 {
+		t.Errorf("Expected one failure notice:\n%s", lt.String())
+	}
+}
+
+func TestOnCycleEnd(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		env: GREETING=hi
+		oncycleend: "echo $GREETING $MODD_PREPS $MODD_FAILURES $MODD_DAEMONS_RESTARTED > summary.tmp && mv summary.tmp summary"
+
+		{
+			prep: true
+			prep: exit 1
+		}
+		{
+			prep: true
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	if err := mr.Trigger(nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for {
+		ret, err := ioutil.ReadFile("summary")
+		if err == nil {
+			if s := strings.TrimSpace(string(ret)); s != "hi 3 1 0" {
+				t.Errorf("Unexpected summary: %q", s)
+			}
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("oncycleend did not run:\n%s", lt.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCycleResult(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		{
+			label: build
+			prep: exit 1
+		}
+		{
+			prep: true
+		}
+		{
+			label: test
+			prep: exit 2
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	if mr.LastCycle() != nil {
+		t.Errorf("Expected no result before the first cycle")
+	}
+	mr.Trigger(nil)
+	res := mr.LastCycle()
+	if res == nil || len(res.Blocks) != 3 {
+		t.Fatalf("Unexpected result: %#v", res)
+	}
+	if res.Blocks[1].Name != "block 2" || res.Blocks[1].Err != nil {
+		t.Errorf("Unexpected block result: %#v", res.Blocks[1])
+	}
+	if _, ok := res.Blocks[2].Err.(ProcError); !ok {
+		t.Errorf("Expected ProcError, got %#v", res.Blocks[2].Err)
+	}
+	summary := ">> 2 of 3 blocks failed: build, test"
+	if n := strings.Count(lt.String(), summary); n != 1 {
+		t.Errorf("Expected one summary line, got %d:\n%s", n, lt.String())
+	}
+}
+
+func TestCycleResultRestarted(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +continueonerror +name=lint: exit 1
+			daemon: sleep 100
+			daemon +norestart: sleep 100
+			daemon +needs=lint: sleep 100
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	var results []CycleResult
+	mr.OnCycle(func(res CycleResult) {
+		results = append(results, res)
+	})
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		for start := time.Now(); mr.WatchStats().Cycles < 1; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for a cycle")
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The daemon that needs the failed prep is never started, and the
+	// +norestart daemon is only started on the initial run
+	if len(results) != 2 || results[0].Restarted() != 2 || results[1].Restarted() != 1 {
+		var counts []int
+		for _, r := range results {
+			counts = append(counts, r.Restarted())
+		}
+		t.Errorf("Expected 2 daemons started, then 1 restarted, got %v", counts)
+	}
+}
+
+func TestCycleResultNonFatal(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		{
+			label: lint
+			prep +continueonerror: exit 1
+			prep: true
+		}
+		{
+			label: build
+			prep +continueonerror: exit 1
+			prep: exit 2
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	mr.Trigger(nil)
+	res := mr.LastCycle()
+	if res == nil || len(res.Blocks) != 2 {
+		t.Fatalf("Unexpected result: %#v", res)
+	}
+	if res.Blocks[0].Err != nil || len(res.Blocks[0].NonFatal) != 1 {
+		t.Errorf("Unexpected block result: %#v", res.Blocks[0])
+	}
+	if _, ok := res.Blocks[1].Err.(ProcError); !ok {
+		t.Errorf("Expected ProcError, got %#v", res.Blocks[1].Err)
+	}
+	summary := ">> 1 of 2 blocks failed: build; 1 of 2 blocks had non-fatal failures: lint"
+	if !strings.Contains(lt.String(), summary) {
+		t.Errorf("Expected summary line:\n%s", lt.String())
+	}
+}
+
+func TestNoWatch(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep: echo ":prep: ran"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		touch("a/changed")
+		time.Sleep(lullTime * 5)
+		modchan <- nil
+	})
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	expected := []string{":prep: ran"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestMask(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		mask: token=[a-z0-9]+
+		mask: 'Bearer \S+'
+
+		{
+			prep: echo ":prep: token=abc123"; echo ":prep: Bearer xyz.789" >&2
+			daemon: echo ":daemon: token=def456"; sleep 100
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		waitFor(t, lt, ":daemon: ***")
+		modchan <- nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{":prep: ***", ":prep: ***", ":daemon: ***"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		env: GREETING=hi
+		prelude: echo ":prelude: $GREETING"
+
+		{
+			prep: echo ":prep: ran"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	if err := mr.runPrelude(); err != nil {
+		t.Fatalf("runPrelude: %s", err)
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	if err := mr.runOnChan(modchan, func() { modchan <- nil }); err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	expected := []string{":prelude: hi", ":prep: ran"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestPreludeFail(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		prelude: exit 3
+
+		{
+			prep: echo ":prep: ran"
+			daemon: echo ":daemon: ran"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	err = mr.PrepOnly(true)
+	pe, ok := err.(PreludeError)
+	if !ok {
+		t.Fatalf("Expected PreludeError, got %#v", err)
+	}
+	if ce, ok := pe.Err.(ProcError); !ok || ce.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %#v", pe.Err)
+	}
+	if ret := events(lt.String()); len(ret) != 0 {
+		t.Errorf("Nothing should run after a failed prelude, got %#v", ret)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+
+		nothing {
+			every: 200ms
+			prep +onchange: echo x >> ticks; echo ":tick: $(grep -c x ticks)"
+		}
+		nothing {
+			prep: echo ":other: ran"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		// Scheduled runs aren't initial runs, so +onchange preps run
+		waitFor(t, lt, ":tick: 2")
+		modchan <- nil
+	})
+	if err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	ret := events(lt.String())
+	if len(ret) < 3 || ret[0] != ":other: ran" || ret[1] != ":tick: 1" || ret[2] != ":tick: 2" {
+		t.Errorf("Unexpected events: %#v", ret)
+	}
+	// The schedule stops with the watch
+	time.Sleep(500 * time.Millisecond)
+	if after := events(lt.String()); len(after) != len(ret) {
+		t.Errorf("Scheduled runs continued after shutdown: %#v", after)
+	}
+	if !strings.Contains(lt.String(), "every 200ms") {
+		t.Errorf("Expected a separator for scheduled cycles, got:\n%s", lt.String())
+	}
+}
+
+func TestPause(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+
+		** {
+			prep +onchange: echo ":cycle:" @mods
+		}
+	`
+	for _, drop := range []bool{false, true} {
+		cnf, err := conf.Parse("test", confTxt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt := termlog.NewLogTest()
+		rec := &eventRecorder{}
+		mr := ModRunner{Log: lt.Log, Config: cnf, DropPaused: drop}
+		mr.events.add(rec)
+		modchan := make(chan *moddwatch.Mod, 1024)
+		expected := []string{":cycle: ./a ./b", ":cycle: ./c"}
+		if drop {
+			expected = []string{":cycle: ./c"}
+		}
+		err = mr.runOnChan(modchan, func() {
+			defer func() { modchan <- nil }()
+			mr.Pause()
+			modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+			modchan <- &moddwatch.Mod{Changed: []string{"b"}}
+			time.Sleep(200 * time.Millisecond)
+			if ret := events(lt.String()); len(ret) != 0 {
+				t.Errorf("Changes ran while paused: %#v", ret)
+			}
+			mr.Resume()
+			if !drop {
+				waitFor(t, lt, expected[0])
+			}
+			modchan <- &moddwatch.Mod{Changed: []string{"c"}}
+			waitFor(t, lt, ":cycle: ./c")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+			t.Errorf("drop=%v: Expected\n%#v\nGot\n%#v", drop, expected, ret)
+		}
+		var types []string
+		for _, e := range rec.events {
+			if e.Type == EventPause || e.Type == EventResume {
+				types = append(types, e.Type)
+			}
+		}
+		if !reflect.DeepEqual(types, []string{EventPause, EventResume}) {
+			t.Errorf("Unexpected pause events: %#v", types)
+		}
+	}
+}
+
+func TestCycleSeparators(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", "@shell = bash\n** {\nprep: true\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	mr.Trigger(nil)
+	mr.Trigger(&moddwatch.Mod{Changed: []string{"b", "a"}})
+	mr.Trigger(&moddwatch.Mod{Changed: []string{"a", "b", "c"}, Deleted: []string{"d", "e"}})
+	out := lt.String()
+	for _, s := range []string{"-- cycle 2: a, b --", "-- cycle 3: a, b, c and 2 more --"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected separator %q in output:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "cycle 1") {
+		t.Errorf("Expected no separator before the initial run:\n%s", out)
+	}
+
+	lt = termlog.NewLogTest()
+	mr = ModRunner{Log: lt.Log, Config: cnf, NoSeparators: true}
+	mr.Trigger(&moddwatch.Mod{Changed: []string{"a"}})
+	if strings.Contains(lt.String(), "-- cycle") {
+		t.Errorf("Expected separators to be suppressed:\n%s", lt.String())
+	}
+}
+
+func TestBlockShell(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = modd
+		shell: bash
+		{
+			prep: echo ":default: ${0##*/}"
+		}
+		{
+			shell: sh
+			prep: echo ":override: ${0##*/}"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	if err := mr.runOnChan(modchan, func() { modchan <- nil }); err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	expected := []string{":default: bash", ":override: sh"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestStagger(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", "{\nprep: true\n}\n{\ndaemon: sleep 100\n}\n{\nprep: true\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagger := 20 * time.Millisecond
+	seeded := func() *rand.Rand { return rand.New(rand.NewSource(1)) }
+	expected := []string{}
+	r := &ModRunner{Stagger: stagger, staggerRand: seeded()}
+	for i := 0; i < 2; i++ {
+		d := r.staggerDelay()
+		if d < 0 || d > stagger {
+			t.Fatalf("Delay out of range: %s", d)
+		}
+		expected = append(expected, fmt.Sprintf("staggered by %s", d))
+	}
+
+	lt := termlog.NewLogTest()
+	lt.Log.Enable("debug")
+	mr := ModRunner{Log: lt.Log, Config: cnf, Stagger: stagger, staggerRand: seeded()}
+	if err := mr.Trigger(nil); err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for _, l := range strings.Split(lt.String(), "\n") {
+		if i := strings.Index(l, "staggered by"); i >= 0 {
+			ret = append(ret, l[i:])
+		}
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, ret)
+	}
+}
+
+func TestMaxRuntime(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", "@shell = bash\n{\ndaemon: sleep 100\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	maxRuntime := 500 * time.Millisecond
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, MaxRuntime: maxRuntime}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- mr.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the max runtime")
+	}
+	if d := time.Since(start); d < maxRuntime || d > maxRuntime+2*time.Second {
+		t.Errorf("Expected to stop after %s, stopped after %s", maxRuntime, d)
+	}
+	out := lt.String()
+	for _, s := range []string{"max runtime of 500ms reached", ">> stopping"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected log to contain %q, got:\n%s", s, out)
+		}
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		env: GREETING=bye
+		teardown: kill -0 $(cat daemon.pid) 2>/dev/null && echo ":teardown: running" || echo ":teardown: $GREETING"
+		{
+			daemon: echo $$ > daemon.pid; exec sleep 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, MaxRuntime: 500 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- mr.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the max runtime")
+	}
+	// The teardown runs once, after the daemon has stopped
+	mr.runTeardown()
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{":teardown: bye"}) {
+		t.Errorf("Expected the teardown to run after shutdown, got %#v", ret)
+	}
+}
+
+func TestBlockDelimiter(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		{
+			delimiter: nul
+			prep: printf ':one\0:two\0'
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	if err := mr.Trigger(nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{":one", ":two"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		**/*.go {
+			label: go
+			prep: echo ":go: @mods"
+		}
+		**/*_test.go {
+			label: tests
+			priority: 10
+			prep: echo ":tests: @mods"
+		}
+		**/*.go **/*.md {
+			label: docs
+			prep: echo ":docs: @mods"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstMatchTests := []struct {
+		changed  []string
+		expected []string
+	}{
+		// Without priorities, the first matching block wins
+		{[]string{"main.go"}, []string{":go: ./main.go"}},
+		// The test block outranks the blocks before it
+		{[]string{"main_test.go"}, []string{":tests: ./main_test.go"}},
+		// Files are divided, and blocks left without any aren't run
+		{
+			[]string{"main.go", "main_test.go", "README.md"},
+			[]string{":go: ./main.go", ":tests: ./main_test.go", ":docs: ./README.md"},
+		},
+	}
+	for _, tt := range firstMatchTests {
+		lt := termlog.NewLogTest()
+		lt.Log.Enable("debug")
+		mr := ModRunner{Log: lt.Log, Config: cnf, FirstMatch: true}
+		err := mr.Trigger(&moddwatch.Mod{Changed: tt.changed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%v: expected\n%#v\ngot\n%#v", tt.changed, tt.expected, ret)
+		}
+	}
+
+	// Every matching block runs without the flag
+	lt := termlog.NewLogTest()
+	lt.Log.Enable("debug")
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	if err := mr.Trigger(&moddwatch.Mod{Changed: []string{"main_test.go"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{":go: ./main_test.go", ":tests: ./main_test.go", ":docs: ./main_test.go"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, ret)
+	}
+
+	lt = termlog.NewLogTest()
+	lt.Log.Enable("debug")
+	mr = ModRunner{Log: lt.Log, Config: cnf, FirstMatch: true}
+	if err := mr.Trigger(&moddwatch.Mod{Changed: []string{"main_test.go"}}); err != nil {
+		t.Fatal(err)
+	}
+	s := "go: not scheduled, changes matched a block of higher priority\n"
+	if !strings.Contains(lt.String(), s) {
+		t.Errorf("Expected %q in output:\n%s", s, lt.String())
+	}
+}
+
+func TestBlockPatterns(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		**/*.go !**/testdata/** **/testdata/golden/* {
+			prep +onchange: echo ":go: @mods"
+		}
+		** !*.tmp {
+			base: web
+			prep +onchange: echo ":web: @mods"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockPatternTests := []struct {
+		changed  []string
+		expected []string
+	}{
+		{[]string{"main.go", "pkg/testdata/fixture.go"}, []string{":go: ./main.go"}},
+		// A later include refines the exclude before it
+		{[]string{"pkg/testdata/golden/out.go"}, []string{":go: ./pkg/testdata/golden/out.go"}},
+		// Patterns are relative to the block's base
+		{[]string{"web/app.js", "web/cache.tmp", "app.js"}, []string{":web: ./web/app.js"}},
+		{[]string{"web/testdata/golden/x.go"}, []string{":go: ./web/testdata/golden/x.go", ":web: ./web/testdata/golden/x.go"}},
+	}
+	for _, tt := range blockPatternTests {
+		lt := termlog.NewLogTest()
+		mr := ModRunner{Log: lt.Log, Config: cnf}
+		if err := mr.Trigger(&moddwatch.Mod{Changed: tt.changed}); err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%v: expected\n%#v\ngot\n%#v", tt.changed, tt.expected, ret)
+		}
+	}
+}
+
+func TestOnCycle(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		{
+			label: build
+			prep: sleep 0.05; exit 1
+		}
+		{
+			label: test
+			prep: true
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	mr.OnCycle(func(CycleResult) {
+		panic("bad callback")
+	})
+	var results []CycleResult
+	mr.OnCycle(func(res CycleResult) {
+		if last := mr.LastCycle(); last == nil || last.Start != res.Start {
+			t.Errorf("Expected the result to be the last cycle, got %#v", last)
+		}
+		results = append(results, res)
+	})
+	mr.Trigger(nil)
+	mr.Trigger(nil)
+	if len(results) != 2 {
+		t.Fatalf("Expected a result for each cycle, got %#v", results)
+	}
+	res := results[0]
+	if len(res.Blocks) != 2 || !reflect.DeepEqual(res.Failed(), []string{"build"}) {
+		t.Errorf("Unexpected result: %#v", res)
+	}
+	if res.Blocks[0].Duration < 50*time.Millisecond || res.Duration < res.Blocks[0].Duration {
+		t.Errorf("Unexpected durations: %#v", res)
+	}
+	if n := strings.Count(lt.String(), "cycle callback panicked: bad callback"); n != 2 {
+		t.Errorf("Expected the panics to be logged, got:\n%s", lt.String())
+	}
+}
+
+func TestMinChanges(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+
+		**/*.go {
+			minchanges: 3
+			prep: echo ":drop: @mods"
+		}
+		**/*.go {
+			minchanges +accumulate: 3
+			prep: echo ":accumulate: @mods"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minChangesTests := []struct {
+		changed  []string
+		expected []string
+	}{
+		{[]string{"a.go", "b.go", "README.md"}, []string{}},
+		{[]string{"c.go"}, []string{":accumulate: ./a.go ./b.go ./c.go"}},
+		{[]string{"d.go"}, []string{}},
+		{
+			[]string{"d.go", "e.go", "f.go"},
+			[]string{":drop: ./d.go ./e.go ./f.go", ":accumulate: ./d.go ./e.go ./f.go"},
+		},
+	}
+	mr := ModRunner{Config: cnf}
+	for _, tt := range minChangesTests {
+		lt := termlog.NewLogTest()
+		lt.Log.Enable("debug")
+		mr.Log = lt.Log
+		if err := mr.Trigger(&moddwatch.Mod{Changed: tt.changed}); err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%v: expected\n%#v\ngot\n%#v\n%s", tt.changed, tt.expected, ret, lt.String())
+		}
+	}
+}
+
+func TestKeepAcrossCycles(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+
+		**/*.go {
+			prep: echo ":prev: [$MODD_PREV_FILES]"
+			prep +keep=files: echo @mods
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := ModRunner{Config: cnf}
+	for _, tt := range []struct {
+		changed  string
+		expected string
+	}{
+		{"a.go", ":prev: []"},
+		{"b.go", ":prev: [./a.go]"},
+	} {
+		lt := termlog.NewLogTest()
+		mr.Log = lt.Log
+		if err := mr.Trigger(&moddwatch.Mod{Changed: []string{tt.changed}}); err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{tt.expected}) {
+			t.Errorf("%s: expected %q, got %#v", tt.changed, tt.expected, ret)
+		}
+	}
+}
+
+// restartRunner is a Runner whose preps fail if their command starts with
+// "fail", and which records the daemons it restarts
+type restartRunner struct {
+	restarted []string
+}
+
+func (r *restartRunner) Prep(b conf.Block, cmd string, stdin string) (string, error) {
+	if strings.HasPrefix(cmd, "fail") {
+		return "", fmt.Errorf("%s failed", cmd)
+	}
+	return "", nil
+}
+
+func (r *restartRunner) Restart(b conf.Block) {
+	for _, d := range b.Daemons {
+		r.restarted = append(r.restarted, d.Command)
+	}
+}
+
+var needsTests = []struct {
+	a, b      string
+	restarted []string
+}{
+	{"build-a", "build-b", []string{"serve-a", "serve-b", "proxy"}},
+	{"fail-a", "build-b", []string{"serve-b", "proxy"}},
+	{"build-a", "fail-b", []string{"serve-a", "proxy"}},
+	{"fail-a", "fail-b", []string{"proxy"}},
+}
+
+func TestDaemonNeeds(t *testing.T) {
+	for _, tt := range needsTests {
+		// serve-b needs the output of b, through the piped prep c
+		cnf, err := conf.Parse("test", fmt.Sprintf(`
+			{
+				prep +continueonerror +name=a: %s
+				prep +continueonerror +name=b: %s
+				prep +pipe +name=c: check
+				daemon +needs=a: serve-a
+				daemon +needs=c: serve-b
+				daemon: proxy
+			}
+		`, tt.a, tt.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt := termlog.NewLogTest()
+		r := &restartRunner{}
+		mr := ModRunner{Log: lt.Log, Config: cnf, Runner: r}
+		_, err = mr.runBlock("test", cnf.Blocks[0], nil, nil, true, nil, &envCache{}, lt.Log, nil)
+		if err != nil && !nonFatal(err) {
+			t.Fatalf("%s %s: unexpected error: %s", tt.a, tt.b, err)
+		}
+		if !reflect.DeepEqual(r.restarted, tt.restarted) {
+			t.Errorf("%s %s: expected %#v to restart, got %#v", tt.a, tt.b, tt.restarted, r.restarted)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	confTxt := `
+		@shell = bash
+
+		**/*.go {
+			prep +onchange: echo ":go: @mods"
+		}
+		docs/** {
+			prep +onchange: echo ":docs: @mods"
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true}
+	if err := mr.Inject([]string{"main.go"}); err == nil {
+		t.Errorf("Expected an error injecting into a runner that isn't running")
+	}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		if err := mr.Inject([]string{"main.go"}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, lt, ":go: ./main.go")
+		if err := mr.Inject([]string{"docs/index.md", "cmd/main.go"}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, lt, ":docs: ./docs/index.md")
+		waitFor(t, lt, ":go: ./cmd/main.go")
+		if err := mr.Inject(nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{":go: ./main.go", ":go: ./cmd/main.go", ":docs: ./docs/index.md"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if ret := mr.WatchStats(); ret.Events != 3 || ret.Cycles != 2 {
+		t.Errorf("Expected injected changes to be counted, got %#v", ret)
+	}
+}
@@ -0,0 +1,116 @@
+// Package moddtest provides helpers for testing modd configurations without
+// running commands or watching the filesystem. A Fake runner records the preps
+// and daemon restarts that a cycle would trigger, and Cycle drives a cycle with
+// a synthetic set of changed files.
+package moddtest
+
+import (
+	"sync"
+
+	"github.com/cortesi/modd"
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+// Call records a single invocation on a Fake runner
+type Call struct {
+	// Restart is true for daemon restarts, and false for preps
+	Restart bool
+	// Label of the block the call was made for
+	Block string
+	// Command is the rendered prep command, and is empty for restarts
+	Command string
+}
+
+// Fake is a modd.Runner that records calls instead of running commands
+type Fake struct {
+	// Output maps prep commands to the output they produce
+	Output map[string]string
+	// Errors maps prep commands to errors returned when they run
+	Errors map[string]error
+
+	calls []Call
+	sync.Mutex
+}
+
+// Prep implements modd.Runner
+func (f *Fake) Prep(b conf.Block, cmd string, stdin string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, Call{Block: b.Label, Command: cmd})
+	return f.Output[cmd], f.Errors[cmd]
+}
+
+// Restart implements modd.Runner
+func (f *Fake) Restart(b conf.Block) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, Call{Restart: true, Block: b.Label})
+}
+
+// Calls returns all calls recorded since the last Reset, in order
+func (f *Fake) Calls() []Call {
+	f.Lock()
+	defer f.Unlock()
+	return append([]Call{}, f.calls...)
+}
+
+// Preps returns the commands of all preps run since the last Reset
+func (f *Fake) Preps() []string {
+	ret := []string{}
+	for _, c := range f.Calls() {
+		if !c.Restart {
+			ret = append(ret, c.Command)
+		}
+	}
+	return ret
+}
+
+// Restarts returns the labels of all blocks whose daemons were restarted
+// since the last Reset
+func (f *Fake) Restarts() []string {
+	ret := []string{}
+	for _, c := range f.Calls() {
+		if c.Restart {
+			ret = append(ret, c.Block)
+		}
+	}
+	return ret
+}
+
+// Reset discards all recorded calls
+func (f *Fake) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = nil
+}
+
+// New parses a configuration and returns a ModRunner that runs it with a Fake
+// runner. Output is sent to log, which may be nil.
+func New(config string, log termlog.TermLog) (*modd.ModRunner, *Fake, error) {
+	cnf, err := conf.Parse("moddtest", config)
+	if err != nil {
+		return nil, nil, err
+	}
+	cnf.CommonExcludes(modd.CommonExcludes)
+	if log == nil {
+		l := termlog.NewLog()
+		l.Quiet()
+		log = l
+	}
+	f := &Fake{}
+	mr := &modd.ModRunner{Log: log, Config: cnf, Runner: f}
+	return mr, f, nil
+}
+
+// Initial runs the initial cycle, as when modd starts
+func Initial(mr *modd.ModRunner) error {
+	return mr.Trigger(nil)
+}
+
+// Cycle runs a cycle in which the specified paths have changed. Paths are
+// relative to the current directory, and need not exist.
+func Cycle(mr *modd.ModRunner, paths ...string) error {
+	return mr.Trigger(&moddwatch.Mod{Changed: paths})
+}
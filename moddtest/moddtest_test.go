@@ -0,0 +1,154 @@
+package moddtest
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const testConf = `
+**/*.go {
+	label: go
+	prep: go test
+	prep +onchange: go install
+	daemon: ./server
+}
+**/*.css {
+	label: css
+	prep: lessc @mods
+}
+`
+
+func TestCycle(t *testing.T) {
+	mr, fake, err := New(testConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Initial(mr); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Call{
+		{Block: "go", Command: "go test"},
+		{Restart: true, Block: "go"},
+		{Block: "css", Command: "lessc "},
+	}
+	if ret := fake.Calls(); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	fake.Reset()
+	if err := Cycle(mr, "src/main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, []string{"go test", "go install"}) {
+		t.Errorf("Unexpected preps: %#v", ret)
+	}
+	if ret := fake.Restarts(); !reflect.DeepEqual(ret, []string{"go"}) {
+		t.Errorf("Unexpected restarts: %#v", ret)
+	}
+
+	fake.Reset()
+	if err := Cycle(mr, "style/main.css"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, []string{`lessc "./style/main.css"`}) {
+		t.Errorf("Unexpected preps: %#v", ret)
+	}
+	if ret := fake.Restarts(); len(ret) != 0 {
+		t.Errorf("Unexpected restarts: %#v", ret)
+	}
+}
+
+func TestCycleNoRestart(t *testing.T) {
+	mr, fake, err := New(testConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.NoRestart = true
+	if err := Initial(mr); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Restarts(); !reflect.DeepEqual(ret, []string{"go"}) {
+		t.Errorf("Expected daemons to start on the initial run, got %#v", ret)
+	}
+	fake.Reset()
+	if err := Cycle(mr, "src/main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, []string{"go test", "go install"}) {
+		t.Errorf("Unexpected preps: %#v", ret)
+	}
+	if ret := fake.Restarts(); len(ret) != 0 {
+		t.Errorf("Unexpected restarts: %#v", ret)
+	}
+}
+
+func TestCycleDedup(t *testing.T) {
+	mr, fake, err := New(`
+**/*.go {
+	label: server
+	prep +dedupkey=modcache: go mod download
+	prep: go build ./cmd/server
+}
+**/*.go {
+	label: client
+	prep +dedupkey=modcache: go mod download
+	prep: go build ./cmd/client
+}
+**/*.md {
+	label: docs
+	prep +dedupkey=modcache: go mod download
+}
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Initial(mr); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"go mod download", "go build ./cmd/server", "go build ./cmd/client"}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	// Keys are forgotten at the end of each cycle
+	fake.Reset()
+	if err := Cycle(mr, "main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+
+	// A failure is shared by every block with the key
+	fake.Reset()
+	fake.Errors = map[string]error{"go mod download": fmt.Errorf("network down")}
+	if err := Cycle(mr, "main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, []string{"go mod download"}) {
+		t.Errorf("Unexpected preps: %#v", ret)
+	}
+	expectedFailed := []string{"server", "client"}
+	if ret := mr.LastCycle().Failed(); !reflect.DeepEqual(ret, expectedFailed) {
+		t.Errorf("Expected failed blocks %#v, got %#v", expectedFailed, ret)
+	}
+}
+
+func TestCycleFailure(t *testing.T) {
+	mr, fake, err := New(testConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Errors = map[string]error{"go test": fmt.Errorf("tests failed")}
+	if err := Cycle(mr, "main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := fake.Preps(); !reflect.DeepEqual(ret, []string{"go test"}) {
+		t.Errorf("Unexpected preps: %#v", ret)
+	}
+	if ret := fake.Restarts(); len(ret) != 0 {
+		t.Errorf("Daemons should not restart after a failed prep: %#v", ret)
+	}
+}
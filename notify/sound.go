@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSoundDebounce is the period after a sound during which further
+// sounds are dropped
+const DefaultSoundDebounce = time.Second
+
+// Default sounds on macOS
+const (
+	macPassSound = "/System/Library/Sounds/Glass.aiff"
+	macFailSound = "/System/Library/Sounds/Basso.aiff"
+)
+
+// An OutcomeNotifier is told whether each run of a block passed or failed,
+// in addition to being pushed errors
+type OutcomeNotifier interface {
+	Notifier
+	Outcome(name string, passed bool)
+}
+
+// A player returns the command that plays a sound file, or a default sound
+// for the outcome if file is empty. It returns nil if there's nothing to
+// play.
+type player func(file string, passed bool) *exec.Cmd
+
+// SoundNotifier plays a sound when a block passes or fails. Sounds in quick
+// succession are debounced, so that a cycle running many blocks plays a
+// single sound - although a failure may still follow a recent pass.
+type SoundNotifier struct {
+	// Pass and Fail are the sound files played for each outcome. If they're
+	// empty, a platform default is used.
+	Pass     string
+	Fail     string
+	Debounce time.Duration
+
+	play       player
+	last       time.Time
+	lastPassed bool
+	sync.Mutex
+}
+
+// NewSoundNotifier creates a notifier that plays the specified sound files,
+// using afplay on macOS, PowerShell on Windows, and paplay or aplay
+// elsewhere. It returns nil if afplay or PowerShell is missing. Elsewhere,
+// sound files are skipped if neither tool is found, and without a file the
+// terminal bell is rung on failure.
+func NewSoundNotifier(pass string, fail string) *SoundNotifier {
+	p := platformPlayer()
+	if p == nil {
+		return nil
+	}
+	return &SoundNotifier{
+		Pass:     pass,
+		Fail:     fail,
+		Debounce: DefaultSoundDebounce,
+		play:     p,
+	}
+}
+
+// Push implements Notifier. Failures are announced through Outcome, so
+// errors don't play a sound of their own.
+func (*SoundNotifier) Push(string, string, string) {}
+
+// Outcome implements OutcomeNotifier
+func (s *SoundNotifier) Outcome(name string, passed bool) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if now.Sub(s.last) < s.Debounce && (passed || !s.lastPassed) {
+		return
+	}
+	s.last = now
+	s.lastPassed = passed
+	file := s.Pass
+	if !passed {
+		file = s.Fail
+	}
+	if cmd := s.play(file, passed); cmd != nil {
+		go cmd.Run()
+	}
+}
+
+func platformPlayer() player {
+	switch runtime.GOOS {
+	case "darwin":
+		if !hasExecutable("afplay") {
+			return nil
+		}
+		return func(file string, passed bool) *exec.Cmd {
+			if file == "" {
+				file = macFailSound
+				if passed {
+					file = macPassSound
+				}
+			}
+			return exec.Command("afplay", file)
+		}
+	case "windows":
+		if !hasExecutable("powershell") {
+			return nil
+		}
+		return func(file string, passed bool) *exec.Cmd {
+			script := "[System.Media.SystemSounds]::Hand.Play()"
+			if file != "" {
+				script = fmt.Sprintf(
+					"(New-Object Media.SoundPlayer '%s').PlaySync()",
+					strings.Replace(file, "'", "''", -1),
+				)
+			} else if passed {
+				script = "[System.Media.SystemSounds]::Asterisk.Play()"
+			}
+			return exec.Command("powershell", "-NoProfile", "-Command", script)
+		}
+	default:
+		var tool string
+		for _, t := range []string{"paplay", "aplay"} {
+			if hasExecutable(t) {
+				tool = t
+				break
+			}
+		}
+		return func(file string, passed bool) *exec.Cmd {
+			if file != "" {
+				if tool == "" {
+					return nil
+				}
+				return exec.Command(tool, file)
+			}
+			// Without a sound file, fall back to the terminal bell for
+			// failures
+			if !passed {
+				fmt.Fprint(os.Stdout, "\a")
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSoundNotifier(t *testing.T) {
+	var played []string
+	s := &SoundNotifier{
+		Pass:     "pass.wav",
+		Debounce: time.Hour,
+		play: func(file string, passed bool) *exec.Cmd {
+			played = append(played, file)
+			return nil
+		},
+	}
+	s.Outcome("one", true)
+	s.Outcome("two", true)
+	s.Outcome("three", false)
+	s.Outcome("four", false)
+	s.Outcome("five", true)
+	expected := []string{"pass.wav", ""}
+	if !reflect.DeepEqual(played, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, played)
+	}
+
+	s.Debounce = 0
+	s.Outcome("six", true)
+	if len(played) != 3 {
+		t.Errorf("Expected sound after debounce period, got %#v", played)
+	}
+}
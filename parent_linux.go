@@ -0,0 +1,24 @@
+package modd
+
+import (
+	"os"
+	"syscall"
+)
+
+// DieWithParent asks the kernel to send modd SIGINT when its parent process
+// exits, so that modd shuts its daemons down and quits rather than leaving
+// them orphaned. If the parent has already gone by the time the request is
+// made, the signal is sent straight away.
+func DieWithParent() error {
+	ppid := os.Getppid()
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGINT), 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	if os.Getppid() != ppid {
+		return syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package modd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/utils"
+)
+
+// TestDieWithParentHelper is run as a child of a short-lived shell by
+// TestDieWithParent, and records whether it's signalled when the shell exits
+func TestDieWithParentHelper(t *testing.T) {
+	out := os.Getenv("MODD_DIE_WITH_PARENT")
+	if out == "" {
+		t.Skip("only run by TestDieWithParent")
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	if err := DieWithParent(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c:
+		ioutil.WriteFile(out, []byte("signalled"), 0644)
+	case <-time.After(timeout):
+	}
+}
+
+func TestDieWithParent(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	out, err := filepath.Abs("signalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(
+		"sh", "-c", `"$0" -test.run '^TestDieWithParentHelper$' & sleep 0.5`,
+		os.Args[0],
+	)
+	cmd.Env = append(os.Environ(), "MODD_DIE_WITH_PARENT="+out)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for {
+		if _, err := os.Stat(out); err == nil {
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatal("Child was not signalled when its parent exited")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package modd
+
+import "errors"
+
+// DieWithParent is only available on Linux
+func DieWithParent() error {
+	return errors.New("dying with the parent process is only supported on Linux")
+}
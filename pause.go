@@ -0,0 +1,113 @@
+package modd
+
+import (
+	"sync"
+
+	"github.com/cortesi/moddwatch"
+)
+
+// pauser gates the processing of changes. While paused, changes are held back
+// and joined together, or dropped. The zero value is unpaused.
+type pauser struct {
+	paused  bool
+	held    *moddwatch.Mod
+	resumed chan struct{}
+	sync.Mutex
+}
+
+// wake returns a channel that receives a value when the pauser is resumed
+func (p *pauser) wake() chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{}, 1)
+	}
+	return p.resumed
+}
+
+// set pauses or resumes, and reports whether the state changed
+func (p *pauser) set(paused bool) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	if !paused && p.resumed != nil {
+		select {
+		case p.resumed <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (p *pauser) isPaused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// hold holds back mod if paused, joining it to any changes already held, or
+// discarding it if drop is set. It reports whether mod was held or dropped.
+// Changes joined to those already held are counted in w.
+func (p *pauser) hold(mod *moddwatch.Mod, drop bool, w *watchCounters) bool {
+	p.Lock()
+	defer p.Unlock()
+	if !p.paused {
+		return false
+	}
+	if drop {
+		return true
+	}
+	if p.held == nil {
+		p.held = mod
+	} else {
+		w.debounce(mod)
+		joined := p.held.Join(*mod)
+		p.held = &joined
+	}
+	return true
+}
+
+// release returns the changes held while paused, if any, and forgets them
+func (p *pauser) release() *moddwatch.Mod {
+	p.Lock()
+	defer p.Unlock()
+	mod := p.held
+	p.held = nil
+	return mod
+}
+
+// Pause stops modd from acting on changes and running scheduled blocks until
+// Resume is called. Daemons keep running while paused. Changes made while
+// paused are run together in a single cycle on resume, or dropped if
+// DropPaused is set.
+func (mr *ModRunner) Pause() {
+	if mr.pause.set(true) {
+		mr.Log.Notice(">> paused")
+		mr.events.emit(Event{Type: EventPause})
+	}
+}
+
+// Resume undoes Pause
+func (mr *ModRunner) Resume() {
+	if mr.pause.set(false) {
+		mr.Log.Notice(">> resumed")
+		mr.events.emit(Event{Type: EventResume})
+	}
+}
+
+// TogglePause pauses modd if it's running, and resumes it if it's paused
+func (mr *ModRunner) TogglePause() {
+	if mr.Paused() {
+		mr.Resume()
+	} else {
+		mr.Pause()
+	}
+}
+
+// Paused reports whether modd is paused
+func (mr *ModRunner) Paused() bool {
+	return mr.pause.isPaused()
+}
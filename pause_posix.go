@@ -0,0 +1,28 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause toggles pausing when modd receives SIGUSR1, unless SIGUSR1 is
+// given another action. The returned function removes the handler.
+func notifyPause(mr *ModRunner) func() {
+	if mr.hasSignalAction(syscall.SIGUSR1) {
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			mr.TogglePause()
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
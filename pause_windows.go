@@ -0,0 +1,8 @@
+// +build windows
+
+package modd
+
+// notifyPause is a no-op on Windows, which has no SIGUSR1.
+func notifyPause(mr *ModRunner) func() {
+	return func() {}
+}
@@ -1,6 +1,12 @@
 package modd
 
 import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cortesi/modd/conf"
@@ -8,39 +14,379 @@ import (
 	"github.com/cortesi/modd/shell"
 	"github.com/cortesi/modd/varcmd"
 	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/moddwatch/filter"
 	"github.com/cortesi/termlog"
+	"golang.org/x/text/encoding"
 )
 
 // ProcError is a process error, possibly containing command output
 type ProcError struct {
 	shorttext string
 	Output    string
+	// ExitCode is the exit code of the process, or -1 if it was terminated
+	// by a signal
+	ExitCode int
 }
 
 func (p ProcError) Error() string {
 	return p.shorttext
 }
 
+// NonFatalError is returned when preps with the ContinueOnError flag failed,
+// but the other preps of the block ran and passed
+type NonFatalError struct {
+	Errors []error
+	// Failed holds the names of the preps that failed, or were skipped
+	// because their input failed, for those that have one
+	Failed []string
+}
+
+func (e NonFatalError) Error() string {
+	if len(e.Errors) == 1 {
+		return "1 non-fatal prep failure"
+	}
+	return fmt.Sprintf("%d non-fatal prep failures", len(e.Errors))
+}
+
+// nonFatal checks whether err reports only non-fatal failures
+func nonFatal(err error) bool {
+	_, ok := err.(NonFatalError)
+	return ok
+}
+
 // RunProc runs a process to completion, sending output to log
 func RunProc(cmd string, shellMethod string, dir string, log termlog.Stream) error {
+	_, err := runProc(cmd, shellMethod, dir, procOptions{}, log)
+	return err
+}
+
+// RunProcTo is like RunProc, but sends lines from the standard output and
+// error of the process to the stdout and stderr functions instead of the log.
+// If either function is nil, the corresponding stream goes to the log as
+// usual.
+func RunProcTo(
+	cmd string,
+	shellMethod string,
+	dir string,
+	log termlog.Stream,
+	stdout func(string, ...interface{}),
+	stderr func(string, ...interface{}),
+) error {
+	_, err := runProc(cmd, shellMethod, dir, procOptions{stdout: stdout, stderr: stderr}, log)
+	return err
+}
+
+// RunProcRaw is like RunProc, but copies the standard output and error of the
+// process byte for byte to the stdout and stderr writers, without splitting it
+// into lines. This preserves partial lines and control characters, for
+// commands that draw progress bars or produce binary output. If either writer
+// is nil, the corresponding stream goes to the log as usual.
+func RunProcRaw(
+	cmd string,
+	shellMethod string,
+	dir string,
+	log termlog.Stream,
+	stdout io.Writer,
+	stderr io.Writer,
+) error {
+	_, err := runProc(cmd, shellMethod, dir, procOptions{rawStdout: stdout, rawStderr: stderr}, log)
+	return err
+}
+
+// procOptions controls the execution of a process by runProc
+type procOptions struct {
+	// If set, connected to the standard input of the process
+	stdin io.Reader
+	// Should the standard output of the process be returned
+	capture bool
+	// NAME=value pairs added to the environment of the process
+	env []string
+	// If cleanEnv is set, only the variables named in passEnv are inherited
+	cleanEnv bool
+	passEnv  []string
+	// Destinations for output lines, if not the log
+	stdout func(string, ...interface{})
+	stderr func(string, ...interface{})
+	// Character encoding of the output, if not UTF-8
+	encoding encoding.Encoding
+	// The byte output is split into lines on, if not newline
+	delimiter string
+	// The octal umask the process is started with, if not modd's
+	umask string
+	// Collapses repeated output lines, if non-zero
+	collapse time.Duration
+	// Log the command line before running the process
+	echo bool
+	// Stops the process with the escalation ladder if it runs for longer
+	// than timeout. If ladder is empty, shell.DefaultLadder is used.
+	timeout time.Duration
+	ladder  []shell.SignalStep
+	// Destinations for unmodified output, if not the log
+	rawStdout io.Writer
+	rawStderr io.Writer
+	// Container the process is run in, if any
+	container *shell.Container
+	// Matches sensitive text that's masked in the output, if set
+	mask *regexp.Regexp
+}
+
+// runProc is like RunProc, but with additional options. If opts.capture is
+// true, the process's standard output is returned.
+func runProc(
+	cmd string,
+	shellMethod string,
+	dir string,
+	opts procOptions,
+	log termlog.Stream,
+) (string, error) {
 	log.Header()
 	ex, err := shell.NewExecutor(shellMethod, cmd, dir)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer procs.acquire(false)()
+	ex.Stdin = opts.stdin
+	ex.BufferOutput = opts.capture
+	ex.Env = opts.env
+	ex.CleanEnv = opts.cleanEnv
+	ex.PassEnv = opts.passEnv
+	ex.Stdout = opts.stdout
+	ex.Stderr = opts.stderr
+	ex.Encoding = opts.encoding
+	ex.Delimiter = opts.delimiter
+	ex.Umask = opts.umask
+	if opts.umask != "" && !shell.UmaskSupported {
+		log.Warn(">> +umask is not supported on this platform, ignored")
 	}
+	ex.Collapse = opts.collapse
+	ex.Echo = opts.echo
+	ex.Timeout = opts.timeout
+	ex.Ladder = opts.ladder
+	ex.RawStdout = opts.rawStdout
+	ex.RawStderr = opts.rawStderr
+	ex.Container = opts.container
+	ex.Mask = opts.mask
+	defer commands.add(ex, opts.ladder)()
 	start := time.Now()
 	err, estate := ex.Run(log, true)
 	if err != nil {
-		return err
-	} else if estate.Error != nil {
+		return "", err
+	}
+	return procResult(estate, start, log)
+}
+
+// commands holds the commands run by runProc that are still running, so they
+// can be stopped when modd quits without waiting for them to finish
+var commands = &commandSet{}
+
+type commandSet struct {
+	running map[*shell.Executor][]shell.SignalStep
+	sync.Mutex
+}
+
+// add records that ex is running, stopped with ladder, and returns a function
+// that removes it once it's done
+func (s *commandSet) add(ex *shell.Executor, ladder []shell.SignalStep) func() {
+	s.Lock()
+	defer s.Unlock()
+	if s.running == nil {
+		s.running = make(map[*shell.Executor][]shell.SignalStep)
+	}
+	s.running[ex] = ladder
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		delete(s.running, ex)
+	}
+}
+
+// terminate stops all the running commands, as for Executor.Terminate, and
+// returns once they've exited
+func (s *commandSet) terminate() {
+	s.Lock()
+	running := make(map[*shell.Executor][]shell.SignalStep, len(s.running))
+	for ex, ladder := range s.running {
+		running[ex] = ladder
+	}
+	s.Unlock()
+	var wg sync.WaitGroup
+	for ex, ladder := range running {
+		wg.Add(1)
+		go func(ex *shell.Executor, ladder []shell.SignalStep) {
+			defer wg.Done()
+			ex.Terminate(ladder)
+		}(ex, ladder)
+	}
+	wg.Wait()
+}
+
+// rollback runs the block's rollback command after the prep at index i, with
+// the command line cmd, failed with err. The rollback runs with the
+// environment of the failed prep, plus variables describing the failure. Its
+// outcome is logged, and doesn't change the error returned by the block.
+func rollback(
+	b conf.Block,
+	vcmd *varcmd.VarCmd,
+	i int,
+	cmd string,
+	err error,
+	sh string,
+	opts procOptions,
+	runner Runner,
+	log termlog.TermLog,
+) {
+	rcmd, rerr := vcmd.Render(b.Rollback)
+	if rerr != nil {
+		log.Shout(">> rollback failed: %s", rerr)
+		return
+	}
+	code := 1
+	if pe, ok := err.(ProcError); ok {
+		code = pe.ExitCode
+	}
+	opts.env = append(
+		append([]string{}, opts.env...),
+		"MODD_FAILED_PREP="+cmd,
+		"MODD_FAILED_INDEX="+strconv.Itoa(i+1),
+		"MODD_FAILED_EXITCODE="+strconv.Itoa(code),
+	)
+	opts.stdin = nil
+	opts.capture = false
+	opts.timeout = 0
+	opts.ladder = nil
+	log.Warn(">> rolling back after failed prep: %s", cmd)
+	if runner != nil {
+		_, rerr = runner.Prep(b, rcmd, "")
+	} else {
+		_, rerr = runProc(rcmd, sh, b.InDir, opts, log.Stream(niceHeader("rollback: ", rcmd)))
+	}
+	if rerr != nil {
+		log.Shout(">> rollback failed: %s", rerr)
+	} else {
+		log.Notice(">> rolled back")
+	}
+}
+
+// signalLadder converts the kill signals of a prep to an escalation ladder
+func signalLadder(steps []conf.KillStep) []shell.SignalStep {
+	var ret []shell.SignalStep
+	for _, s := range steps {
+		ret = append(ret, shell.SignalStep{Signal: s.Signal, Wait: s.Wait})
+	}
+	return ret
+}
+
+// maskPattern joins mask patterns into a single expression, or returns nil if
+// there are none. The patterns are checked when the config is parsed.
+func maskPattern(patts []string) *regexp.Regexp {
+	if len(patts) == 0 {
+		return nil
+	}
+	parts := make([]string, len(patts))
+	for i, p := range patts {
+		parts[i] = "(?:" + p + ")"
+	}
+	return regexp.MustCompile(strings.Join(parts, "|"))
+}
+
+// blockShell returns the name of the shell for commands in block b: its own
+// shell if it has one, and otherwise the @shell variable
+func blockShell(b conf.Block, vars map[string]string) string {
+	if b.Shell != "" {
+		return b.Shell
+	}
+	return vars[shellVarName]
+}
+
+// runInSession is like runProc, but runs the command in a persistent shell
+// session
+func runInSession(
+	s *shell.Session, cmd string, capture bool, log termlog.Stream,
+) (string, error) {
+	log.Header()
+	defer procs.acquire(false)()
+	start := time.Now()
+	err, estate := s.Run(cmd, log, capture)
+	if err != nil {
+		return "", err
+	}
+	return procResult(estate, start, log)
+}
+
+// bareStream is a log stream without a header. Its lines are logged as though
+// they came from the log itself, so no header is shown before them.
+type bareStream struct {
+	termlog.Logger
+}
+
+func (bareStream) Quiet()  {}
+func (bareStream) Header() {}
+
+// prepStream returns the stream that the output of a prep running cmd is
+// logged to, which is headed by the command unless the block turns headers
+// off
+func prepStream(log termlog.TermLog, b conf.Block, cmd string) termlog.Stream {
+	if b.Header == "off" {
+		return bareStream{log}
+	}
+	return log.Stream(niceHeader("prep: ", cmd))
+}
+
+// procResult logs the outcome of a process started at start, and returns its
+// captured output, or a ProcError if it failed
+func procResult(estate *shell.ExecState, start time.Time, log termlog.Stream) (string, error) {
+	if estate.SinkError != nil {
+		log.Warn("output lost: %s", estate.SinkError)
+	}
+	if estate.Error != nil {
 		log.Shout("%s", estate.Error)
-		return ProcError{estate.Error.Error(), estate.ErrOutput}
+		return "", ProcError{
+			shorttext: estate.Error.Error(),
+			Output:    estate.ErrOutput,
+			ExitCode:  estate.ExitCode,
+		}
 	}
-	log.Notice(">> done (%s)", time.Since(start))
-	return nil
+	if _, bare := log.(bareStream); !bare {
+		log.Notice(">> done (%s)", time.Since(start))
+	}
+	return estate.Output, nil
 }
 
-// RunPreps runs all commands in sequence. Stops if any command returns an error.
+// retry calls run, and calls it again if it fails, up to p.Retries more
+// times. Only failures with one of p.RetryOnCodes are retried, if it's set.
+func retry(p conf.Prep, log termlog.TermLog, run func() (string, error)) (string, error) {
+	output, err := run()
+	for i := 1; i <= p.Retries && err != nil && retryable(p, err); i++ {
+		if pe, ok := err.(ProcError); ok {
+			log.Warn(">> retrying after exit code %d (%d of %d)", pe.ExitCode, i, p.Retries)
+		} else {
+			log.Warn(">> retrying after error: %s (%d of %d)", err, i, p.Retries)
+		}
+		output, err = run()
+	}
+	return output, err
+}
+
+// retryable is true if err is a failure of p that may be retried
+func retryable(p conf.Prep, err error) bool {
+	if len(p.RetryOnCodes) == 0 {
+		return true
+	}
+	if pe, ok := err.(ProcError); ok {
+		for _, c := range p.RetryOnCodes {
+			if pe.ExitCode == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RunPreps runs all commands in sequence. Stops if any command returns an
+// error, unless it has the ContinueOnError flag, in which case the error is
+// reported in a NonFatalError once the other preps have run. Preps with the
+// Pipe flag receive the output of the preceding prep on stdin, and are skipped
+// if the preceding prep was skipped or failed.
 func RunPreps(
 	b conf.Block,
 	vars map[string]string,
@@ -49,34 +395,215 @@ func RunPreps(
 	notifiers []notify.Notifier,
 	initial bool,
 ) error {
-	sh, err := shell.GetShellName(vars[shellVarName])
+	return runPreps(b, vars, mod, nil, log, notifiers, initial, &envCache{}, nil, nil, nil, nil)
+}
+
+// runPreps is like RunPreps, with additional context. If given, matches are
+// the patterns that matched mod, which are logged for debugging, kept holds
+// the output kept by preps from the block's last run, and each prep that runs
+// is recorded as a child of span.
+func runPreps(
+	b conf.Block,
+	vars map[string]string,
+	mod *moddwatch.Mod,
+	matches []PatternMatch,
+	log termlog.TermLog,
+	notifiers []notify.Notifier,
+	initial bool,
+	envs *envCache,
+	events *eventBus,
+	runner Runner,
+	kept *keptValues,
+	span *Span,
+) error {
+	sh, err := shell.GetShellName(blockShell(b, vars))
+	if err != nil {
+		return err
+	}
+	env, err := envs.resolve(b.Env, sh, b.InDir)
 	if err != nil {
 		return err
 	}
+	if prev := kept.env(b); len(prev) > 0 {
+		env = append(env[:len(env):len(env)], prev...)
+	}
+	if b.Isolate == "on" && runner == nil {
+		dir, remove, err := isolate(b.InDir)
+		if err != nil {
+			return err
+		}
+		defer remove()
+		log.NoticeAs("debug", ">> preps isolated in %s", dir)
+		b.InDir = dir
+	}
+	var enc encoding.Encoding
+	if b.Encoding != "" {
+		enc, err = shell.LookupEncoding(b.Encoding)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range matches {
+		log.NoticeAs("debug", "pattern %s matched %s", m.Pattern, strings.Join(m.Files, " "))
+	}
 
 	var modified []string
 	if mod != nil {
 		modified = mod.All()
 	}
 	vcmd := varcmd.VarCmd{Block: &b, Modified: modified, Vars: vars}
-	for _, p := range b.Preps {
+	mask := maskPattern(b.Mask)
+	// Shared by preps with the Persist flag, and started on first use
+	var session *shell.Session
+	defer func() {
+		if session != nil {
+			session.Close()
+		}
+	}()
+
+	var output string
+	var failures []error
+	var failed []string
+	// Whether the preceding prep failed, or was skipped because its input
+	// failed
+	skipped, broken := false, false
+	for i, p := range b.Preps {
 		cmd, err := vcmd.Render(p.Command)
-		if initial && p.Onchange {
+		if (initial && p.Onchange) || (p.Pipe && skipped) {
+			if p.Pipe && skipped {
+				log.NoticeAs("debug", "piped prep skipped, its input was skipped")
+				if broken && p.Name != "" {
+					failed = append(failed, p.Name)
+				}
+			} else {
+				log.NoticeAs("debug", "onchange prep skipped on initial run")
+			}
 			log.Say(niceHeader("skipping prep: ", cmd))
+			broken = broken && p.Pipe
+			skipped = true
 			continue
 		}
+		skipped, broken = false, false
 		if err != nil {
 			return err
 		}
-		err = RunProc(cmd, sh, b.InDir, log.Stream(niceHeader("prep: ", cmd)))
-		if err != nil {
+		if len(p.OnlyIf) > 0 && mod != nil {
+			files, err := filter.Files(modified, p.OnlyIf, nil)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				log.NoticeAs("debug", "prep skipped, no changes matched %s", strings.Join(p.OnlyIf, ", "))
+				log.Say(niceHeader("skipping prep: ", cmd))
+				skipped = true
+				continue
+			}
+		}
+		opts := procOptions{
+			capture:   (i+1 < len(b.Preps) && b.Preps[i+1].Pipe) || p.Keep != "",
+			env:       env,
+			cleanEnv:  b.CleanEnv,
+			passEnv:   b.PassEnv,
+			encoding:  enc,
+			delimiter: b.Delimiter,
+			umask:     p.Umask,
+			collapse:  b.Collapse,
+			echo:      b.Echo == "on",
+			timeout:   p.Timeout,
+			ladder:    signalLadder(p.KillSignals),
+			mask:      mask,
+		}
+		if b.Container != nil {
+			opts.container = &shell.Container{
+				Image:   b.Container.Image,
+				Runtime: b.Container.Runtime,
+			}
+		}
+		stdin := ""
+		if p.Pipe {
+			stdin = output
+			opts.stdin = strings.NewReader(output)
+		}
+		if p.Persist && session == nil && runner == nil {
+			session, err = shell.NewSession(sh, b.InDir)
+			if err != nil {
+				return err
+			}
+			session.Env = env
+			session.CleanEnv = b.CleanEnv
+			session.PassEnv = b.PassEnv
+			session.Encoding = enc
+			session.Echo = b.Echo == "on"
+			session.Mask = mask
+		}
+		// A prep with a dedup key that has already run this cycle takes the
+		// outcome of that run, including its failure
+		prior, dup := prepResult{}, false
+		if p.DedupKey != "" {
+			prior, dup = envs.ran(p.DedupKey)
+		}
+		if dup {
+			log.NoticeAs("debug", "prep skipped, already run this cycle with key %s", p.DedupKey)
+			log.Say(niceHeader("skipping prep: ", cmd))
+			output, err = prior.output, prior.err
+		} else {
+			events.emit(Event{Type: EventPrepStart, Block: b.Label, Command: cmd})
+			pspan := span.child("prep")
+			output, err = retry(p, log, func() (string, error) {
+				if runner != nil {
+					return runner.Prep(b, cmd, stdin)
+				} else if p.Persist {
+					return runInSession(session, cmd, opts.capture, prepStream(log, b, cmd))
+				}
+				if p.Pipe {
+					opts.stdin = strings.NewReader(stdin)
+				}
+				return runProc(cmd, sh, b.InDir, opts, prepStream(log, b, cmd))
+			})
+			end := Event{Type: EventPrepEnd, Block: b.Label, Command: cmd}
 			if pe, ok := err.(ProcError); ok {
+				end.ExitCode = pe.ExitCode
+				end.Error = pe.shorttext
+			} else if err != nil {
+				end.Error = err.Error()
+			}
+			events.emit(end)
+			if pspan != nil {
+				pspan.set("modd.command", cmd)
+				pspan.set("process.exit_code", end.ExitCode)
+				pspan.fail(err)
+				pspan.finish()
+			}
+			if p.DedupKey != "" {
+				envs.record(p.DedupKey, prepResult{output: output, err: err})
+			}
+		}
+		if err == nil && p.Keep != "" {
+			kept.set(p.Keep, strings.TrimSuffix(output, "\n"))
+		}
+		if err != nil {
+			if pe, ok := err.(ProcError); ok && !dup {
 				for _, n := range notifiers {
 					n.Push("modd error", pe.Output, "")
 				}
 			}
-			return err
+			if !p.ContinueOnError {
+				if b.Rollback != "" {
+					rollback(b, &vcmd, i, cmd, err, sh, opts, runner, log)
+				}
+				return err
+			}
+			log.Warn(">> continuing after non-fatal failure: %s", cmd)
+			failures = append(failures, err)
+			if p.Name != "" {
+				failed = append(failed, p.Name)
+			}
+			skipped, broken = true, true
 		}
 	}
+	if len(failures) > 0 {
+		return NonFatalError{Errors: failures, Failed: failed}
+	}
 	return nil
 }
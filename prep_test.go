@@ -0,0 +1,547 @@
+package modd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func TestRunPrepsPipe(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: "echo ':upstream: one'; echo ':upstream: two'"},
+			{Command: "sed 's/upstream/downstream/'", Pipe: true},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{
+		":upstream: one",
+		":upstream: two",
+		":downstream: one",
+		":downstream: two",
+	}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsPipeFailure(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: "echo ':upstream: one'; false"},
+			{Command: "sed 's/upstream/downstream/'", Pipe: true},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if _, ok := err.(ProcError); !ok {
+		t.Fatalf("Expected ProcError, got %#v", err)
+	}
+	expected := []string{":upstream: one"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsPipeSkipped(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: "echo ':upstream: one'", Onchange: true},
+			{Command: "sed 's/upstream/downstream/'", Pipe: true},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	if ret := events(lt.String()); len(ret) != 0 {
+		t.Errorf("Expected no output, got %#v", ret)
+	}
+}
+
+func TestRunProcTo(t *testing.T) {
+	lt := termlog.NewLogTest()
+	var stdout, stderr []string
+	err := RunProcTo(
+		"echo moddout; echo modderr >&2", "bash", "", lt.Log.Stream(""),
+		func(s string, args ...interface{}) { stdout = append(stdout, fmt.Sprintf(s, args...)) },
+		func(s string, args ...interface{}) { stderr = append(stderr, fmt.Sprintf(s, args...)) },
+	)
+	if err != nil {
+		t.Fatalf("RunProcTo: %s", err)
+	}
+	if !reflect.DeepEqual(stdout, []string{"moddout"}) {
+		t.Errorf("Unexpected stdout: %#v", stdout)
+	}
+	if !reflect.DeepEqual(stderr, []string{"modderr"}) {
+		t.Errorf("Unexpected stderr: %#v", stderr)
+	}
+	if ret := events(lt.String()); len(ret) != 0 {
+		t.Errorf("Output leaked to log: %#v", ret)
+	}
+}
+
+func TestRunProcRaw(t *testing.T) {
+	lt := termlog.NewLogTest()
+	var stdout, stderr bytes.Buffer
+	err := RunProcRaw(
+		`printf 'progress 50%%\rprogress 100%%'; printf '\x00\x01' >&2`,
+		"bash", "", lt.Log.Stream(""), &stdout, &stderr,
+	)
+	if err != nil {
+		t.Fatalf("RunProcRaw: %s", err)
+	}
+	if stdout.String() != "progress 50%\rprogress 100%" {
+		t.Errorf("Unexpected stdout: %q", stdout.String())
+	}
+	if stderr.String() != "\x00\x01" {
+		t.Errorf("Unexpected stderr: %q", stderr.String())
+	}
+	if strings.Contains(lt.String(), "progress") {
+		t.Errorf("Output leaked to log: %s", lt.String())
+	}
+}
+
+func TestRunPrepsPersist(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: "export STEP=one", Persist: true},
+			{Command: "echo \":persist: ${STEP:-unset}\"", Persist: true},
+			{Command: "echo \":fresh: ${STEP:-unset}\""},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{":persist: one", ":fresh: unset"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsGlobalEnv(t *testing.T) {
+	os.Setenv("MODD_LAYER_OS", "os")
+	os.Setenv("MODD_LAYER_GLOBAL", "os")
+	defer os.Unsetenv("MODD_LAYER_OS")
+	defer os.Unsetenv("MODD_LAYER_GLOBAL")
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		env: MODD_LAYER_GLOBAL=global
+		env: MODD_LAYER_BLOCK=global
+		{
+			env: MODD_LAYER_BLOCK=block
+			prep: echo ":env: $MODD_LAYER_OS $MODD_LAYER_GLOBAL $MODD_LAYER_BLOCK"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{":env: os global block"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsPassEnv(t *testing.T) {
+	os.Setenv("MODD_PASSED", "yes")
+	os.Setenv("MODD_EXCLUDED", "yes")
+	defer os.Unsetenv("MODD_PASSED")
+	defer os.Unsetenv("MODD_EXCLUDED")
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		CleanEnv: true,
+		PassEnv:  []string{"MODD_PASSED"},
+		Env:      []conf.EnvVar{{Name: "MODD_SET", Value: "yes"}},
+		Preps: []conf.Prep{
+			{Command: `echo ":env: ${MODD_PASSED:-no} ${MODD_SET:-no} ${MODD_EXCLUDED:-no}"`},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{":env: yes yes no"}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsOnlyIf(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: `echo ":proto: ran"`, OnlyIf: []string{"**/*.proto"}},
+			{Command: `echo ":always: ran"`},
+		},
+	}
+	tests := []struct {
+		mod      *moddwatch.Mod
+		expected []string
+	}{
+		{&moddwatch.Mod{Changed: []string{"api/service.proto"}}, []string{":proto: ran", ":always: ran"}},
+		{&moddwatch.Mod{Changed: []string{"main.go"}}, []string{":always: ran"}},
+		{nil, []string{":proto: ran", ":always: ran"}},
+	}
+	for _, tt := range tests {
+		lt := termlog.NewLogTest()
+		err := RunPreps(b, vars, tt.mod, lt.Log, nil, tt.mod == nil)
+		if err != nil {
+			t.Fatalf("RunPreps: %s", err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("Expected\n%#v\nGot\n%#v", tt.expected, ret)
+		}
+		if skipped := strings.Contains(lt.String(), "skipping prep"); skipped != (len(tt.expected) == 1) {
+			t.Errorf("Expected skipped prep to be logged:\n%s", lt.String())
+		}
+	}
+}
+
+func TestRunPrepsContinueOnError(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	tests := []struct {
+		preps    []conf.Prep
+		expected []string
+		nonfatal int
+	}{
+		{
+			[]conf.Prep{
+				{Command: `echo ":lint: ran"; exit 1`, ContinueOnError: true},
+				{Command: `echo ":build: ran"`},
+			},
+			[]string{":lint: ran", ":build: ran"},
+			1,
+		},
+		{
+			[]conf.Prep{
+				{Command: `echo ":lint: ran"; exit 1`, ContinueOnError: true},
+				{Command: `echo ":build: ran"; exit 2`},
+				{Command: `echo ":test: ran"`},
+			},
+			[]string{":lint: ran", ":build: ran"},
+			0,
+		},
+		{
+			[]conf.Prep{
+				{Command: `echo ":lint: ran"; exit 1`, ContinueOnError: true},
+				{Command: `echo ":vet: ran"; exit 1`, ContinueOnError: true},
+				{Command: `echo ":build: ran"`},
+			},
+			[]string{":lint: ran", ":vet: ran", ":build: ran"},
+			2,
+		},
+	}
+	for i, tt := range tests {
+		lt := termlog.NewLogTest()
+		err := RunPreps(conf.Block{Preps: tt.preps}, vars, nil, lt.Log, nil, true)
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%d: expected\n%#v\nGot\n%#v", i, tt.expected, ret)
+		}
+		if tt.nonfatal == 0 {
+			if _, ok := err.(ProcError); !ok {
+				t.Errorf("%d: expected ProcError, got %#v", i, err)
+			}
+			continue
+		}
+		nf, ok := err.(NonFatalError)
+		if !ok || len(nf.Errors) != tt.nonfatal {
+			t.Errorf("%d: expected %d non-fatal failures, got %#v", i, tt.nonfatal, err)
+		}
+		if !strings.Contains(lt.String(), "continuing after non-fatal failure") {
+			t.Errorf("%d: expected non-fatal failure to be logged:\n%s", i, lt.String())
+		}
+	}
+}
+
+func TestRunPrepsTimeout(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{
+				Command:     "sleep 5",
+				Timeout:     100 * time.Millisecond,
+				KillSignals: []conf.KillStep{{Signal: os.Interrupt, Wait: time.Second}},
+			},
+			{Command: `echo ":after: ran"`},
+		},
+	}
+	lt := termlog.NewLogTest()
+	start := time.Now()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if pe, ok := err.(ProcError); !ok || !strings.Contains(pe.Error(), "timed out after 100ms") {
+		t.Errorf("Expected timeout ProcError, got %#v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected prep to stop on the first signal")
+	}
+	if ret := events(lt.String()); len(ret) != 0 {
+		t.Errorf("Expected later preps not to run, got %#v", ret)
+	}
+}
+
+func TestRunPrepsRollback(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	rollback := `echo ":rollback: $MODD_FAILED_INDEX $MODD_FAILED_EXITCODE $MODD_FAILED_PREP"`
+	tests := []struct {
+		preps    []conf.Prep
+		expected []string
+	}{
+		{
+			[]conf.Prep{{Command: `echo ":one: ran"`}, {Command: `echo ":two: ran"`}},
+			[]string{":one: ran", ":two: ran"},
+		},
+		{
+			[]conf.Prep{{Command: `echo ":one: ran"`}, {Command: "exit 3"}, {Command: `echo ":three: ran"`}},
+			[]string{":one: ran", ":rollback: 2 3 exit 3"},
+		},
+		{
+			[]conf.Prep{{Command: "exit 1", ContinueOnError: true}, {Command: `echo ":two: ran"`}},
+			[]string{":two: ran"},
+		},
+	}
+	for i, tt := range tests {
+		lt := termlog.NewLogTest()
+		b := conf.Block{Preps: tt.preps, Rollback: rollback}
+		RunPreps(b, vars, nil, lt.Log, nil, true)
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%d: expected\n%#v\nGot\n%#v", i, tt.expected, ret)
+		}
+	}
+
+	lt := termlog.NewLogTest()
+	b := conf.Block{Preps: []conf.Prep{{Command: "exit 1"}}, Rollback: "exit 2"}
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if pe, ok := err.(ProcError); !ok || pe.ExitCode != 1 {
+		t.Errorf("Expected the prep's error, got %#v", err)
+	}
+	if !strings.Contains(lt.String(), "rollback failed") {
+		t.Errorf("Expected rollback failure to be logged:\n%s", lt.String())
+	}
+}
+
+func TestRunPrepsEcho(t *testing.T) {
+	vars := map[string]string{shellVarName: "bash"}
+	b := conf.Block{
+		Echo: "on",
+		Env:  []conf.EnvVar{{Name: "SECRET", Value: "hunter2"}},
+		Preps: []conf.Prep{
+			{Command: `echo ":secret: $SECRET"`},
+		},
+	}
+	lt := termlog.NewLogTest()
+	err := RunPreps(b, vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	out := lt.String()
+	if !strings.Contains(out, `>> running: `) || !strings.Contains(out, `-c 'echo ":secret: $SECRET"'`) {
+		t.Errorf("Expected the command line to be logged:\n%s", out)
+	}
+	if n := strings.Count(out, "hunter2"); n != 1 {
+		t.Errorf("Expected the secret only in the command's own output, got %d:\n%s", n, out)
+	}
+}
+
+func TestRunPrepsIsolate(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	if err := os.MkdirAll("src/.git", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("src/input", []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{shellVarName: "bash"}
+	for _, fail := range []bool{false, true} {
+		last := "true"
+		if fail {
+			last = "exit 1"
+		}
+		b := conf.Block{
+			InDir:   "src",
+			Isolate: "on",
+			Preps: []conf.Prep{
+				{Command: `echo ":dir: $(pwd)"; echo ":input: $(cat input)"`},
+				{Command: `test -e .git || echo ":vcs: none"; touch artifact`},
+				{Command: last},
+			},
+		}
+		lt := termlog.NewLogTest()
+		err := RunPreps(b, vars, nil, lt.Log, nil, true)
+		if (err != nil) != fail {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ret := events(lt.String())
+		if len(ret) != 3 || !strings.HasPrefix(ret[0], ":dir: ") {
+			t.Fatalf("Unexpected output: %#v\n%s", ret, lt.String())
+		}
+		if ret[1] != ":input: hello" || ret[2] != ":vcs: none" {
+			t.Errorf("Expected a copy of the directory without VCS files, got %#v", ret)
+		}
+		dir := strings.TrimPrefix(ret[0], ":dir: ")
+		if abs, _ := filepath.Abs("src"); dir == abs {
+			t.Errorf("Expected preps to run outside the block's directory")
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", dir, err)
+		}
+		if _, err := os.Stat("src/artifact"); !os.IsNotExist(err) {
+			t.Errorf("Expected artifacts to stay out of the block's directory")
+		}
+	}
+}
+
+func TestRunPrepsHeredoc(t *testing.T) {
+	cnf, err := conf.Parse("test", `{
+	prep: <<EOF
+		for i in one two; do
+			echo ":heredoc: $i"
+		done
+		echo ':heredoc: "quoted" \ kept'
+	EOF
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{shellVarName: "bash"}
+	lt := termlog.NewLogTest()
+	err = RunPreps(cnf.Blocks[0], vars, nil, lt.Log, nil, true)
+	if err != nil {
+		t.Fatalf("RunPreps: %s", err)
+	}
+	expected := []string{":heredoc: one", ":heredoc: two", `:heredoc: "quoted" \ kept`}
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestRunPrepsKeep(t *testing.T) {
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: `echo ":prev: [$MODD_PREV_LIST]"`},
+			{Command: "printf run$RUN", Keep: "LIST"},
+		},
+	}
+	vars := map[string]string{shellVarName: "bash"}
+	kept := &keptValues{}
+	defer os.Unsetenv("RUN")
+	for i, expected := range []string{":prev: []", ":prev: [run1]", ":prev: [run2]"} {
+		lt := termlog.NewLogTest()
+		os.Setenv("RUN", fmt.Sprint(i+1))
+		err := runPreps(b, vars, nil, nil, lt.Log, nil, false, &envCache{}, nil, nil, kept, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{expected}) {
+			t.Errorf("Run %d: expected %q, got %#v", i+1, expected, ret)
+		}
+	}
+
+	// A failed run keeps the value from the run before
+	b.Preps[1].Command = "echo discarded; false"
+	lt := termlog.NewLogTest()
+	runPreps(b, vars, nil, nil, lt.Log, nil, false, &envCache{}, nil, nil, kept, nil)
+	if ret := kept.get("LIST"); ret != "run3" {
+		t.Errorf("Expected the last successful output to be kept, got %q", ret)
+	}
+}
+
+func TestRunPrepsHeader(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		header bool
+	}{
+		{"{\nprep: echo :out: one\n}", true},
+		{"{\nheader: off\nprep: echo :out: one\n}", false},
+		{"header: off\n{\nprep: echo :out: one\n}", false},
+		{"header: off\n{\nheader: on\nprep: echo :out: one\n}", true},
+	} {
+		cnf, err := conf.Parse("test", tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := map[string]string{shellVarName: "bash"}
+		lt := termlog.NewLogTest()
+		if err := RunPreps(cnf.Blocks[0], vars, nil, lt.Log, nil, true); err != nil {
+			t.Fatalf("RunPreps: %s", err)
+		}
+		out := lt.String()
+		if !strings.Contains(out, ":out: one") {
+			t.Errorf("%q: expected the output, got:\n%s", tt.config, out)
+		}
+		if strings.Contains(out, "prep: ") != tt.header || strings.Contains(out, ">> done") != tt.header {
+			t.Errorf("%q: expected header %v, got:\n%s", tt.config, tt.header, out)
+		}
+	}
+}
+
+var retryTests = []struct {
+	retries int
+	codes   []int
+	code    int
+	runs    int
+	err     bool
+}{
+	{0, nil, 1, 1, true},
+	{3, nil, 1, 3, false},
+	{1, nil, 1, 2, true},
+	{3, []int{75}, 75, 3, false},
+	{3, []int{75}, 1, 1, true},
+	{3, []int{2, 75}, 75, 3, false},
+}
+
+func TestRunPrepsRetry(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	vars := map[string]string{shellVarName: "bash"}
+	for i, tt := range retryTests {
+		os.Remove("runs")
+		// Fails with tt.code until its third run
+		cmd := fmt.Sprintf(`echo run >> runs; [ $(wc -l < runs) -ge 3 ] || exit %d`, tt.code)
+		b := conf.Block{
+			Preps: []conf.Prep{{Command: cmd, Retries: tt.retries, RetryOnCodes: tt.codes}},
+		}
+		lt := termlog.NewLogTest()
+		err := RunPreps(b, vars, nil, lt.Log, nil, true)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: unexpected error state: %v", i, err)
+		}
+		if pe, ok := err.(ProcError); tt.err && (!ok || pe.ExitCode != tt.code) {
+			t.Errorf("%d: expected exit code %d, got %#v", i, tt.code, err)
+		}
+		data, err := ioutil.ReadFile("runs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs := strings.Count(string(data), "run"); runs != tt.runs {
+			t.Errorf("%d: expected %d runs, got %d", i, tt.runs, runs)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package modd
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// primaryStdin relays modd's stdin to the primary daemon. There's only one,
+// since only one reader can consume stdin, and it carries on across config
+// reloads.
+var primaryStdin = &stdinRelay{}
+
+// A stdinRelay copies its input to the stdin of the daemon attached to it.
+// Input that arrives while no daemon is attached, or while the attached
+// daemon's process isn't running, is discarded.
+type stdinRelay struct {
+	// The input, or os.Stdin if nil
+	in      io.Reader
+	target  *daemon
+	started bool
+	sync.Mutex
+}
+
+// attach makes d the daemon that input is relayed to, and starts reading the
+// input if that hasn't happened yet
+func (r *stdinRelay) attach(d *daemon) {
+	r.Lock()
+	defer r.Unlock()
+	r.target = d
+	if !r.started {
+		r.started = true
+		in := r.in
+		if in == nil {
+			in = os.Stdin
+		}
+		go r.run(in)
+	}
+}
+
+// detach stops relaying input to d, if it's attached
+func (r *stdinRelay) detach(d *daemon) {
+	r.Lock()
+	defer r.Unlock()
+	if r.target == d {
+		r.target = nil
+	}
+}
+
+func (r *stdinRelay) run(in io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := in.Read(buf)
+		r.Lock()
+		d := r.target
+		r.Unlock()
+		if n > 0 && d != nil {
+			d.Lock()
+			w := d.stdin
+			d.Unlock()
+			if w == nil {
+				d.log.NoticeAs("debug", ">> input discarded, daemon not running")
+			} else {
+				w.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			// The daemon's stdin is left open, so that it doesn't see end of
+			// file and exit when modd's stdin isn't a terminal
+			if d != nil && err == io.EOF {
+				d.log.NoticeAs("debug", ">> end of stdin, no more input for the daemon")
+			}
+			return
+		}
+	}
+}
@@ -5,10 +5,19 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cortesi/termlog"
 )
 
+const lineLimit = 80
+
+// Appended to headers that have been truncated
+const postamble = "..."
+
+const ansiReset = "\x1b[0m"
+
 // shortCommand shortens a command to a name we can use in a notification
 // header.
 func shortCommand(command string) string {
@@ -25,12 +34,116 @@ func shortCommand(command string) string {
 	return ret
 }
 
+// wide contains runes that occupy two terminal columns: East Asian wide and
+// fullwidth characters, and emoji.
+var wide = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1},
+		{Lo: 0xa000, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe4f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f900, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
+// runeWidth returns the number of terminal columns a rune occupies
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case unicode.Is(wide, r):
+		return 2
+	}
+	return 1
+}
+
+// escapeLen returns the length in bytes of the ANSI escape sequence at the
+// start of s, or 0 if s doesn't start with an escape sequence.
+func escapeLen(s string) int {
+	if len(s) < 2 || s[0] != '\x1b' {
+		return 0
+	}
+	if s[1] != '[' {
+		return 2
+	}
+	// A control sequence runs until a final byte in the range 0x40-0x7e
+	for i := 2; i < len(s); i++ {
+		if s[i] >= 0x40 && s[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// displayWidth returns the number of terminal columns s occupies, ignoring
+// ANSI escape sequences.
+func displayWidth(s string) int {
+	width := 0
+	for len(s) > 0 {
+		if n := escapeLen(s); n > 0 {
+			s = s[n:]
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// truncate limits s to a display width of limit columns, replacing the tail
+// with a postamble if it's too long. Escape sequences are never split, and if
+// any were included in the truncated string, a reset sequence is added so
+// colour state doesn't leak past the cut.
+func truncate(s string, limit int) string {
+	if displayWidth(s) <= limit {
+		return s
+	}
+	limit -= len(postamble)
+	ret := ""
+	escaped := false
+	width := 0
+	for len(s) > 0 {
+		if n := escapeLen(s); n > 0 {
+			ret += s[:n]
+			s = s[n:]
+			escaped = true
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s)
+		if width+runeWidth(r) > limit {
+			break
+		}
+		ret += s[:size]
+		s = s[size:]
+		width += runeWidth(r)
+	}
+	if escaped {
+		ret += ansiReset
+	}
+	return ret + postamble
+}
+
 // niceHeader tries to produce a nicer process name. We condense whitespace to
 // make commands split over multiple lines with indentation more legible, and
 // limit the line length to 80 characters.
 func niceHeader(preamble string, command string) string {
 	pre := termlog.DefaultPalette.Timestamp.SprintFunc()(preamble)
-	command = termlog.DefaultPalette.Header.SprintFunc()(shortCommand(command))
+	command = truncate(shortCommand(command), lineLimit-displayWidth(preamble))
+	command = termlog.DefaultPalette.Header.SprintFunc()(command)
 	return pre + command
 }
 
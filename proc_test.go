@@ -25,3 +25,54 @@ func TestShortCommand(t *testing.T) {
 		}
 	}
 }
+
+var truncateTests = []struct {
+	input    string
+	limit    int
+	expected string
+}{
+	{"short", 10, "short"},
+	{"exactly10!", 10, "exactly10!"},
+	{"this is too long", 10, "this is..."},
+	{"ééééééééééééé", 10, "ééééééé..."},
+	{"\x1b[31mred\x1b[0m", 3, "\x1b[31mred\x1b[0m"},
+	{"\x1b[31mred text here\x1b[0m", 8, "\x1b[31mred t\x1b[0m..."},
+	{"abc\x1b[1;31mdefghijkl", 8, "abc\x1b[1;31mde\x1b[0m..."},
+	{"ab\x1bcdefghijkl", 8, "ab\x1bcdef\x1b[0m..."},
+	{"漢字漢字漢字漢字漢字", 10, "漢字漢..."},
+	{"漢字漢字漢字漢字漢字", 20, "漢字漢字漢字漢字漢字"},
+	{"漢字漢字漢字漢字漢字", 12, "漢字漢字..."},
+	{"漢字漢字漢字漢字漢字", 13, "漢字漢字漢..."},
+	{"a漢字漢字漢字漢字漢字", 12, "a漢字漢字..."},
+	{"🚀🚀🚀🚀🚀🚀", 9, "🚀🚀🚀..."},
+	{"e\u0301e\u0301e\u0301e\u0301", 4, "e\u0301e\u0301e\u0301e\u0301"},
+}
+
+func TestTruncate(t *testing.T) {
+	for i, tst := range truncateTests {
+		result := truncate(tst.input, tst.limit)
+		if result != tst.expected {
+			t.Errorf("Test %d: expected\n%q\ngot\n%q", i, tst.expected, result)
+		}
+		if w := displayWidth(result); w > tst.limit {
+			t.Errorf("Test %d: width %d exceeds limit %d", i, w, tst.limit)
+		}
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	tests := map[string]int{
+		"":                       0,
+		"abc":                    3,
+		"ééé":                    3,
+		"\x1b[31mabc\x1b[0m":     3,
+		"\x1b[38;5;208mabc\x1b[": 3,
+		"漢字":                     4,
+		"e\u0301":                1,
+	}
+	for input, expected := range tests {
+		if w := displayWidth(input); w != expected {
+			t.Errorf("%q: expected width %d, got %d", input, expected, w)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// notifyResize forwards SIGWINCH to daemons that have opted in. No handler is
+// installed if modd isn't attached to a terminal, or if no daemon wants resize
+// notifications. The returned function removes the handler.
+func notifyResize(dworld *DaemonWorld) func() {
+	wanted := false
+	for _, dp := range dworld.DaemonPens {
+		wanted = wanted || dp.wantsResize()
+	}
+	if !wanted || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		for range c {
+			dworld.Resize()
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package modd
+
+// notifyResize is a no-op on Windows, which has no resize signal.
+func notifyResize(dworld *DaemonWorld) func() {
+	return func() {}
+}
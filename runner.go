@@ -0,0 +1,15 @@
+package modd
+
+import "github.com/cortesi/modd/conf"
+
+// A Runner executes commands on behalf of a ModRunner. By default, preps are
+// run in the shell and daemons are managed by a DaemonWorld. A Runner can be
+// substituted to observe or fake execution - see the moddtest package.
+type Runner interface {
+	// Prep runs a rendered prep command from block b to completion. If the
+	// prep is piped, stdin holds the output of the preceding prep. Prep
+	// returns the standard output of the command.
+	Prep(b conf.Block, cmd string, stdin string) (string, error)
+	// Restart restarts the daemons of block b after its preps succeed
+	Restart(b conf.Block)
+}
@@ -0,0 +1,124 @@
+package shell
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MaxCaptureLines and MaxCaptureBytes, if non-zero, bound the output captured
+// from each stream of a command. Once a capture exceeds either of them, its
+// oldest lines are evicted to make room.
+var (
+	MaxCaptureLines int
+	MaxCaptureBytes int
+)
+
+// CaptureBuffer retains the most recent output of a stream, within the limits
+// it was created with. It can be written to a line at a time, or as raw
+// output, in which case the last line may be incomplete. It's safe for
+// concurrent use.
+type CaptureBuffer struct {
+	maxLines int
+	maxBytes int
+
+	lines []string
+	size  int
+	// The last line hasn't been ended by a newline yet
+	partial bool
+	sync.Mutex
+}
+
+// NewCaptureBuffer returns a buffer bounded by MaxCaptureLines and
+// MaxCaptureBytes, and by maxLines as well if it's positive
+func NewCaptureBuffer(maxLines int) *CaptureBuffer {
+	b := &CaptureBuffer{maxLines: MaxCaptureLines, maxBytes: MaxCaptureBytes}
+	if maxLines > 0 && (b.maxLines <= 0 || maxLines < b.maxLines) {
+		b.maxLines = maxLines
+	}
+	return b
+}
+
+// AddLine adds a complete line of output
+func (b *CaptureBuffer) AddLine(line string) {
+	b.Lock()
+	defer b.Unlock()
+	b.partial = false
+	b.append(line + "\n")
+}
+
+// Write implements io.Writer for raw output
+func (b *CaptureBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	s := string(p)
+	for s != "" {
+		piece := s
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			piece = s[:i+1]
+		}
+		s = s[len(piece):]
+		if b.partial {
+			b.lines[len(b.lines)-1] += piece
+			b.size += len(piece)
+			b.evict()
+		} else {
+			b.append(piece)
+		}
+		b.partial = !strings.HasSuffix(piece, "\n")
+	}
+	return len(p), nil
+}
+
+func (b *CaptureBuffer) append(line string) {
+	b.lines = append(b.lines, line)
+	b.size += len(line)
+	b.evict()
+}
+
+// evict drops the oldest lines until the buffer is within its limits. A
+// single line longer than the byte limit keeps only its end, starting at a
+// whole character.
+func (b *CaptureBuffer) evict() {
+	for len(b.lines) > 1 && b.over() {
+		b.size -= len(b.lines[0])
+		b.lines = b.lines[1:]
+	}
+	if b.maxBytes > 0 && b.size > b.maxBytes {
+		line := b.lines[0]
+		cut := b.size - b.maxBytes
+		for cut < len(line) && !utf8.RuneStart(line[cut]) {
+			cut++
+		}
+		b.lines[0] = line[cut:]
+		b.size -= cut
+	}
+}
+
+func (b *CaptureBuffer) over() bool {
+	return (b.maxLines > 0 && len(b.lines) > b.maxLines) ||
+		(b.maxBytes > 0 && b.size > b.maxBytes)
+}
+
+// String returns the retained output
+func (b *CaptureBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return strings.Join(b.lines, "")
+}
+
+// Last returns the most recent n lines, oldest first and without their
+// newlines, or all of them if there are fewer than n or n isn't positive
+func (b *CaptureBuffer) Last(n int) []string {
+	b.Lock()
+	defer b.Unlock()
+	lines := b.lines
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	ret := make([]string, len(lines))
+	for i, l := range lines {
+		ret[i] = strings.TrimSuffix(l, "\n")
+	}
+	return ret
+}
@@ -0,0 +1,125 @@
+package shell
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/cortesi/termlog"
+)
+
+var captureTests = []struct {
+	maxLines int
+	maxBytes int
+	lines    []string
+	expected string
+}{
+	{0, 0, []string{"a", "b", "c"}, "a\nb\nc\n"},
+	{2, 0, []string{"a", "b", "c", "d"}, "c\nd\n"},
+	{0, 7, []string{"one", "two", "three"}, "three\n"},
+	{0, 8, []string{"one", "two", "six"}, "two\nsix\n"},
+	{3, 8, []string{"a", "b", "c", "d"}, "b\nc\nd\n"},
+	{0, 4, []string{"abcdefgh"}, "fgh\n"},
+	// A line cut to fit starts at a whole character
+	{0, 5, []string{"€€"}, "€\n"},
+	{0, 3, []string{"aé€"}, "\n"},
+}
+
+func TestCaptureBuffer(t *testing.T) {
+	for i, tt := range captureTests {
+		b := &CaptureBuffer{maxLines: tt.maxLines, maxBytes: tt.maxBytes}
+		for _, l := range tt.lines {
+			b.AddLine(l)
+		}
+		if ret := b.String(); ret != tt.expected {
+			t.Errorf("%d: expected %q, got %q", i, tt.expected, ret)
+		}
+		if tt.maxBytes > 0 && b.size > tt.maxBytes {
+			t.Errorf("%d: size %d is over the limit", i, b.size)
+		}
+		if b.size != len(b.String()) || !utf8.ValidString(b.String()) {
+			t.Errorf("%d: expected valid UTF-8 of size %d, got %q", i, b.size, b.String())
+		}
+	}
+}
+
+func TestCaptureBufferWrite(t *testing.T) {
+	b := &CaptureBuffer{maxLines: 2}
+	for _, s := range []string{"a\nb", "b\nc", "cc", "\nd\n"} {
+		b.Write([]byte(s))
+	}
+	if ret := b.String(); ret != "ccc\nd\n" {
+		t.Errorf("Expected the last two lines, got %q", ret)
+	}
+}
+
+var captureLastTests = []struct {
+	maxLines int
+	lines    int
+	n        int
+	expected []string
+}{
+	{3, 0, 2, []string{}},
+	{3, 2, 5, []string{"0", "1"}},
+	{3, 2, 1, []string{"1"}},
+	{3, 5, 2, []string{"3", "4"}},
+	{3, 7, 10, []string{"4", "5", "6"}},
+	{3, 7, 0, []string{"4", "5", "6"}},
+	{0, 4, 0, []string{"0", "1", "2", "3"}},
+}
+
+func TestCaptureBufferLast(t *testing.T) {
+	for i, tt := range captureLastTests {
+		b := NewCaptureBuffer(tt.maxLines)
+		for j := 0; j < tt.lines; j++ {
+			b.AddLine(string(rune('0' + j)))
+		}
+		if ret := b.Last(tt.n); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%d: expected %#v, got %#v", i, tt.expected, ret)
+		}
+	}
+	// The global limits apply as well, whichever is lower
+	defer func(l, b int) { MaxCaptureLines, MaxCaptureBytes = l, b }(MaxCaptureLines, MaxCaptureBytes)
+	MaxCaptureLines, MaxCaptureBytes = 2, 6
+	b := NewCaptureBuffer(3)
+	for _, l := range []string{"a", "b", "c", "dddd"} {
+		b.AddLine(l)
+	}
+	if ret := b.Last(0); !reflect.DeepEqual(ret, []string{"dddd"}) {
+		t.Errorf("Expected the capture limits to apply, got %#v", ret)
+	}
+}
+
+func TestCaptureLimit(t *testing.T) {
+	defer func(l, b int) { MaxCaptureLines, MaxCaptureBytes = l, b }(MaxCaptureLines, MaxCaptureBytes)
+	MaxCaptureLines = 3
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "for i in 1 2 3 4 5; do echo out$i; echo err$i >&2; done", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.BufferOutput = true
+	err, pstate := ex.Run(lt.Log.Stream(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pstate.Output != "out3\nout4\nout5\n" {
+		t.Errorf("Expected the last lines of output, got %q", pstate.Output)
+	}
+	if pstate.ErrOutput != "err3\nerr4\nerr5\n" {
+		t.Errorf("Expected the last lines of error output, got %q", pstate.ErrOutput)
+	}
+
+	s, err := NewSession("sh", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err, pstate = s.Run("for i in 1 2 3 4 5; do echo out$i; done", lt.Log.Stream(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pstate.Output != "out3\nout4\nout5\n" {
+		t.Errorf("Expected the last lines of session output, got %q", pstate.Output)
+	}
+}
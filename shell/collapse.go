@@ -0,0 +1,66 @@
+package shell
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// collapser collapses runs of identical lines. The first line of a run is
+// passed to the sink straight away, and the rest are counted. The count is
+// sent as a summary line when a different line arrives, when the collapser
+// is closed, or when timeout passes with a count pending.
+type collapser struct {
+	sink    func(string, ...interface{})
+	timeout time.Duration
+
+	last    string
+	started bool
+	repeats int
+	timer   *time.Timer
+	sync.Mutex
+}
+
+func newCollapser(sink func(string, ...interface{}), timeout time.Duration) *collapser {
+	return &collapser{sink: sink, timeout: timeout}
+}
+
+// line is a sink function that collapses its input
+func (c *collapser) line(format string, args ...interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	s := fmt.Sprintf(format, args...)
+	if c.started && s == c.last {
+		c.repeats++
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.timeout, c.flush)
+		}
+		return
+	}
+	c.flushLocked()
+	c.last = s
+	c.started = true
+	c.sink("%s", s)
+}
+
+func (c *collapser) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.flushLocked()
+}
+
+func (c *collapser) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.repeats > 0 {
+		c.sink("%s (repeated %d times)", c.last, c.repeats)
+		c.repeats = 0
+	}
+}
+
+// close flushes any pending count
+func (c *collapser) close() {
+	c.flush()
+}
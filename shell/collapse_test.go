@@ -0,0 +1,63 @@
+package shell
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var collapseTests = []struct {
+	input    []string
+	expected []string
+}{
+	{
+		[]string{"a", "b", "c"},
+		[]string{"a", "b", "c"},
+	},
+	{
+		[]string{"a", "a", "a", "b", "a", "a"},
+		[]string{"a", "a (repeated 2 times)", "b", "a", "a (repeated 1 times)"},
+	},
+	{
+		[]string{"a", "b", "b", "b"},
+		[]string{"a", "b", "b (repeated 2 times)"},
+	},
+}
+
+func TestCollapser(t *testing.T) {
+	for _, tt := range collapseTests {
+		var ret []string
+		c := newCollapser(func(s string, args ...interface{}) {
+			ret = append(ret, fmt.Sprintf(s, args...))
+		}, time.Hour)
+		for _, l := range tt.input {
+			c.line("%s", l)
+		}
+		c.close()
+		if !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%#v: expected\n%#v\ngot\n%#v", tt.input, tt.expected, ret)
+		}
+	}
+}
+
+func TestCollapserTimeout(t *testing.T) {
+	var lock sync.Mutex
+	var ret []string
+	c := newCollapser(func(s string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		ret = append(ret, fmt.Sprintf(s, args...))
+	}, 50*time.Millisecond)
+	c.line("%s", "a")
+	c.line("%s", "a")
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	expected := []string{"a", "a (repeated 1 times)"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected count to be flushed, got %#v", ret)
+	}
+	lock.Unlock()
+	c.close()
+}
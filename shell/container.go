@@ -0,0 +1,82 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ContainerDir is where the working directory of a command is mounted inside
+// its container
+const ContainerDir = "/work"
+
+// A Container is an image that a command is run in, using a container runtime
+// like docker or podman that accepts docker's command-line options
+type Container struct {
+	Image   string
+	Runtime string
+}
+
+// containerCommand returns a command that runs spec in its container. The
+// working directory is mounted at ContainerDir, and the variables in Env -
+// plus those named in PassEnv, if CleanEnv is set - are passed through. The
+// runtime itself inherits modd's environment, so that it can find its daemon.
+func containerCommand(spec CommandSpec) (*exec.Cmd, error) {
+	c := spec.Container
+	runtime, err := exec.LookPath(c.Runtime)
+	if err != nil {
+		return nil, fmt.Errorf("container runtime %q not found on path", c.Runtime)
+	}
+	var sh string
+	switch spec.Shell {
+	case "bash":
+		sh = "bash"
+	case "sh", "modd":
+		sh = "sh"
+	default:
+		return nil, fmt.Errorf("shell %q can't be used in a container", spec.Shell)
+	}
+	dir := spec.Dir
+	if dir == "" {
+		dir = "."
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"run", "--rm", "-i",
+		"-v", dir + ":" + ContainerDir,
+		"-w", ContainerDir,
+	}
+	var names []string
+	if spec.CleanEnv {
+		for _, name := range spec.PassEnv {
+			if _, ok := os.LookupEnv(name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, kv := range spec.Env {
+		names = append(names, strings.SplitN(kv, "=", 2)[0])
+	}
+	// Variables are passed by name, so that their values don't appear on
+	// the command line
+	for _, name := range names {
+		args = append(args, "-e", name)
+	}
+	args = append(args, c.Image, sh)
+	args = append(args, spec.Flags...)
+	args = append(args, "-c", spec.Command)
+
+	cmd := exec.Command(runtime, args...)
+	cmd.Env = Environ(false, nil, spec.Env)
+	cmd.SysProcAttr = spec.SysProcAttr
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = defaultSysProcAttr()
+	}
+	return cmd, nil
+}
@@ -0,0 +1,86 @@
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestContainerCommand(t *testing.T) {
+	// Any executable will do as a runtime, since the command isn't run
+	runtime, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	os.Setenv("MODD_PASSED", "yes")
+	defer os.Unsetenv("MODD_PASSED")
+	dir, err := filepath.Abs("inner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := BuildCommand(CommandSpec{
+		Shell:     "bash",
+		Command:   "make test",
+		Dir:       "inner",
+		Env:       []string{"MODDTEST=secret"},
+		CleanEnv:  true,
+		PassEnv:   []string{"MODD_PASSED", "MODD_MISSING"},
+		Container: &Container{Image: "golang:1.22", Runtime: "sh"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		runtime, "run", "--rm", "-i",
+		"-v", dir + ":/work", "-w", "/work",
+		"-e", "MODD_PASSED", "-e", "MODDTEST",
+		"golang:1.22", "bash", "-c", "make test",
+	}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("Expected args\n%#v\ngot\n%#v", expected, cmd.Args)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "secret") {
+		t.Errorf("Variable values leaked onto the command line: %#v", cmd.Args)
+	}
+	if len(cmd.Env) == 0 || cmd.Env[len(cmd.Env)-1] != "MODDTEST=secret" {
+		t.Errorf("Expected env to be extended, got %#v", cmd.Env)
+	}
+
+	cmd, err = BuildCommand(CommandSpec{
+		Shell:     "modd",
+		Command:   "true",
+		Container: &Container{Image: "alpine", Runtime: "sh"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh := cmd.Args[len(cmd.Args)-3]; sh != "sh" {
+		t.Errorf("Expected sh in the container, got %s", sh)
+	}
+}
+
+func TestContainerCommandErrors(t *testing.T) {
+	_, err := BuildCommand(CommandSpec{
+		Shell:     "sh",
+		Command:   "true",
+		Container: &Container{Image: "alpine", Runtime: "modd-no-such-runtime"},
+	})
+	if err == nil || !strings.Contains(err.Error(), `container runtime "modd-no-such-runtime" not found`) {
+		t.Errorf("Expected missing runtime error, got %v", err)
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	_, err = BuildCommand(CommandSpec{
+		Shell:     "powershell",
+		Command:   "true",
+		Container: &Container{Image: "alpine", Runtime: "sh"},
+	})
+	if err == nil {
+		t.Errorf("Expected error for powershell in a container")
+	}
+}
@@ -0,0 +1,72 @@
+// +build !windows
+
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// CheckCredential checks that a process can be run as username and
+// groupname, which are names or numeric IDs, either of which may be empty
+func CheckCredential(username, groupname string) error {
+	_, err := lookupCredential(username, groupname)
+	return err
+}
+
+// lookupCredential returns the credential a process is run with to run as
+// username and groupname. Without a user, the process keeps modd's user, and
+// without a group, it takes the primary group of its user. Numeric IDs that
+// aren't known to the system are used as they are.
+func lookupCredential(username, groupname string) (*syscall.Credential, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			u, err = user.LookupId(username)
+		}
+		if err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		} else if n, nerr := strconv.Atoi(username); nerr == nil && n >= 0 {
+			uid = n
+		} else {
+			return nil, fmt.Errorf("unknown user: %s", username)
+		}
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			g, err = user.LookupGroupId(groupname)
+		}
+		if err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else if n, nerr := strconv.Atoi(groupname); nerr == nil && n >= 0 {
+			gid = n
+		} else {
+			return nil, fmt.Errorf("unknown group: %s", groupname)
+		}
+	}
+	return &syscall.Credential{
+		Uid: uint32(uid),
+		Gid: uint32(gid),
+		// Supplementary groups can only be dropped with privilege
+		NoSetGroups: os.Getuid() != 0,
+	}, nil
+}
+
+// setCredential makes cmd run as username and groupname
+func setCredential(cmd *exec.Cmd, username, groupname string) error {
+	cred, err := lookupCredential(username, groupname)
+	if err != nil {
+		return err
+	}
+	attr := *cmd.SysProcAttr
+	attr.Credential = cred
+	cmd.SysProcAttr = &attr
+	return nil
+}
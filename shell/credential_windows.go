@@ -0,0 +1,21 @@
+// +build windows
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// CheckCredential checks that a process can be run as username and
+// groupname. Running as another user isn't supported on Windows.
+func CheckCredential(username, groupname string) error {
+	if username != "" || groupname != "" {
+		return fmt.Errorf("running as another user or group isn't supported on this platform")
+	}
+	return nil
+}
+
+func setCredential(cmd *exec.Cmd, username, groupname string) error {
+	return CheckCredential(username, groupname)
+}
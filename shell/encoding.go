@@ -0,0 +1,19 @@
+package shell
+
+import (
+	"fmt"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// LookupEncoding returns the character encoding with the specified name, as
+// given in the WHATWG Encoding Standard: for instance "latin1", "shift_jis" or
+// "utf-16le". Names are case-insensitive.
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding: %q", name)
+	}
+	return enc, nil
+}
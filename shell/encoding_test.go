@@ -0,0 +1,50 @@
+package shell
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cortesi/termlog"
+)
+
+var encodingTests = []struct {
+	encoding string
+	// printf-escaped output of the command
+	output   string
+	expected string
+}{
+	{"latin1", `caf\351`, "café"},
+	{"shift_jis", `\223\372\226\173`, "日本"},
+	{"euc-kr", `\307\321\261\333`, "한글"},
+}
+
+func TestEncoding(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	for _, tt := range encodingTests {
+		enc, err := LookupEncoding(tt.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := NewExecutor("sh", fmt.Sprintf("printf '%s\\n'; printf '%s\\n' >&2", tt.output, tt.output), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.Encoding = enc
+		ex.BufferOutput = true
+		lt := termlog.NewLogTest()
+		err, pstate := ex.Run(lt.Log.Stream(""), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pstate.Output != tt.expected+"\n" || pstate.ErrOutput != tt.expected+"\n" {
+			t.Errorf("%s: expected %q, got %q and %q", tt.encoding, tt.expected, pstate.Output, pstate.ErrOutput)
+		}
+	}
+
+	if _, err := LookupEncoding("klingon"); err == nil {
+		t.Errorf("Expected error for unknown encoding")
+	}
+}
@@ -3,13 +3,101 @@
 package shell
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"syscall"
 )
 
-func prepCmd(cmd *exec.Cmd) {
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+// ProcNameSupported is true if processes can be given a name with ProcName
+const ProcNameSupported = true
+
+// UmaskSupported is true if processes can be given a umask with Umask
+const UmaskSupported = true
+
+// ExtraFilesSupported is true if processes can inherit files with ExtraFiles
+const ExtraFilesSupported = true
+
+// ShebangSupported is true if commands that start with a #! line are run as
+// scripts by the interpreter it names
+const ShebangSupported = true
+
+// setProcName sets argv[0], which is what ps and top show for the process.
+// The executable is still found through cmd.Path.
+func setProcName(cmd *exec.Cmd, name string) {
+	cmd.Args[0] = name
+}
+
+func defaultSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// CanAdopt reports whether pid is a running process that leads its own
+// process group, and so can be adopted by an executor
+func CanAdopt(pid int) bool {
+	if !processAlive(pid) {
+		return false
+	}
+	pgid, err := syscall.Getpgid(pid)
+	return err == nil && pgid == pid
+}
+
+// HandoffOutput returns file descriptors for the read ends of the running
+// process's output pipes, which are left open when modd execs another
+// program, so that it can go on reading the output by passing them to Adopt.
+// They aren't closed by the executor, and must be closed with syscall.Close
+// if they aren't passed on.
+func (e *Executor) HandoffOutput() (stdout, stderr int, err error) {
+	e.Lock()
+	defer e.Unlock()
+	if !e.running() {
+		return 0, 0, fmt.Errorf("executor not running")
+	}
+	stdout, err = inheritable(e.stdo)
+	if err != nil {
+		return 0, 0, err
+	}
+	stderr, err = inheritable(e.stde)
+	if err != nil {
+		syscall.Close(stdout)
+		return 0, 0, err
+	}
+	return stdout, stderr, nil
+}
+
+// inheritable duplicates the file descriptor of the pipe r, without the
+// close-on-exec flag that Go sets on the files it opens
+func inheritable(r io.Reader) (int, error) {
+	f, ok := r.(*os.File)
+	if !ok {
+		return 0, fmt.Errorf("output isn't a pipe")
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	cerr := rc.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return fd, err
+}
+
+// processAlive reports whether pid is running and can be signalled by modd.
+// If it's a child of modd that has exited, it's reaped.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	var ws syscall.WaitStatus
+	if wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err == nil && wpid == pid {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
 }
 
 func (e *Executor) sendSignal(sig os.Signal) error {
@@ -0,0 +1,420 @@
+// +build !windows
+
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/termlog"
+)
+
+var ladderTests = []struct {
+	// Trap handlers installed by the command
+	traps    string
+	expected []string
+	// Bounds on the time the process takes to stop after the timeout
+	min, max time.Duration
+}{
+	// A process that ignores every signal in the ladder runs to the end of
+	// it, and is then killed
+	{"trap 'echo int' INT; trap 'echo term' TERM", []string{"int", "term"}, 400 * time.Millisecond, 2 * time.Second},
+	// A process that exits on SIGTERM stops before the last wait
+	{"trap 'echo int' INT; trap 'echo term; exit 3' TERM", []string{"int", "term"}, 200 * time.Millisecond, 350 * time.Millisecond},
+	// A process that exits on SIGINT stops straight away
+	{"trap 'echo int; exit 2' INT", []string{"int"}, 0, 150 * time.Millisecond},
+}
+
+func TestTimeoutLadder(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	for i, tt := range ladderTests {
+		ex, err := NewExecutor("sh", tt.traps+"; while true; do sleep 0.02; done", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		timeout := 100 * time.Millisecond
+		ex.Timeout = timeout
+		ex.Ladder = []SignalStep{
+			{Signal: os.Interrupt, Wait: 200 * time.Millisecond},
+			{Signal: syscall.SIGTERM, Wait: 200 * time.Millisecond},
+		}
+		ex.BufferOutput = true
+		lt := termlog.NewLogTest()
+		start := time.Now()
+		err, pstate := ex.Run(lt.Log.Stream(""), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start) - timeout
+		if elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%d: expected stop within %s-%s of the timeout, took %s", i, tt.min, tt.max, elapsed)
+		}
+		if !pstate.TimedOut || pstate.Error == nil || !strings.Contains(pstate.Error.Error(), "timed out") {
+			t.Errorf("%d: expected timeout to be reported, got %#v", i, pstate)
+		}
+		if ret := strings.Fields(pstate.Output); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%d: expected signals %#v, got %#v", i, tt.expected, ret)
+		}
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	ex, err := NewExecutor("sh", "trap 'echo int; exit 2' INT; while true; do sleep 0.02; done", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.BufferOutput = true
+	ex.Terminate(nil)
+	done := make(chan *ExecState)
+	go func() {
+		_, pstate := ex.Run(termlog.NewLogTest().Log.Stream(""), false)
+		done <- pstate
+	}()
+	for ex.Pid() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the trap be installed
+	time.Sleep(100 * time.Millisecond)
+	ex.Terminate([]SignalStep{{Signal: os.Interrupt, Wait: time.Second}})
+	pstate := <-done
+	if strings.TrimSpace(pstate.Output) != "int" || pstate.ExitCode != 2 {
+		t.Errorf("Expected the process to exit on SIGINT, got %#v", pstate)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	cmd := exec.Command("sleep", "100")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	if !CanAdopt(pid) {
+		t.Fatalf("Expected pid %d to be adoptable", pid)
+	}
+	ex, err := NewExecutor("sh", "sleep 100", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *ExecState)
+	go func() {
+		err, pstate := ex.Adopt(pid, termlog.NewLogTest().Log.Stream(""), nil, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- pstate
+	}()
+	for ex.Pid() != pid {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ex.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pstate := <-done:
+		if pstate.ExitCode != -1 {
+			t.Errorf("Expected an unknown exit code, got %#v", pstate)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the adopted process to exit")
+	}
+	if CanAdopt(pid) {
+		t.Errorf("Expected the exited process not to be adoptable")
+	}
+	if err, _ := ex.Adopt(pid, termlog.NewLogTest().Log.Stream(""), nil, nil); err == nil {
+		t.Errorf("Expected an error adopting an exited process")
+	}
+
+	// Processes that don't lead their own group aren't adopted
+	cmd = exec.Command("sleep", "100")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if CanAdopt(cmd.Process.Pid) {
+		t.Errorf("Expected a process outside its own group not to be adoptable")
+	}
+}
+
+func TestAdoptOutput(t *testing.T) {
+	// The process writes its output after it's been adopted, to pipes made
+	// by whatever started it
+	in, inw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", "read l; echo got $l; echo oops >&2")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin = in
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+	defer inw.Close()
+
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		err, _ := ex.Adopt(cmd.Process.Pid, lt.Log.Stream(""), stdout.(*os.File), stderr.(*os.File))
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	for ex.Pid() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	inw.Write([]byte("hello\n"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		ex.Stop()
+		t.Fatal("Timed out waiting for the adopted process to exit")
+	}
+	for _, s := range []string{"got hello", "oops"} {
+		if !strings.Contains(lt.String(), s) {
+			t.Errorf("Expected %q in the adopted process's output, got:\n%s", s, lt.String())
+		}
+	}
+}
+
+func TestHandoffOutput(t *testing.T) {
+	ex, err := NewExecutor("sh", "sleep 100", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ex.HandoffOutput(); err == nil {
+		t.Errorf("Expected an error handing off the output of an idle executor")
+	}
+	lt := termlog.NewLogTest()
+	done := make(chan bool)
+	go func() {
+		ex.Run(lt.Log.Stream(""), false)
+		close(done)
+	}()
+	defer func() {
+		ex.Stop()
+		<-done
+	}()
+	for ex.Pid() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stdout, stderr, err := ex.HandoffOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range []int{stdout, stderr} {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 {
+			t.Fatalf("fcntl: %s", errno)
+		}
+		if flags&syscall.FD_CLOEXEC != 0 {
+			t.Errorf("Expected fd %d to be left open on exec", fd)
+		}
+		syscall.Close(fd)
+	}
+}
+
+func TestExtraFiles(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Write([]byte("passed\n"))
+	w.Close()
+	ex, err := NewExecutor("sh", "cat <&3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.ExtraFiles = []*os.File{r}
+	ex.BufferOutput = true
+	err, pstate := ex.Run(termlog.NewLogTest().Log.Stream(""), false)
+	if err != nil || pstate.Error != nil {
+		t.Fatalf("%v %#v", err, pstate)
+	}
+	if strings.TrimSpace(pstate.Output) != "passed" {
+		t.Errorf("Expected the child to read from fd 3, got %q", pstate.Output)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if err := CheckCredential("no-such-user-for-modd", ""); err == nil || err.Error() != "unknown user: no-such-user-for-modd" {
+		t.Errorf("Expected an unknown user to be reported, got %v", err)
+	}
+	if err := CheckCredential("", "no-such-group-for-modd"); err == nil || err.Error() != "unknown group: no-such-group-for-modd" {
+		t.Errorf("Expected an unknown group to be reported, got %v", err)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("skipping - changing user needs root")
+	}
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	ex, err := NewExecutor("sh", "id -u; id -g", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.User = "54321"
+	ex.Group = "54322"
+	ex.BufferOutput = true
+	err, pstate := ex.Run(termlog.NewLogTest().Log.Stream(""), false)
+	if err != nil || pstate.Error != nil {
+		t.Fatalf("%v %#v", err, pstate)
+	}
+	if ret := strings.Fields(pstate.Output); !reflect.DeepEqual(ret, []string{"54321", "54322"}) {
+		t.Errorf("Expected to run as 54321:54322, got %#v", ret)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	dir, err := ioutil.TempDir("", "umask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	// Scripts run without the shell have the mask set for them
+	for _, tt := range []struct {
+		umask  string
+		script bool
+		mode   os.FileMode
+	}{
+		{"", false, 0644},
+		{"077", false, 0600},
+		{"0027", false, 0640},
+		{"077", true, 0600},
+	} {
+		p := filepath.Join(dir, "file"+tt.umask)
+		cmd := "touch " + p
+		if tt.script {
+			p += "-script"
+			cmd = "#!/bin/sh\ntouch " + p
+		}
+		ex, err := NewExecutor("sh", cmd, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.Umask = tt.umask
+		err, pstate := ex.Run(termlog.NewLogTest().Log.Stream(""), false)
+		if err != nil || pstate.Error != nil {
+			t.Fatalf("%q: %v %#v", tt.umask, err, pstate)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != tt.mode {
+			t.Errorf("%q: expected mode %o, got %o", tt.umask, tt.mode, fi.Mode().Perm())
+		}
+	}
+	if mask := syscall.Umask(022); mask != 022 {
+		t.Errorf("Expected modd's umask to be put back, got %o", mask)
+	}
+}
+
+func TestTimeoutNotReached(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	ex, err := NewExecutor("sh", "true", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.Timeout = time.Second
+	lt := termlog.NewLogTest()
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pstate.TimedOut || pstate.Error != nil {
+		t.Errorf("Unexpected timeout: %#v", pstate)
+	}
+}
+
+func TestShebang(t *testing.T) {
+	shellTesting = true
+	tests := []struct {
+		name   string
+		interp string
+		cmd    string
+	}{
+		{"bash", "bash", "#!/usr/bin/env bash\nx=shebang\necho \"$x ${BASH_VERSION:+bash}\""},
+		{"python", "python3", "#!/usr/bin/env python3\nprint(' '.join(['shebang', 'python']))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := exec.LookPath(tt.interp); err != nil {
+				t.Skipf("skipping - %s", err)
+			}
+			ex, err := NewExecutor("sh", tt.cmd, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex.BufferOutput = true
+			ex.Echo = true
+			lt := termlog.NewLogTest()
+			err, pstate := ex.Run(lt.Log.Stream(""), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pstate.Error != nil {
+				t.Fatalf("Unexpected error: %s\n%s", pstate.Error, lt.String())
+			}
+			expected := "shebang " + tt.name + "\n"
+			if pstate.Output != expected {
+				t.Errorf("Expected output %q, got %q", expected, pstate.Output)
+			}
+			// The script is run directly, and removed once it's done
+			i := strings.Index(lt.String(), ">> running: ")
+			if i < 0 {
+				t.Fatalf("Expected the command line to be logged, got:\n%s", lt.String())
+			}
+			script := strings.TrimSpace(lt.String()[i+len(">> running: "):])
+			if !strings.HasPrefix(filepath.Base(script), "modd-script-") {
+				t.Errorf("Expected the script to be run directly, got %q", script)
+			}
+			if _, err := os.Stat(script); !os.IsNotExist(err) {
+				t.Errorf("Expected the script to be removed, got %v", err)
+			}
+		})
+	}
+}
@@ -3,19 +3,54 @@
 package shell
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"syscall"
 )
 
-func prepCmd(cmd *exec.Cmd) {
-	cmd.SysProcAttr = &syscall.SysProcAttr{
+// ProcNameSupported is true if processes can be given a name with ProcName.
+// Windows identifies processes by their executable, so names are ignored.
+const ProcNameSupported = false
+
+func setProcName(cmd *exec.Cmd, name string) {}
+
+// UmaskSupported is true if processes can be given a umask with Umask.
+// Windows has no umask, so it's ignored.
+const UmaskSupported = false
+
+// ExtraFilesSupported is true if processes can inherit files with
+// ExtraFiles, which Windows doesn't support
+const ExtraFilesSupported = false
+
+// ShebangSupported is true if commands that start with a #! line are run as
+// scripts by the interpreter it names. Windows doesn't read #! lines, so
+// they're passed to the shell like any other command.
+const ShebangSupported = false
+
+func defaultSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
 		HideWindow:    true,
 		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
 	}
 }
 
+// CanAdopt reports whether pid can be adopted by an executor. Adopting
+// processes isn't supported on Windows.
+func CanAdopt(pid int) bool {
+	return false
+}
+
+func processAlive(pid int) bool {
+	return false
+}
+
+// HandoffOutput isn't supported on Windows, where processes can't be adopted
+func (e *Executor) HandoffOutput() (stdout, stderr int, err error) {
+	return 0, 0, fmt.Errorf("handing off output isn't supported on Windows")
+}
+
 func (e *Executor) sendSignal(sig os.Signal) error {
 	return exec.Command("taskkill", "/f", "/t", "/pid", strconv.Itoa(e.cmd.Process.Pid)).Run()
 }
@@ -0,0 +1,158 @@
+package shell
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultQueueSize is a reasonable output queue size, in lines
+const DefaultQueueSize = 1024
+
+// Overflow is the policy applied when an output queue is full
+type Overflow string
+
+// Overflow policies
+const (
+	// OverflowBlock stops reading from the process until the sink catches up
+	OverflowBlock Overflow = "block"
+	// OverflowDropOldest discards the oldest queued line to make room
+	OverflowDropOldest Overflow = "drop-oldest"
+	// OverflowDropNewest discards the incoming line
+	OverflowDropNewest Overflow = "drop-newest"
+	// OverflowSample keeps a sample of incoming lines in place of the oldest,
+	// and discards the rest. The sample thins out for as long as the queue
+	// stays full.
+	OverflowSample Overflow = "sample"
+)
+
+// maxSampleStride is the most lines a sampling queue passes over for each
+// line it keeps
+const maxSampleStride = 1024
+
+// A queued line. Entries with a non-zero dropped count stand in for a run of
+// discarded lines.
+type queued struct {
+	line    string
+	dropped int
+}
+
+// lineQueue is a bounded queue of output lines between a pipe reader and a
+// sink, so that a slow sink doesn't stall the process writing to the pipe.
+// Dropped lines are replaced by a note giving the number of lines lost.
+type lineQueue struct {
+	size     int
+	overflow Overflow
+
+	lines []queued
+	// Lines dropped from the head of the queue
+	dropped int
+	// When sampling, one line is kept in every stride, and skipped counts
+	// the lines since the last one that was kept
+	stride  int
+	skipped int
+	closed  bool
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+func newLineQueue(size int, overflow Overflow) *lineQueue {
+	q := &lineQueue{size: size, overflow: overflow, stride: 1}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// push adds a line to the queue, applying the overflow policy if it's full
+func (q *lineQueue) push(line string) {
+	q.Lock()
+	defer q.Unlock()
+	defer q.cond.Broadcast()
+	for len(q.lines) >= q.size {
+		switch q.overflow {
+		case OverflowDropNewest:
+			q.dropNewest()
+			return
+		case OverflowDropOldest:
+			q.lines = q.lines[1:]
+			q.dropped++
+		case OverflowSample:
+			q.skipped++
+			if q.skipped < q.stride {
+				q.dropNewest()
+				return
+			}
+			q.skipped = 0
+			if q.stride < maxSampleStride {
+				q.stride *= 2
+			}
+			for len(q.lines) >= q.size {
+				q.dropped += count(q.lines[0])
+				q.lines = q.lines[1:]
+			}
+		default:
+			q.cond.Wait()
+		}
+	}
+	q.lines = append(q.lines, queued{line: line})
+	// Sample densely again once the sink has caught up
+	if len(q.lines) <= q.size/2 {
+		q.stride, q.skipped = 1, 0
+	}
+}
+
+// dropNewest counts an incoming line as dropped, after the lines queued
+func (q *lineQueue) dropNewest() {
+	if n := len(q.lines); n > 0 && q.lines[n-1].dropped > 0 {
+		q.lines[n-1].dropped++
+	} else {
+		q.lines = append(q.lines, queued{dropped: 1})
+	}
+}
+
+// count returns the number of lines of output an entry stands for
+func count(l queued) int {
+	if l.dropped > 0 {
+		return l.dropped
+	}
+	return 1
+}
+
+// close marks the end of input. Queued lines are still delivered.
+func (q *lineQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// run delivers queued lines to out until the queue is closed and empty
+func (q *lineQueue) run(out func(string, ...interface{})) {
+	for {
+		q.Lock()
+		for len(q.lines) == 0 && q.dropped == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.lines) == 0 && q.dropped == 0 {
+			q.Unlock()
+			return
+		}
+		var next []queued
+		if q.dropped > 0 {
+			next = append(next, queued{dropped: q.dropped})
+			q.dropped = 0
+		}
+		if len(q.lines) > 0 {
+			next = append(next, q.lines[0])
+			q.lines = q.lines[1:]
+		}
+		q.cond.Broadcast()
+		q.Unlock()
+
+		for _, l := range next {
+			if l.dropped > 0 {
+				out("%s", fmt.Sprintf("[%d lines dropped]", l.dropped))
+			} else {
+				out("%s", l.line)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/termlog"
+)
+
+func collect(q *lineQueue) []string {
+	var ret []string
+	q.run(func(s string, args ...interface{}) {
+		ret = append(ret, args[0].(string))
+	})
+	return ret
+}
+
+var queueTests = []struct {
+	overflow Overflow
+	expected []string
+}{
+	{OverflowDropNewest, []string{"a", "b", "c", "[9 lines dropped]"}},
+	{OverflowDropOldest, []string{"[9 lines dropped]", "j", "k", "l"}},
+	// Kept lines are further apart the longer the queue stays full
+	{OverflowSample, []string{"[5 lines dropped]", "f", "[3 lines dropped]", "j", "[2 lines dropped]"}},
+}
+
+func TestLineQueue(t *testing.T) {
+	for _, tt := range queueTests {
+		q := newLineQueue(3, tt.overflow)
+		for _, l := range strings.Split("abcdefghijkl", "") {
+			q.push(l)
+		}
+		q.close()
+		if ret := collect(q); !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tt.overflow, tt.expected, ret)
+		}
+	}
+}
+
+func TestLineQueueBlock(t *testing.T) {
+	q := newLineQueue(2, OverflowBlock)
+	expected := []string{"a", "b", "c", "d", "e"}
+	go func() {
+		for _, l := range expected {
+			q.push(l)
+		}
+		q.close()
+	}()
+	if ret := collect(q); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+}
+
+// A process writing far more than a pipe buffer's worth of output must run to
+// completion even though the sink is stalled until it exits.
+func TestSlowSink(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+
+	// The first line is written alone, so that the sink can stall on it
+	// before the rest arrive
+	cmd := `echo start
+	read go
+	pad=$(printf '%0100d' 0)
+	i=0
+	while [ $i -lt 2000 ]; do echo "$i $pad"; i=$((i+1)); done`
+	ex, err := NewExecutor("sh", cmd, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	ex.Stdin = r
+	ex.QueueSize = 10
+	ex.Overflow = OverflowDropOldest
+	started, finished, release := make(chan bool), make(chan bool), make(chan bool)
+	// OnLine sees each line once it's queued, so the last line is seen
+	// once the queue holds everything the sink will get
+	ex.OnLine = func(line string) {
+		if strings.HasPrefix(line, "1999 ") {
+			close(finished)
+		}
+	}
+	var lines []string
+	ex.Stdout = func(s string, args ...interface{}) {
+		if len(lines) == 0 {
+			close(started)
+			<-release
+		}
+		line := args[0].(string)
+		if !strings.HasPrefix(line, "[") {
+			line = strings.Fields(line)[0]
+		}
+		lines = append(lines, line)
+	}
+	go func() {
+		defer close(release)
+		<-started
+		w.Write([]byte("go\n"))
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Process stalled behind slow sink")
+		}
+	}()
+	lt := termlog.NewLogTest()
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pstate.Error != nil {
+		t.Fatalf("Unexpected process error: %s", pstate.Error)
+	}
+	// The line the sink stalled on, followed by a note for the lines
+	// dropped from the full queue, and the queued lines
+	expected := []string{"start", "[1990 lines dropped]"}
+	for i := 1990; i < 2000; i++ {
+		expected = append(expected, fmt.Sprint(i))
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, lines)
+	}
+}
+
+// A flood of output is sampled for a slow sink, while every line still
+// reaches OnLine and the captured output, and the process isn't held up
+func TestSampledSink(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	const total = 20000
+	ex, err := NewExecutor("sh", fmt.Sprintf("i=0; while [ $i -lt %d ]; do echo $i; i=$((i+1)); done", total), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.QueueSize = 100
+	ex.Overflow = OverflowSample
+	ex.BufferOutput = true
+	var shown, dropped int
+	ex.Stdout = func(s string, args ...interface{}) {
+		// A terminal that takes a millisecond a line would need 20s for
+		// all of it
+		time.Sleep(time.Millisecond)
+		var n int
+		if _, err := fmt.Sscanf(args[0].(string), "[%d lines dropped]", &n); err == nil {
+			dropped += n
+		} else {
+			shown++
+		}
+	}
+	var seen int
+	ex.OnLine = func(string) { seen++ }
+	lt := termlog.NewLogTest()
+	start := time.Now()
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected the process not to stall behind the sink, took %s", elapsed)
+	}
+	if seen != total {
+		t.Errorf("Expected OnLine to see all %d lines, got %d", total, seen)
+	}
+	if lines := strings.Count(pstate.Output, "\n"); lines != total {
+		t.Errorf("Expected all %d lines to be captured, got %d", total, lines)
+	}
+	if shown+dropped != total || shown >= total/2 {
+		t.Errorf("Expected a sample of the lines to be shown, got %d shown and %d dropped", shown, dropped)
+	}
+}
@@ -0,0 +1,43 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// isScript reports whether command is an inline script that names its own
+// interpreter with a leading #! line. Scripts are run directly, rather than
+// in the shell, where ShebangSupported is true.
+func isScript(command string) bool {
+	return strings.HasPrefix(command, "#!")
+}
+
+// writeScript writes command to an executable temporary file, and returns
+// its path. The file is only readable by modd's user, unless shared is set
+// for a process run as another user.
+func writeScript(command string, shared bool) (string, error) {
+	fp, err := ioutil.TempFile("", "modd-script-")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(command, "\n") {
+		command += "\n"
+	}
+	_, err = fp.WriteString(command)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	mode := os.FileMode(0700)
+	if shared {
+		mode = 0755
+	}
+	if err == nil {
+		err = os.Chmod(fp.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", err
+	}
+	return fp.Name(), nil
+}
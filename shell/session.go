@@ -0,0 +1,234 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cortesi/termlog"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// A Session is a long-lived shell process that runs a sequence of commands,
+// so that changes to the state of the shell, like the working directory or
+// exported variables, carry over from one command to the next.
+//
+// Each command is written to the standard input of the shell, followed by a
+// line that prints a sentinel and the exit status of the command to both
+// output streams. A command that exits the shell ends the session. Commands
+// can't read from standard input, and output written by background processes
+// after a command completes may be attributed to the next command.
+type Session struct {
+	Shell string
+	Dir   string
+	// Env holds NAME=value pairs added to the environment inherited from modd
+	Env []string
+	// If CleanEnv is set, only the variables named in PassEnv are inherited
+	// from modd's environment
+	CleanEnv bool
+	PassEnv  []string
+	// Encoding, if set, is the character encoding of the shell's output,
+	// which is converted to UTF-8
+	Encoding encoding.Encoding
+	// Echo logs each command before it's run
+	Echo bool
+	// Mask, if set, matches sensitive text in lines of output, as for
+	// Executor
+	Mask *regexp.Regexp
+
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdo     *bufio.Reader
+	stde     *bufio.Reader
+	sentinel string
+	exited   bool
+	sync.Mutex
+}
+
+// NewSession creates a session for a shell. The shell process is started
+// when the first command is run.
+func NewSession(shell string, dir string) (*Session, error) {
+	switch shell {
+	case "bash", "sh":
+	default:
+		return nil, fmt.Errorf("persistent sessions are not supported by shell: %q", shell)
+	}
+	if _, err := CheckShell(shell); err != nil {
+		return nil, err
+	}
+	return &Session{Shell: shell, Dir: dir}, nil
+}
+
+func (s *Session) start() error {
+	shcmd, err := CheckShell(s.Shell)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(shcmd, "-s")
+	cmd.Dir = s.Dir
+	cmd.Env = Environ(s.CleanEnv, s.PassEnv, s.Env)
+	cmd.SysProcAttr = defaultSysProcAttr()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdo, err := stdoutPipe(cmd)
+	if err != nil {
+		stdin.Close()
+		return err
+	}
+	stde, err := stderrPipe(cmd)
+	if err != nil {
+		stdin.Close()
+		stdo.Close()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		stdo.Close()
+		stde.Close()
+		return err
+	}
+	var outr, errr io.Reader = stdo, stde
+	if s.Encoding != nil {
+		outr = transform.NewReader(outr, s.Encoding.NewDecoder())
+		errr = transform.NewReader(errr, s.Encoding.NewDecoder())
+	}
+	s.cmd = cmd
+	s.stdin = stdin
+	s.stdo = bufio.NewReader(outr)
+	s.stde = bufio.NewReader(errr)
+	s.sentinel = fmt.Sprintf("__modd_done_%d_%d", os.Getpid(), time.Now().UnixNano())
+	return nil
+}
+
+// script wraps a command so that it runs in the current shell with its
+// standard input detached, and then reports completion
+func (s *Session) script(command string) string {
+	return fmt.Sprintf(
+		"{\n%s\n} </dev/null\nprintf '%%s %%d\\n' %s $?\nprintf '%%s\\n' %s >&2\n",
+		command, s.sentinel, s.sentinel,
+	)
+}
+
+// readUntilSentinel sends lines read from r to sink until the sentinel line,
+// returning whatever follows the sentinel on that line. Output preceding the
+// sentinel on the same line is treated as a line of its own. If ok is false,
+// the stream ended before the sentinel was seen.
+func (s *Session) readUntilSentinel(r *bufio.Reader, sink func(string)) (string, bool) {
+	for {
+		line, err := r.ReadString('\n')
+		if i := strings.Index(line, s.sentinel); i >= 0 {
+			if i > 0 {
+				sink(line[:i])
+			}
+			return strings.TrimSpace(line[i+len(s.sentinel):]), true
+		}
+		if line != "" {
+			sink(strings.TrimSuffix(line, "\n"))
+		}
+		if err != nil {
+			return "", false
+		}
+	}
+}
+
+// Run runs a command in the session, starting the shell if needed. Output is
+// sent to the log, and standard error is always captured in the returned
+// ExecState. Standard output is captured if capture is true.
+func (s *Session) Run(command string, log termlog.Stream, capture bool) (error, *ExecState) {
+	s.Lock()
+	defer s.Unlock()
+	if s.exited {
+		return fmt.Errorf("session shell has exited"), nil
+	}
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return err, nil
+		}
+	}
+	if s.Echo {
+		log.Notice(">> running in session: %s", command)
+	}
+	// A script with a #! line runs in a process of its own, started from the
+	// session's shell
+	if ShebangSupported && isScript(command) {
+		p, err := writeScript(command, false)
+		if err != nil {
+			return err, nil
+		}
+		defer os.Remove(p)
+		command = CommandLine([]string{p})
+	}
+	if _, err := io.WriteString(s.stdin, s.script(command)); err != nil {
+		return s.wait(), nil
+	}
+
+	outbuff := NewCaptureBuffer(0)
+	errbuff := NewCaptureBuffer(0)
+	var errok bool
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, errok = s.readUntilSentinel(s.stde, func(l string) {
+			l = MaskLine(s.Mask, l)
+			log.Warn("%s", l)
+			errbuff.AddLine(l)
+		})
+	}()
+	status, outok := s.readUntilSentinel(s.stdo, func(l string) {
+		log.Say("%s", MaskLine(s.Mask, l))
+		if capture {
+			outbuff.AddLine(l)
+		}
+	})
+	wg.Wait()
+
+	estate := &ExecState{Output: outbuff.String(), ErrOutput: errbuff.String()}
+	if !outok || !errok {
+		estate.Error = s.wait()
+		if estate.Error == nil {
+			estate.Error = fmt.Errorf("shell exited")
+		}
+		estate.ProcState = s.cmd.ProcessState.String()
+		estate.ExitCode = s.cmd.ProcessState.ExitCode()
+		return nil, estate
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid exit status from session: %q", status), nil
+	}
+	estate.ExitCode = code
+	estate.ProcState = fmt.Sprintf("exit status %d", code)
+	if code != 0 {
+		estate.Error = fmt.Errorf("exit status %d", code)
+	}
+	return nil, estate
+}
+
+// wait marks the session as exited, and waits for the shell process
+func (s *Session) wait() error {
+	s.exited = true
+	return s.cmd.Wait()
+}
+
+// Close ends the session, and waits for the shell to exit
+func (s *Session) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.cmd == nil || s.exited {
+		return nil
+	}
+	s.stdin.Close()
+	return s.wait()
+}
@@ -0,0 +1,72 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+func TestSession(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("bash"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	defer utils.WithTempDir(t)()
+
+	s, err := NewSession("bash", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Env = []string{"MODD_SESSION=yes"}
+	defer s.Close()
+	lt := termlog.NewLogTest()
+	run := func(cmd string) *ExecState {
+		err, estate := s.Run(cmd, lt.Log.Stream(""), true)
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+		return estate
+	}
+
+	run("mkdir sub && cd sub && export FOO=bar")
+	estate := run("basename $(pwd); echo $FOO $MODD_SESSION")
+	if estate.Output != "sub\nbar yes\n" || estate.Error != nil {
+		t.Errorf("Expected state to persist, got %#v", estate)
+	}
+	estate = run("printf partial; echo oops >&2; false")
+	if estate.Output != "partial\n" || estate.ErrOutput != "oops\n" {
+		t.Errorf("Unexpected output: %#v", estate)
+	}
+	if estate.Error == nil || estate.ExitCode != 1 {
+		t.Errorf("Expected failure, got %#v", estate)
+	}
+	if estate = run("read x; echo ${x:-empty}"); estate.Output != "empty\n" {
+		t.Errorf("Expected stdin to be detached, got %#v", estate)
+	}
+	if ShebangSupported {
+		// A script runs in its own process, which sees the session's state,
+		// and exiting it leaves the session running
+		estate = run("#!/usr/bin/env bash\necho $FOO in $(basename $(pwd))\nexit 4")
+		if estate.Output != "bar in sub\n" || estate.ExitCode != 4 {
+			t.Errorf("Expected the script to run, got %#v", estate)
+		}
+	}
+
+	if estate = run("exit 3"); estate.Error == nil || estate.ExitCode != 3 {
+		t.Errorf("Expected shell exit, got %#v", estate)
+	}
+	if err, _ := s.Run("true", lt.Log.Stream(""), false); err == nil {
+		t.Errorf("Expected error after shell exit")
+	}
+	if !strings.Contains(lt.String(), "oops") {
+		t.Errorf("Expected stderr in log, got:\n%s", lt.String())
+	}
+}
+
+func TestSessionShell(t *testing.T) {
+	if _, err := NewSession("powershell", ""); err == nil {
+		t.Errorf("Expected error for unsupported shell")
+	}
+}
@@ -5,11 +5,20 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cortesi/termlog"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 var ValidShells = map[string]bool{
@@ -23,21 +32,139 @@ var shellTesting bool
 
 var Default = "modd"
 
+// Pipe constructors, replaced in tests to simulate setup failures.
+var (
+	stdoutPipe = (*exec.Cmd).StdoutPipe
+	stderrPipe = (*exec.Cmd).StderrPipe
+)
+
 type Executor struct {
 	Shell   string
 	Command string
 	Dir     string
 
-	cmd  *exec.Cmd
-	stdo io.ReadCloser
-	stde io.ReadCloser
+	// Env holds NAME=value pairs added to the environment inherited from modd
+	Env []string
+	// If CleanEnv is set, only the variables named in PassEnv are inherited
+	// from modd's environment
+	CleanEnv bool
+	PassEnv  []string
+	// Stdin, if set, is connected to the standard input of the process
+	Stdin io.Reader
+	// BufferOutput causes standard output to be captured in ExecState
+	BufferOutput bool
+	// Stdout and Stderr receive lines of output from the process. If they
+	// are nil, lines are sent to the log's Say and Warn methods respectively.
+	Stdout func(string, ...interface{})
+	Stderr func(string, ...interface{})
+	// QueueSize, if non-zero, is the number of lines of each output stream
+	// queued for delivery, so that a slow sink doesn't stall the process.
+	// Overflow determines what happens when the queue is full.
+	QueueSize int
+	Overflow  Overflow
+	// Encoding, if set, is the character encoding of the process output,
+	// which is converted to UTF-8
+	Encoding encoding.Encoding
+	// RawStdout and RawStderr, if set, receive the output of the process
+	// byte for byte, in place of the line-oriented Stdout and Stderr.
+	RawStdout io.Writer
+	RawStderr io.Writer
+	// OnOutput, if set, is called whenever the process produces output
+	OnOutput func()
+	// OnStderr, if set, is called with each line of standard error, as it
+	// was produced and in addition to Stderr. It's not called for RawStderr.
+	OnStderr func(string)
+	// OnLine, if set, is called with each line of output from either stream,
+	// masked, as it was produced. It's called from a goroutine for each
+	// stream, and not for raw output.
+	OnLine func(string)
+	// Mask, if set, matches sensitive text in lines of output, which is
+	// replaced with MaskText before they're logged, sent to Stdout, Stderr,
+	// OnStderr, RawStdout or RawStderr, or captured as error output. Captured
+	// standard output is left as it is. Raw output is masked a line at a
+	// time, ending at a newline or carriage return, so a partial line is held
+	// back until it's complete.
+	Mask *regexp.Regexp
+	// Prefix, if set, is called with the PID and start time of the process
+	// for each line of output sent to Stdout or Stderr, and the result is
+	// prepended to the line. Captured output is not prefixed.
+	Prefix func(pid int, start time.Time) string
+	// ProcName, if set, replaces the shell's argv[0], so that the process can
+	// be identified in process listings. It's ignored where
+	// ProcNameSupported is false.
+	ProcName string
+	// Timeout, if non-zero, is how long the process may run before it's
+	// stopped by sending it the signals of Ladder in turn, or DefaultLadder
+	// if Ladder is empty
+	Timeout time.Duration
+	Ladder  []SignalStep
+	// Container, if set, is the container the process is run in
+	Container *Container
+	// Echo logs the command line of the process before it's started. The
+	// environment isn't logged, so values passed through Env stay private.
+	Echo bool
+	// Collapse, if non-zero, collapses runs of identical lines of output into
+	// a single line and a count of repeats. Counts are flushed at least this
+	// often. Captured output is not collapsed.
+	Collapse time.Duration
+	// If a sink fails, its output is discarded but the process's output is
+	// still read to the end, so that the process doesn't get SIGPIPE. The
+	// first failure is reported in ExecState, unless IgnoreSinkErrors is set.
+	IgnoreSinkErrors bool
+
+	// Delimiter, if set, is the byte that output is split into lines on, in
+	// place of newlines
+	Delimiter string
+	// Umask, if set, is the octal file mode creation mask the process is
+	// started with. It's ignored where UmaskSupported is false.
+	Umask string
+	// ExtraFiles are open files inherited by the process, as file
+	// descriptors from 3 up. They're ignored where ExtraFilesSupported is
+	// false.
+	ExtraFiles []*os.File
+	// User and Group, if set, are the user and group the process is run as,
+	// by name or numeric ID. Changing them needs privilege.
+	User  string
+	Group string
+
+	cmd     *exec.Cmd
+	started time.Time
+	// The temporary file the running command was written to, if it's a
+	// script with a #! line
+	script string
+	// Closed when the running process has exited and its output is drained
+	exited  chan struct{}
+	stdo    io.ReadCloser
+	stde    io.ReadCloser
+	sinkErr error
 	sync.Mutex
 }
 
 type ExecState struct {
 	Error     error
+	Output    string
 	ErrOutput string
 	ProcState string
+	ExitCode  int
+	// SinkError is the first error encountered writing output to a sink
+	SinkError error
+	// TimedOut is set if the process was stopped because it ran for longer
+	// than the executor's Timeout
+	TimedOut bool
+}
+
+// A SignalStep is a step in an escalation ladder: Signal is sent, and the
+// process has Wait to exit before the next step
+type SignalStep struct {
+	Signal os.Signal
+	Wait   time.Duration
+}
+
+// DefaultLadder asks a process to stop with SIGINT and then SIGTERM, before
+// it's killed
+var DefaultLadder = []SignalStep{
+	{Signal: os.Interrupt, Wait: 2 * time.Second},
+	{Signal: syscall.SIGTERM, Wait: 5 * time.Second},
 }
 
 func GetShellName(v string) (string, error) {
@@ -51,7 +178,7 @@ func GetShellName(v string) (string, error) {
 }
 
 func NewExecutor(shell string, command string, dir string) (*Executor, error) {
-	_, err := makeCommand(shell, command, dir)
+	_, err := BuildCommand(CommandSpec{Shell: shell, Command: command, Dir: dir})
 	if err != nil {
 		return nil, err
 	}
@@ -64,48 +191,132 @@ func NewExecutor(shell string, command string, dir string) (*Executor, error) {
 
 func (e *Executor) start(
 	log termlog.Stream, bufferr bool,
-) (*exec.Cmd, *bytes.Buffer, *sync.WaitGroup, error) {
+) (*exec.Cmd, *CaptureBuffer, *CaptureBuffer, *sync.WaitGroup, error) {
 	e.Lock()
 	defer e.Unlock()
 
-	cmd, err := makeCommand(e.Shell, e.Command, e.Dir)
+	var script string
+	if ShebangSupported && e.Container == nil && isScript(e.Command) {
+		p, err := writeScript(e.Command, e.User != "" || e.Group != "")
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		script = p
+	}
+	// Setup is all or nothing: if any step fails, we remove whatever we've
+	// created so far and leave the executor in its idle state.
+	fail := func(err error) (*exec.Cmd, *CaptureBuffer, *CaptureBuffer, *sync.WaitGroup, error) {
+		if script != "" {
+			os.Remove(script)
+		}
+		return nil, nil, nil, nil, err
+	}
+	cmd, err := BuildCommand(CommandSpec{
+		Shell:      e.Shell,
+		Command:    e.Command,
+		Script:     script,
+		Dir:        e.Dir,
+		Env:        e.Env,
+		CleanEnv:   e.CleanEnv,
+		PassEnv:    e.PassEnv,
+		ProcName:   e.ProcName,
+		Container:  e.Container,
+		ExtraFiles: e.ExtraFiles,
+		User:       e.User,
+		Group:      e.Group,
+		Umask:      e.Umask,
+	})
 	if err != nil {
-		return nil, nil, nil, err
+		return fail(err)
+	}
+	cmd.Stdin = e.Stdin
+	if e.Echo {
+		log.Notice(">> running: %s", CommandLine(cmd.Args))
 	}
-	e.cmd = cmd
 
-	stdo, err := cmd.StdoutPipe()
+	stdo, err := stdoutPipe(cmd)
 	if err != nil {
-		return nil, nil, nil, err
+		return fail(err)
 	}
-	stde, err := cmd.StderrPipe()
+	stde, err := stderrPipe(cmd)
 	if err != nil {
-		return nil, nil, nil, err
+		stdo.Close()
+		return fail(err)
 	}
-	e.stdo = stdo
-	e.stde = stde
 
-	buff := new(bytes.Buffer)
 	err = cmd.Start()
+	if err != nil && (e.User != "" || e.Group != "") && os.IsPermission(err) {
+		err = fmt.Errorf("%s: modd needs privilege to run commands as another user or group", err)
+	}
 	if err != nil {
-		return nil, nil, nil, err
+		stdo.Close()
+		stde.Close()
+		return fail(err)
+	}
+	e.cmd = cmd
+	e.script = script
+	e.started = time.Now()
+	e.stdo = stdo
+	e.stde = stde
+	buff, outbuff, wg := e.readOutput(log, stdo, stde, bufferr)
+	return cmd, buff, outbuff, wg, nil
+}
+
+// readOutput starts reading the output of the process from stdo and stde,
+// and returns the buffers that capture it, and a WaitGroup that completes
+// once it's all been read. The lock must be held.
+func (e *Executor) readOutput(
+	log termlog.Stream, stdo, stde io.Reader, bufferr bool,
+) (*CaptureBuffer, *CaptureBuffer, *sync.WaitGroup) {
+	buff := NewCaptureBuffer(0)
+	outbuff := NewCaptureBuffer(0)
+	outsink, errsink := log.Say, log.Warn
+	if e.Stdout != nil {
+		outsink = e.Stdout
+	}
+	if e.Stderr != nil {
+		errsink = e.Stderr
 	}
 	wg := sync.WaitGroup{}
 	wg.Add(2)
-	buflock := sync.Mutex{}
-	go logOutput(
-		&wg, stde,
-		func(s string, args ...interface{}) {
-			log.Warn(s, args...)
-			if bufferr {
-				buflock.Lock()
-				defer buflock.Unlock()
-				fmt.Fprintf(buff, "%s\n", args...)
-			}
-		},
-	)
-	go logOutput(&wg, stdo, log.Say)
-	return cmd, buff, &wg, nil
+	if e.RawStderr != nil {
+		w := e.RawStderr
+		if bufferr {
+			w = io.MultiWriter(w, buff)
+		}
+		go e.copyOutput(&wg, stde, w, nil)
+	} else {
+		onStderr := e.OnStderr
+		go e.logOutput(
+			&wg, stde, errsink,
+			func(s string) {
+				s = MaskLine(e.Mask, s)
+				if onStderr != nil {
+					onStderr(s)
+				}
+				if bufferr {
+					buff.AddLine(s)
+				}
+			},
+		)
+	}
+	if e.RawStdout != nil {
+		var capture io.Writer
+		if e.BufferOutput {
+			capture = outbuff
+		}
+		go e.copyOutput(&wg, stdo, e.RawStdout, capture)
+	} else {
+		go e.logOutput(
+			&wg, stdo, outsink,
+			func(s string) {
+				if e.BufferOutput {
+					outbuff.AddLine(s)
+				}
+			},
+		)
+	}
+	return buff, outbuff, &wg
 }
 
 func (e *Executor) running() bool {
@@ -121,32 +332,114 @@ func (e *Executor) Running() bool {
 func (e *Executor) reset() {
 	e.Lock()
 	defer e.Unlock()
+	if e.script != "" {
+		os.Remove(e.script)
+		e.script = ""
+	}
 	e.cmd = nil
+	e.exited = nil
 }
 
 func (e *Executor) Run(log termlog.Stream, bufferr bool) (error, *ExecState) {
 	if e.cmd != nil {
 		return fmt.Errorf("already running"), nil
 	}
-	cmd, buff, wg, err := e.start(log, bufferr)
+	cmd, buff, outbuff, wg, err := e.start(log, bufferr)
 	if err != nil {
 		return err, nil
 	}
 
+	exited := make(chan struct{})
+	e.Lock()
+	e.exited = exited
+	e.Unlock()
+	timedOut := make(chan bool, 1)
+	if e.Timeout > 0 {
+		go e.watchTimeout(log, exited, timedOut)
+	} else {
+		timedOut <- false
+	}
+
 	// Order is important here. We MUST wait for the readers to exit before we wait
 	// on the command itself.
 	wg.Wait()
 
 	eret := cmd.Wait()
+	close(exited)
 	estate := &ExecState{
 		Error:     eret,
+		Output:    outbuff.String(),
 		ErrOutput: buff.String(),
 		ProcState: cmd.ProcessState.String(),
+		ExitCode:  cmd.ProcessState.ExitCode(),
+		TimedOut:  <-timedOut,
+	}
+	if estate.TimedOut {
+		estate.Error = fmt.Errorf("timed out after %s", e.Timeout)
 	}
+	e.Lock()
+	estate.SinkError = e.sinkErr
+	e.sinkErr = nil
+	e.Unlock()
 	e.reset()
 	return nil, estate
 }
 
+// watchTimeout stops the process with the escalation ladder if it's still
+// running once Timeout has passed, and reports whether it did
+func (e *Executor) watchTimeout(log termlog.Stream, exited chan struct{}, timedOut chan bool) {
+	t := time.NewTimer(e.Timeout)
+	defer t.Stop()
+	select {
+	case <-exited:
+		timedOut <- false
+		return
+	case <-t.C:
+	}
+	timedOut <- true
+	ladder := e.Ladder
+	if len(ladder) == 0 {
+		ladder = DefaultLadder
+	}
+	log.Warn(">> timed out after %s, stopping", e.Timeout)
+	e.escalate(ladder, exited)
+}
+
+// escalate sends each signal of the ladder in turn, until exited is closed.
+// If the process outlives the ladder, it's killed.
+func (e *Executor) escalate(ladder []SignalStep, exited chan struct{}) {
+	for _, s := range ladder {
+		if err := e.Signal(s.Signal); err != nil {
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(s.Wait):
+		}
+	}
+	e.Stop()
+}
+
+// Pid returns the process ID of the running process, or 0 if the executor is
+// not running
+func (e *Executor) Pid() int {
+	e.Lock()
+	defer e.Unlock()
+	if !e.running() {
+		return 0
+	}
+	return e.cmd.Process.Pid
+}
+
+// Exited returns a channel that's closed when the running process exits, or
+// nil if the executor is not running
+func (e *Executor) Exited() <-chan struct{} {
+	e.Lock()
+	defer e.Unlock()
+	return e.exited
+}
+
 func (e *Executor) Signal(sig os.Signal) error {
 	e.Lock()
 	defer e.Unlock()
@@ -160,16 +453,353 @@ func (e *Executor) Stop() error {
 	return e.Signal(os.Kill)
 }
 
-func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interface{})) {
+// Terminate stops the running process by sending it the signals of ladder in
+// turn, or DefaultLadder if ladder is empty, and kills it if it outlives the
+// ladder. It returns once the process has exited and its output is drained,
+// or straight away if it isn't running.
+func (e *Executor) Terminate(ladder []SignalStep) {
+	e.Lock()
+	exited := e.exited
+	e.Unlock()
+	if exited == nil {
+		return
+	}
+	if len(ladder) == 0 {
+		ladder = DefaultLadder
+	}
+	e.escalate(ladder, exited)
+	<-exited
+}
+
+// adoptPoll is how often an adopted process is checked to see if it's exited
+const adoptPoll = 100 * time.Millisecond
+
+// Adopt takes charge of a running process that wasn't started by the
+// executor, like a daemon left running by an earlier instance of modd, and
+// waits for it to exit. The process must lead its own process group, as the
+// processes started by Run do. It can be signalled and stopped as if it had
+// been started by Run, but its exit status isn't known. If stdout and stderr
+// are set, they're the read ends of the pipes the process writes its output
+// to, as passed on by HandoffOutput, and its output is read from them as for
+// Run. Otherwise its output can't be read.
+func (e *Executor) Adopt(pid int, log termlog.Stream, stdout, stderr *os.File) (error, *ExecState) {
+	exited, err := e.adopt(pid)
+	if err != nil {
+		return err, nil
+	}
+	if stdout != nil && stderr != nil {
+		e.Lock()
+		e.stdo, e.stde = stdout, stderr
+		_, _, wg := e.readOutput(log, stdout, stderr, false)
+		e.Unlock()
+		wg.Wait()
+		stdout.Close()
+		stderr.Close()
+	}
+	awaitExit(pid, exited)
+	e.reset()
+	return nil, &ExecState{ProcState: "unknown status", ExitCode: -1}
+}
+
+// adopt makes pid the running process of the executor, and returns the
+// channel to close when it exits
+func (e *Executor) adopt(pid int) (chan struct{}, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.cmd != nil {
+		return nil, fmt.Errorf("already running")
+	}
+	if !CanAdopt(pid) {
+		return nil, fmt.Errorf("process %d can't be adopted", pid)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	e.cmd = &exec.Cmd{Process: proc}
+	e.started = time.Now()
+	e.exited = make(chan struct{})
+	return e.exited, nil
+}
+
+// awaitExit polls until pid has exited, and then closes exited
+func awaitExit(pid int, exited chan struct{}) {
+	for processAlive(pid) {
+		time.Sleep(adoptPoll)
+	}
+	close(exited)
+}
+
+// TerminateProcess stops a running process that leads its own process group,
+// as Terminate does for the process of an executor. It returns an error if
+// the process can't be adopted.
+func TerminateProcess(pid int, ladder []SignalStep) error {
+	e := &Executor{}
+	exited, err := e.adopt(pid)
+	if err != nil {
+		return err
+	}
+	go awaitExit(pid, exited)
+	e.Terminate(ladder)
+	return nil
+}
+
+// queue returns a function that queues lines for delivery to out in the
+// background, and a function that marks the end of output. Queued lines are
+// delivered before wg completes.
+func (e *Executor) queue(
+	wg *sync.WaitGroup, out func(string, ...interface{}),
+) (func(string, ...interface{}), func()) {
+	q := newLineQueue(e.QueueSize, e.Overflow)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.run(out)
+	}()
+	push := func(s string, args ...interface{}) {
+		q.push(fmt.Sprintf(s, args...))
+	}
+	return push, q.close
+}
+
+// logOutput splits output read from fp into lines, which are sent to sink
+// and passed to capture. The output is decoded and queued as configured on
+// the executor.
+func (e *Executor) logOutput(
+	wg *sync.WaitGroup,
+	fp io.Reader,
+	sink func(string, ...interface{}),
+	capture func(string),
+) {
 	defer wg.Done()
-	r := bufio.NewReader(fp)
-	for {
-		line, _, err := r.ReadLine()
-		if err != nil {
+	sink = e.guard(sink)
+	if e.QueueSize > 0 {
+		var done func()
+		sink, done = e.queue(wg, sink)
+		defer done()
+	}
+	if e.Prefix != nil {
+		sink = e.prefix(sink)
+	}
+	if e.Collapse > 0 {
+		c := newCollapser(sink, e.Collapse)
+		sink = c.line
+		defer c.close()
+	}
+	if e.Encoding != nil {
+		fp = transform.NewReader(fp, e.Encoding.NewDecoder())
+	}
+	delim := byte('\n')
+	if e.Delimiter != "" {
+		delim = e.Delimiter[0]
+	}
+	// Lines longer than the read buffer come in pieces. When masking, they're
+	// kept whole, so that a match can't be split between pieces and escape
+	// the mask.
+	s := bufio.NewScanner(fp)
+	s.Buffer(make([]byte, pieceSize), maxLineSize)
+	s.Split(splitLines(delim, e.Mask == nil))
+	for s.Scan() {
+		line := s.Text()
+		if e.OnOutput != nil {
+			e.OnOutput()
+		}
+		masked := MaskLine(e.Mask, line)
+		sink("%s", masked)
+		if e.OnLine != nil {
+			e.OnLine(masked)
+		}
+		capture(line)
+	}
+	// Drain the rest of the output if a line was too long to hold, so that
+	// the process isn't blocked writing it
+	if s.Err() != nil {
+		io.Copy(ioutil.Discard, fp)
+	}
+}
+
+// The size of the pieces that long lines are split into, and the longest a
+// line is allowed to grow when it's kept whole
+const (
+	pieceSize   = 4096
+	maxLineSize = 1 << 30
+)
+
+// splitLines returns a split function for a bufio.Scanner that splits input
+// on delim, which isn't included in the lines. For newlines, a trailing
+// carriage return is dropped too. If pieces is set, lines longer than
+// pieceSize are returned in pieces, as bufio.Reader.ReadLine does.
+func splitLines(delim byte, pieces bool) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			line := data[:i]
+			if delim == '\n' {
+				line = bytes.TrimSuffix(line, []byte{'\r'})
+			}
+			return i + 1, line, nil
+		}
+		if atEOF || (pieces && len(data) >= pieceSize) {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// MaskText replaces text matched by a mask
+const MaskText = "***"
+
+// MaskLine replaces all matches of mask in line with MaskText. If mask is nil,
+// line is returned as it is.
+func MaskLine(mask *regexp.Regexp, line string) string {
+	if mask == nil {
+		return line
+	}
+	return mask.ReplaceAllLiteralString(line, MaskText)
+}
+
+// copyOutput copies output read from fp to w, masked, and to capture, if it's
+// set, unchanged
+func (e *Executor) copyOutput(wg *sync.WaitGroup, fp io.Reader, w io.Writer, capture io.Writer) {
+	defer wg.Done()
+	dw := &drainWriter{w: w}
+	w = dw
+	var mw *maskWriter
+	if e.Mask != nil {
+		mw = &maskWriter{w: dw, mask: e.Mask}
+		w = mw
+	}
+	if capture != nil {
+		w = io.MultiWriter(w, capture)
+	}
+	if e.OnOutput != nil {
+		w = activityWriter{w, e.OnOutput}
+	}
+	io.Copy(w, fp)
+	if mw != nil {
+		mw.flush()
+	}
+	if dw.err != nil {
+		e.sinkError(dw.err)
+	}
+}
+
+// maskWriter masks output before writing it to w. Output is written a line at
+// a time, ending with a newline or a carriage return, so that a match can't be
+// split between writes and escape the mask. A partial line is held until it's
+// complete, it grows beyond maxLineSize, or flush is called.
+type maskWriter struct {
+	w       io.Writer
+	mask    *regexp.Regexp
+	pending []byte
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.pending = append(m.pending, p...)
+	end := bytes.LastIndexAny(m.pending, "\r\n") + 1
+	if end == 0 && len(m.pending) > maxLineSize {
+		end = len(m.pending)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+	err := m.write(m.pending[:end])
+	m.pending = append([]byte(nil), m.pending[end:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write masks each line of b, and writes the result to w
+func (m *maskWriter) write(b []byte) error {
+	var out []byte
+	for len(b) > 0 {
+		i := bytes.IndexAny(b, "\r\n") + 1
+		if i == 0 {
+			i = len(b)
+		}
+		out = append(out, m.mask.ReplaceAllLiteral(b[:i], []byte(MaskText))...)
+		b = b[i:]
+	}
+	_, err := m.w.Write(out)
+	return err
+}
+
+// flush writes the partial line held back, if there is one
+func (m *maskWriter) flush() error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+	err := m.write(m.pending)
+	m.pending = nil
+	return err
+}
+
+// sinkError records the first sink failure
+func (e *Executor) sinkError(err error) {
+	if e.IgnoreSinkErrors {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.sinkErr == nil {
+		e.sinkErr = err
+	}
+}
+
+// guard returns a sink that calls sink until it panics, and then discards
+// output
+func (e *Executor) guard(sink func(string, ...interface{})) func(string, ...interface{}) {
+	failed := false
+	return func(s string, args ...interface{}) {
+		if failed {
 			return
 		}
-		out("%s", string(line))
+		defer func() {
+			if r := recover(); r != nil {
+				failed = true
+				e.sinkError(fmt.Errorf("output sink failed: %v", r))
+			}
+		}()
+		sink(s, args...)
+	}
+}
+
+// prefix returns a sink that prepends the result of Prefix to each line
+// before passing it to sink
+func (e *Executor) prefix(sink func(string, ...interface{})) func(string, ...interface{}) {
+	pid, start := e.cmd.Process.Pid, e.started
+	return func(format string, args ...interface{}) {
+		sink("%s %s", e.Prefix(pid, start), fmt.Sprintf(format, args...))
+	}
+}
+
+// drainWriter writes to w until a write fails, and then discards output.
+// Writes never fail, so copying to a drainWriter always reads to the end.
+type drainWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *drainWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
 	}
+	return len(p), nil
+}
+
+// activityWriter calls a function on every write
+type activityWriter struct {
+	io.Writer
+	activity func()
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.activity()
+	return w.Writer.Write(p)
 }
 
 // CheckShell checks that a shell is supported, and returns the correct command name
@@ -198,21 +828,173 @@ func CheckShell(shell string) (string, error) {
 	}
 }
 
-func makeCommand(shell string, command string, dir string) (*exec.Cmd, error) {
-	shcmd, err := CheckShell(shell)
-	if err != nil {
-		return nil, err
+// CommandSpec describes how to run a command in a shell
+type CommandSpec struct {
+	Shell   string
+	Command string
+	Dir     string
+	// Flags are extra arguments passed to the shell before the command
+	Flags []string
+	// Env holds NAME=value pairs added to the environment inherited from modd
+	Env []string
+	// If CleanEnv is set, only the variables named in PassEnv are inherited
+	// from modd's environment
+	CleanEnv bool
+	PassEnv  []string
+	// ProcName, if set, replaces the shell's argv[0] where the platform
+	// supports it
+	ProcName string
+	// SysProcAttr overrides the platform default, which runs the command in
+	// its own process group
+	SysProcAttr *syscall.SysProcAttr
+	// ExtraFiles are inherited by the command, as file descriptors from 3 up
+	ExtraFiles []*os.File
+	// User and Group, if set, are the user and group the command is run as,
+	// by name or numeric ID. Container commands ignore them.
+	User  string
+	Group string
+	// Container, if set, runs the command in a container instead. ProcName
+	// is ignored.
+	Container *Container
+	// Script, if set, is the path of an executable script that's run
+	// directly in place of Command, without the shell
+	Script string
+	// Umask, if set, is the octal file mode creation mask the command is run
+	// with. It's ignored where UmaskSupported is false.
+	Umask string
+}
+
+// BuildCommand returns a command that runs spec in its shell, or runs its
+// Script. Both preps and daemons are started through here, so they are always
+// run the same way.
+func BuildCommand(spec CommandSpec) (*exec.Cmd, error) {
+	// The umask is set by the child, since setting modd's own would change
+	// it for every file modd creates meanwhile. Commands run by a shell set
+	// it first thing, and others are run through sh, which execs them once
+	// it's set.
+	var setUmask string
+	if spec.Umask != "" && UmaskSupported {
+		mask, err := strconv.ParseUint(spec.Umask, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid umask: %q", spec.Umask)
+		}
+		setUmask = fmt.Sprintf("umask %04o", mask)
+		if spec.Script == "" && (spec.Container != nil || spec.Shell == "bash" || spec.Shell == "sh") {
+			spec.Command = setUmask + "; " + spec.Command
+			setUmask = ""
+		}
+	}
+	if spec.Container != nil {
+		return containerCommand(spec)
 	}
 	var cmd *exec.Cmd
-	switch shell {
-	case "bash", "sh":
-		cmd = exec.Command(shcmd, "-c", command)
-	case "modd":
-		cmd = exec.Command(shcmd, "--exec", command)
-	case "powershell":
-		cmd = exec.Command(shcmd, "-Command", command)
+	if spec.Script != "" {
+		cmd = exec.Command(spec.Script)
+	} else {
+		shcmd, err := CheckShell(spec.Shell)
+		if err != nil {
+			return nil, err
+		}
+		var cmdflag string
+		switch spec.Shell {
+		case "bash", "sh":
+			cmdflag = "-c"
+		case "modd":
+			cmdflag = "--exec"
+		case "powershell":
+			cmdflag = "-Command"
+		}
+		args := append(append([]string{}, spec.Flags...), cmdflag, spec.Command)
+		cmd = exec.Command(shcmd, args...)
+	}
+	if setUmask != "" {
+		sh, err := exec.LookPath("sh")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Args = append([]string{"sh", "-c", setUmask + ` && exec "$0" "$@"`, cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = sh
+	}
+	cmd.Dir = spec.Dir
+	cmd.Env = Environ(spec.CleanEnv, spec.PassEnv, spec.Env)
+	cmd.SysProcAttr = spec.SysProcAttr
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = defaultSysProcAttr()
+	}
+	if spec.ProcName != "" {
+		setProcName(cmd, spec.ProcName)
+	}
+	cmd.ExtraFiles = spec.ExtraFiles
+	if spec.User != "" || spec.Group != "" {
+		if err := setCredential(cmd, spec.User, spec.Group); err != nil {
+			return nil, err
+		}
 	}
-	cmd.Dir = dir
-	prepCmd(cmd)
 	return cmd, nil
 }
+
+// CommandLine formats args as a command line, quoting arguments as the shell
+// would need them
+func CommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.IndexFunc(a, needsQuote) < 0 {
+			quoted[i] = a
+		} else {
+			quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("-_./=:,+@%", r))
+}
+
+// Environ returns the environment for a command, given the NAME=value pairs
+// in env. The command inherits modd's environment, or only the variables named
+// in pass if clean is set. A nil return means the environment is inherited
+// unchanged.
+func Environ(clean bool, pass []string, env []string) []string {
+	if !clean {
+		if len(env) == 0 {
+			return nil
+		}
+		return MergeEnv(os.Environ(), env)
+	}
+	base := []string{}
+	for _, name := range pass {
+		if v, ok := os.LookupEnv(name); ok {
+			base = append(base, name+"="+v)
+		}
+	}
+	// An empty environment must not be nil, or everything is inherited
+	return append([]string{}, MergeEnv(base, env)...)
+}
+
+// MergeEnv layers lists of NAME=value pairs, so that a variable set in a later
+// layer replaces any earlier value. Variables keep the position at which they
+// were first set. Names are case-insensitive on Windows.
+func MergeEnv(layers ...[]string) []string {
+	var ret []string
+	index := map[string]int{}
+	for _, layer := range layers {
+		for _, kv := range layer {
+			name := kv
+			if i := strings.Index(kv, "="); i >= 0 {
+				name = kv[:i]
+			}
+			if runtime.GOOS == "windows" {
+				name = strings.ToUpper(name)
+			}
+			if i, ok := index[name]; ok {
+				ret[i] = kv
+			} else {
+				index[name] = len(ret)
+				ret = append(ret, kv)
+			}
+		}
+	}
+	return ret
+}
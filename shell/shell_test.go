@@ -1,9 +1,18 @@
 package shell
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -162,3 +171,447 @@ func TestShells(t *testing.T) {
 		}
 	}
 }
+
+func TestPipeSetupFailure(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	var stdo io.ReadCloser
+	stdoutPipe = func(c *exec.Cmd) (io.ReadCloser, error) {
+		r, err := c.StdoutPipe()
+		stdo = r
+		return r, err
+	}
+	stderrPipe = func(*exec.Cmd) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("injected pipe failure")
+	}
+	defer func() {
+		stdoutPipe = (*exec.Cmd).StdoutPipe
+		stderrPipe = (*exec.Cmd).StderrPipe
+	}()
+
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "echo moddtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err == nil || pstate != nil {
+		t.Fatalf("Expected setup error, got %v, %v", err, pstate)
+	}
+	if ex.Running() {
+		t.Errorf("Executor should not be running after failed setup")
+	}
+	if _, err := stdo.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected stdout pipe to be closed")
+	}
+
+	// Once the fault clears, the same executor must be usable again.
+	stderrPipe = (*exec.Cmd).StderrPipe
+	err, pstate = ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatalf("Unexpected error after recovery: %s", err)
+	}
+	if pstate.Error != nil {
+		t.Errorf("Unexpected process error: %s", pstate.Error)
+	}
+	if !strings.Contains(lt.String(), "moddtest") {
+		t.Errorf("Unexpected log return: %s", lt.String())
+	}
+}
+
+func TestOutputSinks(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "echo moddout; echo modderr >&2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var stdout, stderr []string
+	ex.Stdout = func(s string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		stdout = append(stdout, fmt.Sprintf(s, args...))
+	}
+	ex.Stderr = func(s string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		stderr = append(stderr, fmt.Sprintf(s, args...))
+	}
+	err, pstate := ex.Run(lt.Log.Stream(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stdout, []string{"moddout"}) {
+		t.Errorf("Unexpected stdout: %#v", stdout)
+	}
+	if !reflect.DeepEqual(stderr, []string{"modderr"}) {
+		t.Errorf("Unexpected stderr: %#v", stderr)
+	}
+	if pstate.ErrOutput != "modderr\n" {
+		t.Errorf("Expected stderr to still be buffered, got %q", pstate.ErrOutput)
+	}
+	if strings.Contains(lt.String(), "moddout") || strings.Contains(lt.String(), "modderr") {
+		t.Errorf("Output leaked to log: %s", lt.String())
+	}
+}
+
+func TestOutputDelimiter(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	ex, err := NewExecutor("sh", `printf 'one\000two\nlines\000three'`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.Delimiter = "\x00"
+	var stdout []string
+	ex.Stdout = func(s string, args ...interface{}) {
+		stdout = append(stdout, fmt.Sprintf(s, args...))
+	}
+	err, _ = ex.Run(termlog.NewLogTest().Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"one", "two\nlines", "three"}; !reflect.DeepEqual(stdout, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, stdout)
+	}
+}
+
+var splitLinesTests = []struct {
+	input  string
+	delim  byte
+	pieces bool
+	lines  []string
+}{
+	{"a\nb\r\n\nc", '\n', true, []string{"a", "b", "", "c"}},
+	{"a\r;b;", ';', true, []string{"a\r", "b"}},
+	{strings.Repeat("x", pieceSize+1) + "\n", '\n', true, []string{strings.Repeat("x", pieceSize), "x"}},
+	{strings.Repeat("x", pieceSize+1) + "\n", '\n', false, []string{strings.Repeat("x", pieceSize+1)}},
+}
+
+func TestSplitLines(t *testing.T) {
+	for i, tt := range splitLinesTests {
+		s := bufio.NewScanner(strings.NewReader(tt.input))
+		s.Buffer(make([]byte, pieceSize), maxLineSize)
+		s.Split(splitLines(tt.delim, tt.pieces))
+		var lines []string
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		if !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("%d: expected %q, got %q", i, tt.lines, lines)
+		}
+	}
+}
+
+func TestOutputPrefix(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor("sh", "echo moddout; echo moddout; echo modderr >&2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.Collapse = time.Hour
+	ex.BufferOutput = true
+	// The prefix is called for stdout and stderr at once
+	var mu sync.Mutex
+	var pids []int
+	ex.Prefix = func(pid int, start time.Time) string {
+		mu.Lock()
+		defer mu.Unlock()
+		pids = append(pids, pid)
+		return "[pre]"
+	}
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"[pre] moddout", "[pre] modderr"} {
+		if !strings.Contains(lt.String(), l) {
+			t.Errorf("Expected prefixed line %q, got:\n%s", l, lt.String())
+		}
+	}
+	if strings.Contains(lt.String(), "[pre] [pre]") {
+		t.Errorf("Expected a single prefix per line:\n%s", lt.String())
+	}
+	if len(pids) == 0 || pids[0] == 0 {
+		t.Errorf("Expected prefix to receive the pid, got %#v", pids)
+	}
+	if pstate.Output != "moddout\nmoddout\n" {
+		t.Errorf("Expected captured output to be unprefixed, got %q", pstate.Output)
+	}
+}
+
+func TestMaskLine(t *testing.T) {
+	mask := regexp.MustCompile(`(?:token=\S+)|(?:(?i)password: \w+)|(?:ghp_[a-zA-Z0-9]{8,})`)
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"connecting with token=abc123 to db", "connecting with *** to db"},
+		{"Password: hunter2", "***"},
+		{"token=a token=b", "*** ***"},
+		{"pushing with ghp_abcdefgh1234", "pushing with ***"},
+		{"ghp_short", "ghp_short"},
+		{"nothing to see", "nothing to see"},
+	}
+	for _, tt := range tests {
+		if ret := MaskLine(mask, tt.line); ret != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.line, tt.expected, ret)
+		}
+	}
+	if ret := MaskLine(nil, "token=abc"); ret != "token=abc" {
+		t.Errorf("Expected no masking without a mask, got %q", ret)
+	}
+}
+
+func TestOutputMask(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	// The secret straddles the end of the read buffer, and must still be
+	// masked in full
+	pad := strings.Repeat("x", 4090)
+	lt := termlog.NewLogTest()
+	ex, err := NewExecutor(
+		"sh",
+		"echo token=abc123 out; echo "+pad+"secret=0123456789; echo token=def456 err >&2",
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.BufferOutput = true
+	ex.Mask = regexp.MustCompile(`(?:token=\S+)|(?:secret=\d+)`)
+	var errLines []string
+	ex.OnStderr = func(s string) { errLines = append(errLines, s) }
+	err, pstate := ex.Run(lt.Log.Stream(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := lt.String()
+	for _, s := range []string{"abc123", "def456", "0123456789", "secret="} {
+		if strings.Contains(out, s) {
+			t.Errorf("Expected %q to be masked, got:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{"*** out", pad + "***", "*** err"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in output, got:\n%s", s, out)
+		}
+	}
+	if pstate.ErrOutput != "*** err\n" || !reflect.DeepEqual(errLines, []string{"*** err"}) {
+		t.Errorf("Expected error output to be masked, got %q and %#v", pstate.ErrOutput, errLines)
+	}
+	// Captured output is passed on to other commands, and isn't masked
+	if !strings.HasPrefix(pstate.Output, "token=abc123 out\n") {
+		t.Errorf("Expected captured output to be unmasked, got %q", pstate.Output)
+	}
+}
+
+func TestRawOutputMask(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	// Progress output ends with a carriage return, and a secret split across
+	// writes must still be masked
+	ex, err := NewExecutor(
+		"sh",
+		"printf 'token=abc123 1%%\\r'; printf 'tok'; sleep 0.1; printf 'en=def456 done\\n'; "+
+			"printf 'token=ghi789' >&2",
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.BufferOutput = true
+	ex.Mask = regexp.MustCompile(`token=\S+`)
+	var stdout, stderr bytes.Buffer
+	ex.RawStdout = &stdout
+	ex.RawStderr = &stderr
+	lt := termlog.NewLogTest()
+	err, pstate := ex.Run(lt.Log.Stream(""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "*** 1%\r*** done\n" {
+		t.Errorf("Expected raw stdout to be masked, got %q", stdout.String())
+	}
+	if stderr.String() != "***" || pstate.ErrOutput != "***" {
+		t.Errorf("Expected raw stderr to be masked, got %q and %q", stderr.String(), pstate.ErrOutput)
+	}
+	if pstate.Output != "token=abc123 1%\rtoken=def456 done\n" {
+		t.Errorf("Expected captured output to be unmasked, got %q", pstate.Output)
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	shellTesting = true
+	path, err := CheckShell("sh")
+	if err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	cmd, err := BuildCommand(CommandSpec{
+		Shell:   "sh",
+		Command: "echo hi",
+		Dir:     "inner",
+		Flags:   []string{"-e"},
+		Env:     []string{"MODDTEST=1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{path, "-e", "-c", "echo hi"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("Expected args %#v, got %#v", expected, cmd.Args)
+	}
+	if cmd.Dir != "inner" {
+		t.Errorf("Unexpected dir: %s", cmd.Dir)
+	}
+	if len(cmd.Env) == 0 || cmd.Env[len(cmd.Env)-1] != "MODDTEST=1" {
+		t.Errorf("Expected env to be extended, got %#v", cmd.Env)
+	}
+	if cmd.SysProcAttr == nil {
+		t.Errorf("Expected default SysProcAttr")
+	}
+
+	cmd, err = BuildCommand(CommandSpec{Shell: "sh", Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Env != nil {
+		t.Errorf("Expected inherited environment, got %#v", cmd.Env)
+	}
+	attr := &syscall.SysProcAttr{}
+	cmd, err = BuildCommand(CommandSpec{Shell: "sh", Command: "true", SysProcAttr: attr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.SysProcAttr != attr {
+		t.Errorf("Expected SysProcAttr override to be used")
+	}
+
+	if _, err := BuildCommand(CommandSpec{Shell: "csh", Command: "true"}); err == nil {
+		t.Errorf("Expected error for unsupported shell")
+	}
+}
+
+func TestProcName(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("skipping - no /proc")
+	}
+	ex, err := NewExecutor("sh", `args=$(tr '\0' ' ' </proc/$$/cmdline); echo "$args"`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.ProcName = "modd-test-daemon"
+	ex.BufferOutput = true
+	lt := termlog.NewLogTest()
+	err, pstate := ex.Run(lt.Log.Stream(""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pstate.Output, "modd-test-daemon -c ") {
+		t.Errorf("Expected process name in argv[0], got %q", pstate.Output)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("sink closed")
+}
+
+// A failing sink must not stop the process output from being drained, or the
+// process would block, or die of SIGPIPE.
+func TestFailingSink(t *testing.T) {
+	shellTesting = true
+	if _, err := CheckShell("sh"); err != nil {
+		t.Skipf("skipping - %s", err)
+	}
+	cmd := `pad=$(printf '%0100d' 0)
+	i=0
+	while [ $i -lt 2000 ]; do echo "$pad"; echo "$pad" >&2; i=$((i+1)); done`
+	for _, ignore := range []bool{false, true} {
+		ex, err := NewExecutor("sh", cmd, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.IgnoreSinkErrors = ignore
+		ex.RawStdout = failingWriter{}
+		ex.Stderr = func(s string, args ...interface{}) {
+			panic("sink closed")
+		}
+		lt := termlog.NewLogTest()
+		err, pstate := ex.Run(lt.Log.Stream(""), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pstate.Error != nil {
+			t.Fatalf("Unexpected process error: %s", pstate.Error)
+		}
+		if strings.Count(pstate.ErrOutput, "\n") != 2000 {
+			t.Errorf("Expected stderr to be read to the end")
+		}
+		if ignore && pstate.SinkError != nil {
+			t.Errorf("Expected sink errors to be ignored, got %s", pstate.SinkError)
+		} else if !ignore && pstate.SinkError == nil {
+			t.Errorf("Expected sink error")
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	ret := MergeEnv(
+		[]string{"PATH=/bin", "FOO=os", "HOME=/root"},
+		[]string{"FOO=global", "BAR=global"},
+		[]string{"BAR=block", "BAZ=block"},
+	)
+	expected := []string{"PATH=/bin", "FOO=global", "HOME=/root", "BAR=block", "BAZ=block"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	os.Setenv("MODD_PASSED", "yes")
+	os.Setenv("MODD_EXCLUDED", "yes")
+	defer os.Unsetenv("MODD_PASSED")
+	defer os.Unsetenv("MODD_EXCLUDED")
+
+	if ret := Environ(false, nil, nil); ret != nil {
+		t.Errorf("Expected inherited environment, got %#v", ret)
+	}
+	ret := Environ(true, []string{"MODD_PASSED", "MODD_UNSET"}, []string{"FOO=bar"})
+	expected := []string{"MODD_PASSED=yes", "FOO=bar"}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\nGot\n%#v", expected, ret)
+	}
+	if ret := Environ(true, nil, nil); ret == nil || len(ret) != 0 {
+		t.Errorf("Expected empty environment, got %#v", ret)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	ret := CommandLine([]string{"/bin/sh", "-c", "echo 'hi' $FOO", ""})
+	expected := `/bin/sh -c 'echo '\''hi'\'' $FOO' ''`
+	if ret != expected {
+		t.Errorf("Expected %s, got %s", expected, ret)
+	}
+}
@@ -0,0 +1,112 @@
+package modd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/cortesi/modd/conf"
+)
+
+// SignalAction is something modd does when it receives a signal
+type SignalAction string
+
+// Signal actions
+const (
+	// ActionRestartDaemons restarts all daemons, as the r key does
+	ActionRestartDaemons SignalAction = "restart-daemons"
+	// ActionRerunPreps runs the preps of every block, as the p key does
+	ActionRerunPreps SignalAction = "rerun-preps"
+	// ActionReloadConfig reads the config again, as a change to it does
+	ActionReloadConfig SignalAction = "reload-config"
+	// ActionTogglePause pauses or resumes modd, as the z key does
+	ActionTogglePause SignalAction = "toggle-pause"
+)
+
+var signalActions = map[SignalAction]bool{
+	ActionRestartDaemons: true,
+	ActionRerunPreps:     true,
+	ActionReloadConfig:   true,
+	ActionTogglePause:    true,
+}
+
+// ParseSignalActions parses mappings of the form SIGNAL=ACTION, like
+// sighup=restart-daemons. SIGINT is left alone, since it shuts modd down.
+func ParseSignalActions(specs []string) (map[os.Signal]SignalAction, error) {
+	ret := map[os.Signal]SignalAction{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("signal action must be of the form SIGNAL=ACTION, got %q", spec)
+		}
+		sig, ok := conf.LookupSignal(parts[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown signal: %s", parts[0])
+		}
+		if sig == os.Interrupt || sig == os.Kill {
+			return nil, fmt.Errorf("%s can't be given an action", parts[0])
+		}
+		action := SignalAction(parts[1])
+		if !signalActions[action] {
+			return nil, fmt.Errorf("unknown signal action: %q", parts[1])
+		}
+		if _, ok := ret[sig]; ok {
+			return nil, fmt.Errorf("%s is given more than one action", parts[0])
+		}
+		ret[sig] = action
+	}
+	return ret, nil
+}
+
+// hasSignalAction reports whether sig is given an action, in place of the
+// handler modd would otherwise install for it
+func (mr *ModRunner) hasSignalAction(sig os.Signal) bool {
+	_, ok := mr.SignalActions[sig]
+	return ok
+}
+
+// signalAction carries out action. Config reloads are asked for on reload,
+// which the main loop acts on.
+func (mr *ModRunner) signalAction(action SignalAction, reload chan<- struct{}) {
+	switch action {
+	case ActionRestartDaemons:
+		mr.restartDaemons()
+	case ActionRerunPreps:
+		mr.rerunPreps()
+	case ActionReloadConfig:
+		if mr.ConfPath == ConfStdin {
+			mr.Log.Warn(">> a config read from stdin can't be reloaded")
+			return
+		}
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	case ActionTogglePause:
+		mr.TogglePause()
+	}
+}
+
+// notifySignals carries out the SignalActions of the signals modd receives.
+// The returned function removes the handler.
+func notifySignals(mr *ModRunner, reload chan<- struct{}) func() {
+	if len(mr.SignalActions) == 0 {
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	for sig := range mr.SignalActions {
+		signal.Notify(c, sig)
+	}
+	go func() {
+		for sig := range c {
+			action := mr.SignalActions[sig]
+			mr.Log.NoticeAs("debug", ">> received %s: %s", sig, action)
+			mr.signalAction(action, reload)
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,82 @@
+package modd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func TestParseSignalActions(t *testing.T) {
+	ret, err := ParseSignalActions([]string{"sighup=restart-daemons", "TERM=reload-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[os.Signal]SignalAction{
+		syscall.SIGHUP:  ActionRestartDaemons,
+		syscall.SIGTERM: ActionReloadConfig,
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+	for _, spec := range [][]string{
+		{"sighup"},
+		{"sigfoo=restart-daemons"},
+		{"sighup=explode"},
+		{"sigint=toggle-pause"},
+		{"hup=rerun-preps", "sighup=toggle-pause"},
+	} {
+		if _, err := ParseSignalActions(spec); err == nil {
+			t.Errorf("Expected an error for %#v", spec)
+		}
+	}
+}
+
+func TestSignalAction(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			prep +onchange: echo ":prep: ran"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	reload := make(chan struct{}, 1)
+
+	mr.signalAction(ActionRerunPreps, reload)
+	if ret := events(lt.String()); !reflect.DeepEqual(ret, []string{":prep: ran"}) {
+		t.Errorf("Expected preps to run, got %#v", ret)
+	}
+	mr.signalAction(ActionRestartDaemons, reload)
+	if !strings.Contains(lt.String(), ">> no daemons running") {
+		t.Errorf("Expected a restart to be attempted, got:\n%s", lt.String())
+	}
+	mr.signalAction(ActionTogglePause, reload)
+	if !mr.Paused() {
+		t.Errorf("Expected modd to be paused")
+	}
+	mr.signalAction(ActionTogglePause, reload)
+	if mr.Paused() {
+		t.Errorf("Expected modd to be resumed")
+	}
+
+	// Reloads are passed to the main loop, and don't pile up
+	mr.signalAction(ActionReloadConfig, reload)
+	mr.signalAction(ActionReloadConfig, reload)
+	if len(reload) != 1 {
+		t.Errorf("Expected a single reload to be asked for, got %d", len(reload))
+	}
+	<-reload
+	mr.ConfPath = ConfStdin
+	mr.signalAction(ActionReloadConfig, reload)
+	if len(reload) != 0 || !strings.Contains(lt.String(), "can't be reloaded") {
+		t.Errorf("Expected a config from stdin not to be reloaded")
+	}
+}
@@ -0,0 +1,254 @@
+package modd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/termlog"
+)
+
+// stateInterval is how often the state file is brought up to date
+const stateInterval = time.Second
+
+// handoffEnv is set in the environment of the modd that a modd handing off
+// its daemons executes in its place, which unsets it once it's running. Only
+// then are the output pipes recorded in the state file taken up.
+const handoffEnv = "MODD_HANDOFF"
+
+// startSlack is how far the start time of a process may be from the time
+// recorded in the state file, for it to be taken as the same process
+const startSlack = 5 * time.Second
+
+// State is the content of the state file. It records the daemon processes
+// that are running, so that a later instance of modd can adopt them rather
+// than starting them afresh.
+type State struct {
+	Daemons []SavedDaemon `json:"daemons"`
+}
+
+// SavedDaemon records a running daemon process
+type SavedDaemon struct {
+	Name    string    `json:"name"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	// ConfigHash is a digest of the config the daemon was started with. A
+	// process is only adopted by a daemon with the same digest.
+	ConfigHash string `json:"confighash"`
+	// Stdout and Stderr are the file descriptors of the read ends of the
+	// process's output pipes, when they're passed on to the modd that
+	// executes in place of the one handing the daemon off
+	Stdout int `json:"stdout,omitempty"`
+	Stderr int `json:"stderr,omitempty"`
+}
+
+// running reports whether the recorded process is still running, and can be
+// adopted. Where start times are available, a process with a different start
+// time is taken to have reused the PID of one that has exited.
+func (sd SavedDaemon) running() bool {
+	if !shell.CanAdopt(sd.Pid) {
+		return false
+	}
+	started, err := processStarted(sd.Pid)
+	if err != nil || sd.Started.IsZero() {
+		return true
+	}
+	diff := started.Sub(sd.Started)
+	return diff < startSlack && diff > -startSlack
+}
+
+// configHash returns a digest of everything that determines how the daemon
+// is run
+func (d *daemon) configHash() string {
+	data, err := json.Marshal(struct {
+		Daemon conf.Daemon
+		Dir    string
+		Shell  string
+		Env    []conf.EnvVar
+	}{d.conf, d.indir, d.shell, d.env})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// saveState returns the state of the running daemons of dworld. If handoff is
+// set, the output pipes of each daemon are passed on as well.
+func saveState(dworld *DaemonWorld, handoff bool) *State {
+	s := &State{Daemons: []SavedDaemon{}}
+	for _, dp := range dworld.DaemonPens {
+		for _, d := range dp.daemons {
+			st := d.Status()
+			if st.Pid == 0 {
+				continue
+			}
+			sd := SavedDaemon{
+				Name:       d.conf.Name(),
+				Pid:        st.Pid,
+				Started:    st.Started,
+				ConfigHash: d.configHash(),
+			}
+			if handoff {
+				d.Lock()
+				ex := d.ex
+				d.Unlock()
+				sd.Stdout, sd.Stderr, _ = ex.HandoffOutput()
+			}
+			s.Daemons = append(s.Daemons, sd)
+		}
+	}
+	return s
+}
+
+// readState reads a state file. A missing file gives an empty state.
+func readState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeState replaces the state file with s, if it has changed since last,
+// which is the content last written
+func writeState(path string, s *State, last []byte) ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return last, err
+	}
+	data = append(data, '\n')
+	if string(data) == string(last) {
+		return last, nil
+	}
+	if err := writeAtomic(path, data); err != nil {
+		return last, err
+	}
+	return data, nil
+}
+
+// adopt arranges for each daemon of dw that matches a process of s to adopt
+// that process when it's first started, rather than starting a new one.
+// Processes that have exited are passed over, and those still running that
+// no daemon matches, because the config has changed, are stopped.
+func (dw *DaemonWorld) adopt(s *State, log termlog.TermLog) {
+	used := make([]bool, len(s.Daemons))
+	for _, dp := range dw.DaemonPens {
+		for _, d := range dp.daemons {
+			hash := d.configHash()
+			for i, sd := range s.Daemons {
+				if used[i] || sd.ConfigHash != hash || sd.Name != d.conf.Name() {
+					continue
+				}
+				used[i] = true
+				if !sd.running() {
+					d.log.NoticeAs("debug", ">> pid %d has exited, starting afresh", sd.Pid)
+					sd.closeOutput()
+					continue
+				}
+				sd := sd
+				d.Lock()
+				d.adoption = &sd
+				d.Unlock()
+				break
+			}
+		}
+	}
+	for i, sd := range s.Daemons {
+		if used[i] {
+			continue
+		}
+		sd.closeOutput()
+		if !sd.running() {
+			continue
+		}
+		log.Notice(">> stopping pid %d of %s, left running by an earlier modd with a different config", sd.Pid, sd.Name)
+		shell.TerminateProcess(sd.Pid, nil)
+	}
+}
+
+// keepState adopts the daemon processes recorded in the state file, and then
+// keeps the file up to date with the daemons of dworld. The returned function
+// stops updates and removes the file, as the daemons are about to be shut
+// down.
+func (mr *ModRunner) keepState(dworld *DaemonWorld) func() {
+	inherited := os.Getenv(handoffEnv) != ""
+	os.Unsetenv(handoffEnv)
+	s, err := readState(mr.StateFile)
+	if err != nil {
+		mr.Log.Warn(">> could not read state file: %s", err)
+	} else {
+		if !inherited {
+			// The descriptors were only open in the modd handed off to,
+			// and may name something else entirely here
+			for i := range s.Daemons {
+				s.Daemons[i].Stdout, s.Daemons[i].Stderr = 0, 0
+			}
+		}
+		dworld.adopt(s, mr.Log)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(stateInterval)
+		defer t.Stop()
+		var last []byte
+		for {
+			var err error
+			last, err = writeState(mr.StateFile, saveState(dworld, false), last)
+			if err != nil {
+				mr.Log.Warn(">> could not write state file: %s", err)
+			}
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		os.Remove(mr.StateFile)
+	}
+}
+
+// handoff writes the state of the daemons of dworld to the state file, and
+// executes modd afresh in place of this one, with the same arguments, to adopt
+// the daemons and go on reading their output. If modd can't be executed, it
+// exits, leaving the daemons running for the next instance of modd to adopt,
+// although their output is lost.
+func (mr *ModRunner) handoff(dworld *DaemonWorld) {
+	if mr.StateFile == "" {
+		mr.Log.Warn(">> can't hand off daemons without a state file")
+		return
+	}
+	if _, err := writeState(mr.StateFile, saveState(dworld, true), nil); err != nil {
+		mr.Log.Shout("could not write state file: %s", err)
+		return
+	}
+	mr.Log.Notice(">> state written to %s, handing daemons off to a new modd", mr.StateFile)
+	if mr.BeforeHandoff != nil {
+		mr.BeforeHandoff()
+	}
+	mr.events.close()
+	mr.Tracer.Close()
+	err := reexec()
+	mr.Log.Shout(
+		"could not execute modd: %s - exiting and leaving daemons running, without their output",
+		err,
+	)
+	os.Exit(0)
+}
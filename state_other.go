@@ -0,0 +1,13 @@
+// +build !linux
+
+package modd
+
+import (
+	"errors"
+	"time"
+)
+
+// processStarted is only available on Linux
+func processStarted(pid int) (time.Time, error) {
+	return time.Time{}, errors.New("process start times are not available")
+}
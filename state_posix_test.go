@@ -0,0 +1,206 @@
+// +build !windows
+
+package modd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/shell"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/termlog"
+)
+
+// startGroup starts a process in its own process group, as daemons are
+func startGroup(t *testing.T) int {
+	cmd := exec.Command("sleep", "100")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func stateWorld(t *testing.T, lt *termlog.LogTest) *DaemonWorld {
+	cnf, err := conf.Parse("test", "@shell = bash\n{\ndaemon +sigterm: sleep 100\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dw
+}
+
+func TestWriteState(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	p := filepath.Join(".", "state.json")
+	s, err := readState(p)
+	if err != nil || len(s.Daemons) != 0 {
+		t.Fatalf("Expected a missing file to give an empty state, got %#v, %v", s, err)
+	}
+	lt := termlog.NewLogTest()
+	dw := stateWorld(t, lt)
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	dp.Restart()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid != 0 })
+	last, err := writeState(p, saveState(dw, false), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := writeState(p, saveState(dw, false), last); err != nil || string(ret) != string(last) {
+		t.Errorf("Expected an unchanged state to be left alone")
+	}
+	s, err = readState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SavedDaemon{{
+		Name:       "sleep 100",
+		Pid:        st.Pid,
+		Started:    st.Started,
+		ConfigHash: dp.daemons[0].configHash(),
+	}}
+	if len(s.Daemons) != 1 || !s.Daemons[0].Started.Equal(st.Started) {
+		t.Fatalf("Expected\n%#v\ngot\n%#v", expected, s.Daemons)
+	}
+	s.Daemons[0].Started = st.Started
+	if !reflect.DeepEqual(s.Daemons, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, s.Daemons)
+	}
+}
+
+func TestAdoptDaemon(t *testing.T) {
+	lt := termlog.NewLogTest()
+	dw := stateWorld(t, lt)
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	d := dp.daemons[0]
+
+	pid := startGroup(t)
+	dw.adopt(&State{Daemons: []SavedDaemon{
+		{Name: d.conf.Name(), Pid: pid, Started: time.Now(), ConfigHash: d.configHash()},
+	}}, lt.Log)
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid == pid })
+	if !strings.Contains(lt.String(), "adopting pid") {
+		t.Errorf("Expected the adoption to be logged, got:\n%s", lt.String())
+	}
+
+	// A restart stops the adopted process and starts a new one
+	dp.Restart()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid != 0 && st.Pid != pid })
+	if shell.CanAdopt(pid) {
+		t.Errorf("Expected the adopted process to have been stopped")
+	}
+	if st.History[0].ExitCode != -1 {
+		t.Errorf("Expected an unknown exit code for the adopted process, got %#v", st.History)
+	}
+}
+
+func TestAdoptStale(t *testing.T) {
+	lt := termlog.NewLogTest()
+	lt.Log.Enable("debug")
+	dw := stateWorld(t, lt)
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	d := dp.daemons[0]
+
+	exited := startGroup(t)
+	shell.TerminateProcess(exited, nil)
+	changed := startGroup(t)
+	dw.adopt(&State{Daemons: []SavedDaemon{
+		{Name: d.conf.Name(), Pid: exited, ConfigHash: d.configHash()},
+		{Name: d.conf.Name(), Pid: changed, ConfigHash: "0123456789abcdef"},
+	}}, lt.Log)
+	if shell.CanAdopt(changed) {
+		t.Errorf("Expected a process with a different config to be stopped")
+	}
+	dp.Restart()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid != 0 })
+	if st.Pid == exited || st.Pid == changed {
+		t.Errorf("Expected a new process, got pid %d", st.Pid)
+	}
+	out := lt.String()
+	for _, s := range []string{"has exited, starting afresh", "with a different config"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected log to contain %q, got:\n%s", s, out)
+		}
+	}
+
+	// A process whose start time doesn't match has reused the PID
+	pid := startGroup(t)
+	defer shell.TerminateProcess(pid, nil)
+	sd := SavedDaemon{Pid: pid, Started: time.Now().Add(-time.Hour)}
+	if _, err := processStarted(pid); err == nil && sd.running() {
+		t.Errorf("Expected a process with a different start time not to be taken as running")
+	}
+	sd.Started = time.Now()
+	if !sd.running() {
+		t.Errorf("Expected a process with a matching start time to be taken as running")
+	}
+}
+
+func TestAdoptOutput(t *testing.T) {
+	lt := termlog.NewLogTest()
+	dw := stateWorld(t, lt)
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	d := dp.daemons[0]
+
+	// A process handed off by an earlier modd, which passed on the read ends
+	// of its output pipes
+	in, inw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inw.Close()
+	cmd := exec.Command("bash", "-c", `while read l; do echo ":out: $l"; echo ":err: $l" >&2; done`)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin = in
+	var fds []int
+	var writers []*os.File
+	for i := 0; i < 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(r.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		fds, writers = append(fds, fd), append(writers, w)
+	}
+	cmd.Stdout, cmd.Stderr = writers[0], writers[1]
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+	writers[0].Close()
+	writers[1].Close()
+
+	dw.adopt(&State{Daemons: []SavedDaemon{{
+		Name: d.conf.Name(), Pid: cmd.Process.Pid, Started: time.Now(), ConfigHash: d.configHash(),
+		Stdout: fds[0], Stderr: fds[1],
+	}}}, lt.Log)
+	dp.Restart()
+	waitStatus(t, dp, func(st DaemonStatus) bool { return st.Pid == cmd.Process.Pid })
+	// The daemon writes after it's been handed off, and its output is logged
+	// as usual
+	inw.Write([]byte("after\n"))
+	waitFor(t, lt, ":out: after")
+	waitFor(t, lt, ":err: after")
+	if lines, _ := dp.Tail(d.conf.Name(), 0); len(lines) != 2 {
+		t.Errorf("Expected the adopted daemon's output to be kept, got %#v", lines)
+	}
+}
@@ -0,0 +1,124 @@
+package modd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cortesi/termlog"
+)
+
+// spinnerFrames are drawn in turn at the start of the status line
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+const spinnerInterval = 100 * time.Millisecond
+
+// clearLine returns the cursor to the start of the line, and erases it
+const clearLine = "\r\x1b[K"
+
+// StatusLine shows a transient status line, with a spinner, below the log
+// output on a terminal. The log should be written through the StatusLine, so
+// that the status line can be cleared before each write and then redrawn.
+type StatusLine struct {
+	// TTY is set if out is a terminal. If it isn't, there's no status line,
+	// and a plain log line is written instead.
+	TTY bool
+
+	out   io.Writer
+	text  string
+	frame int
+	stop  chan struct{}
+	sync.Mutex
+}
+
+// NewStatusLine creates a StatusLine that writes to out
+func NewStatusLine(out io.Writer, tty bool) *StatusLine {
+	return &StatusLine{TTY: tty, out: out}
+}
+
+// Write writes p to the underlying writer, keeping the status line, if any,
+// below it. Writes are expected to be whole lines.
+func (s *StatusLine) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.text == "" {
+		return s.out.Write(p)
+	}
+	io.WriteString(s.out, clearLine)
+	n, err := s.out.Write(p)
+	s.draw()
+	return n, err
+}
+
+// draw writes the status line. The lock must be held.
+func (s *StatusLine) draw() {
+	fmt.Fprintf(s.out, "%s%s %s", clearLine, spinnerFrames[s.frame], s.text)
+}
+
+// Start shows text on the status line until Stop is called
+func (s *StatusLine) Start(text string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+	}
+	s.text = text
+	s.frame = 0
+	s.stop = make(chan struct{})
+	s.draw()
+	go s.spin(s.stop)
+}
+
+func (s *StatusLine) spin(stop chan struct{}) {
+	t := time.NewTicker(spinnerInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Lock()
+			select {
+			case <-stop:
+			default:
+				s.frame = (s.frame + 1) % len(spinnerFrames)
+				s.draw()
+			}
+			s.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop removes the status line, and writes result in its place
+func (s *StatusLine) Stop(result string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.stop = nil
+	s.text = ""
+	fmt.Fprintf(s.out, "%s%s\n", clearLine, result)
+}
+
+// building shows that the named block's preps are running, and returns a
+// function to be called with the outcome once they're done
+func (mr *ModRunner) building(name string, log termlog.TermLog) func(passed bool) {
+	if mr.Status == nil {
+		return func(bool) {}
+	}
+	if !mr.Status.TTY {
+		log.Notice(">> building %s", name)
+		return func(bool) {}
+	}
+	mr.Status.Start(fmt.Sprintf("building %s...", name))
+	return func(passed bool) {
+		if passed {
+			mr.Status.Stop(recoveredBanner(">> %s: built", name))
+		} else {
+			mr.Status.Stop(failingBanner(">> %s: failed", name))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package modd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func TestStatusLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewStatusLine(buf, true)
+	s.Start("building")
+	fmt.Fprintf(s, "output\n")
+	s.Stop("done")
+	fmt.Fprintf(s, "after\n")
+
+	out := buf.String()
+	expected := []string{
+		clearLine + "| building",
+		clearLine + "output\n" + clearLine,
+		clearLine + "done\nafter\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in output:\n%q", e, out)
+		}
+	}
+	if strings.HasSuffix(out, "building") {
+		t.Errorf("Status line should be removed on stop:\n%q", out)
+	}
+}
+
+func TestBuildingNoTTY(t *testing.T) {
+	cnf, err := conf.Parse("test", "@shell = bash\n{\nlabel: build\nprep: true\n}\n{\ndaemon: true\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	buf := &bytes.Buffer{}
+	mr := ModRunner{Log: lt.Log, Config: cnf, Status: NewStatusLine(buf, false)}
+	if err := mr.Trigger(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(lt.String(), ">> building"); n != 1 {
+		t.Errorf("Expected one building line for the block with preps, got %d:\n%s", n, lt.String())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no status line without a terminal, got %q", buf.String())
+	}
+}
@@ -0,0 +1,152 @@
+package modd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cortesi/termlog"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// The narrowest the command column of a status table is truncated to
+const minCommandWidth = 12
+
+var statusTableHeader = []string{"DAEMON", "STATE", "PID", "UPTIME", "RESTARTS", "LAST EXIT"}
+
+var (
+	stateRunning = color.New(color.FgGreen).SprintFunc()
+	stateWaiting = color.New(color.FgYellow).SprintFunc()
+	stateStopped = color.New(color.FgRed).SprintFunc()
+	tableHeader  = color.New(color.Bold).SprintFunc()
+)
+
+// terminalWidth returns the width of the terminal on stdout, or lineLimit if
+// stdout isn't a terminal
+func terminalWidth() int {
+	w, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 {
+		return lineLimit
+	}
+	return w
+}
+
+// stateName describes the state of a daemon in a word
+func stateName(st DaemonStatus) string {
+	switch {
+	case st.Disabled:
+		return "disabled"
+	case st.Failed:
+		return "failed"
+	case st.Unhealthy:
+		return "unhealthy"
+	case st.Running && st.Ready:
+		return "ready"
+	case st.Running:
+		return "running"
+	case st.Waiting:
+		return "waiting"
+	}
+	return "stopped"
+}
+
+// daemonState is stateName, coloured to show whether the daemon is up
+func daemonState(st DaemonStatus) string {
+	s := stateName(st)
+	switch s {
+	case "disabled", "waiting":
+		return stateWaiting(s)
+	case "ready", "running":
+		return stateRunning(s)
+	}
+	return stateStopped(s)
+}
+
+// statusRow returns the cells of the status table row for a daemon at time
+// now
+func statusRow(st DaemonStatus, now time.Time) []string {
+	pid, uptime, last := "-", "-", "-"
+	if st.Running {
+		uptime = now.Sub(st.Started).Round(time.Second).String()
+		if st.Pid != 0 {
+			pid = strconv.Itoa(st.Pid)
+		}
+	}
+	if n := len(st.History); n > 0 {
+		rec := st.History[n-1]
+		last = fmt.Sprintf("%d (%s)", rec.ExitCode, rec.Reason)
+	}
+	return []string{
+		shortCommand(st.Command),
+		daemonState(st),
+		pid,
+		uptime,
+		strconv.Itoa(st.Restarts),
+		last,
+	}
+}
+
+// renderTable aligns rows of cells into lines no wider than width, where
+// possible. All rows have the same number of cells, which may contain colour
+// escapes. The first column is truncated to make the rows fit, but not below
+// minCommandWidth.
+func renderTable(rows [][]string, width int) []string {
+	if len(rows) == 0 {
+		return nil
+	}
+	widths := make([]int, len(rows[0]))
+	for _, r := range rows {
+		for i, c := range r {
+			if w := displayWidth(c); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	rest := 0
+	for _, w := range widths[1:] {
+		rest += w + 2
+	}
+	if width-rest < widths[0] {
+		widths[0] = width - rest
+		if widths[0] < minCommandWidth {
+			widths[0] = minCommandWidth
+		}
+	}
+	var ret []string
+	for _, r := range rows {
+		cells := make([]string, len(r))
+		for i, c := range r {
+			if i == 0 {
+				c = truncate(c, widths[0])
+			}
+			cells[i] = c
+			if i < len(r)-1 {
+				cells[i] += strings.Repeat(" ", widths[i]-displayWidth(c))
+			}
+		}
+		ret = append(ret, strings.Join(cells, "  "))
+	}
+	return ret
+}
+
+// StatusTable logs the status of the daemons in the pen as an aligned table,
+// with a row for each daemon giving its state, PID, the uptime of the current
+// run, the number of restarts, and the exit code and reason for the last run
+// to end. Daemon commands are truncated so that rows fit in width columns.
+func (dp *DaemonPen) StatusTable(log termlog.Logger, width int) {
+	header := make([]string, len(statusTableHeader))
+	for i, c := range statusTableHeader {
+		header[i] = tableHeader(c)
+	}
+	rows := [][]string{header}
+	now := time.Now()
+	for _, st := range dp.Status() {
+		rows = append(rows, statusRow(st, now))
+	}
+	for _, l := range renderTable(rows, width) {
+		log.Say("%s", l)
+	}
+}
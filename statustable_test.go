@@ -0,0 +1,89 @@
+package modd
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func TestRenderTable(t *testing.T) {
+	rows := [][]string{
+		{"DAEMON", "STATE", "PID"},
+		{"./server --port 8080", "\x1b[32mready\x1b[0m", "123"},
+		{"./worker", "stopped", "-"},
+	}
+	expected := []string{
+		"DAEMON                STATE    PID",
+		"./server --port 8080  \x1b[32mready\x1b[0m    123",
+		"./worker              stopped  -",
+	}
+	if ret := renderTable(rows, 80); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, ret)
+	}
+
+	expected = []string{
+		"DAEMON         STATE    PID",
+		"./server -...  \x1b[32mready\x1b[0m    123",
+		"./worker       stopped  -",
+	}
+	if ret := renderTable(rows, 27); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, ret)
+	}
+	// Commands aren't truncated beyond the minimum
+	for _, l := range renderTable(rows, 10)[1:2] {
+		if !strings.HasPrefix(l, "./server ...") {
+			t.Errorf("Expected truncation to the minimum width, got %q", l)
+		}
+	}
+}
+
+func TestStatusRow(t *testing.T) {
+	now := time.Now()
+	st := DaemonStatus{
+		Command:  "./server\n--port 8080",
+		Running:  true,
+		Ready:    true,
+		Started:  now.Add(-90 * time.Second),
+		Pid:      4321,
+		Restarts: 2,
+		History:  []RunRecord{{ExitCode: 1, Reason: "exited"}, {ExitCode: -1, Reason: "restart"}},
+	}
+	expected := []string{"./server", daemonState(st), "4321", "1m30s", "2", "-1 (restart)"}
+	if ret := statusRow(st, now); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, ret)
+	}
+	ret := statusRow(DaemonStatus{Command: "./worker"}, now)
+	if ret[2] != "-" || ret[3] != "-" || ret[5] != "-" {
+		t.Errorf("Expected placeholders for a stopped daemon, got %#v", ret)
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	lt := termlog.NewLogTest()
+	b := conf.Block{
+		Daemons: []conf.Daemon{{Command: "sleep 100", RestartSignal: syscall.SIGTERM}},
+	}
+	dp, err := NewDaemonPen(b, map[string]string{shellVarName: "bash"}, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Shutdown(nil)
+	dp.Restart()
+	st := waitStatus(t, dp, func(st DaemonStatus) bool { return st.Running && st.Pid != 0 })
+	dp.StatusTable(lt.Log, 80)
+	out := lt.String()
+	for _, s := range []string{"DAEMON", "LAST EXIT", "sleep 100", "running"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected table to contain %q, got:\n%s", s, out)
+		}
+	}
+	if !strings.Contains(out, " "+strconv.Itoa(st.Pid)+" ") {
+		t.Errorf("Expected table to contain the PID, got:\n%s", out)
+	}
+}
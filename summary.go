@@ -0,0 +1,122 @@
+package modd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Summary is the content of the summary file, written after each cycle
+type Summary struct {
+	// Cycle is the number of the cycle, which increases with each cycle run
+	Cycle    int             `json:"cycle"`
+	Start    time.Time       `json:"start"`
+	Duration float64         `json:"duration"`
+	Blocks   []BlockSummary  `json:"blocks"`
+	Daemons  []DaemonSummary `json:"daemons"`
+	// Errors holds the errors that stopped blocks, prefixed with the block
+	// name
+	Errors []string `json:"errors"`
+}
+
+// BlockSummary describes a block run during a cycle
+type BlockSummary struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label,omitempty"`
+	Passed   bool     `json:"passed"`
+	Error    string   `json:"error,omitempty"`
+	NonFatal []string `json:"nonfatal,omitempty"`
+}
+
+// DaemonSummary describes the state of a daemon at the end of a cycle
+type DaemonSummary struct {
+	Block    string `json:"block,omitempty"`
+	Command  string `json:"command"`
+	State    string `json:"state"`
+	Pid      int    `json:"pid,omitempty"`
+	Restarts int    `json:"restarts"`
+}
+
+// newSummary summarises cycle number n, with the states of the daemons of
+// dworld. Blocks holds the label of each block in the config.
+func newSummary(n int, result *CycleResult, blocks []string, dworld *DaemonWorld) *Summary {
+	s := &Summary{
+		Cycle:    n,
+		Start:    result.Start,
+		Duration: result.Duration.Seconds(),
+		Blocks:   []BlockSummary{},
+		Daemons:  []DaemonSummary{},
+		Errors:   []string{},
+	}
+	for _, b := range result.Blocks {
+		bs := BlockSummary{Name: b.Name, Label: b.Label, Passed: b.Err == nil}
+		if b.Err != nil {
+			bs.Error = b.Err.Error()
+			s.Errors = append(s.Errors, b.Name+": "+bs.Error)
+		}
+		for _, e := range b.NonFatal {
+			bs.NonFatal = append(bs.NonFatal, e.Error())
+		}
+		s.Blocks = append(s.Blocks, bs)
+	}
+	if dworld != nil {
+		for i, dp := range dworld.DaemonPens {
+			// Pens are missing when a cycle is triggered while modd isn't
+			// running
+			if dp == nil {
+				continue
+			}
+			for _, st := range dp.Status() {
+				s.Daemons = append(s.Daemons, DaemonSummary{
+					Block:    blocks[i],
+					Command:  st.Command,
+					State:    stateName(st),
+					Pid:      st.Pid,
+					Restarts: st.Restarts,
+				})
+			}
+		}
+	}
+	return s
+}
+
+// writeAtomic writes data to a temporary file beside path, and renames it
+// into place, so that readers never see a partial file
+func writeAtomic(path string, data []byte) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(fp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// writeSummary writes the summary of the cycle just completed to the summary
+// file. The lock must be held.
+func (mr *ModRunner) writeSummary(result *CycleResult, dworld *DaemonWorld) {
+	blocks := make([]string, len(mr.Config.Blocks))
+	for i, b := range mr.Config.Blocks {
+		blocks[i] = b.Label
+	}
+	data, err := json.MarshalIndent(newSummary(mr.cycles, result, blocks, dworld), "", "  ")
+	if err == nil {
+		err = writeAtomic(mr.SummaryFile, append(data, '\n'))
+	}
+	if err != nil {
+		mr.Log.Warn(">> could not write summary file: %s", err)
+	}
+}
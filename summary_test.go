@@ -0,0 +1,97 @@
+package modd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+func readSummary(t *testing.T, path string) *Summary {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Summary{}
+	if err := json.Unmarshal(data, s); err != nil {
+		t.Fatalf("Summary is not valid JSON: %s\n%s", err, data)
+	}
+	return s
+}
+
+func TestSummaryFile(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		{
+			label: good
+			prep: true
+		}
+		{
+			label: bad
+			prep: exit 3
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, SummaryFile: "summary.json"}
+	for i := 1; i <= 2; i++ {
+		mr.Trigger(nil)
+		s := readSummary(t, "summary.json")
+		if s.Cycle != i {
+			t.Errorf("Expected cycle %d, got %d", i, s.Cycle)
+		}
+		if len(s.Blocks) != 2 || !s.Blocks[0].Passed || s.Blocks[1].Passed {
+			t.Errorf("Unexpected block results: %#v", s.Blocks)
+		}
+		if len(s.Errors) != 1 || s.Errors[0] != "bad: "+s.Blocks[1].Error {
+			t.Errorf("Unexpected errors: %#v", s.Errors)
+		}
+	}
+	files, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected temporary files to be cleaned up, got %d files", len(files))
+	}
+}
+
+func TestSummaryDaemons(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	confTxt := `
+		@shell = bash
+		{
+			label: server
+			daemon +sigterm: sleep 100
+		}
+	`
+	cnf, err := conf.Parse("test", confTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, SummaryFile: "summary.json"}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	if err := mr.runOnChan(modchan, func() { modchan <- nil }); err != nil {
+		t.Fatalf("runOnChan: %s", err)
+	}
+	s := readSummary(t, "summary.json")
+	if len(s.Daemons) != 1 {
+		t.Fatalf("Expected one daemon, got %#v", s.Daemons)
+	}
+	d := s.Daemons[0]
+	d.State, d.Pid = "", 0
+	expected := DaemonSummary{Block: "server", Command: "sleep 100"}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("Expected\n%#v\ngot\n%#v", expected, d)
+	}
+}
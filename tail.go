@@ -0,0 +1,18 @@
+package modd
+
+// TailLines is the number of recent lines of output kept for each daemon, to
+// be shown on demand with DaemonPen.Tail. Fewer are kept if
+// shell.MaxCaptureLines or shell.MaxCaptureBytes is lower.
+var TailLines = 500
+
+// Tail returns the last n lines of output, from either stream, of the daemon
+// in the pen named id, as for conf.Daemon.Name. At most TailLines lines are
+// kept, and all of them are returned if n is larger or isn't positive. Output
+// is kept across restarts, and for daemons whose output isn't logged.
+func (dp *DaemonPen) Tail(id string, n int) ([]string, error) {
+	daemons, err := dp.named(id)
+	if err != nil {
+		return nil, err
+	}
+	return daemons[0].recent.Last(n), nil
+}
@@ -0,0 +1,77 @@
+package modd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+func TestDaemonTail(t *testing.T) {
+	defer func(n int) { TailLines = n }(TailLines)
+	TailLines = 3
+	cnf, err := conf.Parse("test", `
+		@shell = bash
+		{
+			daemon +quiet: for i in 1 2 3 4; do echo out$i; echo err$i >&2; done; sleep 100
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	dw, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dw.Shutdown(nil)
+	dp := dw.DaemonPens[0]
+	dp.Restart()
+	id := cnf.Blocks[0].Daemons[0].Name()
+	var lines []string
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Millisecond) {
+		lines, err = dp.Tail(id, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) == 3 && strings.HasSuffix(lines[2], "4") {
+			break
+		}
+	}
+	if len(lines) != 3 || !strings.HasSuffix(lines[2], "4") {
+		t.Fatalf("Expected the last three lines of output, got %#v", lines)
+	}
+	if ret, _ := dp.Tail(id, 1); !reflect.DeepEqual(ret, lines[2:]) {
+		t.Errorf("Expected the last line, got %#v", ret)
+	}
+	if _, err := dp.Tail("nonexistent", 1); err == nil {
+		t.Errorf("Expected an error for an unknown daemon")
+	}
+
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	mr.setDaemonWorld(dw)
+	mr.tailDaemons("", 1)
+	if !strings.Contains(lt.String(), lines[2]) {
+		t.Errorf("Expected the tail to be logged, got:\n%s", lt.String())
+	}
+
+	// The tail command shows the lines asked for, of one daemon
+	lt = termlog.NewLogTest()
+	mr.Log = lt.Log
+	keys := ":tail " + id + " 2\n:tail nonexistent\n:tail\n:tail " + id + " 0\n"
+	if err := mr.Interactive(strings.NewReader(keys), func() {}); err != nil {
+		t.Fatal(err)
+	}
+	out := lt.String()
+	if strings.Contains(out, lines[0]) || !strings.Contains(out, lines[1]) || !strings.Contains(out, lines[2]) {
+		t.Errorf("Expected the last two lines, got:\n%s", out)
+	}
+	for _, s := range []string{">> no daemon named nonexistent", "usage: tail NAME [LINES]"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in output:\n%s", s, out)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package modd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cortesi/termlog"
+)
+
+// How many finished spans are held for export before the oldest are dropped,
+// and the most sent in a single request
+const (
+	traceQueue = 2048
+	traceBatch = 512
+)
+
+// traceInterval is how often finished spans are exported
+var traceInterval = 5 * time.Second
+
+// statusError is the OTLP status code of a failed span
+const statusError = 2
+
+// Tracer records OpenTelemetry spans for cycles, blocks, preps and daemon
+// runs, and exports them to an OTLP collector over HTTP, as JSON. A nil
+// Tracer records nothing, so tracing costs nothing when it's off.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource map[string]string
+	log      termlog.TermLog
+	client   *http.Client
+
+	// The cycle in progress, which daemon runs started during it are
+	// recorded under
+	cycle   *Span
+	spans   []*Span
+	dropped int
+	failing bool
+	done    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+// NewTracerFromEnv returns a Tracer configured by the standard OpenTelemetry
+// environment variables, or nil if tracing is off. Tracing is on when
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT is set,
+// unless OTEL_SDK_DISABLED is true or OTEL_TRACES_EXPORTER is something other
+// than otlp. Only the http/json protocol is supported: http/protobuf, the
+// usual default, falls back to it with a warning.
+func NewTracerFromEnv(log termlog.TermLog) (*Tracer, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	if e := os.Getenv("OTEL_TRACES_EXPORTER"); e != "" && e != "otlp" {
+		return nil, nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %s", err)
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol == "http/protobuf" {
+		log.Warn(">> OTLP protocol http/protobuf isn't supported, exporting traces as http/json")
+	} else if protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, only http/json is supported", protocol)
+	}
+	headers, err := parseOtelPairs(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %s", err)
+	}
+	resource, err := parseOtelPairs(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %s", err)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["service.name"] = name
+	} else if resource["service.name"] == "" {
+		resource["service.name"] = "modd"
+	}
+	return newTracer(endpoint, headers, resource, log), nil
+}
+
+func newTracer(endpoint string, headers, resource map[string]string, log termlog.TermLog) *Tracer {
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		resource: resource,
+		log:      log,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// parseOtelPairs parses a list of the form key1=value1,key2=value2, with
+// URL-encoded values
+func parseOtelPairs(s string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", p)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		ret[strings.TrimSpace(parts[0])] = v
+	}
+	return ret, nil
+}
+
+// Close exports any spans that are left, and stops the exporter
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	select {
+	case <-t.done:
+		t.Unlock()
+		return
+	default:
+	}
+	close(t.done)
+	t.Unlock()
+	<-t.stopped
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	tick := time.NewTicker(traceInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.flush(false)
+		case <-t.done:
+			t.flush(true)
+			return
+		}
+	}
+}
+
+// flush exports the finished spans. Spans that fail to export are put back to
+// be tried again at the next flush, unless this is the last one, when they're
+// reported as lost.
+func (t *Tracer) flush(last bool) {
+	for {
+		t.Lock()
+		spans := t.spans
+		if len(spans) > traceBatch {
+			spans = spans[:traceBatch]
+		}
+		t.spans = t.spans[len(spans):]
+		dropped := t.dropped
+		t.dropped = 0
+		t.Unlock()
+		if dropped > 0 {
+			t.log.Warn(">> %d trace spans dropped, the exporter can't keep up", dropped)
+		}
+		if len(spans) == 0 {
+			return
+		}
+		err := t.export(spans)
+		t.Lock()
+		failing := t.failing
+		t.failing = err != nil
+		if err != nil && !last {
+			t.requeue(spans)
+		}
+		t.Unlock()
+		if err != nil {
+			if !failing {
+				t.log.Warn(">> could not export traces: %s", err)
+			}
+			if last {
+				t.Lock()
+				lost := len(spans) + len(t.spans)
+				t.spans = nil
+				t.Unlock()
+				t.log.Warn(">> %d trace spans could not be exported", lost)
+			}
+			return
+		} else if failing {
+			t.log.Notice(">> exporting traces again")
+		}
+	}
+}
+
+// requeue puts spans that failed to export back ahead of the spans finished
+// since, dropping the oldest if the queue overflows. The lock must be held.
+func (t *Tracer) requeue(spans []*Span) {
+	spans = append(spans[:len(spans):len(spans)], t.spans...)
+	if over := len(spans) - traceQueue; over > 0 {
+		spans = spans[over:]
+		t.dropped += over
+	}
+	t.spans = spans
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(t.resource, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// start begins a span. If parent is nil, the span starts a new trace.
+func (t *Tracer) start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		spanID: randomID(8),
+		attrs:  map[string]interface{}{},
+	}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return s
+}
+
+// startCycle begins the span of a cycle, which daemon runs started before
+// it ends are recorded under
+func (t *Tracer) startCycle() *Span {
+	if t == nil {
+		return nil
+	}
+	s := t.start("cycle", nil)
+	t.Lock()
+	t.cycle = s
+	t.Unlock()
+	return s
+}
+
+// startDaemon begins the span of a daemon run, under the cycle in progress
+// if there is one
+func (t *Tracer) startDaemon() *Span {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	parent := t.cycle
+	t.Unlock()
+	return t.start("daemon", parent)
+}
+
+func (t *Tracer) finish(s *Span) {
+	t.Lock()
+	defer t.Unlock()
+	if t.cycle == s {
+		t.cycle = nil
+	}
+	if len(t.spans) >= traceQueue {
+		t.spans = t.spans[1:]
+		t.dropped++
+	}
+	t.spans = append(t.spans, s)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Span is a timed piece of work recorded by a Tracer. The methods of a nil
+// Span do nothing.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	status   int
+	message  string
+}
+
+// child begins a span under s
+func (s *Span) child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(name, s)
+}
+
+// set records an attribute, which is a string, int or bool
+func (s *Span) set(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = val
+}
+
+// fail marks the span as failed with err
+func (s *Span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.status = statusError
+	s.message = err.Error()
+}
+
+// finish ends the span, and queues it for export
+func (s *Span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.finish(s)
+}
+
+// The OTLP JSON encoding of a trace export request
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := []otlpAttr{}
+	for _, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		ret = append(ret, otlpAttr{Key: k, Value: v})
+	}
+	return ret
+}
+
+func otlpRequest(resource map[string]string, spans []*Span) interface{} {
+	res := map[string]interface{}{}
+	for k, v := range resource {
+		res[k] = v
+	}
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:      s.traceID,
+			SpanID:       s.spanID,
+			ParentSpanID: s.parentID,
+			Name:         s.name,
+			Kind:         1,
+			Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:   otlpAttrs(s.attrs),
+			Status:       otlpStatus{Code: s.status, Message: s.message},
+		}
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttrs(res)},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "modd", "version": Version},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
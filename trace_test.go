@@ -0,0 +1,251 @@
+package modd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/termlog"
+)
+
+var tracerEnvTests = []struct {
+	env      map[string]string
+	endpoint string
+	err      bool
+}{
+	{map[string]string{}, "", false},
+	{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318/"}, "http://c:4318/v1/traces", false},
+	{
+		map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://c:4318",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://t:4318/traces",
+		},
+		"http://t:4318/traces", false,
+	},
+	{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318", "OTEL_SDK_DISABLED": "true"}, "", false},
+	{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318", "OTEL_TRACES_EXPORTER": "none"}, "", false},
+	{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, "", true},
+	{
+		map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf"},
+		"http://c:4318/v1/traces", false,
+	},
+	{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://c:4318", "OTEL_EXPORTER_OTLP_HEADERS": "nope"}, "", true},
+}
+
+var tracerEnvVars = []string{
+	"OTEL_SDK_DISABLED",
+	"OTEL_TRACES_EXPORTER",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_PROTOCOL",
+	"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL",
+	"OTEL_EXPORTER_OTLP_HEADERS",
+	"OTEL_RESOURCE_ATTRIBUTES",
+	"OTEL_SERVICE_NAME",
+}
+
+func TestNewTracerFromEnv(t *testing.T) {
+	saved := map[string]string{}
+	for _, k := range tracerEnvVars {
+		saved[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	}()
+	lt := termlog.NewLogTest()
+	for i, tt := range tracerEnvTests {
+		for _, k := range tracerEnvVars {
+			os.Setenv(k, tt.env[k])
+		}
+		tr, err := NewTracerFromEnv(lt.Log)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: unexpected error state: %v", i, err)
+			continue
+		}
+		if tt.endpoint == "" {
+			if tr != nil {
+				t.Errorf("%d: expected tracing to be off", i)
+				tr.Close()
+			}
+			continue
+		}
+		if tr == nil || tr.endpoint != tt.endpoint {
+			t.Errorf("%d: expected endpoint %q, got %#v", i, tt.endpoint, tr)
+		} else if tr.resource["service.name"] != "modd" {
+			t.Errorf("%d: expected the default service name, got %q", i, tr.resource["service.name"])
+		}
+		tr.Close()
+	}
+}
+
+// collector is an OTLP endpoint that keeps the spans it receives
+type collector struct {
+	spans   []map[string]interface{}
+	headers http.Header
+	sync.Mutex
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.headers = r.Header
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+// spanAttr returns the value of a span attribute, as its JSON encoding
+func spanAttr(span map[string]interface{}, key string) interface{} {
+	attrs, _ := span["attributes"].([]interface{})
+	for _, a := range attrs {
+		a := a.(map[string]interface{})
+		if a["key"] == key {
+			for _, v := range a["value"].(map[string]interface{}) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestTraceExport(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	lt := termlog.NewLogTest()
+	tr := newTracer(srv.URL, map[string]string{"X-Token": "secret"}, map[string]string{"service.name": "modd"}, lt.Log)
+	cycle := tr.startCycle()
+	block := cycle.child("block")
+	b := conf.Block{
+		Preps: []conf.Prep{
+			{Command: "echo one"},
+			{Command: "exit 3"},
+		},
+	}
+	vars := map[string]string{shellVarName: "bash"}
+	err := runPreps(b, vars, nil, nil, lt.Log, nil, true, &envCache{}, nil, nil, nil, block)
+	if _, ok := err.(ProcError); !ok {
+		t.Fatalf("Expected ProcError, got %#v", err)
+	}
+	block.fail(err)
+	block.finish()
+	cycle.finish()
+	tr.Close()
+
+	c.Lock()
+	defer c.Unlock()
+	if c.headers.Get("X-Token") != "secret" {
+		t.Errorf("Expected the configured headers to be sent")
+	}
+	if len(c.spans) != 4 {
+		t.Fatalf("Expected 4 spans, got %#v", c.spans)
+	}
+	byName := map[string][]map[string]interface{}{}
+	for _, s := range c.spans {
+		name := s["name"].(string)
+		byName[name] = append(byName[name], s)
+	}
+	top := byName["cycle"][0]
+	if top["parentSpanId"] != nil {
+		t.Errorf("Expected the cycle to be the root span, got %#v", top)
+	}
+	blk := byName["block"][0]
+	if blk["parentSpanId"] != top["spanId"] || blk["traceId"] != top["traceId"] {
+		t.Errorf("Expected the block to be a child of the cycle, got %#v", blk)
+	}
+	preps := byName["prep"]
+	if len(preps) != 2 {
+		t.Fatalf("Expected two prep spans, got %#v", preps)
+	}
+	for _, p := range preps {
+		if p["parentSpanId"] != blk["spanId"] {
+			t.Errorf("Expected the prep to be a child of the block, got %#v", p)
+		}
+	}
+	if spanAttr(preps[0], "process.exit_code") != "0" || spanAttr(preps[1], "process.exit_code") != "3" {
+		t.Errorf("Expected the exit codes to be recorded, got %#v", preps)
+	}
+	status, _ := preps[1]["status"].(map[string]interface{})
+	if status["code"] != float64(statusError) {
+		t.Errorf("Expected the failed prep to have an error status, got %#v", preps[1])
+	}
+}
+
+func TestTraceExportFailure(t *testing.T) {
+	c := &collector{}
+	var fail int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		c.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// Spans that fail to export are kept, and sent once the collector is back
+	lt := termlog.NewLogTest()
+	tr := newTracer(srv.URL, nil, map[string]string{"service.name": "modd"}, lt.Log)
+	tr.startCycle().finish()
+	tr.flush(false)
+	if !strings.Contains(lt.String(), "could not export traces") {
+		t.Errorf("Expected the failure to be logged, got:\n%s", lt.String())
+	}
+	tr.Lock()
+	queued := len(tr.spans)
+	tr.Unlock()
+	if queued != 1 {
+		t.Errorf("Expected the span to be kept for export, got %d", queued)
+	}
+	atomic.StoreInt32(&fail, 0)
+	tr.Close()
+	c.Lock()
+	if len(c.spans) != 1 {
+		t.Errorf("Expected the span to be exported, got %#v", c.spans)
+	}
+	c.Unlock()
+
+	// Spans that can't be sent before the tracer closes are reported
+	atomic.StoreInt32(&fail, 1)
+	lt = termlog.NewLogTest()
+	tr = newTracer(srv.URL, nil, map[string]string{"service.name": "modd"}, lt.Log)
+	tr.startCycle().finish()
+	tr.startCycle().finish()
+	tr.Close()
+	if !strings.Contains(lt.String(), "2 trace spans could not be exported") {
+		t.Errorf("Expected the lost spans to be reported, got:\n%s", lt.String())
+	}
+}
+
+func TestTracerDisabled(t *testing.T) {
+	var tr *Tracer
+	span := tr.startCycle()
+	span.child("block").set("modd.block", "b")
+	span.finish()
+	tr.Close()
+	if span != nil {
+		t.Errorf("Expected a nil tracer to record nothing")
+	}
+}
@@ -25,6 +25,20 @@ func getDirs(paths []string) []string {
 	return keys
 }
 
+// unique returns paths without repeats, which a listing has when the bases of
+// its patterns overlap
+func unique(paths []string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
 // quotePath quotes a path for use on the command-line. The path must be in
 // slash-delimited format, and the quoted path will use the native OS separator.
 // FIXME: This is actually dependent on the shell used.
@@ -74,10 +88,13 @@ func (v *VarCmd) get(name string) (string, error) {
 		var modified []string
 		if v.Modified == nil {
 			var err error
-			modified, err = moddwatch.List(".", v.Block.Include, v.Block.Exclude)
+			modified, err = moddwatch.List(".", v.Block.Include, nil)
 			if err != nil {
 				return "", err
 			}
+			if modified, err = v.Block.Filter(unique(modified)); err != nil {
+				return "", err
+			}
 		} else {
 			modified = v.Modified
 		}
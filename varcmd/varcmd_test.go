@@ -95,6 +95,29 @@ func TestVarCmd(t *testing.T) {
 	if ret != expected {
 		t.Errorf("Expected: %#v, got %#v", expected, ret)
 	}
+
+	// Files that an include after an exclude brings back are listed too
+	for _, f := range []string{"tdir/testdata/input", "tdir/testdata/golden/a"} {
+		if err := os.MkdirAll(path.Dir(f), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, []byte("test"), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cnf, err := conf.Parse("test", "tdir/** !**/testdata/** **/testdata/golden/* {}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc = VarCmd{&cnf.Blocks[0], nil, map[string]string{}}
+	ret, err = vc.Render("@mods")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = `"./tdir/testdata/golden/a" "./tdir/tfile"`
+	if ret != expected {
+		t.Errorf("Expected: %#v, got %#v", expected, ret)
+	}
 }
 
 func TestRenderErrors(t *testing.T) {
@@ -0,0 +1,98 @@
+package modd
+
+import (
+	"sync/atomic"
+
+	"github.com/cortesi/moddwatch"
+)
+
+// WatchStats counts the file changes modd has received from its watcher, and
+// what became of them, to help find patterns that watch more than intended.
+// A change is a file in a batch from the watcher, so a file that changes
+// twice counts twice.
+type WatchStats struct {
+	// Events is the number of changes received from the watcher
+	Events int64
+	// Filtered is the number of changes dropped without running anything:
+	// those that left a file's content as it was, with ContentHash, those
+	// made while paused, with DropPaused, and those that repeated the last
+	// cycle, with SkipDuplicateCycles
+	Filtered int64
+	// Debounced is the number of changes folded into a batch that was
+	// already waiting to run, by Settle, Cooldown, MinInterval or pausing,
+	// rather than running a cycle of their own
+	Debounced int64
+	// Cycles is the number of cycles run for changes
+	Cycles int64
+}
+
+// watchCounters accumulates WatchStats, and is safe for concurrent use
+type watchCounters struct {
+	events, filtered, debounced, cycles int64
+}
+
+// changeCount returns the number of changes in mod, which may be nil
+func changeCount(mod *moddwatch.Mod) int64 {
+	if mod == nil {
+		return 0
+	}
+	return int64(len(mod.Changed) + len(mod.Added) + len(mod.Deleted))
+}
+
+func (w *watchCounters) received(mod *moddwatch.Mod) {
+	atomic.AddInt64(&w.events, changeCount(mod))
+}
+
+func (w *watchCounters) filter(mod *moddwatch.Mod, kept *moddwatch.Mod) {
+	atomic.AddInt64(&w.filtered, changeCount(mod)-changeCount(kept))
+}
+
+func (w *watchCounters) debounce(mod *moddwatch.Mod) {
+	atomic.AddInt64(&w.debounced, changeCount(mod))
+}
+
+func (w *watchCounters) cycle() {
+	atomic.AddInt64(&w.cycles, 1)
+}
+
+func (w *watchCounters) stats() WatchStats {
+	return WatchStats{
+		Events:    atomic.LoadInt64(&w.events),
+		Filtered:  atomic.LoadInt64(&w.filtered),
+		Debounced: atomic.LoadInt64(&w.debounced),
+		Cycles:    atomic.LoadInt64(&w.cycles),
+	}
+}
+
+// WatchStats returns the counts of file changes received and acted on since
+// the runner was created
+func (mr *ModRunner) WatchStats() WatchStats {
+	return mr.watch.stats()
+}
+
+// countChanges counts the changes received on modchan, and passes them on to
+// the returned channel. It stops when modchan receives nil, which is passed
+// on, or when done is closed.
+func (mr *ModRunner) countChanges(modchan chan *moddwatch.Mod, done chan struct{}) chan *moddwatch.Mod {
+	ret := make(chan *moddwatch.Mod, cap(modchan))
+	go func() {
+		for {
+			var mod *moddwatch.Mod
+			select {
+			case mod = <-modchan:
+			case <-done:
+				return
+			}
+			mr.watch.received(mod)
+			select {
+			case ret <- mod:
+			case <-done:
+				return
+			}
+			if mod == nil {
+				return
+			}
+		}
+	}()
+	return ret
+}
@@ -0,0 +1,164 @@
+package modd
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cortesi/modd/conf"
+	"github.com/cortesi/modd/utils"
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/termlog"
+)
+
+const watchStatsConf = `
+	@shell = bash
+
+	** {
+		prep +onchange: echo ":cycle:" @mods
+	}
+`
+
+func TestWatchStatsDebounced(t *testing.T) {
+	cnf, err := conf.Parse("test", watchStatsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, Cooldown: 300 * time.Millisecond}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		// The first change runs at once, and the burst after it is batched
+		// into one cycle, led by the first change to arrive
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"b"}}
+		modchan <- &moddwatch.Mod{Added: []string{"c"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"d"}, Deleted: []string{"e"}}
+		waitFor(t, lt, ":cycle: ./b ./c ./d")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WatchStats{Events: 5, Debounced: 3, Cycles: 2}
+	if ret := mr.WatchStats(); ret != expected {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+}
+
+func TestWatchStatsFiltered(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	if err := ioutil.WriteFile("a", []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cnf, err := conf.Parse("test", watchStatsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, ContentHash: true, DropPaused: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		// Unchanged content is filtered, and so are changes while paused
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		ioutil.WriteFile("b", []byte("new"), 0644)
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}, Added: []string{"b"}}
+		waitFor(t, lt, ":cycle: ./b")
+		mr.Pause()
+		ioutil.WriteFile("a", []byte("two"), 0644)
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		for start := time.Now(); mr.WatchStats().Filtered < 3; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > timeout {
+				t.Fatalf("Timed out waiting for the changes to be dropped, got %#v", mr.WatchStats())
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WatchStats{Events: 4, Filtered: 3, Cycles: 1}
+	if ret := mr.WatchStats(); ret != expected {
+		t.Errorf("Expected %#v, got %#v", expected, ret)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	mr := ModRunner{}
+	mr.watch.received(&moddwatch.Mod{Changed: []string{"a", "b"}})
+	mr.watch.cycle()
+	rec := httptest.NewRecorder()
+	mr.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, s := range []string{
+		"# TYPE modd_watch_events_total counter\nmodd_watch_events_total 2\n",
+		"modd_watch_filtered_total 0\n",
+		"modd_watch_cycles_total 1\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in metrics, got:\n%s", s, out)
+		}
+	}
+}
+
+func TestSkipDuplicateCycles(t *testing.T) {
+	defer utils.WithTempDir(t)()
+	for _, f := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(f, []byte("one"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cnf, err := conf.Parse("test", watchStatsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, NoWatch: true, SkipDuplicateCycles: true}
+	modchan := make(chan *moddwatch.Mod, 1024)
+	err = mr.runOnChan(modchan, func() {
+		defer func() { modchan <- nil }()
+		// waitFiltered waits for n changes to have been skipped
+		waitFiltered := func(n int64) {
+			for start := time.Now(); mr.WatchStats().Filtered < n; time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > timeout {
+					t.Fatalf("Timed out waiting for a skipped cycle, got %#v", mr.WatchStats())
+				}
+			}
+		}
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, ":cycle: ./a")
+		// The same file with the same content is skipped
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFiltered(1)
+		// New content runs again
+		ioutil.WriteFile("a", []byte("two"), 0644)
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFor(t, lt, ":cycle: ./a")
+		// So does a different set of files, and a repeat of a set that
+		// didn't come immediately before
+		modchan <- &moddwatch.Mod{Changed: []string{"a", "b"}}
+		waitFor(t, lt, ":cycle: ./a ./b")
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		modchan <- &moddwatch.Mod{Changed: []string{"a"}}
+		waitFiltered(2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cycles []string
+	for _, e := range events(lt.String()) {
+		if strings.HasPrefix(e, ":cycle:") {
+			cycles = append(cycles, e)
+		}
+	}
+	expected := []string{":cycle: ./a", ":cycle: ./a", ":cycle: ./a ./b", ":cycle: ./a"}
+	if !reflect.DeepEqual(cycles, expected) {
+		t.Errorf("Expected cycles %#v, got %#v", expected, cycles)
+	}
+	if ret := mr.WatchStats(); ret.Cycles != 4 || ret.Filtered != 2 {
+		t.Errorf("Expected 4 cycles and 2 skipped changes, got %#v", ret)
+	}
+}